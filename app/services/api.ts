@@ -23,6 +23,49 @@ api.interceptors.request.use(async (config) => {
   return config;
 });
 
+// Access tokens are short-lived, so transparently refresh once on a 401
+let refreshPromise: Promise<string | null> | null = null;
+
+const refreshAccessToken = async (): Promise<string | null> => {
+  const refreshToken = await AsyncStorage.getItem('refresh_token');
+  if (!refreshToken) {
+    return null;
+  }
+  try {
+    const response = await axios.post(`${API_URL}/token/refresh`, {
+      refresh_token: refreshToken,
+    });
+    await AsyncStorage.setItem('token', response.data.token);
+    await AsyncStorage.setItem('refresh_token', response.data.refresh_token);
+    return response.data.token;
+  } catch (error) {
+    await AsyncStorage.multiRemove(['token', 'refresh_token']);
+    return null;
+  }
+};
+
+api.interceptors.response.use(
+  (response) => response,
+  async (error) => {
+    const original = error.config;
+    if (error.response?.status !== 401 || !original || original._retried) {
+      return Promise.reject(error);
+    }
+    original._retried = true;
+    if (!refreshPromise) {
+      refreshPromise = refreshAccessToken().finally(() => {
+        refreshPromise = null;
+      });
+    }
+    const token = await refreshPromise;
+    if (!token) {
+      return Promise.reject(error);
+    }
+    original.headers.Authorization = `Bearer ${token}`;
+    return api(original);
+  }
+);
+
 export interface LoginCredentials {
   email: string;
   password: string;
@@ -59,18 +102,45 @@ export interface UserBadge {
 
 export const login = async (credentials: LoginCredentials) => {
   const response = await api.post('/login', credentials);
-  const { token } = response.data;
+  const { token, refresh_token } = response.data;
   await AsyncStorage.setItem('token', token);
+  if (refresh_token) {
+    await AsyncStorage.setItem('refresh_token', refresh_token);
+  }
   return token;
 };
 
-export const register = async (credentials: RegisterCredentials) => {
+export const requestMagicLink = async (email: string) => {
+  const response = await api.post('/login/magic', { email });
+  return response.data;
+};
+
+// Returns the token, or the MFA challenge when two-factor authentication is on
+export const redeemMagicLink = async (magicToken: string) => {
+  const response = await api.post('/login/magic/redeem', { token: magicToken });
+  const { token, refresh_token } = response.data;
+  if (token) {
+    await AsyncStorage.setItem('token', token);
+  }
+  if (refresh_token) {
+    await AsyncStorage.setItem('refresh_token', refresh_token);
+  }
+  return response.data;
+};
+
+export const register =async (credentials: RegisterCredentials) => {
   const response = await api.post('/register', credentials);
   return response.data;
 };
 
 export const logout = async () => {
-  await AsyncStorage.removeItem('token');
+  try {
+    await api.post('/logout');
+  } catch (error) {
+    // The local session is cleared even if the server cannot be reached
+    console.error('Logout error:', error);
+  }
+  await AsyncStorage.multiRemove(['token', 'refresh_token']);
 };
 
 // Profile functions
@@ -141,11 +211,33 @@ export const uploadProfilePicture = async () => {
   }
 };
 
-export const updateProfile = async (data: { full_name?: string }) => {
+export const updateProfile = async (data: {
+  full_name?: string;
+  email?: string;
+  current_password?: string;
+}) => {
   const response = await api.put('/profile', data);
   return response.data;
 };
 
+export const changePassword = async (currentPassword: string, newPassword: string) => {
+  const response = await api.post('/profile/password', {
+    current_password: currentPassword,
+    new_password: newPassword,
+  });
+  return response.data;
+};
+
+// Accounts without a password get 202 and confirm through an emailed link,
+// they stay signed in until then
+export const deleteAccount = async (password?: string) => {
+  const response = await api.delete('/account', { data: { password } });
+  if (response.status !== 202) {
+    await AsyncStorage.multiRemove(['token', 'refresh_token']);
+  }
+  return response.data;
+};
+
 export const getProfile = async (): Promise<User> => {
   const response = await api.get('/profile');
   return response.data;
@@ -161,4 +253,20 @@ export const getBadges = async (): Promise<UserBadge[]> => {
   }
 };
 
+export interface SearchResult {
+  type: 'course' | 'lesson';
+  course_id: string;
+  course_title: string;
+  lesson_id?: string;
+  // Matches are wrapped in <mark></mark>
+  title: string;
+  snippet: string;
+  link: string;
+}
+
+export const searchContent = async (q: string, limit = 20): Promise<SearchResult[]> => {
+  const response = await api.get('/search', { params: { q, limit } });
+  return response.data;
+};
+
 export default api; 
\ No newline at end of file
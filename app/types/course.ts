@@ -13,6 +13,9 @@ export interface Course {
   recommended: boolean;
   achievements: Achievement[];
   lessons: Lesson[];
+  last_accessed?: string;
+  // First lesson not completed yet, absent once the course is finished
+  next_lesson_id?: string;
 }
 
 export interface Achievement {
@@ -30,6 +33,7 @@ export interface Lesson {
   duration: string;
   content: LessonContent;
   completed: boolean;
+  last_accessed?: string;
 }
 
 export interface LessonContent {
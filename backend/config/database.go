@@ -3,6 +3,8 @@ package config
 import (
 	"database/sql"
 	"log"
+	"os"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -17,6 +19,9 @@ func InitDB() {
 		log.Fatalf("Failed to open database: %v", err)
 	}
 
+	// Foreign keys are not enforced: progress outlives the lessons it was
+	// made in, and whatever deletes a row deletes the rows that depend on it
+
 	// Create users table
 	createUsersTable := `CREATE TABLE IF NOT EXISTS users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -111,8 +116,8 @@ func InitDB() {
 		progress INTEGER DEFAULT 0,
 		completed BOOLEAN DEFAULT 0,
 		awarded_at DATETIME,
-		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
-		FOREIGN KEY(badge_id) REFERENCES badges(id) ON DELETE CASCADE,
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		FOREIGN KEY(badge_id) REFERENCES badges(id),
 		UNIQUE(user_id, badge_id)
 	);`
 	_, err = DB.Exec(createUserBadgesTable)
@@ -120,6 +125,364 @@ func InitDB() {
 		log.Fatalf("Failed to create user_badges table: %v", err)
 	}
 
+	// Create user_totp table for authenticator app secrets
+	createTOTPTable := `CREATE TABLE IF NOT EXISTS user_totp (
+		user_id INTEGER PRIMARY KEY,
+		secret TEXT NOT NULL,
+		enabled BOOLEAN NOT NULL DEFAULT 0,
+		last_used_step INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		confirmed_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+	_, err = DB.Exec(createTOTPTable)
+	if err != nil {
+		log.Fatalf("Failed to create user_totp table: %v", err)
+	}
+
+	// Create user_recovery_codes table, codes are stored as SHA-256 hashes
+	createRecoveryCodesTable := `CREATE TABLE IF NOT EXISTS user_recovery_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at DATETIME,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		UNIQUE(user_id, code_hash)
+	);`
+	_, err = DB.Exec(createRecoveryCodesTable)
+	if err != nil {
+		log.Fatalf("Failed to create user_recovery_codes table: %v", err)
+	}
+
+	// Create mfa_challenges table for logins waiting on a second factor
+	createMFAChallengesTable := `CREATE TABLE IF NOT EXISTS mfa_challenges (
+		token_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		expires_at DATETIME NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+	_, err = DB.Exec(createMFAChallengesTable)
+	if err != nil {
+		log.Fatalf("Failed to create mfa_challenges table: %v", err)
+	}
+
+	// Create mfa_failures table, wrong second factors per user across challenges
+	createMFAFailuresTable := `CREATE TABLE IF NOT EXISTS mfa_failures (
+		user_id INTEGER PRIMARY KEY,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_failure_at DATETIME NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+	_, err = DB.Exec(createMFAFailuresTable)
+	if err != nil {
+		log.Fatalf("Failed to create mfa_failures table: %v", err)
+	}
+
+	// Create refresh_tokens table, tokens are stored as SHA-256 hashes and
+	// rotated on every use. Tokens descending from one login share a family.
+	createRefreshTokensTable := `CREATE TABLE IF NOT EXISTS refresh_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		family_id TEXT NOT NULL,
+		expires_at DATETIME NOT NULL,
+		created_at DATETIME NOT NULL,
+		rotated_at DATETIME,
+		revoked_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+	_, err = DB.Exec(createRefreshTokensTable)
+	if err != nil {
+		log.Fatalf("Failed to create refresh_tokens table: %v", err)
+	}
+
+	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens(family_id);`)
+	if err != nil {
+		log.Fatalf("Failed to create refresh token index: %v", err)
+	}
+
+	// Create revoked_tokens table holding access token IDs revoked before they expire
+	createRevokedTokensTable := `CREATE TABLE IF NOT EXISTS revoked_tokens (
+		jti TEXT PRIMARY KEY,
+		expires_at DATETIME NOT NULL
+	);`
+	_, err = DB.Exec(createRevokedTokensTable)
+	if err != nil {
+		log.Fatalf("Failed to create revoked_tokens table: %v", err)
+	}
+
+	// Create user_tokens table for hashed, single-use tokens sent by email
+	createUserTokensTable := `CREATE TABLE IF NOT EXISTS user_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		purpose TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		data TEXT,
+		expires_at DATETIME NOT NULL,
+		used_at DATETIME,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+	_, err = DB.Exec(createUserTokensTable)
+	if err != nil {
+		log.Fatalf("Failed to create user_tokens table: %v", err)
+	}
+
+	// Create roles table
+	createRolesTable := `CREATE TABLE IF NOT EXISTS roles (
+		name TEXT PRIMARY KEY,
+		description TEXT NOT NULL
+	);`
+	_, err = DB.Exec(createRolesTable)
+	if err != nil {
+		log.Fatalf("Failed to create roles table: %v", err)
+	}
+
+	// Create user_roles table
+	createUserRolesTable := `CREATE TABLE IF NOT EXISTS user_roles (
+		user_id INTEGER NOT NULL,
+		role TEXT NOT NULL,
+		granted_at DATETIME NOT NULL,
+		granted_by INTEGER,
+		PRIMARY KEY(user_id, role),
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		FOREIGN KEY(role) REFERENCES roles(name),
+		FOREIGN KEY(granted_by) REFERENCES users(id)
+	);`
+	_, err = DB.Exec(createUserRolesTable)
+	if err != nil {
+		log.Fatalf("Failed to create user_roles table: %v", err)
+	}
+
+	// Create login_throttle table tracking failed logins per account and per IP
+	createLoginThrottleTable := `CREATE TABLE IF NOT EXISTS login_throttle (
+		key TEXT PRIMARY KEY,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_failure_at DATETIME NOT NULL,
+		locked_until DATETIME,
+		pending INTEGER NOT NULL DEFAULT 0,
+		reserved_at DATETIME
+	);`
+	_, err = DB.Exec(createLoginThrottleTable)
+	if err != nil {
+		log.Fatalf("Failed to create login_throttle table: %v", err)
+	}
+
+	// Create sessions table, one row per signed-in device. The session ID is
+	// carried in access tokens as "sid" and shared by its refresh token family.
+	createSessionsTable := `CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		user_agent TEXT,
+		ip TEXT,
+		created_at DATETIME NOT NULL,
+		last_seen_at DATETIME NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+	_, err = DB.Exec(createSessionsTable)
+	if err != nil {
+		log.Fatalf("Failed to create sessions table: %v", err)
+	}
+
+	// Create user_identities table linking accounts to OpenID Connect logins
+	createUserIdentitiesTable := `CREATE TABLE IF NOT EXISTS user_identities (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		provider TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		email TEXT,
+		created_at DATETIME NOT NULL,
+		last_login_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		UNIQUE(provider, subject)
+	);`
+	_, err = DB.Exec(createUserIdentitiesTable)
+	if err != nil {
+		log.Fatalf("Failed to create user_identities table: %v", err)
+	}
+
+	// Create oidc_states table for sign-ins waiting on the provider's redirect
+	createOIDCStatesTable := `CREATE TABLE IF NOT EXISTS oidc_states (
+		state_hash TEXT PRIMARY KEY,
+		provider TEXT NOT NULL,
+		nonce TEXT NOT NULL,
+		code_verifier TEXT NOT NULL,
+		expires_at DATETIME NOT NULL
+	);`
+	_, err = DB.Exec(createOIDCStatesTable)
+	if err != nil {
+		log.Fatalf("Failed to create oidc_states table: %v", err)
+	}
+
+	// Create api_tokens table for personal access tokens, stored as SHA-256 hashes
+	createAPITokensTable := `CREATE TABLE IF NOT EXISTS api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		token_hint TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		last_used_at DATETIME,
+		last_used_ip TEXT,
+		revoked_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+	_, err = DB.Exec(createAPITokensTable)
+	if err != nil {
+		log.Fatalf("Failed to create api_tokens table: %v", err)
+	}
+
+	// Create organizations table for teams buying access together
+	createOrganizationsTable := `CREATE TABLE IF NOT EXISTS organizations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		created_by INTEGER,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY(created_by) REFERENCES users(id)
+	);`
+	_, err = DB.Exec(createOrganizationsTable)
+	if err != nil {
+		log.Fatalf("Failed to create organizations table: %v", err)
+	}
+
+	// Create organization_members table, role is admin or member
+	createOrganizationMembersTable := `CREATE TABLE IF NOT EXISTS organization_members (
+		org_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		role TEXT NOT NULL,
+		joined_at DATETIME NOT NULL,
+		PRIMARY KEY(org_id, user_id),
+		FOREIGN KEY(org_id) REFERENCES organizations(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+	_, err = DB.Exec(createOrganizationMembersTable)
+	if err != nil {
+		log.Fatalf("Failed to create organization_members table: %v", err)
+	}
+
+	// Create organization_invitations table, tokens are stored as SHA-256 hashes
+	createOrganizationInvitationsTable := `CREATE TABLE IF NOT EXISTS organization_invitations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		org_id INTEGER NOT NULL,
+		email TEXT NOT NULL,
+		role TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		invited_by INTEGER,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		accepted_at DATETIME,
+		FOREIGN KEY(org_id) REFERENCES organizations(id),
+		FOREIGN KEY(invited_by) REFERENCES users(id)
+	);`
+	_, err = DB.Exec(createOrganizationInvitationsTable)
+	if err != nil {
+		log.Fatalf("Failed to create organization_invitations table: %v", err)
+	}
+
+	// Create webauthn_credentials table for passkeys. Credential IDs are
+	// base64url, public keys are COSE encoded.
+	createWebAuthnCredentialsTable := `CREATE TABLE IF NOT EXISTS webauthn_credentials (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		credential_id TEXT NOT NULL UNIQUE,
+		public_key BLOB NOT NULL,
+		algorithm INTEGER NOT NULL,
+		sign_count INTEGER NOT NULL DEFAULT 0,
+		name TEXT NOT NULL,
+		transports TEXT NOT NULL DEFAULT '',
+		aaguid TEXT NOT NULL DEFAULT '',
+		backed_up BOOLEAN NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME,
+		clone_detected_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+	_, err = DB.Exec(createWebAuthnCredentialsTable)
+	if err != nil {
+		log.Fatalf("Failed to create webauthn_credentials table: %v", err)
+	}
+
+	// Create webauthn_challenges table for ceremonies in progress, challenges
+	// are stored as SHA-256 hashes. Passkey logins have no user yet.
+	createWebAuthnChallengesTable := `CREATE TABLE IF NOT EXISTS webauthn_challenges (
+		challenge_hash TEXT PRIMARY KEY,
+		purpose TEXT NOT NULL,
+		user_id INTEGER,
+		expires_at DATETIME NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+	_, err = DB.Exec(createWebAuthnChallengesTable)
+	if err != nil {
+		log.Fatalf("Failed to create webauthn_challenges table: %v", err)
+	}
+
+	// Create audit_events table, the security log of account events. user_id
+	// is the account the event is about, actor_id who caused it.
+	createAuditEventsTable := `CREATE TABLE IF NOT EXISTS audit_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER,
+		actor_id INTEGER,
+		event_type TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		metadata TEXT NOT NULL DEFAULT '{}',
+		created_at DATETIME NOT NULL
+	);`
+	_, err = DB.Exec(createAuditEventsTable)
+	if err != nil {
+		log.Fatalf("Failed to create audit_events table: %v", err)
+	}
+
+	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS idx_audit_events_user ON audit_events(user_id, id);`)
+	if err != nil {
+		log.Fatalf("Failed to create audit event index: %v", err)
+	}
+
+	// Events are append-only, they can only expire or be purged with their account
+	_, err = DB.Exec(`CREATE TRIGGER IF NOT EXISTS audit_events_append_only
+		BEFORE UPDATE ON audit_events
+		BEGIN
+			SELECT RAISE(ABORT, 'audit_events is append-only');
+		END;`)
+	if err != nil {
+		log.Fatalf("Failed to create audit_events trigger: %v", err)
+	}
+
+	// Create course_revisions table, the versions of a course from draft
+	// through review to published. snapshot holds the whole course with its
+	// lessons in catalog form.
+	createCourseRevisionsTable := `CREATE TABLE IF NOT EXISTS course_revisions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		course_id TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		snapshot TEXT NOT NULL,
+		based_on INTEGER,
+		author_id INTEGER,
+		reviewer_id INTEGER,
+		review_note TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		submitted_at DATETIME,
+		reviewed_at DATETIME,
+		published_at DATETIME,
+		FOREIGN KEY(course_id) REFERENCES courses(id),
+		FOREIGN KEY(author_id) REFERENCES users(id),
+		FOREIGN KEY(reviewer_id) REFERENCES users(id),
+		UNIQUE(course_id, version)
+	);`
+	_, err = DB.Exec(createCourseRevisionsTable)
+	if err != nil {
+		log.Fatalf("Failed to create course_revisions table: %v", err)
+	}
+
+	// Create the search index over courses and lessons
+	createSearchIndex()
+
 	// Create index for faster progress lookups
 	createIndex := `CREATE INDEX IF NOT EXISTS idx_user_course_progress 
 		ON user_course_progress(user_id, course_id, lesson_id);`
@@ -159,6 +522,17 @@ func InitDB() {
 		log.Fatalf("Failed to insert default badges: %v", err)
 	}
 
+	// Insert default roles if they don't exist
+	insertDefaultRoles := `
+	INSERT OR IGNORE INTO roles (name, description) VALUES
+	('learner', 'Takes courses and earns badges'),
+	('instructor', 'Creates and edits course content'),
+	('admin', 'Manages users, content and platform settings');`
+	_, err = DB.Exec(insertDefaultRoles)
+	if err != nil {
+		log.Fatalf("Failed to insert default roles: %v", err)
+	}
+
 	log.Println("Database initialized and tables ready.")
 }
 
@@ -198,4 +572,116 @@ func MigrateDB() {
 		// Ignore error if column already exists
 		log.Printf("Note: category column may already exist: %v", err)
 	}
+
+	// Add tokens_valid_after column, access tokens issued before it are rejected
+	_, err = DB.Exec(`ALTER TABLE users ADD COLUMN tokens_valid_after INTEGER NOT NULL DEFAULT 0;`)
+	if err != nil {
+		// Ignore error if column already exists
+		log.Printf("Note: tokens_valid_after column may already exist: %v", err)
+	}
+
+	// Add email_verified_at column, NULL until the user confirms their address
+	_, err = DB.Exec(`ALTER TABLE users ADD COLUMN email_verified_at DATETIME;`)
+	if err != nil {
+		// Ignore error if column already exists
+		log.Printf("Note: email_verified_at column may already exist: %v", err)
+	}
+
+	// Store addresses in lowercase, unless that would clash with another
+	// account, and keep addresses unique whatever their case
+	_, err = DB.Exec(`UPDATE users SET email = lower(email)
+		WHERE email != lower(email)
+			AND NOT EXISTS (SELECT 1 FROM users other WHERE other.id != users.id AND other.email = lower(users.email) COLLATE NOCASE);`)
+	if err != nil {
+		log.Printf("Warning: failed to lowercase email addresses: %v", err)
+	}
+	_, err = DB.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_nocase ON users(email COLLATE NOCASE);`)
+	if err != nil {
+		log.Printf("Warning: accounts share an address in different case, it is not unique without case: %v", err)
+	}
+
+	// Add deletion_requested_at column, set while an account waits to be purged
+	_, err = DB.Exec(`ALTER TABLE users ADD COLUMN deletion_requested_at DATETIME;`)
+	if err != nil {
+		// Ignore error if column already exists
+		log.Printf("Note: deletion_requested_at column may already exist: %v", err)
+	}
+
+	// Add webauthn_user_handle column, the random ID passkeys store for the account
+	_, err = DB.Exec(`ALTER TABLE users ADD COLUMN webauthn_user_handle TEXT;`)
+	if err != nil {
+		// Ignore error if column already exists
+		log.Printf("Note: webauthn_user_handle column may already exist: %v", err)
+	}
+
+	// Add status column to courses table, courses that existed before it stay published
+	_, err = DB.Exec(`ALTER TABLE courses ADD COLUMN status TEXT NOT NULL DEFAULT 'published';`)
+	if err != nil {
+		// Ignore error if column already exists
+		log.Printf("Note: status column may already exist: %v", err)
+	}
+
+	// Add achievements column to courses table, the JSON list a catalog import brings along
+	_, err = DB.Exec(`ALTER TABLE courses ADD COLUMN achievements TEXT;`)
+	if err != nil {
+		// Ignore error if column already exists
+		log.Printf("Note: achievements column may already exist: %v", err)
+	}
+
+	// Add version column to courses table, the revision that is live, 0 before the first one
+	_, err = DB.Exec(`ALTER TABLE courses ADD COLUMN version INTEGER NOT NULL DEFAULT 0;`)
+	if err != nil {
+		// Ignore error if column already exists
+		log.Printf("Note: version column may already exist: %v", err)
+	}
+
+	// Add course_version column to user_course_progress table, the version of the course the progress was made in
+	_, err = DB.Exec(`ALTER TABLE user_course_progress ADD COLUMN course_version INTEGER NOT NULL DEFAULT 0;`)
+	if err != nil {
+		// Ignore error if column already exists
+		log.Printf("Note: course_version column may already exist: %v", err)
+	}
+}
+
+// BootstrapAdmin grants the admin role to the account named by ADMIN_EMAIL.
+// It is how the first admin gets created: register normally, confirm the
+// address, then start the server with ADMIN_EMAIL set. Once there is an
+// admin it does nothing, later admins are managed through the API.
+func BootstrapAdmin() {
+	email := os.Getenv("ADMIN_EMAIL")
+	if email == "" {
+		return
+	}
+
+	var hasAdmin bool
+	if err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM user_roles WHERE role = 'admin')").Scan(&hasAdmin); err != nil {
+		log.Fatalf("Failed to look up admins: %v", err)
+	}
+	if hasAdmin {
+		return
+	}
+
+	// Anyone can register the address, only its owner can confirm it
+	var userID int
+	var verifiedAt sql.NullString
+	err := DB.QueryRow("SELECT id, email_verified_at FROM users WHERE email = ? COLLATE NOCASE", email).Scan(&userID, &verifiedAt)
+	if err == sql.ErrNoRows {
+		log.Printf("Warning: ADMIN_EMAIL %s does not match any registered user", email)
+		return
+	} else if err != nil {
+		log.Fatalf("Failed to look up admin user: %v", err)
+	}
+	if !verifiedAt.Valid {
+		log.Printf("Warning: ADMIN_EMAIL %s has not been verified yet, no admin was created", email)
+		return
+	}
+
+	_, err = DB.Exec(
+		"INSERT OR IGNORE INTO user_roles (user_id, role, granted_at) VALUES (?, 'admin', ?)",
+		userID, time.Now().Format(time.RFC3339),
+	)
+	if err != nil {
+		log.Fatalf("Failed to grant admin role: %v", err)
+	}
+	log.Printf("Admin role ensured for %s", email)
 }
@@ -0,0 +1,108 @@
+package config
+
+import "log"
+
+// FullTextSearch reports whether SQLite has FTS5, which search needs. The
+// driver only includes it when built with -tags sqlite_fts5, main refuses to
+// start without it and the search index is not created.
+var FullTextSearch bool
+
+// searchSkippedKeys are lesson content keys whose values are not text a
+// learner searches for, such as IDs, senders and answer markers
+const searchSkippedKeys = `'id', 'type', 'sender', 'timestamp', 'triggeredBy', 'outcome', 'correctAnswer', 'icon', 'image'`
+
+// searchTagsSQL turns a JSON array of tags into space separated words
+func searchTagsSQL(column string) string {
+	return `CASE WHEN json_valid(` + column + `) THEN
+		(SELECT COALESCE(group_concat(json_each.value, ' '), '') FROM json_each(` + column + `))
+		ELSE COALESCE(` + column + `, '') END`
+}
+
+// searchContentSQL extracts the readable text of lesson content, such as
+// dialog questions and chat simulation messages, from its JSON
+func searchContentSQL(column string) string {
+	return `CASE WHEN json_valid(` + column + `) THEN
+		(SELECT COALESCE(group_concat(json_tree.value, ' '), '') FROM json_tree(` + column + `)
+		WHERE json_tree.type = 'text' AND (json_tree.key IS NULL OR json_tree.key NOT IN (` + searchSkippedKeys + `)))
+		ELSE COALESCE(` + column + `, '') END`
+}
+
+// createSearchIndex creates search_index, one row per course and per lesson
+// with lesson_id empty for courses, and the triggers keeping it in sync with
+// the courses and lessons tables whichever way they are changed
+func createSearchIndex() {
+	if err := DB.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&FullTextSearch); err != nil {
+		log.Fatalf("Failed to check for FTS5 support: %v", err)
+	}
+	if !FullTextSearch {
+		var triggers int
+		if err := DB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'search_index_%'").Scan(&triggers); err != nil {
+			log.Fatalf("Failed to look up search index triggers: %v", err)
+		}
+		// The triggers would fail every change to courses and lessons
+		if triggers > 0 {
+			log.Fatalf("The database has a search index, build with -tags sqlite_fts5")
+		}
+		return
+	}
+
+	_, err := DB.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS search_index USING fts5(
+		course_id UNINDEXED,
+		lesson_id UNINDEXED,
+		title,
+		tags,
+		body,
+		tokenize = 'porter unicode61'
+	);`)
+	if err != nil {
+		log.Fatalf("Failed to create search index: %v", err)
+	}
+
+	// Inserts also clear the old row, INSERT OR REPLACE does not fire delete triggers
+	courseRow := `
+		DELETE FROM search_index WHERE course_id = NEW.id AND lesson_id = '';
+		INSERT INTO search_index (course_id, lesson_id, title, tags, body)
+		VALUES (NEW.id, '', NEW.title, ` + searchTagsSQL("NEW.tags") + `, COALESCE(NEW.description, ''));`
+	lessonRow := `
+		DELETE FROM search_index WHERE lesson_id = NEW.id;
+		INSERT INTO search_index (course_id, lesson_id, title, tags, body)
+		VALUES (NEW.course_id, NEW.id, NEW.title, '', ` + searchContentSQL("NEW.content") + `);`
+	triggers := []string{
+		`CREATE TRIGGER IF NOT EXISTS search_index_course_insert AFTER INSERT ON courses BEGIN` + courseRow + ` END;`,
+		`CREATE TRIGGER IF NOT EXISTS search_index_course_update AFTER UPDATE ON courses BEGIN
+			DELETE FROM search_index WHERE course_id = OLD.id AND lesson_id = '';` + courseRow + ` END;`,
+		`CREATE TRIGGER IF NOT EXISTS search_index_course_delete AFTER DELETE ON courses BEGIN
+			DELETE FROM search_index WHERE course_id = OLD.id AND lesson_id = '';
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS search_index_lesson_insert AFTER INSERT ON lessons BEGIN` + lessonRow + ` END;`,
+		`CREATE TRIGGER IF NOT EXISTS search_index_lesson_update AFTER UPDATE ON lessons BEGIN
+			DELETE FROM search_index WHERE lesson_id = OLD.id;` + lessonRow + ` END;`,
+		`CREATE TRIGGER IF NOT EXISTS search_index_lesson_delete AFTER DELETE ON lessons BEGIN
+			DELETE FROM search_index WHERE lesson_id = OLD.id;
+		END;`,
+	}
+	for _, trigger := range triggers {
+		if _, err := DB.Exec(trigger); err != nil {
+			log.Fatalf("Failed to create search index trigger: %v", err)
+		}
+	}
+
+	// Fill a new index from the content that is already there
+	var indexed int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM search_index").Scan(&indexed); err != nil {
+		log.Fatalf("Failed to count search index rows: %v", err)
+	}
+	if indexed > 0 {
+		return
+	}
+	for _, fill := range []string{
+		`INSERT INTO search_index (course_id, lesson_id, title, tags, body)
+		SELECT id, '', title, ` + searchTagsSQL("tags") + `, COALESCE(description, '') FROM courses`,
+		`INSERT INTO search_index (course_id, lesson_id, title, tags, body)
+		SELECT course_id, id, title, '', ` + searchContentSQL("content") + ` FROM lessons`,
+	} {
+		if _, err := DB.Exec(fill); err != nil {
+			log.Fatalf("Failed to fill search index: %v", err)
+		}
+	}
+}
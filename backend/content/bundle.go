@@ -0,0 +1,216 @@
+package content
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// catalogFile is the name of the course list inside a zip bundle
+	catalogFile = "courses.json"
+	// bundleImageDir holds the course pictures inside a zip bundle
+	bundleImageDir = "images/"
+	// maxAssetSize keeps a single picture from filling the disk
+	maxAssetSize = 5 << 20
+	// maxCatalogSize bounds the course list read from a zip bundle
+	maxCatalogSize = 50 << 20
+)
+
+// imageExtensions are the picture formats a bundle may carry
+var imageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+}
+
+// Course is a course as written in a catalog. Lessons are listed in order
+// and their IDs are local to the course.
+type Course struct {
+	ID           string          `json:"id"`
+	Title        string          `json:"title"`
+	Description  string          `json:"description"`
+	Category     string          `json:"category"`
+	Duration     string          `json:"duration"`
+	Progress     int             `json:"progress"`
+	Level        string          `json:"level"`
+	Tags         []string        `json:"tags"`
+	Image        string          `json:"image"`
+	Rating       float64         `json:"rating"`
+	Learners     int             `json:"learners"`
+	Recommended  bool            `json:"recommended"`
+	Status       string          `json:"status,omitempty"`
+	Achievements json.RawMessage `json:"achievements,omitempty"`
+	Lessons      []Lesson        `json:"lessons"`
+}
+
+// Lesson is a lesson as written in a catalog, its content is kept as JSON
+type Lesson struct {
+	ID        string          `json:"id"`
+	Title     string          `json:"title"`
+	Type      string          `json:"type"`
+	Duration  string          `json:"duration"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	Completed bool            `json:"completed"`
+}
+
+// Bundle is a catalog with the pictures it refers to, keyed by their path
+// in the bundle, such as images/course-1.jpg
+type Bundle struct {
+	Courses []Course
+	Assets  map[string][]byte
+}
+
+// isZip reports whether a catalog file name is a zip bundle
+func isZip(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".zip")
+}
+
+// ReadBundle loads a catalog from a .json file or a .zip bundle
+func ReadBundle(filename string) (*Bundle, error) {
+	if isZip(filename) {
+		return readZipBundle(filename)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &Bundle{Assets: map[string][]byte{}}
+	if err := json.Unmarshal(data, &bundle.Courses); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", filename, err)
+	}
+	return bundle, nil
+}
+
+// readZipBundle loads courses.json and the images of a zip bundle. Other
+// files are ignored.
+func readZipBundle(filename string) (*Bundle, error) {
+	archive, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	bundle := &Bundle{Assets: map[string][]byte{}}
+	foundCatalog := false
+	for _, file := range archive.File {
+		name := file.Name
+		switch {
+		case name == catalogFile:
+			data, err := readZipFile(file, maxCatalogSize)
+			if err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal(data, &bundle.Courses); err != nil {
+				return nil, fmt.Errorf("parsing %s: %v", catalogFile, err)
+			}
+			foundCatalog = true
+		case strings.HasPrefix(name, bundleImageDir) && !strings.HasSuffix(name, "/"):
+			if !isBundleImage(name) {
+				return nil, fmt.Errorf("%s: only %s files directly in %s are allowed", name, imageExtensionList(), bundleImageDir)
+			}
+			data, err := readZipFile(file, maxAssetSize)
+			if err != nil {
+				return nil, err
+			}
+			bundle.Assets[name] = data
+		}
+	}
+	if !foundCatalog {
+		return nil, fmt.Errorf("%s has no %s", filename, catalogFile)
+	}
+	return bundle, nil
+}
+
+// readZipFile reads a file of a zip archive, failing if it is larger than limit
+func readZipFile(file *zip.File, limit int64) ([]byte, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %v", file.Name, err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", file.Name, err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s is larger than %d bytes", file.Name, limit)
+	}
+	return data, nil
+}
+
+// isBundleImage reports whether name is a picture directly inside the
+// images directory, which also rules out paths such as images/../x
+func isBundleImage(name string) bool {
+	dir, base := path.Split(name)
+	return dir == bundleImageDir && base != "" && base != ".." &&
+		imageExtensions[strings.ToLower(path.Ext(base))]
+}
+
+// imageExtensionList names the accepted picture formats for error messages
+func imageExtensionList() string {
+	var list []string
+	for ext := range imageExtensions {
+		list = append(list, ext)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
+
+// WriteBundle saves a catalog as a .zip bundle with its images, or as plain
+// JSON otherwise. "-" writes the JSON to standard output.
+func WriteBundle(filename string, bundle *Bundle) error {
+	data, err := json.MarshalIndent(bundle.Courses, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if filename == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if !isZip(filename) {
+		return os.WriteFile(filename, data, 0644)
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	writer, err := archive.Create(catalogFile)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(bundle.Assets))
+	for name := range bundle.Assets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writer, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(bundle.Assets[name]); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0644)
+}
@@ -0,0 +1,651 @@
+package content
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"defenzo/config"
+	"defenzo/models"
+)
+
+// ImageDir is where imported course pictures are stored, served under /uploads/
+const ImageDir = "uploads/course_images"
+
+// Change is one difference between a catalog and the database, or between
+// two versions of a course
+type Change struct {
+	// Op is "+" for an addition, "~" for an update and "-" for a removal
+	Op      string `json:"op"`
+	Subject string `json:"subject"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+func (c Change) String() string {
+	if c.Detail == "" {
+		return c.Op + " " + c.Subject
+	}
+	return c.Op + " " + c.Subject + ": " + c.Detail
+}
+
+// Plan is what importing a catalog would change
+type Plan struct {
+	Changes   []Change
+	Unchanged int
+	// Published lists the courses the plan changes that learners see now.
+	// Their content changes through revisions, so Apply refuses them.
+	Published []string
+
+	courses []plannedCourse
+}
+
+// plannedCourse is a catalog course resolved against the database
+type plannedCourse struct {
+	course  Course
+	image   string
+	asset   []byte
+	lessons []plannedLesson
+	removed []string
+}
+
+// plannedLesson is a catalog lesson with the ID it has in the database
+type plannedLesson struct {
+	lesson  Lesson
+	id      string
+	content string
+}
+
+// storedCourse is a course as it is in the database
+type storedCourse struct {
+	Course
+	lessonIDs []string
+}
+
+// Validate checks every course and lesson of a bundle and normalizes them as
+// the admin API does. It returns all problems found, not just the first.
+func Validate(bundle *Bundle) []error {
+	var errs []error
+	courseIDs := make(map[string]bool)
+	for i := range bundle.Courses {
+		course := &bundle.Courses[i]
+		subject := course.ID
+		if subject == "" {
+			subject = fmt.Sprintf("course #%d", i+1)
+		}
+		fail := func(format string, args ...interface{}) {
+			errs = append(errs, fmt.Errorf("%s: %s", subject, fmt.Sprintf(format, args...)))
+		}
+
+		if err := ValidateID("course", course.ID); err != nil {
+			fail("%v", err)
+		}
+		if courseIDs[course.ID] {
+			fail("listed more than once")
+		}
+		courseIDs[course.ID] = true
+
+		model := models.Course{
+			Title:    course.Title,
+			Level:    course.Level,
+			Tags:     course.Tags,
+			Rating:   course.Rating,
+			Learners: course.Learners,
+			Status:   course.Status,
+		}
+		if err := ValidateCourse(&model); err != nil {
+			fail("%v", err)
+		}
+		course.Title, course.Tags = model.Title, model.Tags
+
+		if len(course.Achievements) > 0 {
+			var achievements []json.RawMessage
+			if err := json.Unmarshal(course.Achievements, &achievements); err != nil {
+				fail("achievements must be a JSON array")
+			}
+		}
+		if strings.HasPrefix(course.Image, bundleImageDir) {
+			if !isBundleImage(course.Image) {
+				fail("image %s must be a %s file directly in %s", course.Image, imageExtensionList(), bundleImageDir)
+			} else if _, ok := bundle.Assets[course.Image]; !ok {
+				fail("image %s is not in the bundle", course.Image)
+			}
+		}
+
+		lessonIDs := make(map[string]bool)
+		for j := range course.Lessons {
+			lesson := &course.Lessons[j]
+			lessonSubject := fmt.Sprintf("%s/%s", subject, lesson.ID)
+			if lesson.ID == "" {
+				lessonSubject = fmt.Sprintf("%s/lesson #%d", subject, j+1)
+			}
+
+			if err := ValidateID("lesson", lesson.ID); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", lessonSubject, err))
+			}
+			if lessonIDs[lesson.ID] {
+				errs = append(errs, fmt.Errorf("%s: listed more than once", lessonSubject))
+			}
+			lessonIDs[lesson.ID] = true
+
+			model := models.Lesson{Title: lesson.Title, Type: lesson.Type, Content: string(lesson.Content)}
+			if err := ValidateLesson(&model); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", lessonSubject, err))
+			}
+			lesson.Title = model.Title
+		}
+	}
+	return errs
+}
+
+// lessonDBID returns the database ID of a catalog lesson. Lesson IDs in a
+// catalog are local to their course, in the database they are prefixed with
+// the course ID, unless the course already has a lesson with the bare ID.
+func lessonDBID(courseID, localID string, existing map[string]bool) string {
+	if existing[localID] {
+		return localID
+	}
+	if strings.HasPrefix(localID, courseID+"-") {
+		return localID
+	}
+	return courseID + "-" + localID
+}
+
+// localLessonID strips the course prefix from a lesson's database ID
+func localLessonID(courseID, id string) string {
+	return strings.TrimPrefix(id, courseID+"-")
+}
+
+// compactJSON strips the whitespace from JSON before it is stored, keeping
+// the order of keys. Anything that is not JSON is returned as it is.
+func compactJSON(data []byte) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return string(data)
+	}
+	return buf.String()
+}
+
+// sameJSON reports whether two JSON documents hold the same values, however
+// they are formatted, ordered or escaped
+func sameJSON(a, b []byte) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	ca, _ := json.Marshal(va)
+	cb, _ := json.Marshal(vb)
+	return bytes.Equal(ca, cb)
+}
+
+// querier runs the queries of a plan, on the database or in a transaction
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// loadStoredCourse reads a course and the IDs of its lessons in order. It
+// returns nil if the course does not exist.
+func loadStoredCourse(q querier, courseID string) (*storedCourse, error) {
+	var c storedCourse
+	var description, category, duration, level, tags, image, achievements sql.NullString
+	var progress, learners sql.NullInt64
+	var rating sql.NullFloat64
+	var recommended sql.NullBool
+	err := q.QueryRow(`
+		SELECT id, title, description, category, duration, progress, level, tags, image, rating,
+			learners, recommended, status, achievements
+		FROM courses WHERE id = ?`, courseID,
+	).Scan(&c.ID, &c.Title, &description, &category, &duration, &progress, &level, &tags, &image, &rating,
+		&learners, &recommended, &c.Status, &achievements)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	c.Description = description.String
+	c.Category = category.String
+	c.Duration = duration.String
+	c.Progress = int(progress.Int64)
+	c.Level = level.String
+	c.Image = image.String
+	c.Rating = rating.Float64
+	c.Learners = int(learners.Int64)
+	c.Recommended = recommended.Bool
+	c.Tags = []string{}
+	if tags.String != "" {
+		if err := json.Unmarshal([]byte(tags.String), &c.Tags); err != nil {
+			return nil, fmt.Errorf("parsing tags of course %s: %v", courseID, err)
+		}
+	}
+	if achievements.String != "" {
+		c.Achievements = json.RawMessage(achievements.String)
+	}
+
+	rows, err := q.Query(`
+		SELECT id, title, type, duration, content, completed
+		FROM lessons WHERE course_id = ?
+		ORDER BY order_num`, courseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	c.Lessons = []Lesson{}
+	for rows.Next() {
+		var lesson Lesson
+		var lessonDuration, lessonContent sql.NullString
+		var completed sql.NullBool
+		if err := rows.Scan(&lesson.ID, &lesson.Title, &lesson.Type, &lessonDuration, &lessonContent, &completed); err != nil {
+			return nil, err
+		}
+		lesson.Duration = lessonDuration.String
+		lesson.Completed = completed.Bool
+		if lessonContent.String != "" {
+			lesson.Content = json.RawMessage(lessonContent.String)
+		}
+		c.lessonIDs = append(c.lessonIDs, lesson.ID)
+		c.Lessons = append(c.Lessons, lesson)
+	}
+	return &c, rows.Err()
+}
+
+// retiredLessonIDs returns the IDs of lessons removed from a course that
+// learners still have progress in
+func retiredLessonIDs(q querier, courseID string) ([]string, error) {
+	rows, err := q.Query(`
+		SELECT DISTINCT lesson_id FROM user_course_progress
+		WHERE course_id = ? AND lesson_id IS NOT NULL
+			AND lesson_id NOT IN (SELECT id FROM lessons WHERE course_id = ?)`,
+		courseID, courseID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// MakePlan compares a validated bundle with the database
+func MakePlan(bundle *Bundle) (*Plan, error) {
+	return makePlan(config.DB, bundle)
+}
+
+// MakePlanTx compares a validated bundle with the database as the
+// transaction sees it, for a plan the transaction applies
+func MakePlanTx(tx *sql.Tx, bundle *Bundle) (*Plan, error) {
+	return makePlan(tx, bundle)
+}
+
+// makePlan compares a validated bundle with what q reads
+func makePlan(q querier, bundle *Bundle) (*Plan, error) {
+	plan := &Plan{}
+	planned := make(map[string]string)
+	for _, course := range bundle.Courses {
+		stored, err := loadStoredCourse(q, course.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		pc := plannedCourse{course: course, image: course.Image}
+		if asset, ok := bundle.Assets[course.Image]; ok {
+			pc.image = ImageDir + "/" + course.ID + strings.ToLower(path.Ext(course.Image))
+			pc.asset = asset
+		}
+		if pc.course.Status == "" {
+			pc.course.Status = models.CourseStatusPublished
+		}
+
+		existing := make(map[string]bool)
+		storedLessons := make(map[string]Lesson)
+		storedPosition := make(map[string]int)
+		if stored != nil {
+			for i, id := range stored.lessonIDs {
+				existing[id] = true
+				storedLessons[id] = stored.Lessons[i]
+				storedPosition[id] = i
+			}
+			// A lesson that comes back gets its old ID, and with it the
+			// progress learners made before it was removed
+			retired, err := retiredLessonIDs(q, course.ID)
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range retired {
+				existing[id] = true
+			}
+		}
+
+		changesBefore := len(plan.Changes)
+		if stored == nil {
+			plan.Changes = append(plan.Changes, Change{"+", "course " + course.ID, fmt.Sprintf("%d lesson(s)", len(course.Lessons))})
+		} else if fields := changedCourseFields(stored, &pc); len(fields) > 0 {
+			plan.Changes = append(plan.Changes, Change{"~", "course " + course.ID, strings.Join(fields, ", ")})
+		} else {
+			plan.Unchanged++
+		}
+
+		kept := make(map[string]bool)
+		for i, lesson := range course.Lessons {
+			id := lessonDBID(course.ID, lesson.ID, existing)
+			if owner, ok := planned[id]; ok {
+				return nil, fmt.Errorf("lesson %s is listed in both %s and %s", id, owner, course.ID)
+			}
+			planned[id] = course.ID
+			kept[id] = true
+			pl := plannedLesson{lesson: lesson, id: id, content: compactJSON(lesson.Content)}
+			pc.lessons = append(pc.lessons, pl)
+
+			subject := "lesson " + id
+			old, ok := storedLessons[id]
+			if !ok {
+				var owner string
+				err := q.QueryRow("SELECT course_id FROM lessons WHERE id = ?", id).Scan(&owner)
+				if err == nil {
+					return nil, fmt.Errorf("lesson %s already belongs to course %s", id, owner)
+				} else if err != sql.ErrNoRows {
+					return nil, err
+				}
+				if stored != nil {
+					plan.Changes = append(plan.Changes, Change{"+", subject, ""})
+				}
+				continue
+			}
+
+			if fields := changedLessonFields(old, lesson, storedPosition[id], i); len(fields) > 0 {
+				plan.Changes = append(plan.Changes, Change{"~", subject, strings.Join(fields, ", ")})
+			} else {
+				plan.Unchanged++
+			}
+		}
+
+		if stored != nil {
+			for _, id := range stored.lessonIDs {
+				if kept[id] {
+					continue
+				}
+				var learners int
+				if err := q.QueryRow(
+					"SELECT COUNT(DISTINCT user_id) FROM user_course_progress WHERE lesson_id = ? AND course_id = ?",
+					id, course.ID,
+				).Scan(&learners); err != nil {
+					return nil, err
+				}
+				detail := ""
+				if learners > 0 {
+					detail = fmt.Sprintf("keeps the progress of %d learner(s)", learners)
+				}
+				plan.Changes = append(plan.Changes, Change{"-", "lesson " + id, detail})
+				pc.removed = append(pc.removed, id)
+			}
+		}
+		if stored != nil && stored.Status == models.CourseStatusPublished && len(plan.Changes) > changesBefore {
+			plan.Published = append(plan.Published, course.ID)
+		}
+
+		plan.courses = append(plan.courses, pc)
+	}
+	return plan, nil
+}
+
+// changedCourseFields lists the fields a planned course changes
+func changedCourseFields(stored *storedCourse, planned *plannedCourse) []string {
+	c := planned.course
+	c.Image = planned.image
+	fields := courseChanges(&stored.Course, &c)
+	if stored.Image == planned.image && planned.asset != nil && !sameFile(planned.image, planned.asset) {
+		// The picture is replaced under the same name
+		fields = append(fields, "image")
+	}
+	return fields
+}
+
+// courseChanges lists the fields that differ between two versions of a
+// course, leaving out its lessons
+func courseChanges(old, c *Course) []string {
+	var fields []string
+	add := func(name string, changed bool) {
+		if changed {
+			fields = append(fields, name)
+		}
+	}
+	add("title", old.Title != c.Title)
+	add("description", old.Description != c.Description)
+	add("category", old.Category != c.Category)
+	add("duration", old.Duration != c.Duration)
+	add("progress", old.Progress != c.Progress)
+	add("level", old.Level != c.Level)
+	add("tags", strings.Join(old.Tags, "\x00") != strings.Join(c.Tags, "\x00"))
+	add("image", old.Image != c.Image)
+	add("rating", old.Rating != c.Rating)
+	add("learners", old.Learners != c.Learners)
+	add("recommended", old.Recommended != c.Recommended)
+	add("status", old.Status != c.Status)
+	add("achievements", !sameJSON(old.Achievements, c.Achievements))
+	return fields
+}
+
+// changedLessonFields lists the fields that differ between two versions of
+// a lesson, and its move when it is at another position
+func changedLessonFields(old, lesson Lesson, oldPosition, position int) []string {
+	var fields []string
+	if old.Title != lesson.Title {
+		fields = append(fields, "title")
+	}
+	if old.Type != lesson.Type {
+		fields = append(fields, "type")
+	}
+	if old.Duration != lesson.Duration {
+		fields = append(fields, "duration")
+	}
+	if !sameJSON(old.Content, lesson.Content) {
+		fields = append(fields, "content")
+	}
+	if old.Completed != lesson.Completed {
+		fields = append(fields, "completed")
+	}
+	if oldPosition != position {
+		fields = append(fields, fmt.Sprintf("position %d -> %d", oldPosition+1, position+1))
+	}
+	return fields
+}
+
+// sameFile reports whether the file at name holds exactly data
+func sameFile(name string, data []byte) bool {
+	existing, err := os.ReadFile(name)
+	return err == nil && bytes.Equal(existing, data)
+}
+
+// Apply makes the changes of the plan in one transaction. Pictures are
+// written before the commit, so a failed import can leave unused files
+// behind but never courses pointing at missing ones. A plan that changes
+// published courses is refused, their next version goes through review.
+func Apply(plan *Plan) error {
+	if len(plan.Published) > 0 {
+		return fmt.Errorf("course(s) %s are published, change them through a revision", strings.Join(plan.Published, ", "))
+	}
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := ApplyTx(tx, plan); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ApplyTx makes the changes of the plan as part of a transaction the caller
+// commits
+func ApplyTx(tx *sql.Tx, plan *Plan) error {
+	for _, planned := range plan.courses {
+		c := planned.course
+		tags, _ := json.Marshal(c.Tags)
+		var achievements interface{}
+		if len(c.Achievements) > 0 {
+			achievements = compactJSON(c.Achievements)
+		}
+		_, err := tx.Exec(`
+			INSERT INTO courses (id, title, description, category, duration, progress, level, tags, image, rating,
+				learners, recommended, status, achievements)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(id) DO UPDATE SET
+				title = excluded.title, description = excluded.description, category = excluded.category,
+				duration = excluded.duration, progress = excluded.progress, level = excluded.level,
+				tags = excluded.tags, image = excluded.image, rating = excluded.rating,
+				learners = excluded.learners, recommended = excluded.recommended, status = excluded.status,
+				achievements = excluded.achievements`,
+			c.ID, c.Title, c.Description, c.Category, c.Duration, c.Progress, c.Level, string(tags), planned.image,
+			c.Rating, c.Learners, c.Recommended, c.Status, achievements,
+		)
+		if err != nil {
+			return fmt.Errorf("saving course %s: %v", c.ID, err)
+		}
+
+		for i, pl := range planned.lessons {
+			l := pl.lesson
+			_, err := tx.Exec(`
+				INSERT INTO lessons (id, course_id, title, type, duration, content, order_num, completed)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT(id) DO UPDATE SET
+					title = excluded.title, type = excluded.type, duration = excluded.duration,
+					content = excluded.content, order_num = excluded.order_num, completed = excluded.completed`,
+				pl.id, c.ID, l.Title, l.Type, l.Duration, pl.content, i+1, l.Completed,
+			)
+			if err != nil {
+				return fmt.Errorf("saving lesson %s: %v", pl.id, err)
+			}
+		}
+
+		// The progress in removed lessons is kept, for when they come back
+		for _, id := range planned.removed {
+			if _, err := tx.Exec("DELETE FROM lessons WHERE id = ? AND course_id = ?", id, c.ID); err != nil {
+				return fmt.Errorf("removing lesson %s: %v", id, err)
+			}
+		}
+
+		if planned.asset != nil {
+			if err := os.MkdirAll(ImageDir, 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(planned.image, planned.asset, 0644); err != nil {
+				return fmt.Errorf("saving image of course %s: %v", c.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Export reads every course from the database in catalog form. With
+// withImages, pictures stored by an import are added to the bundle and the
+// courses refer to them by their path in it.
+func Export(withImages bool) (*Bundle, error) {
+	rows, err := config.DB.Query("SELECT id FROM courses ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	bundle := &Bundle{Courses: []Course{}, Assets: map[string][]byte{}}
+	for _, id := range ids {
+		stored, err := loadStoredCourse(config.DB, id)
+		if err != nil {
+			return nil, err
+		}
+		course := catalogCourse(stored)
+
+		if withImages && strings.HasPrefix(course.Image, ImageDir+"/") {
+			data, err := os.ReadFile(course.Image)
+			if err != nil {
+				return nil, fmt.Errorf("reading image of course %s: %v", course.ID, err)
+			}
+			name := bundleImageDir + filepath.Base(course.Image)
+			bundle.Assets[name] = data
+			course.Image = name
+		}
+		bundle.Courses = append(bundle.Courses, course)
+	}
+	return bundle, nil
+}
+
+// catalogCourse turns a course from the database into catalog form
+func catalogCourse(stored *storedCourse) Course {
+	course := stored.Course
+	if course.Status == models.CourseStatusPublished {
+		course.Status = ""
+	}
+	for i := range course.Lessons {
+		course.Lessons[i].ID = localLessonID(course.ID, course.Lessons[i].ID)
+		if content := course.Lessons[i].Content; len(content) > 0 && !json.Valid(content) {
+			// Keep legacy content that is not JSON readable as a string
+			course.Lessons[i].Content, _ = json.Marshal(string(content))
+		}
+	}
+	return course
+}
+
+// Snapshot reads a course as it is in the database in catalog form, nil if
+// it does not exist
+func Snapshot(courseID string) (*Course, error) {
+	stored, err := loadStoredCourse(config.DB, courseID)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+	course := catalogCourse(stored)
+	return &course, nil
+}
+
+// Diff lists the changes that turn one version of a course into another,
+// matching lessons by their ID
+func Diff(old, course *Course) []Change {
+	changes := []Change{}
+	if fields := courseChanges(old, course); len(fields) > 0 {
+		changes = append(changes, Change{"~", "course " + course.ID, strings.Join(fields, ", ")})
+	}
+
+	oldLessons := make(map[string]Lesson)
+	oldPosition := make(map[string]int)
+	for i, lesson := range old.Lessons {
+		oldLessons[lesson.ID] = lesson
+		oldPosition[lesson.ID] = i
+	}
+	kept := make(map[string]bool)
+	for i, lesson := range course.Lessons {
+		kept[lesson.ID] = true
+		previous, ok := oldLessons[lesson.ID]
+		if !ok {
+			changes = append(changes, Change{"+", "lesson " + lesson.ID, ""})
+		} else if fields := changedLessonFields(previous, lesson, oldPosition[lesson.ID], i); len(fields) > 0 {
+			changes = append(changes, Change{"~", "lesson " + lesson.ID, strings.Join(fields, ", ")})
+		}
+	}
+	for _, lesson := range old.Lessons {
+		if !kept[lesson.ID] {
+			changes = append(changes, Change{"-", "lesson " + lesson.ID, ""})
+		}
+	}
+	return changes
+}
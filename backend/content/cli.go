@@ -0,0 +1,113 @@
+package content
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+const usage = `Usage:
+  defenzo content validate <catalog.json|bundle.zip>
+  defenzo content import [-dry-run] <catalog.json|bundle.zip>
+  defenzo content export <catalog.json|bundle.zip|->
+
+Catalogs are JSON arrays of courses shaped like mockCourses.json. A zip
+bundle holds one as courses.json, with the course pictures in images/.
+Import adds or updates the listed courses and their lessons, and removes
+lessons of those courses that the catalog no longer lists. Courses without
+a status are published. Other courses are left alone. Published courses
+are not changed by an import, their next version goes through a revision.
+`
+
+// Run executes a content command with the arguments following "content" and
+// returns the process exit code. The database must be initialized.
+func Run(args []string) int {
+	stdout, stderr := os.Stdout, os.Stderr
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	flags := flag.NewFlagSet("content "+args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, usage) }
+	dryRun := false
+	if args[0] == "import" {
+		flags.BoolVar(&dryRun, "dry-run", false, "show the changes without making them")
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	filename := flags.Arg(0)
+
+	switch args[0] {
+	case "validate", "import":
+		bundle, err := ReadBundle(filename)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		if errs := Validate(bundle); len(errs) > 0 {
+			for _, err := range errs {
+				fmt.Fprintf(stderr, "Invalid: %v\n", err)
+			}
+			fmt.Fprintf(stderr, "%s has %d problem(s)\n", filename, len(errs))
+			return 1
+		}
+		if args[0] == "validate" {
+			fmt.Fprintf(stdout, "%s is valid: %d course(s), %d image(s)\n", filename, len(bundle.Courses), len(bundle.Assets))
+			return 0
+		}
+
+		plan, err := MakePlan(bundle)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		for _, change := range plan.Changes {
+			fmt.Fprintln(stdout, change)
+		}
+		fmt.Fprintf(stdout, "%d change(s), %d unchanged\n", len(plan.Changes), plan.Unchanged)
+		if len(plan.Published) > 0 {
+			for _, id := range plan.Published {
+				fmt.Fprintf(stderr, "Refused: course %s is published, change it through a revision\n", id)
+			}
+			return 1
+		}
+		if dryRun {
+			fmt.Fprintln(stdout, "Dry run, nothing was changed")
+			return 0
+		}
+		if len(plan.Changes) == 0 {
+			return 0
+		}
+		if err := Apply(plan); err != nil {
+			fmt.Fprintf(stderr, "Import failed, the database was not changed: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "Imported %s\n", filename)
+		return 0
+
+	case "export":
+		bundle, err := Export(isZip(filename))
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		if err := WriteBundle(filename, bundle); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		if filename != "-" {
+			fmt.Fprintf(stdout, "Exported %d course(s) to %s\n", len(bundle.Courses), filename)
+		}
+		return 0
+	}
+
+	fmt.Fprint(stderr, usage)
+	return 2
+}
@@ -0,0 +1,128 @@
+// Package content loads course catalogs into the database and writes them
+// back out. A catalog is a JSON array of courses in the shape of
+// mockCourses.json, or a zip bundle holding that file as courses.json next to
+// an images directory with the course pictures.
+package content
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"defenzo/models"
+)
+
+const (
+	maxIDLength    = 64
+	maxTitleLength = 200
+	maxTags        = 20
+	maxTagLength   = 50
+	maxRating      = 5
+)
+
+// idPattern is the shape of course and lesson IDs, such as course-1-lesson-7
+var idPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// Levels are the levels the app filters courses by
+var Levels = []string{"Beginner", "Intermediate", "Advanced"}
+
+// ValidateID checks the ID of a new course or lesson, kind names which one
+// it is in the error
+func ValidateID(kind, id string) error {
+	if id == "" {
+		return fmt.Errorf("%s id is required", kind)
+	}
+	if len(id) > maxIDLength || !idPattern.MatchString(id) {
+		return fmt.Errorf("%s id must be lowercase letters, digits and dashes, at most %d characters", kind, maxIDLength)
+	}
+	return nil
+}
+
+// ValidateCourse checks and normalizes the editable fields of a course, but
+// not its lessons. An empty status is left for the caller to fill in.
+func ValidateCourse(course *models.Course) error {
+	course.Title = strings.TrimSpace(course.Title)
+	if course.Title == "" {
+		return errors.New("title is required")
+	}
+	if len(course.Title) > maxTitleLength {
+		return fmt.Errorf("title must be at most %d characters", maxTitleLength)
+	}
+
+	if course.Level != "" {
+		valid := false
+		for _, level := range Levels {
+			if course.Level == level {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("level must be one of %s", strings.Join(Levels, ", "))
+		}
+	}
+
+	if len(course.Tags) > maxTags {
+		return fmt.Errorf("a course can have at most %d tags", maxTags)
+	}
+	seen := make(map[string]bool)
+	tags := []string{}
+	for _, tag := range course.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			return errors.New("tags must not be empty")
+		}
+		if len(tag) > maxTagLength {
+			return fmt.Errorf("tags must be at most %d characters", maxTagLength)
+		}
+		if seen[strings.ToLower(tag)] {
+			return fmt.Errorf("duplicate tag %q", tag)
+		}
+		seen[strings.ToLower(tag)] = true
+		tags = append(tags, tag)
+	}
+	course.Tags = tags
+
+	if course.Rating < 0 || course.Rating > maxRating {
+		return fmt.Errorf("rating must be between 0 and %d", maxRating)
+	}
+	if course.Learners < 0 {
+		return errors.New("learners must not be negative")
+	}
+
+	switch course.Status {
+	case "", models.CourseStatusDraft, models.CourseStatusPublished:
+	default:
+		return fmt.Errorf("status must be %s or %s", models.CourseStatusDraft, models.CourseStatusPublished)
+	}
+	return nil
+}
+
+// ValidateLesson checks and normalizes the editable fields of a lesson
+func ValidateLesson(lesson *models.Lesson) error {
+	lesson.Title = strings.TrimSpace(lesson.Title)
+	if lesson.Title == "" {
+		return errors.New("lesson title is required")
+	}
+	if len(lesson.Title) > maxTitleLength {
+		return fmt.Errorf("lesson title must be at most %d characters", maxTitleLength)
+	}
+
+	switch lesson.Type {
+	case models.LessonTypeDialog, models.LessonTypeCards, models.LessonTypeScenario, models.LessonTypeChatSimulation:
+	default:
+		return fmt.Errorf("lesson type must be one of %s, %s, %s, %s",
+			models.LessonTypeDialog, models.LessonTypeCards, models.LessonTypeScenario, models.LessonTypeChatSimulation)
+	}
+
+	// The app parses the content as JSON
+	if lesson.Content != "" && !json.Valid([]byte(lesson.Content)) {
+		return errors.New("lesson content must be valid JSON")
+	}
+	if lesson.OrderNum < 0 {
+		return errors.New("order_num must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,509 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"defenzo/config"
+	"defenzo/loginguard"
+	"defenzo/mailer"
+	"defenzo/middleware"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// defaultDeletionGracePeriod is how long a deleted account can still be
+	// restored by signing in, ACCOUNT_DELETION_GRACE_DAYS overrides it
+	defaultDeletionGracePeriod = 14 * 24 * time.Hour
+	// accountDeletionConfirmTTL is how long the link confirming the deletion
+	// of an account without a password stays valid
+	accountDeletionConfirmTTL = time.Hour
+	// accountPurgeInterval is how often accounts past their grace period are removed
+	accountPurgeInterval = time.Hour
+	// profilePictureDir is where UploadProfilePicture stores files
+	profilePictureDir = "uploads/profile_pictures"
+)
+
+// accountDataTables lists every table holding rows owned by a user through a
+// user_id column. Purging an account deletes its rows from all of them.
+var accountDataTables = []string{
+	"user_course_progress",
+	"user_badges",
+	"user_totp",
+	"user_recovery_codes",
+	"mfa_challenges",
+	"mfa_failures",
+	"refresh_tokens",
+	"sessions",
+	"user_tokens",
+	"user_roles",
+	"user_identities",
+	"api_tokens",
+	"organization_members",
+	"webauthn_credentials",
+	"webauthn_challenges",
+	"audit_events",
+}
+
+// deletionGracePeriod returns the configured time between a deletion request and the purge
+func deletionGracePeriod() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("ACCOUNT_DELETION_GRACE_DAYS"))
+	if err != nil || days < 0 {
+		return defaultDeletionGracePeriod
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// cancelAccountDeletion restores an account scheduled for deletion, it is
+// called whenever the user signs in again
+func cancelAccountDeletion(userID int) error {
+	result, err := config.DB.Exec(
+		"UPDATE users SET deletion_requested_at = NULL WHERE id = ? AND deletion_requested_at IS NOT NULL",
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	if restored, err := result.RowsAffected(); err == nil && restored > 0 {
+		log.Printf("Cancelled scheduled deletion of user %d after sign-in", userID)
+	}
+	return nil
+}
+
+// DeleteAccount schedules the account for deletion after the user confirms
+// their password. Accounts without a password, such as those created
+// through single sign-on, confirm through a link sent to their address
+// instead. All sessions end immediately, signing in again before the grace
+// period is over cancels the deletion.
+func DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling delete account request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	var email, passwordHash string
+	err = config.DB.QueryRow("SELECT email, password_hash FROM users WHERE id = ?", userID).Scan(&email, &passwordHash)
+	if err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	if passwordHash == "" {
+		if err := requestAccountDeletion(userID, email); err != nil {
+			log.Printf("Error sending account deletion confirmation: %v", err)
+			http.Error(w, `{"error": "Failed to send confirmation email"}`, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Check your email to confirm the deletion of your account",
+		})
+		return
+	}
+
+	if req.Password == "" {
+		http.Error(w, `{"error": "Password is required"}`, http.StatusBadRequest)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)) != nil {
+		http.Error(w, `{"error": "Password is incorrect"}`, http.StatusUnauthorized)
+		return
+	}
+
+	scheduleAccountDeletion(w, userID, email)
+}
+
+// requestAccountDeletion mails a link confirming the deletion of an account
+// that has no password to confirm it with. Only the latest link works.
+func requestAccountDeletion(userID int, email string) error {
+	if err := invalidateUserTokens(userID, tokenPurposeDeleteAccount); err != nil {
+		return err
+	}
+	token, err := createUserToken(userID, tokenPurposeDeleteAccount, email, accountDeletionConfirmTTL)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := mailer.Send(mailer.Message{
+			To:      email,
+			Subject: "Confirm the deletion of your DEFENZO account",
+			Body: fmt.Sprintf(
+				"You asked to delete your DEFENZO account.\n\n"+
+					"Open this link within %d minutes to confirm:\n%s\n\n"+
+					"If you didn't ask for this, you can ignore this email and your account will be kept.",
+				int(accountDeletionConfirmTTL.Minutes()), appLink("confirm-account-deletion", token),
+			),
+		})
+		if err != nil {
+			log.Printf("Error sending account deletion confirmation to user %d: %v", userID, err)
+		}
+	}()
+	return nil
+}
+
+// ConfirmAccountDeletion schedules the deletion of an account from the link
+// mailed by DeleteAccount
+func ConfirmAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling account deletion confirmation")
+	token := r.URL.Query().Get("token")
+	if token == "" && r.Method == http.MethodPost {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+		token = req.Token
+	}
+	if token == "" {
+		http.Error(w, `{"error": "Token is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, _, err := consumeUserToken(token, tokenPurposeDeleteAccount)
+	if err == errInvalidUserToken {
+		http.Error(w, `{"error": "Invalid or expired confirmation token"}`, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error consuming account deletion token: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// The notice goes to the current address, which may have changed since
+	var email string
+	if err := config.DB.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	scheduleAccountDeletion(w, userID, email)
+}
+
+// scheduleAccountDeletion marks the account for deletion, ends its sessions
+// and tells the user when the data will be gone
+func scheduleAccountDeletion(w http.ResponseWriter, userID int, email string) {
+	now := time.Now()
+	_, err := config.DB.Exec("UPDATE users SET deletion_requested_at = ? WHERE id = ?", now.Format(time.RFC3339), userID)
+	if err != nil {
+		log.Printf("Error scheduling account deletion: %v", err)
+		http.Error(w, `{"error": "Failed to delete account"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeAllUserTokens(userID); err != nil {
+		log.Printf("Error revoking sessions after deletion request: %v", err)
+		http.Error(w, `{"error": "Failed to revoke existing sessions"}`, http.StatusInternalServerError)
+		return
+	}
+
+	deleteAt := now.Add(deletionGracePeriod())
+	go func() {
+		err := mailer.Send(mailer.Message{
+			To:      email,
+			Subject: "Your DEFENZO account will be deleted",
+			Body: fmt.Sprintf(
+				"Your DEFENZO account and all of its data will be permanently deleted on %s.\n\n"+
+					"Changed your mind? Sign in before then and your account will be kept.",
+				deleteAt.Format("January 2, 2006"),
+			),
+		})
+		if err != nil {
+			log.Printf("Error sending deletion notice to user %d: %v", userID, err)
+		}
+	}()
+
+	log.Printf("User %d scheduled their account for deletion at %s", userID, deleteAt.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":   "Account scheduled for deletion, sign in again to cancel",
+		"delete_at": deleteAt.Format(time.RFC3339),
+	})
+}
+
+// StartAccountPurge removes accounts whose grace period has ended, once at
+// startup and then periodically in the background
+func StartAccountPurge() {
+	go func() {
+		for {
+			purged, err := purgeDeletedAccounts()
+			if err != nil {
+				log.Printf("Error purging deleted accounts: %v", err)
+			} else if purged > 0 {
+				log.Printf("Purged %d deleted account(s)", purged)
+			}
+			time.Sleep(accountPurgeInterval)
+		}
+	}()
+}
+
+// purgeDeletedAccounts permanently removes every account past its grace period
+func purgeDeletedAccounts() (int, error) {
+	cutoff := time.Now().Add(-deletionGracePeriod()).Format(time.RFC3339)
+	rows, err := config.DB.Query(
+		"SELECT id FROM users WHERE deletion_requested_at IS NOT NULL AND deletion_requested_at <= ?",
+		cutoff,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, userID := range userIDs {
+		if err := purgeAccount(userID); err != nil {
+			return i, fmt.Errorf("purging user %d: %v", userID, err)
+		}
+	}
+	return len(userIDs), nil
+}
+
+// purgeAccount deletes a user together with all of their rows and uploads
+func purgeAccount(userID int) error {
+	var email string
+	if err := config.DB.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+		return err
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range accountDataTables {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", userID); err != nil {
+			return fmt.Errorf("deleting from %s: %v", table, err)
+		}
+	}
+
+	// Keep what this user granted or created for others, but forget who did it
+	for _, query := range []string{
+		"UPDATE user_roles SET granted_by = NULL WHERE granted_by = ?",
+		"UPDATE organizations SET created_by = NULL WHERE created_by = ?",
+		"UPDATE organization_invitations SET invited_by = NULL WHERE invited_by = ?",
+		"UPDATE course_revisions SET author_id = NULL WHERE author_id = ?",
+		"UPDATE course_revisions SET reviewer_id = NULL WHERE reviewer_id = ?",
+	} {
+		if _, err := tx.Exec(query, userID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM organization_invitations WHERE email = ? COLLATE NOCASE", email); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM login_throttle WHERE key = ?", loginguard.Key(loginguard.KindAccount, email)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM users WHERE id = ?", userID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// Every picture the user ever uploaded, not just the current one
+	pictures, err := filepath.Glob(filepath.Join(profilePictureDir, fmt.Sprintf("%d_*", userID)))
+	if err != nil {
+		return err
+	}
+	for _, picture := range pictures {
+		if err := os.Remove(picture); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing profile picture %s: %v", picture, err)
+		}
+	}
+
+	log.Printf("Purged account of user %d", userID)
+	return nil
+}
+
+// queryRecords runs a query and returns each row as a map keyed by column name
+func queryRecords(query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := config.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	records := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		record := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			record[column] = values[i]
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// exportFile is one JSON document in the account export archive
+type exportFile struct {
+	name string
+	data interface{}
+}
+
+// ExportAccount returns a zip archive with everything stored about the user
+// as JSON files. Secrets such as password hashes, TOTP seeds and token hashes
+// are left out.
+func ExportAccount(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling export account request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	profile, err := loadProfile(userID)
+	if err != nil {
+		log.Printf("Error getting user profile: %v", err)
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	files := []exportFile{{"profile.json", profile}}
+
+	queries := []struct {
+		name  string
+		query string
+	}{
+		{"progress.json", `
+			SELECT course_id, lesson_id, completed, progress, last_accessed, course_version
+			FROM user_course_progress WHERE user_id = ? ORDER BY course_id, lesson_id`},
+		{"badges.json", `
+			SELECT ub.badge_id, b.name, ub.progress, ub.completed, ub.awarded_at
+			FROM user_badges ub LEFT JOIN badges b ON b.id = ub.badge_id
+			WHERE ub.user_id = ? ORDER BY ub.badge_id`},
+		{"sessions.json", `
+			SELECT id, user_agent, ip, created_at, last_seen_at
+			FROM sessions WHERE user_id = ? ORDER BY created_at`},
+		{"roles.json", `
+			SELECT role, granted_at FROM user_roles WHERE user_id = ? ORDER BY role`},
+		{"two_factor.json", `
+			SELECT enabled, created_at, confirmed_at,
+				(SELECT COUNT(*) FROM user_recovery_codes c WHERE c.user_id = t.user_id AND c.used_at IS NULL) AS recovery_codes_left
+			FROM user_totp t WHERE user_id = ?`},
+		{"linked_logins.json", `
+			SELECT provider, subject, email, created_at, last_login_at
+			FROM user_identities WHERE user_id = ? ORDER BY created_at`},
+		{"organizations.json", `
+			SELECT o.id, o.name, m.role, m.joined_at
+			FROM organization_members m JOIN organizations o ON o.id = m.org_id
+			WHERE m.user_id = ? ORDER BY m.joined_at`},
+		{"passkeys.json", `
+			SELECT name, aaguid, transports, backed_up, created_at, last_used_at, clone_detected_at
+			FROM webauthn_credentials WHERE user_id = ? ORDER BY created_at`},
+		{"api_tokens.json", `
+			SELECT name, token_hint, scopes, created_at, expires_at, last_used_at, last_used_ip, revoked_at
+			FROM api_tokens WHERE user_id = ? ORDER BY created_at`},
+		{"email_tokens.json", `
+			SELECT purpose, data, created_at, expires_at, used_at
+			FROM user_tokens WHERE user_id = ? ORDER BY created_at`},
+		{"activity.json", `
+			SELECT event_type, ip, user_agent, metadata, created_at
+			FROM audit_events WHERE user_id = ? ORDER BY id`},
+	}
+	for _, q := range queries {
+		records, err := queryRecords(q.query, userID)
+		if err != nil {
+			log.Printf("Error exporting %s for user %d: %v", q.name, userID, err)
+			http.Error(w, `{"error": "Failed to export data"}`, http.StatusInternalServerError)
+			return
+		}
+		files = append(files, exportFile{q.name, records})
+	}
+
+	throttle, err := queryRecords(
+		"SELECT failures, last_failure_at, locked_until FROM login_throttle WHERE key = ?",
+		loginguard.Key(loginguard.KindAccount, profile.Email),
+	)
+	if err != nil {
+		log.Printf("Error exporting login throttle for user %d: %v", userID, err)
+		http.Error(w, `{"error": "Failed to export data"}`, http.StatusInternalServerError)
+		return
+	}
+	files = append(files, exportFile{"failed_logins.json", throttle})
+
+	// Everything is loaded, so errors from here on can only be write errors
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(
+		`attachment; filename="defenzo-export-%d-%s.zip"`, userID, time.Now().Format("20060102")))
+
+	exportedAt := time.Now()
+	archive := zip.NewWriter(w)
+	for _, file := range files {
+		f, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     file.name,
+			Method:   zip.Deflate,
+			Modified: exportedAt,
+		})
+		if err != nil {
+			log.Printf("Error writing export archive: %v", err)
+			return
+		}
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(file.data); err != nil {
+			log.Printf("Error writing export archive: %v", err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Error writing export archive: %v", err)
+		return
+	}
+
+	log.Printf("Exported account data for user %d", userID)
+}
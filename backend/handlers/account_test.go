@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"testing"
+
+	"defenzo/config"
+)
+
+// danglingUserRows counts rows that point to a user who does not exist
+func danglingUserRows(t *testing.T) int {
+	t.Helper()
+	var n int
+	if err := config.DB.QueryRow("SELECT COUNT(*) FROM pragma_foreign_key_check WHERE parent = 'users'").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPurgeAccountLeavesNoRows(t *testing.T) {
+	userID := createTestUser(t, "purged@example.com", "")
+	other := createTestUser(t, "purge-other@example.com", "")
+	if _, err := config.DB.Exec(
+		"INSERT INTO mfa_failures (user_id, failures, last_failure_at) VALUES (?, 1, datetime('now'))", userID,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.DB.Exec(
+		"INSERT INTO user_roles (user_id, role, granted_by, granted_at) VALUES (?, 'instructor', ?, datetime('now'))", other, userID,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.DB.Exec(
+		`INSERT INTO course_revisions (course_id, version, status, snapshot, author_id, reviewer_id, created_at, updated_at)
+		VALUES ('purged-course', 1, 'approved', '{}', ?, ?, datetime('now'), datetime('now'))`, userID, userID,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if n := danglingUserRows(t); n != 0 {
+		t.Fatalf("%d rows point to missing users before the purge", n)
+	}
+
+	if err := purgeAccount(userID); err != nil {
+		t.Fatal(err)
+	}
+	if n := danglingUserRows(t); n != 0 {
+		t.Fatalf("%d rows still point to the purged user", n)
+	}
+}
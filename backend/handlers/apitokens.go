@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"defenzo/config"
+	"defenzo/middleware"
+	"defenzo/models"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultAPITokenDays is the lifetime of an API token when none is given
+	defaultAPITokenDays = 30
+	// maxAPITokenDays caps the lifetime of an API token
+	maxAPITokenDays = 365
+	// maxAPITokensPerUser limits how many active API tokens a user can hold
+	maxAPITokensPerUser = 20
+	// maxAPITokenNameLength keeps token labels short enough to list
+	maxAPITokenNameLength = 100
+)
+
+// APIToken is a personal access token as listed to its owner. The token
+// itself is only returned once, when it is created.
+type APIToken struct {
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	Token      string   `json:"token,omitempty"`
+	Hint       string   `json:"hint"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"created_at"`
+	ExpiresAt  string   `json:"expires_at"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	LastUsedIP string   `json:"last_used_ip,omitempty"`
+}
+
+// isValidScope reports whether API tokens can be granted the scope
+func isValidScope(scope string) bool {
+	for _, s := range models.APITokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ListAPITokens returns the user's active API tokens
+func ListAPITokens(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling list API tokens request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT id, name, token_hint, scopes, created_at, expires_at, last_used_at, last_used_ip
+		FROM api_tokens
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?
+		ORDER BY created_at DESC, id DESC
+	`, userID, time.Now().Format(time.RFC3339))
+	if err != nil {
+		log.Printf("Database error while fetching API tokens: %v", err)
+		http.Error(w, `{"error": "Failed to fetch tokens"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		var t APIToken
+		var scopes string
+		var lastUsedAt, lastUsedIP sql.NullString
+		if err := rows.Scan(&t.ID, &t.Name, &t.Hint, &scopes, &t.CreatedAt, &t.ExpiresAt, &lastUsedAt, &lastUsedIP); err != nil {
+			log.Printf("Error scanning API token row: %v", err)
+			http.Error(w, `{"error": "Failed to scan token data"}`, http.StatusInternalServerError)
+			return
+		}
+		t.Scopes = strings.Fields(scopes)
+		t.LastUsedAt = lastUsedAt.String
+		t.LastUsedIP = lastUsedIP.String
+		tokens = append(tokens, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating API token rows: %v", err)
+		http.Error(w, `{"error": "Failed to fetch tokens"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// CreateAPIToken creates a personal access token and returns it once
+func CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling create API token request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > maxAPITokenNameLength {
+		http.Error(w, `{"error": "Name is required and must be at most 100 characters"}`, http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, `{"error": "At least one scope is required"}`, http.StatusBadRequest)
+		return
+	}
+	seen := map[string]bool{}
+	var scopes []string
+	for _, scope := range req.Scopes {
+		if !isValidScope(scope) {
+			writeJSONError(w, "Unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	days := req.ExpiresInDays
+	if days == 0 {
+		days = defaultAPITokenDays
+	}
+	if days < 1 || days > maxAPITokenDays {
+		http.Error(w, `{"error": "expires_in_days must be between 1 and 365"}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	var active int
+	err = config.DB.QueryRow(
+		"SELECT COUNT(*) FROM api_tokens WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?",
+		userID, now.Format(time.RFC3339),
+	).Scan(&active)
+	if err != nil {
+		log.Printf("Error counting API tokens: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if active >= maxAPITokensPerUser {
+		http.Error(w, `{"error": "Too many active tokens, revoke one first"}`, http.StatusConflict)
+		return
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		log.Printf("Error generating API token: %v", err)
+		http.Error(w, `{"error": "Failed to create token"}`, http.StatusInternalServerError)
+		return
+	}
+	token := middleware.APITokenPrefix + secret
+
+	t := APIToken{
+		Name:      name,
+		Token:     token,
+		Hint:      token[len(token)-4:],
+		Scopes:    scopes,
+		CreatedAt: now.Format(time.RFC3339),
+		ExpiresAt: now.Add(time.Duration(days) * 24 * time.Hour).Format(time.RFC3339),
+	}
+	result, err := config.DB.Exec(
+		"INSERT INTO api_tokens (user_id, name, token_hash, token_hint, scopes, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		userID, t.Name, middleware.HashAPIToken(token), t.Hint, strings.Join(scopes, " "), t.CreatedAt, t.ExpiresAt,
+	)
+	if err != nil {
+		log.Printf("Error storing API token: %v", err)
+		http.Error(w, `{"error": "Failed to create token"}`, http.StatusInternalServerError)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Printf("Error getting last insert ID: %v", err)
+		http.Error(w, `{"error": "Failed to create token"}`, http.StatusInternalServerError)
+		return
+	}
+	t.ID = int(id)
+
+	log.Printf("User %d created API token %d with scopes %v", userID, t.ID, scopes)
+	recordAuditEvent(r, userID, auditAPITokenCreated, map[string]interface{}{
+		"token_id": t.ID,
+		"name":     t.Name,
+		"scopes":   scopes,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// RevokeAPIToken revokes one of the user's API tokens
+func RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling revoke API token request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	tokenID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error": "Invalid token ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	result, err := config.DB.Exec(
+		"UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+		time.Now().Format(time.RFC3339), tokenID, userID,
+	)
+	if err != nil {
+		log.Printf("Error revoking API token: %v", err)
+		http.Error(w, `{"error": "Failed to revoke token"}`, http.StatusInternalServerError)
+		return
+	}
+	if revoked, err := result.RowsAffected(); err != nil || revoked == 0 {
+		http.Error(w, `{"error": "Token not found"}`, http.StatusNotFound)
+		return
+	}
+
+	log.Printf("User %d revoked API token %d", userID, tokenID)
+	recordAuditEvent(r, userID, auditAPITokenRevoked, map[string]interface{}{"token_id": tokenID})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Token revoked",
+	})
+}
@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"defenzo/config"
+	"defenzo/middleware"
+)
+
+// Audit event types
+const (
+	auditRegister               = "register"
+	auditLoginFailed            = "login_failed"
+	auditSessionStarted         = "session_started"
+	auditMFAFailed              = "mfa_failed"
+	auditProfileUpdated         = "profile_updated"
+	auditEmailChangeRequested   = "email_change_requested"
+	auditEmailChanged           = "email_changed"
+	auditPasswordChanged        = "password_changed"
+	auditPasswordReset          = "password_reset"
+	auditProfilePictureUploaded = "profile_picture_uploaded"
+	auditAPITokenCreated        = "api_token_created"
+	auditAPITokenRevoked        = "api_token_revoked"
+	auditRolesChanged           = "roles_changed"
+)
+
+const (
+	defaultAuditRetention  = 365 * 24 * time.Hour
+	auditRetentionInterval = 24 * time.Hour
+	defaultAuditPageSize   = 50
+	maxAuditPageSize       = 200
+	// maxAuditUserAgentLength keeps oversized headers out of the log
+	maxAuditUserAgentLength = 255
+)
+
+// AuditEvent is one entry of the security audit log
+type AuditEvent struct {
+	ID        int             `json:"id"`
+	UserID    *int            `json:"user_id"`
+	ActorID   *int            `json:"actor_id"`
+	EventType string          `json:"event_type"`
+	IP        string          `json:"ip"`
+	UserAgent string          `json:"user_agent"`
+	Metadata  json.RawMessage `json:"metadata"`
+	CreatedAt string          `json:"created_at"`
+}
+
+// unauthenticatedEvents are caused by someone who has not proven who they
+// are, so they are never attributed to the account they are about
+var unauthenticatedEvents = map[string]bool{
+	auditLoginFailed: true,
+	auditMFAFailed:   true,
+}
+
+// recordAuditEvent appends an event about the account userID (0 when no
+// account is known) to the audit log. The actor is the signed-in caller,
+// which differs from the account when an admin acts on someone else.
+// Failures are logged but never fail the request.
+func recordAuditEvent(r *http.Request, userID int, eventType string, metadata map[string]interface{}) {
+	actorID, err := middleware.GetUserID(r)
+	if err != nil {
+		actorID = userID
+		if unauthenticatedEvents[eventType] {
+			actorID = 0
+		}
+	}
+
+	data := []byte("{}")
+	if metadata != nil {
+		if data, err = json.Marshal(metadata); err != nil {
+			log.Printf("Error encoding audit metadata for %s: %v", eventType, err)
+			data = []byte("{}")
+		}
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxAuditUserAgentLength {
+		userAgent = userAgent[:maxAuditUserAgentLength]
+	}
+
+	_, err = config.DB.Exec(
+		"INSERT INTO audit_events (user_id, actor_id, event_type, ip, user_agent, metadata, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		nullableID(userID), nullableID(actorID), eventType, middleware.ClientIP(r), userAgent, string(data),
+		time.Now().UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		log.Printf("Error recording audit event %s for user %d: %v", eventType, userID, err)
+	}
+}
+
+// nullableID stores 0 as NULL
+func nullableID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// auditRetention returns how long audit events are kept, 0 keeps them forever
+func auditRetention() time.Duration {
+	value := os.Getenv("AUDIT_RETENTION_DAYS")
+	if value == "" {
+		return defaultAuditRetention
+	}
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 0 {
+		return defaultAuditRetention
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// StartAuditRetention deletes audit events older than the retention period,
+// once at startup and then daily in the background
+func StartAuditRetention() {
+	go func() {
+		for {
+			if retention := auditRetention(); retention > 0 {
+				cutoff := time.Now().UTC().Add(-retention).Format(time.RFC3339)
+				result, err := config.DB.Exec("DELETE FROM audit_events WHERE created_at < ?", cutoff)
+				if err != nil {
+					log.Printf("Error deleting old audit events: %v", err)
+				} else if deleted, _ := result.RowsAffected(); deleted > 0 {
+					log.Printf("Deleted %d audit event(s) older than %s", deleted, cutoff)
+				}
+			}
+			time.Sleep(auditRetentionInterval)
+		}
+	}()
+}
+
+// queryAuditEvents writes the events matching the conditions, newest first.
+// Pages are requested with limit and before_id, the ID of the last event of
+// the previous page.
+func queryAuditEvents(w http.ResponseWriter, r *http.Request, conditions []string, args []interface{}) {
+	query := r.URL.Query()
+
+	limit := defaultAuditPageSize
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, `{"error": "Invalid limit"}`, http.StatusBadRequest)
+			return
+		}
+		if n < maxAuditPageSize {
+			limit = n
+		} else {
+			limit = maxAuditPageSize
+		}
+	}
+	if value := query.Get("before_id"); value != "" {
+		beforeID, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, `{"error": "Invalid before_id"}`, http.StatusBadRequest)
+			return
+		}
+		conditions = append(conditions, "id < ?")
+		args = append(args, beforeID)
+	}
+
+	sqlQuery := "SELECT id, user_id, actor_id, event_type, ip, user_agent, metadata, created_at FROM audit_events"
+	if len(conditions) > 0 {
+		sqlQuery += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sqlQuery += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := config.DB.Query(sqlQuery, args...)
+	if err != nil {
+		log.Printf("Database error while fetching audit events: %v", err)
+		http.Error(w, `{"error": "Failed to fetch activity"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		var metadata string
+		if err := rows.Scan(&e.ID, &e.UserID, &e.ActorID, &e.EventType, &e.IP, &e.UserAgent, &metadata, &e.CreatedAt); err != nil {
+			log.Printf("Error scanning audit event row: %v", err)
+			http.Error(w, `{"error": "Failed to scan activity data"}`, http.StatusInternalServerError)
+			return
+		}
+		e.Metadata = json.RawMessage(metadata)
+		events = append(events, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// GetAccountActivity returns the security events of the user's own account
+func GetAccountActivity(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling account activity request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	queryAuditEvents(w, r, []string{"user_id = ?"}, []interface{}{userID})
+}
+
+// ListAuditEvents returns audit events for all accounts (admin only). They can
+// be filtered by user_id, actor_id, event_type (comma separated), ip, and a
+// since/until time range in RFC 3339.
+func ListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling list audit events request")
+	query := r.URL.Query()
+
+	var conditions []string
+	var args []interface{}
+	for _, column := range []string{"user_id", "actor_id"} {
+		if value := query.Get(column); value != "" {
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				writeJSONError(w, fmt.Sprintf("Invalid %s", column), http.StatusBadRequest)
+				return
+			}
+			conditions = append(conditions, column+" = ?")
+			args = append(args, id)
+		}
+	}
+	if value := query.Get("event_type"); value != "" {
+		types := strings.Split(value, ",")
+		placeholders := make([]string, len(types))
+		for i, eventType := range types {
+			placeholders[i] = "?"
+			args = append(args, strings.TrimSpace(eventType))
+		}
+		conditions = append(conditions, "event_type IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if value := query.Get("ip"); value != "" {
+		conditions = append(conditions, "ip = ?")
+		args = append(args, value)
+	}
+	for param, operator := range map[string]string{"since": ">=", "until": "<"} {
+		if value := query.Get(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				writeJSONError(w, fmt.Sprintf("Invalid %s, use RFC 3339", param), http.StatusBadRequest)
+				return
+			}
+			conditions = append(conditions, "created_at "+operator+" ?")
+			args = append(args, t.UTC().Format(time.RFC3339))
+		}
+	}
+
+	queryAuditEvents(w, r, conditions, args)
+}
@@ -154,7 +154,11 @@ func GetUserBadges(w http.ResponseWriter, r *http.Request) {
 
 // UpdateBadgeProgress updates the progress of a badge for a user
 func UpdateBadgeProgress(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("user_id").(int)
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
 
 	var req struct {
 		BadgeID  int `json:"badge_id"`
@@ -168,7 +172,7 @@ func UpdateBadgeProgress(w http.ResponseWriter, r *http.Request) {
 
 	// Get badge requirement
 	var requirementValue sql.NullInt64
-	err := config.DB.QueryRow("SELECT requirement_value FROM badges WHERE id = $1", req.BadgeID).Scan(&requirementValue)
+	err = config.DB.QueryRow("SELECT requirement_value FROM badges WHERE id = $1", req.BadgeID).Scan(&requirementValue)
 	if err != nil {
 		http.Error(w, "Badge not found", http.StatusNotFound)
 		return
@@ -207,7 +211,11 @@ func UpdateBadgeProgress(w http.ResponseWriter, r *http.Request) {
 
 // CheckAndAwardBadges checks and awards badges based on user actions
 func CheckAndAwardBadges(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("user_id").(int)
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
 
 	var req struct {
 		ActionType string                 `json:"action_type"`
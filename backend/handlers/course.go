@@ -1,191 +1,264 @@
 package handlers
 
 import (
-	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
-	"defenzo/config"
 	"defenzo/middleware"
-	"defenzo/models"
+	"defenzo/repository"
 
 	"github.com/gorilla/mux"
 )
 
-// GetCourses handles getting all courses
+const (
+	// defaultCoursePageSize applies when a cursor is given without a limit
+	defaultCoursePageSize = 20
+	maxCoursePageSize     = 100
+)
+
+// courseSorts are the orders GetCourses can list courses in. Every column is
+// sorted descending and the last one is unique, so a page can continue after
+// the last course of the previous one.
+var courseSorts = map[string][]string{
+	"":         {"recommended", "COALESCE(rating, 0)", "id"},
+	"rating":   {"COALESCE(rating, 0)", "id"},
+	"learners": {"COALESCE(learners, 0)", "id"},
+	"newest":   {"rowid"},
+}
+
+// courseFields are the fields of a course that can be selected with fields
+var courseFields = map[string]bool{
+	"id": true, "title": true, "description": true, "category": true, "duration": true, "progress": true,
+	"level": true, "tags": true, "image": true, "rating": true, "learners": true, "recommended": true,
+	"version": true, "last_accessed": true, "next_lesson_id": true,
+}
+
+// courseCursor marks where the next page of courses starts
+type courseCursor struct {
+	Sort string        `json:"s"`
+	Key  []interface{} `json:"k"`
+}
+
+// encodeCourseCursor makes an opaque cursor from the sort values of the last course of a page
+func encodeCourseCursor(sort string, key []interface{}) string {
+	data, _ := json.Marshal(courseCursor{Sort: sort, Key: key})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCourseCursor reads a cursor, which must have been made for the same sort
+func decodeCourseCursor(value, sort string) ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	var cursor courseCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	if cursor.Sort != sort || len(cursor.Key) != len(courseSorts[sort]) {
+		return nil, errors.New("cursor does not match the sort")
+	}
+	return cursor.Key, nil
+}
+
+// splitParam splits a comma separated query parameter, dropping empty values
+func splitParam(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// likeEscaper escapes the wildcards of user input for LIKE ... ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// placeholders returns "?, ?, ?" for n values
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// GetCourses lists the published courses. They can be filtered by category,
+// level and tags (comma separated, any of them matches), recommended and a
+// free-text q over title, description and tags, and sorted by rating,
+// learners or newest instead of recommended first.
+//
+// Without limit or cursor every course is returned. With them a page of
+// courses is returned, and the X-Next-Cursor header holds the cursor of the
+// next page when there is one.
+//
+// By default courses come with their lessons, in full. fields selects the
+// course fields to return, and when fields or include is given lessons are
+// only added with include=lessons.
+//
+// Progress, completed lessons, last_accessed and next_lesson_id, the lesson
+// to resume at, are the caller's own. Anonymous callers get courses not
+// started yet.
 func GetCourses(w http.ResponseWriter, r *http.Request) {
 	userID, _ := middleware.GetUserID(r) // If not authenticated, userID will be 0
+	query := r.URL.Query()
 
-	rows, err := config.DB.Query(`
-		SELECT id, title, description, category, duration, progress, level, tags, image, rating, learners, recommended
-		FROM courses
-		ORDER BY recommended DESC, rating DESC
-	`)
-	if err != nil {
-		http.Error(w, `{"error": "Failed to fetch courses"}`, http.StatusInternalServerError)
-		return
+	var conditions []string
+	var args []interface{}
+	for _, column := range []string{"category", "level"} {
+		if values := splitParam(query.Get(column)); len(values) > 0 {
+			conditions = append(conditions, "LOWER("+column+") IN ("+placeholders(len(values))+")")
+			for _, v := range values {
+				args = append(args, strings.ToLower(v))
+			}
+		}
 	}
-	defer rows.Close()
-
-	var courses []models.Course
-	for rows.Next() {
-		var course models.Course
-		var tags string
-		err := rows.Scan(
-			&course.ID,
-			&course.Title,
-			&course.Description,
-			&course.Category,
-			&course.Duration,
-			&course.Progress,
-			&course.Level,
-			&tags,
-			&course.Image,
-			&course.Rating,
-			&course.Learners,
-			&course.Recommended,
-		)
+	if tags := splitParam(query.Get("tags")); len(tags) > 0 {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM json_each(courses.tags) WHERE LOWER(json_each.value) IN ("+placeholders(len(tags))+"))")
+		for _, tag := range tags {
+			args = append(args, strings.ToLower(tag))
+		}
+	}
+	if value := query.Get("recommended"); value != "" {
+		recommended, err := strconv.ParseBool(value)
 		if err != nil {
-			http.Error(w, `{"error": "Failed to scan course data"}`, http.StatusInternalServerError)
+			http.Error(w, `{"error": "Invalid recommended, use true or false"}`, http.StatusBadRequest)
 			return
 		}
+		conditions = append(conditions, "recommended = ?")
+		args = append(args, recommended)
+	}
+	if q := strings.TrimSpace(query.Get("q")); q != "" {
+		pattern := "%" + likeEscaper.Replace(q) + "%"
+		conditions = append(conditions, `(title LIKE ? ESCAPE '\' OR description LIKE ? ESCAPE '\' OR tags LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern, pattern)
+	}
 
-		// Parse tags from JSON string
-		if err := json.Unmarshal([]byte(tags), &course.Tags); err != nil {
-			http.Error(w, `{"error": "Failed to parse course tags"}`, http.StatusInternalServerError)
-			return
-		}
+	sort := query.Get("sort")
+	sortColumns, ok := courseSorts[sort]
+	if !ok {
+		http.Error(w, `{"error": "Invalid sort, use rating, learners or newest"}`, http.StatusBadRequest)
+		return
+	}
 
-		// If user is authenticated, get their LATEST course-level progress
-		if userID > 0 {
-			var userProgress sql.NullInt64
-			err := config.DB.QueryRow(
-				`SELECT progress FROM user_course_progress WHERE user_id = ? AND course_id = ? AND lesson_id IS NULL ORDER BY last_accessed DESC LIMIT 1`,
-				userID, course.ID,
-			).Scan(&userProgress)
-			if err == nil && userProgress.Valid {
-				course.Progress = int(userProgress.Int64)
-			} else {
-				// If no progress found (sql.ErrNoRows) or invalid, default to 0
-				course.Progress = 0
-			}
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxCoursePageSize {
+			writeJSONError(w, fmt.Sprintf("Invalid limit, use 1 to %d", maxCoursePageSize), http.StatusBadRequest)
+			return
 		}
-
-		// Get lessons for the course
-		lessonRows, err := config.DB.Query(`
-			SELECT id, title, type, duration, content, order_num, completed
-			FROM lessons
-			WHERE course_id = ?
-			ORDER BY order_num
-		`, course.ID)
+		limit = n
+	}
+	if value := query.Get("cursor"); value != "" {
+		key, err := decodeCourseCursor(value, sort)
 		if err != nil {
-			http.Error(w, `{"error": "Failed to fetch lessons for course"}`, http.StatusInternalServerError)
+			http.Error(w, `{"error": "Invalid cursor"}`, http.StatusBadRequest)
 			return
 		}
-		defer lessonRows.Close()
-
-		var lessons []models.Lesson
-		for lessonRows.Next() {
-			var lesson models.Lesson
-			err := lessonRows.Scan(
-				&lesson.ID,
-				&lesson.Title,
-				&lesson.Type,
-				&lesson.Duration,
-				&lesson.Content,
-				&lesson.OrderNum,
-				&lesson.Completed,
-			)
-			if err != nil {
-				http.Error(w, `{"error": "Failed to scan lesson data"}`, http.StatusInternalServerError)
+		conditions = append(conditions, "("+strings.Join(sortColumns, ", ")+") < ("+placeholders(len(key))+")")
+		args = append(args, key...)
+		if limit == 0 {
+			limit = defaultCoursePageSize
+		}
+	}
+
+	var fields []string
+	if value := query.Get("fields"); value != "" {
+		for _, field := range splitParam(value) {
+			if !courseFields[field] {
+				writeJSONError(w, fmt.Sprintf("Unknown field %q", field), http.StatusBadRequest)
+				return
+			}
+			fields = append(fields, field)
+		}
+	}
+	includeLessons := true
+	if query.Has("fields") || query.Has("include") {
+		includeLessons = false
+		for _, include := range splitParam(query.Get("include")) {
+			if include != "lessons" {
+				writeJSONError(w, fmt.Sprintf("Unknown include %q", include), http.StatusBadRequest)
 				return
 			}
-			lesson.CourseID = course.ID
-			lessons = append(lessons, lesson)
+			includeLessons = true
 		}
+	}
 
-		course.Lessons = lessons
-		courses = append(courses, course)
+	courseQuery := repository.CourseQuery{
+		Conditions:  conditions,
+		Args:        args,
+		SortColumns: sortColumns,
+		WithLessons: includeLessons,
+		UserID:      userID,
+	}
+	if limit > 0 {
+		// One more than the page shows whether there is a next page
+		courseQuery.Limit = limit + 1
+	}
+	courses, keys, err := repository.FindCourses(courseQuery)
+	if err != nil {
+		log.Printf("Database error while fetching courses: %v", err)
+		http.Error(w, `{"error": "Failed to fetch courses"}`, http.StatusInternalServerError)
+		return
+	}
+	if limit > 0 && len(courses) > limit {
+		courses = courses[:limit]
+		w.Header().Set("X-Next-Cursor", encodeCourseCursor(sort, keys[limit-1]))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(courses)
+	if fields == nil && includeLessons {
+		json.NewEncoder(w).Encode(courses)
+		return
+	}
+
+	// Leave out what was not asked for
+	selected := make([]map[string]json.RawMessage, 0, len(courses))
+	for _, course := range courses {
+		data, _ := json.Marshal(course)
+		var all map[string]json.RawMessage
+		json.Unmarshal(data, &all)
+
+		entry := map[string]json.RawMessage{}
+		if fields == nil {
+			entry = all
+		} else {
+			entry["id"] = all["id"]
+			for _, field := range fields {
+				entry[field] = all[field]
+			}
+		}
+		if includeLessons {
+			entry["lessons"] = all["lessons"]
+		} else {
+			delete(entry, "lessons")
+		}
+		selected = append(selected, entry)
+	}
+	json.NewEncoder(w).Encode(selected)
 }
 
-// GetCourseByID handles getting a specific course by ID
+// GetCourseByID handles getting a specific course by ID, with the caller's
+// progress merged in as in GetCourses
 func GetCourseByID(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	courseID := vars["id"]
+	userID, _ := middleware.GetUserID(r) // If not authenticated, userID will be 0
 
-	var course models.Course
-	var tags string
-	err := config.DB.QueryRow(`
-		SELECT id, title, description, category, duration, progress, level, tags, image, rating, learners, recommended
-		FROM courses
-		WHERE id = ?
-	`, courseID).Scan(
-		&course.ID,
-		&course.Title,
-		&course.Description,
-		&course.Category,
-		&course.Duration,
-		&course.Progress,
-		&course.Level,
-		&tags,
-		&course.Image,
-		&course.Rating,
-		&course.Learners,
-		&course.Recommended,
-	)
-	if err == sql.ErrNoRows {
+	course, err := repository.GetCourse(courseID, userID, false)
+	if err == repository.ErrNotFound {
 		http.Error(w, `{"error": "Course not found"}`, http.StatusNotFound)
 		return
 	} else if err != nil {
+		log.Printf("Database error while fetching course %s: %v", courseID, err)
 		http.Error(w, `{"error": "Failed to fetch course"}`, http.StatusInternalServerError)
 		return
 	}
 
-	// Parse tags from JSON string
-	if err := json.Unmarshal([]byte(tags), &course.Tags); err != nil {
-		http.Error(w, `{"error": "Failed to parse course tags"}`, http.StatusInternalServerError)
-		return
-	}
-
-	// Get lessons for the course
-	rows, err := config.DB.Query(`
-		SELECT id, title, type, duration, content, order_num, completed
-		FROM lessons
-		WHERE course_id = ?
-		ORDER BY order_num
-	`, courseID)
-	if err != nil {
-		http.Error(w, `{"error": "Failed to fetch lessons"}`, http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	var lessons []models.Lesson
-	for rows.Next() {
-		var lesson models.Lesson
-		err := rows.Scan(
-			&lesson.ID,
-			&lesson.Title,
-			&lesson.Type,
-			&lesson.Duration,
-			&lesson.Content,
-			&lesson.OrderNum,
-			&lesson.Completed,
-		)
-		if err != nil {
-			http.Error(w, `{"error": "Failed to scan lesson data"}`, http.StatusInternalServerError)
-			return
-		}
-		lesson.CourseID = courseID
-		lessons = append(lessons, lesson)
-	}
-
-	course.Lessons = lessons
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(course)
 }
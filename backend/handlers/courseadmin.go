@@ -0,0 +1,637 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"defenzo/config"
+	"defenzo/content"
+	"defenzo/models"
+	"defenzo/repository"
+
+	"github.com/gorilla/mux"
+)
+
+// errContentNotFound is returned when a course or lesson does not exist
+var errContentNotFound = errors.New("not found")
+
+// errLessonPosition is returned when a lesson is inserted past the end of its course
+var errLessonPosition = errors.New("order_num is past the last lesson of the course")
+
+// rejectPublishedEdit refuses to change a published course in place, which
+// would change it under the learners taking it. Its content changes through
+// a revision instead. It reports whether the request was refused.
+func rejectPublishedEdit(w http.ResponseWriter, courseID string) bool {
+	var status string
+	err := config.DB.QueryRow("SELECT status FROM courses WHERE id = ?", courseID).Scan(&status)
+	if err == sql.ErrNoRows {
+		// The handler reports the course as not found
+		return false
+	} else if err != nil {
+		log.Printf("Error checking course %s: %v", courseID, err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return true
+	}
+	if status == models.CourseStatusPublished {
+		http.Error(w, `{"error": "The course is published, change it through a revision"}`, http.StatusConflict)
+		return true
+	}
+	return false
+}
+
+// sameCourseFields reports whether two courses have the same editable
+// fields, leaving out their status and lessons
+func sameCourseFields(a, b *models.Course) bool {
+	if a.Title != b.Title || a.Description != b.Description || a.Category != b.Category ||
+		a.Duration != b.Duration || a.Level != b.Level || a.Image != b.Image || a.Rating != b.Rating ||
+		a.Learners != b.Learners || a.Recommended != b.Recommended || len(a.Tags) != len(b.Tags) {
+		return false
+	}
+	for i := range a.Tags {
+		if a.Tags[i] != b.Tags[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// contentIDTaken reports whether a course or lesson already uses the ID
+func contentIDTaken(table, id string) (bool, error) {
+	var exists bool
+	err := config.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM "+table+" WHERE id = ?)", id).Scan(&exists)
+	return exists, err
+}
+
+// loadAdminCourse returns a course with its lessons, drafts included
+func loadAdminCourse(courseID string) (*models.Course, error) {
+	course, err := repository.GetCourse(courseID, 0, true)
+	if err == repository.ErrNotFound {
+		return nil, errContentNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	fillAdminCourse(course)
+	return course, nil
+}
+
+// fillAdminCourse lists missing tags and lessons as empty rather than null
+func fillAdminCourse(course *models.Course) {
+	if course.Tags == nil {
+		course.Tags = []string{}
+	}
+	if course.Lessons == nil {
+		course.Lessons = []models.Lesson{}
+	}
+}
+
+// writeAdminCourse responds with the current state of a course
+func writeAdminCourse(w http.ResponseWriter, courseID string, code int) {
+	course, err := loadAdminCourse(courseID)
+	if err != nil {
+		log.Printf("Error loading course %s: %v", courseID, err)
+		http.Error(w, `{"error": "Failed to fetch course"}`, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(course)
+}
+
+// insertLesson adds a lesson to a course at position orderNum, moving the
+// lessons from that position on down by one. An orderNum of 0 appends it.
+func insertLesson(tx *sql.Tx, courseID string, lesson models.Lesson) error {
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM lessons WHERE course_id = ?", courseID).Scan(&count); err != nil {
+		return err
+	}
+	if lesson.OrderNum == 0 {
+		if err := tx.QueryRow("SELECT COALESCE(MAX(order_num), 0) + 1 FROM lessons WHERE course_id = ?", courseID).Scan(&lesson.OrderNum); err != nil {
+			return err
+		}
+	} else if lesson.OrderNum > count+1 {
+		return errLessonPosition
+	} else if _, err := tx.Exec(
+		"UPDATE lessons SET order_num = order_num + 1 WHERE course_id = ? AND order_num >= ?",
+		courseID, lesson.OrderNum,
+	); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(
+		"INSERT INTO lessons (id, course_id, title, type, duration, content, order_num) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		lesson.ID, courseID, lesson.Title, lesson.Type, lesson.Duration, lesson.Content, lesson.OrderNum,
+	)
+	return err
+}
+
+// ListAdminCourses returns every course with its lessons, drafts included (admin only)
+func ListAdminCourses(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling list admin courses request")
+
+	courses, _, err := repository.FindCourses(repository.CourseQuery{
+		IncludeDrafts: true,
+		WithLessons:   true,
+	})
+	if err != nil {
+		log.Printf("Database error while listing courses: %v", err)
+		http.Error(w, `{"error": "Failed to fetch courses"}`, http.StatusInternalServerError)
+		return
+	}
+	// Drafts first, then by title
+	sort.SliceStable(courses, func(i, j int) bool {
+		if courses[i].Status != courses[j].Status {
+			return courses[i].Status < courses[j].Status
+		}
+		return courses[i].Title < courses[j].Title
+	})
+	if courses == nil {
+		courses = []models.Course{}
+	}
+	for i := range courses {
+		fillAdminCourse(&courses[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(courses)
+}
+
+// GetAdminCourse returns a course with its lessons, even while it is a draft (admin only)
+func GetAdminCourse(w http.ResponseWriter, r *http.Request) {
+	courseID := mux.Vars(r)["id"]
+
+	course, err := loadAdminCourse(courseID)
+	if err == errContentNotFound {
+		http.Error(w, `{"error": "Course not found"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error loading course %s: %v", courseID, err)
+		http.Error(w, `{"error": "Failed to fetch course"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(course)
+}
+
+// CreateCourse adds a course (admin only). It starts as a draft and is
+// published through a revision, and may include its lessons, which are
+// numbered in the order given.
+func CreateCourse(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling create course request")
+
+	var course models.Course
+	if err := json.NewDecoder(r.Body).Decode(&course); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	course.ID = strings.TrimSpace(course.ID)
+	if err := content.ValidateID("course", course.ID); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := content.ValidateCourse(&course); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if course.Status == models.CourseStatusPublished {
+		http.Error(w, `{"error": "A new course starts as a draft, publish it through a revision"}`, http.StatusBadRequest)
+		return
+	}
+	course.Status = models.CourseStatusDraft
+
+	lessonIDs := make(map[string]bool)
+	for i := range course.Lessons {
+		lesson := &course.Lessons[i]
+		lesson.ID = strings.TrimSpace(lesson.ID)
+		if err := content.ValidateID("lesson", lesson.ID); err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := content.ValidateLesson(lesson); err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if lessonIDs[lesson.ID] {
+			writeJSONError(w, fmt.Sprintf("duplicate lesson id %q", lesson.ID), http.StatusBadRequest)
+			return
+		}
+		lessonIDs[lesson.ID] = true
+		lesson.OrderNum = i + 1
+	}
+
+	taken, err := contentIDTaken("courses", course.ID)
+	if err != nil {
+		log.Printf("Error checking course ID: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, `{"error": "A course with this id already exists"}`, http.StatusConflict)
+		return
+	}
+	for id := range lessonIDs {
+		taken, err := contentIDTaken("lessons", id)
+		if err != nil {
+			log.Printf("Error checking lesson ID: %v", err)
+			http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			writeJSONError(w, fmt.Sprintf("A lesson with id %q already exists", id), http.StatusConflict)
+			return
+		}
+	}
+
+	tags, _ := json.Marshal(course.Tags)
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO courses (id, title, description, category, duration, level, tags, image, rating, learners, recommended, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		course.ID, course.Title, course.Description, course.Category, course.Duration, course.Level,
+		string(tags), course.Image, course.Rating, course.Learners, course.Recommended, course.Status,
+	)
+	if err != nil {
+		log.Printf("Error creating course: %v", err)
+		http.Error(w, `{"error": "Failed to create course"}`, http.StatusInternalServerError)
+		return
+	}
+	for _, lesson := range course.Lessons {
+		if err := insertLesson(tx, course.ID, lesson); err != nil {
+			log.Printf("Error creating lesson %s: %v", lesson.ID, err)
+			http.Error(w, `{"error": "Failed to create course"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing course: %v", err)
+		http.Error(w, `{"error": "Failed to create course"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Created %s course %s with %d lesson(s)", course.Status, course.ID, len(course.Lessons))
+	writeAdminCourse(w, course.ID, http.StatusCreated)
+}
+
+// UpdateCourse replaces the fields of a draft course (admin only). Lessons
+// are changed through their own endpoints and ignored here. A published
+// course can only be unpublished here, by setting status to "draft" with its
+// fields left as they are. Courses are published, and their published
+// content changed, through revisions.
+func UpdateCourse(w http.ResponseWriter, r *http.Request) {
+	courseID := mux.Vars(r)["id"]
+	log.Printf("Handling update course request for %s", courseID)
+
+	var course models.Course
+	if err := json.NewDecoder(r.Body).Decode(&course); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if course.ID != "" && course.ID != courseID {
+		http.Error(w, `{"error": "The id of a course cannot be changed"}`, http.StatusBadRequest)
+		return
+	}
+	if err := content.ValidateCourse(&course); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if course.Status == models.CourseStatusPublished {
+		http.Error(w, `{"error": "Publish the course through a revision"}`, http.StatusBadRequest)
+		return
+	}
+
+	current, err := loadAdminCourse(courseID)
+	if err == errContentNotFound {
+		http.Error(w, `{"error": "Course not found"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error loading course %s: %v", courseID, err)
+		http.Error(w, `{"error": "Failed to fetch course"}`, http.StatusInternalServerError)
+		return
+	}
+	if course.Status != "" && course.Status != current.Status {
+		// Unpublishing must not carry edits the published course cannot take
+		if !sameCourseFields(current, &course) {
+			http.Error(w, `{"error": "Change the status of a course without changing its fields"}`, http.StatusBadRequest)
+			return
+		}
+	} else if rejectPublishedEdit(w, courseID) {
+		return
+	}
+
+	tags, _ := json.Marshal(course.Tags)
+	result, err := config.DB.Exec(
+		`UPDATE courses SET title = ?, description = ?, category = ?, duration = ?, level = ?, tags = ?,
+			image = ?, rating = ?, learners = ?, recommended = ?, status = COALESCE(NULLIF(?, ''), status)
+		WHERE id = ? AND status = ?`,
+		course.Title, course.Description, course.Category, course.Duration, course.Level, string(tags),
+		course.Image, course.Rating, course.Learners, course.Recommended, course.Status, courseID, current.Status,
+	)
+	if err != nil {
+		log.Printf("Error updating course: %v", err)
+		http.Error(w, `{"error": "Failed to update course"}`, http.StatusInternalServerError)
+		return
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		// The course was deleted, published or unpublished meanwhile
+		http.Error(w, `{"error": "The course changed while it was being updated, try again"}`, http.StatusConflict)
+		return
+	}
+
+	log.Printf("Updated course %s", courseID)
+	writeAdminCourse(w, courseID, http.StatusOK)
+}
+
+// DeleteCourse removes a course with its lessons, its revisions and the
+// progress learners made on it (admin only)
+func DeleteCourse(w http.ResponseWriter, r *http.Request) {
+	courseID := mux.Vars(r)["id"]
+	log.Printf("Handling delete course request for %s", courseID)
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM courses WHERE id = ?", courseID)
+	if err != nil {
+		log.Printf("Error deleting course: %v", err)
+		http.Error(w, `{"error": "Failed to delete course"}`, http.StatusInternalServerError)
+		return
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		http.Error(w, `{"error": "Course not found"}`, http.StatusNotFound)
+		return
+	}
+	for _, table := range []string{"lessons", "user_course_progress", "course_revisions"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE course_id = ?", courseID); err != nil {
+			log.Printf("Error deleting from %s: %v", table, err)
+			http.Error(w, `{"error": "Failed to delete course"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing course deletion: %v", err)
+		http.Error(w, `{"error": "Failed to delete course"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Deleted course %s", courseID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Course deleted",
+	})
+}
+
+// CreateLesson adds a lesson to a course (admin only). Without order_num it
+// goes last, otherwise the lessons from that position on move down.
+func CreateLesson(w http.ResponseWriter, r *http.Request) {
+	courseID := mux.Vars(r)["id"]
+	log.Printf("Handling create lesson request for course %s", courseID)
+
+	var lesson models.Lesson
+	if err := json.NewDecoder(r.Body).Decode(&lesson); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	lesson.ID = strings.TrimSpace(lesson.ID)
+	if err := content.ValidateID("lesson", lesson.ID); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := content.ValidateLesson(&lesson); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if exists, err := contentIDTaken("courses", courseID); err != nil {
+		log.Printf("Error checking course: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	} else if !exists {
+		http.Error(w, `{"error": "Course not found"}`, http.StatusNotFound)
+		return
+	}
+	if rejectPublishedEdit(w, courseID) {
+		return
+	}
+	if taken, err := contentIDTaken("lessons", lesson.ID); err != nil {
+		log.Printf("Error checking lesson ID: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	} else if taken {
+		http.Error(w, `{"error": "A lesson with this id already exists"}`, http.StatusConflict)
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := insertLesson(tx, courseID, lesson); err != nil {
+		if err == errLessonPosition {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error creating lesson: %v", err)
+		http.Error(w, `{"error": "Failed to create lesson"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing lesson: %v", err)
+		http.Error(w, `{"error": "Failed to create lesson"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Created lesson %s in course %s", lesson.ID, courseID)
+	writeAdminCourse(w, courseID, http.StatusCreated)
+}
+
+// UpdateLesson replaces the fields of a lesson (admin only). Its position
+// is changed with ReorderLessons, order_num is ignored here.
+func UpdateLesson(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	courseID, lessonID := vars["id"], vars["lessonId"]
+	log.Printf("Handling update lesson request for %s", lessonID)
+
+	var lesson models.Lesson
+	if err := json.NewDecoder(r.Body).Decode(&lesson); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if lesson.ID != "" && lesson.ID != lessonID {
+		http.Error(w, `{"error": "The id of a lesson cannot be changed"}`, http.StatusBadRequest)
+		return
+	}
+	if err := content.ValidateLesson(&lesson); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rejectPublishedEdit(w, courseID) {
+		return
+	}
+
+	result, err := config.DB.Exec(
+		"UPDATE lessons SET title = ?, type = ?, duration = ?, content = ? WHERE id = ? AND course_id = ?",
+		lesson.Title, lesson.Type, lesson.Duration, lesson.Content, lessonID, courseID,
+	)
+	if err != nil {
+		log.Printf("Error updating lesson: %v", err)
+		http.Error(w, `{"error": "Failed to update lesson"}`, http.StatusInternalServerError)
+		return
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		http.Error(w, `{"error": "Lesson not found"}`, http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Updated lesson %s in course %s", lessonID, courseID)
+	writeAdminCourse(w, courseID, http.StatusOK)
+}
+
+// DeleteLesson removes a lesson and the progress learners made on it, closing
+// the gap in the order (admin only)
+func DeleteLesson(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	courseID, lessonID := vars["id"], vars["lessonId"]
+	log.Printf("Handling delete lesson request for %s", lessonID)
+
+	if rejectPublishedEdit(w, courseID) {
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var orderNum int
+	err = tx.QueryRow("SELECT order_num FROM lessons WHERE id = ? AND course_id = ?", lessonID, courseID).Scan(&orderNum)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error": "Lesson not found"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error getting lesson: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	for _, query := range []string{
+		"DELETE FROM lessons WHERE id = ? AND course_id = ?",
+		"DELETE FROM user_course_progress WHERE lesson_id = ? AND course_id = ?",
+	} {
+		if _, err := tx.Exec(query, lessonID, courseID); err != nil {
+			log.Printf("Error deleting lesson: %v", err)
+			http.Error(w, `{"error": "Failed to delete lesson"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := tx.Exec(
+		"UPDATE lessons SET order_num = order_num - 1 WHERE course_id = ? AND order_num > ?",
+		courseID, orderNum,
+	); err != nil {
+		log.Printf("Error renumbering lessons: %v", err)
+		http.Error(w, `{"error": "Failed to delete lesson"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing lesson deletion: %v", err)
+		http.Error(w, `{"error": "Failed to delete lesson"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Deleted lesson %s from course %s", lessonID, courseID)
+	writeAdminCourse(w, courseID, http.StatusOK)
+}
+
+// ReorderLessons sets the order of a course's lessons (admin only). The body
+// lists every lesson ID of the course exactly once, in the new order.
+func ReorderLessons(w http.ResponseWriter, r *http.Request) {
+	courseID := mux.Vars(r)["id"]
+	log.Printf("Handling reorder lessons request for course %s", courseID)
+
+	var req struct {
+		LessonIDs []string `json:"lesson_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	course, err := loadAdminCourse(courseID)
+	if err == errContentNotFound {
+		http.Error(w, `{"error": "Course not found"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error loading course %s: %v", courseID, err)
+		http.Error(w, `{"error": "Failed to fetch course"}`, http.StatusInternalServerError)
+		return
+	}
+	if rejectPublishedEdit(w, courseID) {
+		return
+	}
+
+	remaining := make(map[string]bool)
+	for _, lesson := range course.Lessons {
+		remaining[lesson.ID] = true
+	}
+	for _, id := range req.LessonIDs {
+		if !remaining[id] {
+			writeJSONError(w, fmt.Sprintf("lesson %q is not in the course or listed twice", id), http.StatusBadRequest)
+			return
+		}
+		delete(remaining, id)
+	}
+	if len(remaining) > 0 {
+		http.Error(w, `{"error": "lesson_ids must list every lesson of the course"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for i, id := range req.LessonIDs {
+		if _, err := tx.Exec("UPDATE lessons SET order_num = ? WHERE id = ? AND course_id = ?", i+1, id, courseID); err != nil {
+			log.Printf("Error reordering lessons: %v", err)
+			http.Error(w, `{"error": "Failed to reorder lessons"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing lesson order: %v", err)
+		http.Error(w, `{"error": "Failed to reorder lessons"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Reordered %d lesson(s) of course %s", len(req.LessonIDs), courseID)
+	writeAdminCourse(w, courseID, http.StatusOK)
+}
@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"defenzo/config"
+	"defenzo/mailer"
+	"defenzo/middleware"
+)
+
+const (
+	emailVerificationTTL = 24 * time.Hour
+	// Minimum time between two verification emails for the same account
+	verificationResendInterval = time.Minute
+	// Maximum number of verification emails per account per day
+	verificationDailyLimit = 5
+	// How long the link confirming a new email address stays valid
+	emailChangeTTL = 24 * time.Hour
+)
+
+// validateEmail trims the address, checks that it is a bare email address
+// and lowercases it, the way addresses are stored
+func validateEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", fmt.Errorf("Invalid email address")
+	}
+	return strings.ToLower(email), nil
+}
+
+// emailInUse reports whether another account already uses the address
+func emailInUse(email string, exceptUserID int) (bool, error) {
+	var exists bool
+	err := config.DB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM users WHERE email = ? COLLATE NOCASE AND id != ?)",
+		email, exceptUserID,
+	).Scan(&exists)
+	return exists, err
+}
+
+// pendingEmailChange returns the address waiting for confirmation, if any
+func pendingEmailChange(userID int) (string, error) {
+	var email string
+	err := config.DB.QueryRow(`
+		SELECT data FROM user_tokens
+		WHERE user_id = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+		ORDER BY created_at DESC, id DESC
+		LIMIT 1
+	`, userID, tokenPurposeChangeEmail, time.Now().Format(time.RFC3339)).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return email, err
+}
+
+// requestEmailChange sends a confirmation link to the new address and warns
+// the current one. Only the latest requested address can be confirmed.
+func requestEmailChange(userID int, currentEmail, newEmail string) error {
+	if err := invalidateUserTokens(userID, tokenPurposeChangeEmail); err != nil {
+		return err
+	}
+	token, err := createUserToken(userID, tokenPurposeChangeEmail, newEmail, emailChangeTTL)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := mailer.Send(mailer.Message{
+			To:      newEmail,
+			Subject: "Confirm your new DEFENZO email address",
+			Body: fmt.Sprintf(
+				"You asked to use this address for your DEFENZO account.\n\n"+
+					"Open this link within %d hours to confirm the change:\n%s\n\n"+
+					"If you didn't ask for this, you can ignore this email.",
+				int(emailChangeTTL.Hours()), appLink("confirm-email-change", token),
+			),
+		})
+		if err != nil {
+			log.Printf("Error sending email change confirmation to user %d: %v", userID, err)
+		}
+
+		err = mailer.Send(mailer.Message{
+			To:      currentEmail,
+			Subject: "Your DEFENZO email address is being changed",
+			Body: fmt.Sprintf(
+				"Someone asked to change the email address of your DEFENZO account to %s.\n\n"+
+					"Nothing changes until the new address is confirmed. "+
+					"If this wasn't you, change your password right away.",
+				newEmail,
+			),
+		})
+		if err != nil {
+			log.Printf("Error sending email change notice to user %d: %v", userID, err)
+		}
+	}()
+	return nil
+}
+
+// sendVerificationEmail creates a verification token and mails it to the user
+func sendVerificationEmail(userID int, email string) error {
+	token, err := createUserToken(userID, tokenPurposeVerifyEmail, email, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := mailer.Send(mailer.Message{
+			To:      email,
+			Subject: "Confirm your DEFENZO email address",
+			Body: fmt.Sprintf(
+				"Welcome to DEFENZO!\n\n"+
+					"Please confirm your email address by opening this link within %d hours:\n%s\n\n"+
+					"If you didn't create an account, you can ignore this email.",
+				int(emailVerificationTTL.Hours()), appLink("verify-email", token),
+			),
+		})
+		if err != nil {
+			log.Printf("Error sending verification email to user %d: %v", userID, err)
+		}
+	}()
+	return nil
+}
+
+// VerifyEmail confirms an email address using the token from the verification link
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling email verification request")
+
+	// The link can be opened directly (GET) or submitted by the app (POST)
+	token := r.URL.Query().Get("token")
+	if token == "" && r.Method == http.MethodPost {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+		token = req.Token
+	}
+	if token == "" {
+		http.Error(w, `{"error": "Token is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, email, err := consumeUserToken(token, tokenPurposeVerifyEmail)
+	if err == errInvalidUserToken {
+		http.Error(w, `{"error": "Invalid or expired verification token"}`, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error consuming verification token: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Only verify the address the token was sent to, in case it changed since
+	result, err := config.DB.Exec(
+		"UPDATE users SET email_verified_at = ? WHERE id = ? AND email = ?",
+		time.Now().Format(time.RFC3339), userID, email,
+	)
+	if err != nil {
+		log.Printf("Error marking email as verified: %v", err)
+		http.Error(w, `{"error": "Failed to verify email"}`, http.StatusInternalServerError)
+		return
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated != 1 {
+		http.Error(w, `{"error": "Invalid or expired verification token"}`, http.StatusBadRequest)
+		return
+	}
+
+	if err := invalidateUserTokens(userID, tokenPurposeVerifyEmail); err != nil {
+		log.Printf("Error invalidating verification tokens: %v", err)
+	}
+
+	log.Printf("Verified email for user %d", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"email_verified": true,
+	})
+}
+
+// ResendVerificationEmail sends a new verification link, throttled per account
+func ResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling resend verification email request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var email string
+	var verifiedAt sql.NullString
+	err = config.DB.QueryRow("SELECT email, email_verified_at FROM users WHERE id = ?", userID).Scan(&email, &verifiedAt)
+	if err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+	if verifiedAt.Valid {
+		http.Error(w, `{"error": "Email is already verified"}`, http.StatusConflict)
+		return
+	}
+
+	// Throttle: one email per interval and a daily cap
+	now := time.Now()
+	var lastSent sql.NullString
+	var sentToday int
+	err = config.DB.QueryRow(`
+		SELECT MAX(created_at), COUNT(*) FROM user_tokens
+		WHERE user_id = ? AND purpose = ? AND created_at > ?
+	`, userID, tokenPurposeVerifyEmail, now.Add(-24*time.Hour).Format(time.RFC3339)).Scan(&lastSent, &sentToday)
+	if err != nil {
+		log.Printf("Error checking verification throttle: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if sentToday >= verificationDailyLimit {
+		w.Header().Set("Retry-After", strconv.Itoa(int((24 * time.Hour).Seconds())))
+		http.Error(w, `{"error": "Too many verification emails, try again tomorrow"}`, http.StatusTooManyRequests)
+		return
+	}
+	if lastSent.Valid {
+		if sentAt, err := time.Parse(time.RFC3339, lastSent.String); err == nil {
+			if wait := verificationResendInterval - now.Sub(sentAt); wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				http.Error(w, `{"error": "Please wait before requesting another email"}`, http.StatusTooManyRequests)
+				return
+			}
+		}
+	}
+
+	if err := sendVerificationEmail(userID, email); err != nil {
+		log.Printf("Error creating verification token: %v", err)
+		http.Error(w, `{"error": "Failed to send verification email"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Resent verification email for user %d", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Verification email sent",
+	})
+}
+
+// ConfirmEmailChange switches the account to the new address using the token
+// sent to it by UpdateProfile
+func ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling confirm email change request")
+
+	// The link can be opened directly (GET) or submitted by the app (POST)
+	token := r.URL.Query().Get("token")
+	if token == "" && r.Method == http.MethodPost {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+		token = req.Token
+	}
+	if token == "" {
+		http.Error(w, `{"error": "Token is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, newEmail, err := consumeUserToken(token, tokenPurposeChangeEmail)
+	if err == errInvalidUserToken {
+		http.Error(w, `{"error": "Invalid or expired confirmation token"}`, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error consuming email change token: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Someone may have registered the address since the change was requested
+	taken, err := emailInUse(newEmail, userID)
+	if err != nil {
+		log.Printf("Error checking email: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, `{"error": "Email already exists"}`, http.StatusConflict)
+		return
+	}
+
+	// Opening the link proves ownership, so the new address is verified as well
+	_, err = config.DB.Exec(
+		"UPDATE users SET email = ?, email_verified_at = ? WHERE id = ?",
+		newEmail, time.Now().Format(time.RFC3339), userID,
+	)
+	if err != nil {
+		log.Printf("Error updating email: %v", err)
+		http.Error(w, `{"error": "Failed to update email"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Links sent to the old address must not verify or reset anything anymore
+	for _, purpose := range []string{tokenPurposeVerifyEmail, tokenPurposePasswordReset} {
+		if err := invalidateUserTokens(userID, purpose); err != nil {
+			log.Printf("Error invalidating %s tokens: %v", purpose, err)
+		}
+	}
+
+	log.Printf("Changed email for user %d", userID)
+	recordAuditEvent(r, userID, auditEmailChanged, map[string]interface{}{"new_email": newEmail})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"email":          newEmail,
+		"email_verified": true,
+	})
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"defenzo/config"
+	"defenzo/loginguard"
+	"defenzo/mailer"
+
+	"github.com/gorilla/mux"
+)
+
+// LoginGuard throttles failed logins, configured by InitLoginGuard
+var LoginGuard *loginguard.Guard
+
+// InitLoginGuard sets up brute-force protection for the login endpoint
+func InitLoginGuard() {
+	LoginGuard = loginguard.New(config.DB)
+	LoginGuard.OnLockout = notifyLockout
+}
+
+// notifyLockout tells the owner of an account that it has been locked
+func notifyLockout(entry loginguard.Entry) {
+	kind, value, _ := strings.Cut(entry.Key, ":")
+	log.Printf("Login lockout for %s until %s", entry.Key, entry.LockedUntil.Format("15:04:05 MST"))
+	if kind != loginguard.KindAccount {
+		return
+	}
+
+	// Only mail addresses that actually belong to an account
+	var email string
+	if err := config.DB.QueryRow("SELECT email FROM users WHERE lower(email) = ?", value).Scan(&email); err != nil {
+		return
+	}
+
+	go func() {
+		err := mailer.Send(mailer.Message{
+			To:      email,
+			Subject: "Your DEFENZO account has been temporarily locked",
+			Body: fmt.Sprintf(
+				"We noticed several failed attempts to sign in to your DEFENZO account, "+
+					"so we have blocked new sign-ins until %s.\n\n"+
+					"If this was you, just wait and try again. If it wasn't, "+
+					"consider resetting your password and enabling two-factor authentication.",
+				entry.LockedUntil.Format("2006-01-02 15:04 MST"),
+			),
+		})
+		if err != nil {
+			log.Printf("Error sending lockout notification: %v", err)
+		}
+	}()
+}
+
+// ListLockouts returns accounts and IPs with recent failed logins (admin only)
+func ListLockouts(w http.ResponseWriter, r *http.Request) {
+	entries, err := LoginGuard.List()
+	if err != nil {
+		log.Printf("Error listing lockouts: %v", err)
+		http.Error(w, `{"error": "Failed to fetch lockouts"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// ClearLockout resets the failed logins and lockout of one key (admin only)
+func ClearLockout(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	cleared, err := LoginGuard.Clear(key)
+	if err != nil {
+		log.Printf("Error clearing lockout: %v", err)
+		http.Error(w, `{"error": "Failed to clear lockout"}`, http.StatusInternalServerError)
+		return
+	}
+	if !cleared {
+		http.Error(w, `{"error": "Lockout not found"}`, http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Cleared login lockout for %s", key)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Lockout cleared",
+	})
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"defenzo/config"
+	"defenzo/mailer"
+)
+
+const (
+	// How long a sign-in link stays valid
+	magicLinkTTL = 15 * time.Minute
+	// Minimum time between two sign-in links for the same account
+	magicLinkResendInterval = time.Minute
+	// Maximum number of sign-in links per account per hour
+	magicLinkHourlyLimit = 5
+)
+
+// magicLinkEnabled reports whether users may sign in with an emailed link.
+// It is controlled by the MAGIC_LINK_LOGIN environment variable.
+func magicLinkEnabled() bool {
+	return os.Getenv("MAGIC_LINK_LOGIN") == "true"
+}
+
+// magicLinkThrottled reports whether the account has asked for too many sign-in links recently
+func magicLinkThrottled(userID int) (bool, error) {
+	now := time.Now()
+	var lastSent sql.NullString
+	var sentLastHour int
+	err := config.DB.QueryRow(`
+		SELECT MAX(created_at), COUNT(*) FROM user_tokens
+		WHERE user_id = ? AND purpose = ? AND created_at > ?
+	`, userID, tokenPurposeMagicLink, now.Add(-time.Hour).Format(time.RFC3339)).Scan(&lastSent, &sentLastHour)
+	if err != nil {
+		return false, err
+	}
+	if sentLastHour >= magicLinkHourlyLimit {
+		return true, nil
+	}
+	if lastSent.Valid {
+		if sentAt, err := time.Parse(time.RFC3339, lastSent.String); err == nil && now.Sub(sentAt) < magicLinkResendInterval {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RequestMagicLink emails a single-use sign-in link if the address belongs to an account
+func RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling magic link request")
+	if !magicLinkEnabled() {
+		http.Error(w, `{"error": "Sign-in links are not enabled"}`, http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(w, `{"error": "Email is required"}`, http.StatusBadRequest)
+		return
+	}
+	email, err := validateEmail(req.Email)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var userID int
+	err = config.DB.QueryRow("SELECT id, email FROM users WHERE email = ? COLLATE NOCASE", email).Scan(&userID, &email)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Database error during magic link request: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err == nil {
+		// Throttled requests get the normal response, a 429 would reveal that the account exists
+		throttled, err := magicLinkThrottled(userID)
+		if err != nil {
+			log.Printf("Error checking magic link throttle: %v", err)
+			http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+			return
+		}
+
+		if throttled {
+			log.Printf("Magic link throttled for user %d", userID)
+		} else {
+			// Only the newest link works, so older emails cannot be replayed
+			if err := invalidateUserTokens(userID, tokenPurposeMagicLink); err != nil {
+				log.Printf("Error invalidating magic links: %v", err)
+				http.Error(w, `{"error": "Failed to create sign-in link"}`, http.StatusInternalServerError)
+				return
+			}
+			token, err := createUserToken(userID, tokenPurposeMagicLink, email, magicLinkTTL)
+			if err != nil {
+				log.Printf("Error creating magic link token: %v", err)
+				http.Error(w, `{"error": "Failed to create sign-in link"}`, http.StatusInternalServerError)
+				return
+			}
+
+			go func() {
+				err := mailer.Send(mailer.Message{
+					To:      email,
+					Subject: "Your DEFENZO sign-in link",
+					Body: fmt.Sprintf(
+						"Someone asked to sign in to your DEFENZO account with this email address.\n\n"+
+							"Open this link within %d minutes to sign in. It can only be used once:\n%s\n\n"+
+							"If this wasn't you, you can ignore this email.",
+						int(magicLinkTTL.Minutes()), appLink("magic-login", token),
+					),
+				})
+				if err != nil {
+					log.Printf("Error sending magic link to user %d: %v", userID, err)
+				}
+			}()
+			log.Printf("Created magic link for user %d", userID)
+		}
+	} else {
+		log.Printf("Magic link requested for unknown email")
+	}
+
+	// Same response either way so the endpoint cannot be used to discover accounts
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If an account exists for that email, a sign-in link has been sent",
+	})
+}
+
+// RedeemMagicLink signs the user in with a token from RequestMagicLink. The
+// response is the same as for Login. Only POST is accepted, so link scanners
+// that prefetch URLs in emails cannot use up the token.
+func RedeemMagicLink(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling magic link redeem request")
+	if !magicLinkEnabled() {
+		http.Error(w, `{"error": "Sign-in links are not enabled"}`, http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" {
+		http.Error(w, `{"error": "Token is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, sentTo, err := consumeUserToken(req.Token, tokenPurposeMagicLink)
+	if err == errInvalidUserToken {
+		http.Error(w, `{"error": "Invalid or expired sign-in link"}`, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("Error consuming magic link token: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// The link only proves access to the address it was sent to, in case the email changed since
+	var email string
+	err = config.DB.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email)
+	if err == sql.ErrNoRows || (err == nil && email != sentTo) {
+		http.Error(w, `{"error": "Invalid or expired sign-in link"}`, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Opening the link proves the user owns the address
+	if _, err := config.DB.Exec(
+		"UPDATE users SET email_verified_at = ? WHERE id = ? AND email_verified_at IS NULL",
+		time.Now().Format(time.RFC3339), userID,
+	); err != nil {
+		log.Printf("Error marking email as verified: %v", err)
+	}
+
+	log.Printf("User %d signed in with a magic link", userID)
+	completeLogin(w, r, userID, email)
+}
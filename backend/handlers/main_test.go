@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"defenzo/config"
+	"defenzo/mailer"
+	"defenzo/middleware"
+)
+
+// TestMain runs the handler tests against a fresh database in a temporary
+// directory, with a throwaway signing key and mail written to an outbox there
+func TestMain(m *testing.M) {
+	flag.Parse()
+	dir, err := os.MkdirTemp("", "defenzo-handlers")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+
+	config.InitDB()
+	config.MigrateDB()
+	keys, err := middleware.LoadKeys("HS256", "test=handler-tests-signing-secret-0123456789", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	middleware.Keys = keys
+	mailer.Default = &mailer.OutboxMailer{Dir: "outbox"}
+	InitLoginGuard()
+
+	code := m.Run()
+	config.DB.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// createTestUser inserts a user with a password and the learner role
+func createTestUser(t *testing.T, email, passwordHash string) int {
+	t.Helper()
+	result, err := config.DB.Exec(
+		"INSERT INTO users (email, password_hash, full_name, created_at) VALUES (?, ?, 'Test', datetime('now'))",
+		email, passwordHash,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := grantDefaultRole(int(id)); err != nil {
+		t.Fatal(err)
+	}
+	return int(id)
+}
+
+// callHandler sends a JSON body to a handler, authenticated with the access
+// token if there is one
+func callHandler(t *testing.T, handler http.HandlerFunc, accessToken string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(data))
+	if accessToken != "" {
+		r.Header.Set("Authorization", "Bearer "+accessToken)
+		handler = middleware.AuthMiddleware(handler)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// signIn returns an access token for the user
+func signIn(t *testing.T, userID int) string {
+	t.Helper()
+	tokens, err := issueTokens(httptest.NewRequest("POST", "/", nil), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens.Token
+}
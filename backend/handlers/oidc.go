@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"defenzo/config"
+	"defenzo/oidc"
+
+	"github.com/gorilla/mux"
+)
+
+// oidcStateTTL is how long the user has to finish signing in at the provider
+const oidcStateTTL = 10 * time.Minute
+
+// errUnverifiedOIDCEmail is returned when a new identity has no verified email to link by
+var errUnverifiedOIDCEmail = errors.New("provider did not return a verified email")
+
+// OIDCProviders are the configured "Sign in with..." providers by name
+var OIDCProviders = map[string]*oidc.Provider{}
+
+// InitOIDC loads the OpenID Connect providers from the environment.
+//
+// OIDC_PROVIDERS is a comma separated list of names such as "google,okta".
+// For each name, OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID,
+// OIDC_<NAME>_CLIENT_SECRET and OIDC_<NAME>_REDIRECT_URL are required, and
+// OIDC_<NAME>_SCOPES optionally replaces the default "openid email profile".
+// The redirect URL must point at /api/oidc/<name>/callback.
+func InitOIDC() {
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		provider := oidc.NewProvider(
+			name,
+			os.Getenv(prefix+"ISSUER"),
+			os.Getenv(prefix+"CLIENT_ID"),
+			os.Getenv(prefix+"CLIENT_SECRET"),
+			os.Getenv(prefix+"REDIRECT_URL"),
+		)
+		if provider.Issuer == "" || provider.ClientID == "" || provider.RedirectURL == "" {
+			log.Fatalf("OIDC provider %q needs %sISSUER, %sCLIENT_ID and %sREDIRECT_URL", name, prefix, prefix, prefix)
+		}
+		if scopes := strings.Fields(os.Getenv(prefix + "SCOPES")); len(scopes) > 0 {
+			provider.Scopes = scopes
+		}
+
+		OIDCProviders[name] = provider
+		log.Printf("OIDC provider %q configured with issuer %s", name, provider.Issuer)
+	}
+}
+
+// ListOIDCProviders returns the names of the providers users can sign in with
+func ListOIDCProviders(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(OIDCProviders))
+	for name := range OIDCProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"providers": names,
+	})
+}
+
+// StartOIDCLogin redirects the user to the provider's sign-in page. The state,
+// nonce and PKCE verifier are kept server side until the provider redirects back.
+func StartOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := OIDCProviders[name]
+	if !ok {
+		http.Error(w, `{"error": "Unknown provider"}`, http.StatusNotFound)
+		return
+	}
+
+	state, err := oidc.RandomString()
+	if err != nil {
+		log.Printf("Error generating OIDC state: %v", err)
+		http.Error(w, `{"error": "Failed to start sign-in"}`, http.StatusInternalServerError)
+		return
+	}
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		log.Printf("Error generating OIDC nonce: %v", err)
+		http.Error(w, `{"error": "Failed to start sign-in"}`, http.StatusInternalServerError)
+		return
+	}
+	verifier, err := oidc.RandomString()
+	if err != nil {
+		log.Printf("Error generating PKCE verifier: %v", err)
+		http.Error(w, `{"error": "Failed to start sign-in"}`, http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Printf("Error preparing %s sign-in: %v", name, err)
+		http.Error(w, `{"error": "Identity provider is unavailable"}`, http.StatusBadGateway)
+		return
+	}
+
+	now := time.Now()
+	if _, err := config.DB.Exec("DELETE FROM oidc_states WHERE expires_at < ?", now.Format(time.RFC3339)); err != nil {
+		log.Printf("Error removing expired OIDC states: %v", err)
+	}
+	_, err = config.DB.Exec(
+		"INSERT INTO oidc_states (state_hash, provider, nonce, code_verifier, expires_at) VALUES (?, ?, ?, ?, ?)",
+		hashToken(state), name, nonce, verifier, now.Add(oidcStateTTL).Format(time.RFC3339),
+	)
+	if err != nil {
+		log.Printf("Error storing OIDC state: %v", err)
+		http.Error(w, `{"error": "Failed to start sign-in"}`, http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// consumeOIDCState looks up and deletes a pending sign-in, so every state can only be used once
+func consumeOIDCState(state, provider string) (nonce, verifier string, err error) {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	var expiresAt string
+	err = tx.QueryRow(
+		"SELECT nonce, code_verifier, expires_at FROM oidc_states WHERE state_hash = ? AND provider = ?",
+		hashToken(state), provider,
+	).Scan(&nonce, &verifier, &expiresAt)
+	if err == sql.ErrNoRows {
+		return "", "", errInvalidUserToken
+	} else if err != nil {
+		return "", "", err
+	}
+
+	result, err := tx.Exec("DELETE FROM oidc_states WHERE state_hash = ?", hashToken(state))
+	if err != nil {
+		return "", "", err
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted != 1 {
+		return "", "", errInvalidUserToken
+	}
+	if err := tx.Commit(); err != nil {
+		return "", "", err
+	}
+
+	if expires, err := time.Parse(time.RFC3339, expiresAt); err != nil || time.Now().After(expires) {
+		return "", "", errInvalidUserToken
+	}
+	return nonce, verifier, nil
+}
+
+// findOrLinkOIDCUser returns the account for a provider identity. Unknown
+// identities are linked to the account with the same verified email, or a
+// new account is created when there is none.
+func findOrLinkOIDCUser(provider string, claims *oidc.Claims) (int, string, error) {
+	now := time.Now().Format(time.RFC3339)
+
+	var userID int
+	var email string
+	err := config.DB.QueryRow(`
+		SELECT u.id, u.email FROM user_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.provider = ? AND i.subject = ?
+	`, provider, claims.Subject).Scan(&userID, &email)
+	if err == nil {
+		if _, err := config.DB.Exec(
+			"UPDATE user_identities SET last_login_at = ? WHERE provider = ? AND subject = ?",
+			now, provider, claims.Subject,
+		); err != nil {
+			log.Printf("Error updating identity: %v", err)
+		}
+		return userID, email, nil
+	} else if err != sql.ErrNoRows {
+		return 0, "", err
+	}
+
+	// Only an address the provider vouches for may be matched to an account
+	if claims.Email == "" || !claims.EmailVerified {
+		return 0, "", errUnverifiedOIDCEmail
+	}
+
+	err = config.DB.QueryRow("SELECT id, email FROM users WHERE email = ? COLLATE NOCASE", claims.Email).Scan(&userID, &email)
+	switch {
+	case err == sql.ErrNoRows:
+		// Accounts created through a provider have no password until the
+		// user sets one with the forgot password flow
+		result, err := config.DB.Exec(
+			"INSERT INTO users (email, password_hash, full_name, created_at, email_verified_at) VALUES (?, '', ?, ?, ?)",
+			claims.Email, claims.Name, now, now,
+		)
+		if err != nil {
+			return 0, "", err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return 0, "", err
+		}
+		userID, email = int(id), claims.Email
+		if err := grantDefaultRole(userID); err != nil {
+			return 0, "", err
+		}
+		log.Printf("Created user %d from %s sign-in", userID, provider)
+	case err != nil:
+		return 0, "", err
+	default:
+		// The provider verified the address, so ours is verified too
+		if _, err := config.DB.Exec(
+			"UPDATE users SET email_verified_at = ? WHERE id = ? AND email_verified_at IS NULL",
+			now, userID,
+		); err != nil {
+			log.Printf("Error marking email as verified: %v", err)
+		}
+	}
+
+	_, err = config.DB.Exec(
+		"INSERT INTO user_identities (user_id, provider, subject, email, created_at, last_login_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, provider, claims.Subject, claims.Email, now, now,
+	)
+	if err != nil {
+		return 0, "", err
+	}
+	log.Printf("Linked %s identity to user %d", provider, userID)
+	return userID, email, nil
+}
+
+// OIDCCallback completes a sign-in when the provider redirects back with an
+// authorization code. The app can also forward code and state with a POST.
+// The response is the same as for Login.
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	log.Printf("Handling OIDC callback for provider %s", name)
+	provider, ok := OIDCProviders[name]
+	if !ok {
+		http.Error(w, `{"error": "Unknown provider"}`, http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+		Error string `json:"error"`
+	}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+	} else {
+		query := r.URL.Query()
+		req.Code, req.State, req.Error = query.Get("code"), query.Get("state"), query.Get("error")
+	}
+
+	if req.Error != "" {
+		log.Printf("Provider %s returned error: %s", name, req.Error)
+		http.Error(w, `{"error": "Sign-in was cancelled or denied"}`, http.StatusUnauthorized)
+		return
+	}
+	if req.Code == "" || req.State == "" {
+		http.Error(w, `{"error": "Code and state are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	nonce, verifier, err := consumeOIDCState(req.State, name)
+	if err == errInvalidUserToken {
+		http.Error(w, `{"error": "Invalid or expired sign-in attempt"}`, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error consuming OIDC state: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	rawIDToken, err := provider.Exchange(r.Context(), req.Code, verifier)
+	if err != nil {
+		log.Printf("Error exchanging %s authorization code: %v", name, err)
+		http.Error(w, `{"error": "Failed to complete sign-in with provider"}`, http.StatusBadGateway)
+		return
+	}
+
+	claims, err := provider.VerifyIDToken(r.Context(), rawIDToken, nonce)
+	if err != nil {
+		log.Printf("Rejected %s ID token: %v", name, err)
+		http.Error(w, `{"error": "Invalid identity token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	userID, email, err := findOrLinkOIDCUser(name, claims)
+	if err == errUnverifiedOIDCEmail {
+		http.Error(w, `{"error": "The provider did not share a verified email address"}`, http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Printf("Error linking %s identity: %v", name, err)
+		http.Error(w, `{"error": "Failed to sign in"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d signed in with %s", userID, name)
+	completeLogin(w, r, userID, email)
+}
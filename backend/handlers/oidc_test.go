@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"defenzo/config"
+	"defenzo/oidc"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// testIssuer is an OpenID provider serving discovery, its signing key and a
+// token endpoint that checks PKCE
+type testIssuer struct {
+	server *httptest.Server
+	key    *ecdsa.PrivateKey
+
+	mu sync.Mutex
+	// grants maps authorization codes to their PKCE challenge and ID token claims
+	grants map[string]testGrant
+}
+
+type testGrant struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti := &testIssuer{key: key, grants: map[string]testGrant{}}
+
+	r := http.NewServeMux()
+	r.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidc.Metadata{
+			Issuer:                ti.server.URL,
+			AuthorizationEndpoint: ti.server.URL + "/authorize",
+			TokenEndpoint:         ti.server.URL + "/token",
+			JWKSURI:               ti.server.URL + "/jwks",
+		})
+	})
+	r.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "EC",
+			"kid": "k1",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+	r.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		ti.mu.Lock()
+		grant, ok := ti.grants[r.PostFormValue("code")]
+		delete(ti.grants, r.PostFormValue("code"))
+		ti.mu.Unlock()
+		if !ok || oidc.CodeChallenge(r.PostFormValue("code_verifier")) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, grant.claims)
+		token.Header["kid"] = "k1"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed})
+	})
+	ti.server = httptest.NewServer(r)
+	t.Cleanup(ti.server.Close)
+	return ti
+}
+
+// register configures a provider for the issuer under name
+func (ti *testIssuer) register(t *testing.T, name string) {
+	provider := oidc.NewProvider(name, ti.server.URL, "client-id", "secret", "https://app.example/api/oidc/"+name+"/callback")
+	provider.HTTPClient = ti.server.Client()
+	provider.Now = func() time.Time { return time.Now() }
+	OIDCProviders[name] = provider
+	t.Cleanup(func() { delete(OIDCProviders, name) })
+}
+
+// authorize plays the user signing in at the provider and returns the code
+// and state it redirects back with. The ID token gets the requested nonce
+// unless claims set their own.
+func (ti *testIssuer) authorize(t *testing.T, authURL string, claims jwt.MapClaims) (code, state string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	now := time.Now()
+	token := jwt.MapClaims{
+		"iss":   ti.server.URL,
+		"aud":   query.Get("client_id"),
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for name, value := range claims {
+		token[name] = value
+	}
+
+	code, err = oidc.RandomString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti.mu.Lock()
+	ti.grants[code] = testGrant{challenge: query.Get("code_challenge"), claims: token}
+	ti.mu.Unlock()
+	return code, query.Get("state")
+}
+
+func oidcRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/api/oidc/{provider}/start", StartOIDCLogin).Methods("GET")
+	r.HandleFunc("/api/oidc/{provider}/callback", OIDCCallback).Methods("GET", "POST")
+	return r
+}
+
+// startOIDC begins a sign-in and returns the provider URL the user is sent to
+func startOIDC(t *testing.T, router http.Handler, provider string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/oidc/"+provider+"/start", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("start returned %d: %s", w.Code, w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+func oidcCallback(router http.Handler, provider, code, state string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	query := url.Values{"code": {code}, "state": {state}}
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/oidc/"+provider+"/callback?"+query.Encode(), nil))
+	return w
+}
+
+// identityOwner returns the user a provider identity is linked to, 0 if none
+func identityOwner(t *testing.T, provider, subject string) int {
+	t.Helper()
+	var userID int
+	err := config.DB.QueryRow(
+		"SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?", provider, subject,
+	).Scan(&userID)
+	if err != nil && err != sql.ErrNoRows {
+		t.Fatal(err)
+	}
+	return userID
+}
+
+func TestOIDCSignInCreatesAccount(t *testing.T) {
+	ti := newTestIssuer(t)
+	ti.register(t, "acme")
+	router := oidcRouter()
+
+	code, state := ti.authorize(t, startOIDC(t, router, "acme"), jwt.MapClaims{
+		"sub": "acme-new", "email": "New.User@example.com", "email_verified": true, "name": "New User",
+	})
+	w := oidcCallback(router, "acme", code, state)
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback returned %d: %s", w.Code, w.Body)
+	}
+	var tokens tokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&tokens); err != nil || tokens.Token == "" {
+		t.Fatalf("no tokens in %s", w.Body)
+	}
+
+	userID := identityOwner(t, "acme", "acme-new")
+	var passwordHash string
+	var verified bool
+	err := config.DB.QueryRow(
+		"SELECT password_hash, email_verified_at IS NOT NULL FROM users WHERE id = ?", userID,
+	).Scan(&passwordHash, &verified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passwordHash != "" || !verified {
+		t.Fatalf("new account has password hash %q and verified %v", passwordHash, verified)
+	}
+
+	// The state was used up by the first callback
+	if w := oidcCallback(router, "acme", code, state); w.Code != http.StatusBadRequest {
+		t.Fatalf("replayed state returned %d, want 400", w.Code)
+	}
+}
+
+func TestOIDCCallbackChecksState(t *testing.T) {
+	ti := newTestIssuer(t)
+	ti.register(t, "acme")
+	ti.register(t, "other")
+	router := oidcRouter()
+	claims := jwt.MapClaims{"sub": "acme-state", "email": "state@example.com", "email_verified": true}
+
+	code, _ := ti.authorize(t, startOIDC(t, router, "acme"), claims)
+	if w := oidcCallback(router, "acme", code, "made-up-state"); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown state returned %d, want 400", w.Code)
+	}
+
+	// A state only works with the provider it was issued for
+	code, state := ti.authorize(t, startOIDC(t, router, "acme"), claims)
+	if w := oidcCallback(router, "other", code, state); w.Code != http.StatusBadRequest {
+		t.Fatalf("state of another provider returned %d, want 400", w.Code)
+	}
+
+	code, state = ti.authorize(t, startOIDC(t, router, "acme"), claims)
+	_, err := config.DB.Exec(
+		"UPDATE oidc_states SET expires_at = ? WHERE state_hash = ?",
+		time.Now().Add(-time.Second).Format(time.RFC3339), hashToken(state),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := oidcCallback(router, "acme", code, state); w.Code != http.StatusBadRequest {
+		t.Fatalf("expired state returned %d, want 400", w.Code)
+	}
+
+	if owner := identityOwner(t, "acme", "acme-state"); owner != 0 {
+		t.Fatalf("identity linked to user %d", owner)
+	}
+}
+
+func TestOIDCCallbackChecksNonce(t *testing.T) {
+	ti := newTestIssuer(t)
+	ti.register(t, "acme")
+	router := oidcRouter()
+
+	code, state := ti.authorize(t, startOIDC(t, router, "acme"), jwt.MapClaims{
+		"sub": "acme-nonce", "email": "nonce@example.com", "email_verified": true, "nonce": "replayed-nonce",
+	})
+	if w := oidcCallback(router, "acme", code, state); w.Code != http.StatusUnauthorized {
+		t.Fatalf("nonce mismatch returned %d, want 401", w.Code)
+	}
+	if owner := identityOwner(t, "acme", "acme-nonce"); owner != 0 {
+		t.Fatalf("identity linked to user %d", owner)
+	}
+}
+
+func TestOIDCLinksOnlyVerifiedEmail(t *testing.T) {
+	ti := newTestIssuer(t)
+	ti.register(t, "acme")
+	router := oidcRouter()
+	existing := createTestUser(t, "bob@example.com", "$2a$10$notarealhashnotarealhashnotarealhashnotarealhashnotar")
+
+	// An unverified address must not take over the existing account
+	code, state := ti.authorize(t, startOIDC(t, router, "acme"), jwt.MapClaims{
+		"sub": "acme-bob", "email": "bob@example.com", "email_verified": false,
+	})
+	if w := oidcCallback(router, "acme", code, state); w.Code != http.StatusForbidden {
+		t.Fatalf("unverified email returned %d, want 403", w.Code)
+	}
+	if owner := identityOwner(t, "acme", "acme-bob"); owner != 0 {
+		t.Fatalf("identity linked to user %d", owner)
+	}
+
+	// A verified address links to the account, whatever its case
+	code, state = ti.authorize(t, startOIDC(t, router, "acme"), jwt.MapClaims{
+		"sub": "acme-bob", "email": "BOB@example.com", "email_verified": "true",
+	})
+	if w := oidcCallback(router, "acme", code, state); w.Code != http.StatusOK {
+		t.Fatalf("verified email returned %d: %s", w.Code, w.Body)
+	}
+	if owner := identityOwner(t, "acme", "acme-bob"); owner != existing {
+		t.Fatalf("identity linked to user %d, want %d", owner, existing)
+	}
+
+	// Once linked, the identity signs in by subject alone
+	code, state = ti.authorize(t, startOIDC(t, router, "acme"), jwt.MapClaims{"sub": "acme-bob"})
+	if w := oidcCallback(router, "acme", code, state); w.Code != http.StatusOK {
+		t.Fatalf("linked identity returned %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"defenzo/config"
+	"defenzo/models"
+)
+
+// MemberCourseProgress is one course a member has started
+type MemberCourseProgress struct {
+	CourseID     string `json:"course_id"`
+	CourseTitle  string `json:"course_title"`
+	Progress     int    `json:"progress"`
+	Completed    bool   `json:"completed"`
+	LastAccessed string `json:"last_accessed"`
+}
+
+// MemberProgress summarizes a member's course completion for org admins
+type MemberProgress struct {
+	UserID           int                    `json:"user_id"`
+	Email            string                 `json:"email"`
+	FullName         string                 `json:"full_name"`
+	CoursesStarted   int                    `json:"courses_started"`
+	CoursesCompleted int                    `json:"courses_completed"`
+	Courses          []MemberCourseProgress `json:"courses"`
+}
+
+// MemberBadge is a badge a member has earned
+type MemberBadge struct {
+	BadgeID   string `json:"badge_id"`
+	Name      string `json:"name"`
+	Icon      string `json:"icon"`
+	Category  string `json:"category"`
+	AwardedAt string `json:"awarded_at"`
+}
+
+// MemberBadges lists the badges earned by a member for org admins
+type MemberBadges struct {
+	UserID   int           `json:"user_id"`
+	Email    string        `json:"email"`
+	FullName string        `json:"full_name"`
+	Badges   []MemberBadge `json:"badges"`
+}
+
+// GetOrgProgress returns the course completion of every member (org admins only).
+// It reads the course level rows of user_course_progress, where lesson_id is NULL.
+func GetOrgProgress(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling get organization progress request")
+	orgID, _, ok := authorizeOrg(w, r, models.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	// One query for all members, members without progress get a single row of NULLs
+	rows, err := config.DB.Query(`
+		SELECT u.id, u.email, u.full_name, p.course_id, c.title,
+			MAX(p.progress), MAX(p.completed), MAX(p.last_accessed)
+		FROM organization_members m
+		JOIN users u ON u.id = m.user_id
+		LEFT JOIN user_course_progress p ON p.user_id = m.user_id AND p.lesson_id IS NULL
+		LEFT JOIN courses c ON c.id = p.course_id
+		WHERE m.org_id = ?
+		GROUP BY u.id, p.course_id
+		ORDER BY u.email, p.course_id
+	`, orgID)
+	if err != nil {
+		log.Printf("Database error while fetching organization progress: %v", err)
+		http.Error(w, `{"error": "Failed to fetch progress"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	members := []*MemberProgress{}
+	byUser := map[int]*MemberProgress{}
+	for rows.Next() {
+		var userID int
+		var email string
+		var fullName, courseID, courseTitle, lastAccessed sql.NullString
+		var progress sql.NullInt64
+		var completed sql.NullBool
+		if err := rows.Scan(&userID, &email, &fullName, &courseID, &courseTitle, &progress, &completed, &lastAccessed); err != nil {
+			log.Printf("Error scanning progress row: %v", err)
+			http.Error(w, `{"error": "Failed to scan progress data"}`, http.StatusInternalServerError)
+			return
+		}
+
+		member, seen := byUser[userID]
+		if !seen {
+			member = &MemberProgress{UserID: userID, Email: email, FullName: fullName.String, Courses: []MemberCourseProgress{}}
+			byUser[userID] = member
+			members = append(members, member)
+		}
+		if !courseID.Valid {
+			continue
+		}
+
+		member.Courses = append(member.Courses, MemberCourseProgress{
+			CourseID:     courseID.String,
+			CourseTitle:  courseTitle.String,
+			Progress:     int(progress.Int64),
+			Completed:    completed.Bool,
+			LastAccessed: lastAccessed.String,
+		})
+		member.CoursesStarted++
+		if completed.Bool {
+			member.CoursesCompleted++
+		}
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating progress rows: %v", err)
+		http.Error(w, `{"error": "Failed to fetch progress"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// GetOrgBadges returns the badges every member has earned (org admins only)
+func GetOrgBadges(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling get organization badges request")
+	orgID, _, ok := authorizeOrg(w, r, models.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT u.id, u.email, u.full_name, b.id, b.name, b.icon, b.category, ub.awarded_at
+		FROM organization_members m
+		JOIN users u ON u.id = m.user_id
+		LEFT JOIN user_badges ub ON ub.user_id = m.user_id AND ub.completed = 1
+		LEFT JOIN badges b ON b.id = ub.badge_id
+		WHERE m.org_id = ?
+		ORDER BY u.email, ub.awarded_at
+	`, orgID)
+	if err != nil {
+		log.Printf("Database error while fetching organization badges: %v", err)
+		http.Error(w, `{"error": "Failed to fetch badges"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	members := []*MemberBadges{}
+	byUser := map[int]*MemberBadges{}
+	for rows.Next() {
+		var userID int
+		var email string
+		var fullName, badgeID, name, icon, category, awardedAt sql.NullString
+		if err := rows.Scan(&userID, &email, &fullName, &badgeID, &name, &icon, &category, &awardedAt); err != nil {
+			log.Printf("Error scanning badge row: %v", err)
+			http.Error(w, `{"error": "Failed to scan badge data"}`, http.StatusInternalServerError)
+			return
+		}
+
+		member, seen := byUser[userID]
+		if !seen {
+			member = &MemberBadges{UserID: userID, Email: email, FullName: fullName.String, Badges: []MemberBadge{}}
+			byUser[userID] = member
+			members = append(members, member)
+		}
+		if !badgeID.Valid {
+			continue
+		}
+
+		member.Badges = append(member.Badges, MemberBadge{
+			BadgeID:   badgeID.String,
+			Name:      name.String,
+			Icon:      icon.String,
+			Category:  category.String,
+			AwardedAt: awardedAt.String,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating badge rows: %v", err)
+		http.Error(w, `{"error": "Failed to fetch badges"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
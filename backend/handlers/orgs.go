@@ -0,0 +1,766 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"defenzo/config"
+	"defenzo/mailer"
+	"defenzo/middleware"
+	"defenzo/models"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// orgInvitationTTL is how long an invitation link can be accepted
+	orgInvitationTTL = 7 * 24 * time.Hour
+	// maxOrgNameLength keeps organization names readable in lists
+	maxOrgNameLength = 100
+)
+
+// errNotOrgMember is returned when the caller does not belong to the organization
+var errNotOrgMember = errors.New("not a member of the organization")
+
+// Organization is a team of users, usually a department of a customer
+type Organization struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Role        string `json:"role,omitempty"`
+	MemberCount int    `json:"member_count"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// OrgMember is a user's membership in an organization
+type OrgMember struct {
+	UserID   int    `json:"user_id"`
+	Email    string `json:"email"`
+	FullName string `json:"full_name"`
+	Role     string `json:"role"`
+	JoinedAt string `json:"joined_at"`
+}
+
+// OrgInvitation is a pending invitation to join an organization
+type OrgInvitation struct {
+	ID        int    `json:"id"`
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	InvitedBy int    `json:"invited_by,omitempty"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// isValidOrgRole reports whether the role can be given to an organization member
+func isValidOrgRole(role string) bool {
+	return role == models.OrgRoleAdmin || role == models.OrgRoleMember
+}
+
+// orgRole returns the role of the user in the organization. Platform admins
+// act as organization admins everywhere.
+func orgRole(r *http.Request, orgID, userID int) (string, error) {
+	var exists bool
+	if err := config.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM organizations WHERE id = ?)", orgID).Scan(&exists); err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", errNotOrgMember
+	}
+
+	var role string
+	err := config.DB.QueryRow(
+		"SELECT role FROM organization_members WHERE org_id = ? AND user_id = ?",
+		orgID, userID,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		if middleware.HasRole(r, models.RoleAdmin) {
+			return models.OrgRoleAdmin, nil
+		}
+		return "", errNotOrgMember
+	}
+	return role, err
+}
+
+// authorizeOrg resolves the organization in the URL and checks that the caller
+// holds one of the roles, writing the error response if not
+func authorizeOrg(w http.ResponseWriter, r *http.Request, roles ...string) (orgID, userID int, ok bool) {
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return 0, 0, false
+	}
+	orgID, err = strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error": "Invalid organization ID"}`, http.StatusBadRequest)
+		return 0, 0, false
+	}
+
+	role, err := orgRole(r, orgID, userID)
+	if err == errNotOrgMember {
+		// Outsiders cannot tell whether the organization exists
+		http.Error(w, `{"error": "Organization not found"}`, http.StatusNotFound)
+		return 0, 0, false
+	} else if err != nil {
+		log.Printf("Error checking organization role: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return 0, 0, false
+	}
+
+	for _, allowed := range roles {
+		if role == allowed {
+			return orgID, userID, true
+		}
+	}
+	http.Error(w, `{"error": "Forbidden"}`, http.StatusForbidden)
+	return 0, 0, false
+}
+
+// countOrgAdmins returns how many admins the organization has
+func countOrgAdmins(tx *sql.Tx, orgID int) (int, error) {
+	var admins int
+	err := tx.QueryRow(
+		"SELECT COUNT(*) FROM organization_members WHERE org_id = ? AND role = ?",
+		orgID, models.OrgRoleAdmin,
+	).Scan(&admins)
+	return admins, err
+}
+
+// CreateOrganization creates an organization with the caller as its first admin
+func CreateOrganization(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling create organization request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > maxOrgNameLength {
+		http.Error(w, `{"error": "Name is required and must be at most 100 characters"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, `{"error": "Failed to create organization"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Format(time.RFC3339)
+	result, err := tx.Exec("INSERT INTO organizations (name, created_by, created_at) VALUES (?, ?, ?)", name, userID, now)
+	if err != nil {
+		log.Printf("Error creating organization: %v", err)
+		http.Error(w, `{"error": "Failed to create organization"}`, http.StatusInternalServerError)
+		return
+	}
+	orgID, err := result.LastInsertId()
+	if err != nil {
+		log.Printf("Error getting last insert ID: %v", err)
+		http.Error(w, `{"error": "Failed to create organization"}`, http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(
+		"INSERT INTO organization_members (org_id, user_id, role, joined_at) VALUES (?, ?, ?, ?)",
+		orgID, userID, models.OrgRoleAdmin, now,
+	)
+	if err != nil {
+		log.Printf("Error adding organization admin: %v", err)
+		http.Error(w, `{"error": "Failed to create organization"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		http.Error(w, `{"error": "Failed to create organization"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d created organization %d", userID, orgID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Organization{
+		ID:          int(orgID),
+		Name:        name,
+		Role:        models.OrgRoleAdmin,
+		MemberCount: 1,
+		CreatedAt:   now,
+	})
+}
+
+// ListOrganizations returns the organizations the caller belongs to
+func ListOrganizations(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling list organizations request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT o.id, o.name, m.role, o.created_at,
+			(SELECT COUNT(*) FROM organization_members c WHERE c.org_id = o.id)
+		FROM organization_members m
+		JOIN organizations o ON o.id = m.org_id
+		WHERE m.user_id = ?
+		ORDER BY o.name
+	`, userID)
+	if err != nil {
+		log.Printf("Database error while fetching organizations: %v", err)
+		http.Error(w, `{"error": "Failed to fetch organizations"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	orgs := []Organization{}
+	for rows.Next() {
+		var o Organization
+		if err := rows.Scan(&o.ID, &o.Name, &o.Role, &o.CreatedAt, &o.MemberCount); err != nil {
+			log.Printf("Error scanning organization row: %v", err)
+			http.Error(w, `{"error": "Failed to scan organization data"}`, http.StatusInternalServerError)
+			return
+		}
+		orgs = append(orgs, o)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating organization rows: %v", err)
+		http.Error(w, `{"error": "Failed to fetch organizations"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orgs)
+}
+
+// DeleteOrganization removes an organization with its memberships and invitations (org admins only)
+func DeleteOrganization(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling delete organization request")
+	orgID, userID, ok := authorizeOrg(w, r, models.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, `{"error": "Failed to delete organization"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"DELETE FROM organization_invitations WHERE org_id = ?",
+		"DELETE FROM organization_members WHERE org_id = ?",
+		"DELETE FROM organizations WHERE id = ?",
+	} {
+		if _, err := tx.Exec(query, orgID); err != nil {
+			log.Printf("Error deleting organization: %v", err)
+			http.Error(w, `{"error": "Failed to delete organization"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		http.Error(w, `{"error": "Failed to delete organization"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d deleted organization %d", userID, orgID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Organization deleted",
+	})
+}
+
+// ListOrgMembers returns the members of an organization (members only)
+func ListOrgMembers(w http.ResponseWriter, r *http.Request) {
+	orgID, _, ok := authorizeOrg(w, r, models.OrgRoleAdmin, models.OrgRoleMember)
+	if !ok {
+		return
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT u.id, u.email, u.full_name, m.role, m.joined_at
+		FROM organization_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.org_id = ?
+		ORDER BY u.email
+	`, orgID)
+	if err != nil {
+		log.Printf("Database error while fetching members: %v", err)
+		http.Error(w, `{"error": "Failed to fetch members"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	members := []OrgMember{}
+	for rows.Next() {
+		var m OrgMember
+		var fullName sql.NullString
+		if err := rows.Scan(&m.UserID, &m.Email, &fullName, &m.Role, &m.JoinedAt); err != nil {
+			log.Printf("Error scanning member row: %v", err)
+			http.Error(w, `{"error": "Failed to scan member data"}`, http.StatusInternalServerError)
+			return
+		}
+		m.FullName = fullName.String
+		members = append(members, m)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating member rows: %v", err)
+		http.Error(w, `{"error": "Failed to fetch members"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// UpdateOrgMember changes the role of a member (org admins only)
+func UpdateOrgMember(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling update organization member request")
+	orgID, userID, ok := authorizeOrg(w, r, models.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+	memberID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil {
+		http.Error(w, `{"error": "Invalid user ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if !isValidOrgRole(req.Role) {
+		http.Error(w, `{"error": "Unknown role"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, `{"error": "Failed to update member"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE organization_members SET role = ? WHERE org_id = ? AND user_id = ?",
+		req.Role, orgID, memberID,
+	)
+	if err != nil {
+		log.Printf("Error updating member role: %v", err)
+		http.Error(w, `{"error": "Failed to update member"}`, http.StatusInternalServerError)
+		return
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		http.Error(w, `{"error": "Member not found"}`, http.StatusNotFound)
+		return
+	}
+
+	// Never leave an organization without an admin
+	admins, err := countOrgAdmins(tx, orgID)
+	if err != nil {
+		log.Printf("Error counting organization admins: %v", err)
+		http.Error(w, `{"error": "Failed to update member"}`, http.StatusInternalServerError)
+		return
+	}
+	if admins == 0 {
+		http.Error(w, `{"error": "Cannot remove the last admin"}`, http.StatusConflict)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		http.Error(w, `{"error": "Failed to update member"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d set role of user %d in organization %d to %s", userID, memberID, orgID, req.Role)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id": memberID,
+		"role":    req.Role,
+	})
+}
+
+// RemoveOrgMember removes a member from an organization. Admins can remove
+// anyone, members can only remove themselves to leave.
+func RemoveOrgMember(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling remove organization member request")
+	orgID, userID, ok := authorizeOrg(w, r, models.OrgRoleAdmin, models.OrgRoleMember)
+	if !ok {
+		return
+	}
+	memberID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil {
+		http.Error(w, `{"error": "Invalid user ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	if memberID != userID {
+		role, err := orgRole(r, orgID, userID)
+		if err != nil || role != models.OrgRoleAdmin {
+			http.Error(w, `{"error": "Forbidden"}`, http.StatusForbidden)
+			return
+		}
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, `{"error": "Failed to remove member"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM organization_members WHERE org_id = ? AND user_id = ?", orgID, memberID)
+	if err != nil {
+		log.Printf("Error removing member: %v", err)
+		http.Error(w, `{"error": "Failed to remove member"}`, http.StatusInternalServerError)
+		return
+	}
+	if removed, err := result.RowsAffected(); err != nil || removed == 0 {
+		http.Error(w, `{"error": "Member not found"}`, http.StatusNotFound)
+		return
+	}
+
+	admins, err := countOrgAdmins(tx, orgID)
+	if err != nil {
+		log.Printf("Error counting organization admins: %v", err)
+		http.Error(w, `{"error": "Failed to remove member"}`, http.StatusInternalServerError)
+		return
+	}
+	if admins == 0 {
+		http.Error(w, `{"error": "Cannot remove the last admin"}`, http.StatusConflict)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		http.Error(w, `{"error": "Failed to remove member"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d removed user %d from organization %d", userID, memberID, orgID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Member removed",
+	})
+}
+
+// CreateOrgInvitation emails an invitation link to join the organization (org admins only)
+func CreateOrgInvitation(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling create organization invitation request")
+	orgID, userID, ok := authorizeOrg(w, r, models.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	email, err := validateEmail(req.Email)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = models.OrgRoleMember
+	}
+	if !isValidOrgRole(req.Role) {
+		http.Error(w, `{"error": "Unknown role"}`, http.StatusBadRequest)
+		return
+	}
+
+	var orgName string
+	var alreadyMember bool
+	err = config.DB.QueryRow(`
+		SELECT o.name, EXISTS(
+			SELECT 1 FROM organization_members m JOIN users u ON u.id = m.user_id
+			WHERE m.org_id = o.id AND u.email = ? COLLATE NOCASE
+		)
+		FROM organizations o WHERE o.id = ?
+	`, email, orgID).Scan(&orgName, &alreadyMember)
+	if err != nil {
+		log.Printf("Error loading organization: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if alreadyMember {
+		http.Error(w, `{"error": "User is already a member"}`, http.StatusConflict)
+		return
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		log.Printf("Error generating invitation token: %v", err)
+		http.Error(w, `{"error": "Failed to create invitation"}`, http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	invitation := OrgInvitation{
+		Email:     email,
+		Role:      req.Role,
+		InvitedBy: userID,
+		CreatedAt: now.Format(time.RFC3339),
+		ExpiresAt: now.Add(orgInvitationTTL).Format(time.RFC3339),
+	}
+
+	// A new invitation replaces any pending one for the same address
+	_, err = config.DB.Exec(
+		"DELETE FROM organization_invitations WHERE org_id = ? AND email = ? COLLATE NOCASE AND accepted_at IS NULL",
+		orgID, email,
+	)
+	if err != nil {
+		log.Printf("Error replacing invitation: %v", err)
+		http.Error(w, `{"error": "Failed to create invitation"}`, http.StatusInternalServerError)
+		return
+	}
+	result, err := config.DB.Exec(`
+		INSERT INTO organization_invitations (org_id, email, role, token_hash, invited_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, orgID, email, req.Role, hashToken(token), userID, invitation.CreatedAt, invitation.ExpiresAt)
+	if err != nil {
+		log.Printf("Error storing invitation: %v", err)
+		http.Error(w, `{"error": "Failed to create invitation"}`, http.StatusInternalServerError)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Printf("Error getting last insert ID: %v", err)
+		http.Error(w, `{"error": "Failed to create invitation"}`, http.StatusInternalServerError)
+		return
+	}
+	invitation.ID = int(id)
+
+	go func() {
+		err := mailer.Send(mailer.Message{
+			To:      email,
+			Subject: fmt.Sprintf("You're invited to join %s on DEFENZO", orgName),
+			Body: fmt.Sprintf(
+				"You have been invited to join %s on DEFENZO.\n\n"+
+					"Sign in or create an account with this email address, then open this link within %d days to accept:\n%s\n\n"+
+					"If you weren't expecting this, you can ignore this email.",
+				orgName, int(orgInvitationTTL.Hours()/24), appLink("accept-invite", token),
+			),
+		})
+		if err != nil {
+			log.Printf("Error sending invitation for organization %d: %v", orgID, err)
+		}
+	}()
+
+	log.Printf("User %d invited %s to organization %d as %s", userID, email, orgID, req.Role)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invitation)
+}
+
+// ListOrgInvitations returns the pending invitations of an organization (org admins only)
+func ListOrgInvitations(w http.ResponseWriter, r *http.Request) {
+	orgID, _, ok := authorizeOrg(w, r, models.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT id, email, role, invited_by, created_at, expires_at
+		FROM organization_invitations
+		WHERE org_id = ? AND accepted_at IS NULL AND expires_at > ?
+		ORDER BY created_at DESC
+	`, orgID, time.Now().Format(time.RFC3339))
+	if err != nil {
+		log.Printf("Database error while fetching invitations: %v", err)
+		http.Error(w, `{"error": "Failed to fetch invitations"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	invitations := []OrgInvitation{}
+	for rows.Next() {
+		var inv OrgInvitation
+		var invitedBy sql.NullInt64
+		if err := rows.Scan(&inv.ID, &inv.Email, &inv.Role, &invitedBy, &inv.CreatedAt, &inv.ExpiresAt); err != nil {
+			log.Printf("Error scanning invitation row: %v", err)
+			http.Error(w, `{"error": "Failed to scan invitation data"}`, http.StatusInternalServerError)
+			return
+		}
+		inv.InvitedBy = int(invitedBy.Int64)
+		invitations = append(invitations, inv)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating invitation rows: %v", err)
+		http.Error(w, `{"error": "Failed to fetch invitations"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invitations)
+}
+
+// RevokeOrgInvitation cancels a pending invitation (org admins only)
+func RevokeOrgInvitation(w http.ResponseWriter, r *http.Request) {
+	orgID, userID, ok := authorizeOrg(w, r, models.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+	invitationID, err := strconv.Atoi(mux.Vars(r)["invitationID"])
+	if err != nil {
+		http.Error(w, `{"error": "Invalid invitation ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	result, err := config.DB.Exec(
+		"DELETE FROM organization_invitations WHERE id = ? AND org_id = ? AND accepted_at IS NULL",
+		invitationID, orgID,
+	)
+	if err != nil {
+		log.Printf("Error revoking invitation: %v", err)
+		http.Error(w, `{"error": "Failed to revoke invitation"}`, http.StatusInternalServerError)
+		return
+	}
+	if revoked, err := result.RowsAffected(); err != nil || revoked == 0 {
+		http.Error(w, `{"error": "Invitation not found"}`, http.StatusNotFound)
+		return
+	}
+
+	log.Printf("User %d revoked invitation %d of organization %d", userID, invitationID, orgID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Invitation revoked",
+	})
+}
+
+// AcceptOrgInvitation adds the signed-in user to the organization using the
+// token from the invitation email. The invitation must have been sent to the
+// user's own email address.
+func AcceptOrgInvitation(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling accept organization invitation request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, `{"error": "Token is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, `{"error": "Failed to accept invitation"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var invitationID, orgID int
+	var invitedEmail, role, expiresAt, orgName string
+	err = tx.QueryRow(`
+		SELECT i.id, i.org_id, i.email, i.role, i.expires_at, o.name
+		FROM organization_invitations i JOIN organizations o ON o.id = i.org_id
+		WHERE i.token_hash = ? AND i.accepted_at IS NULL
+	`, hashToken(req.Token)).Scan(&invitationID, &orgID, &invitedEmail, &role, &expiresAt, &orgName)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error": "Invalid or expired invitation"}`, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error loading invitation: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if expires, err := time.Parse(time.RFC3339, expiresAt); err != nil || time.Now().After(expires) {
+		http.Error(w, `{"error": "Invalid or expired invitation"}`, http.StatusBadRequest)
+		return
+	}
+
+	var email string
+	if err := tx.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+	if !strings.EqualFold(email, invitedEmail) {
+		http.Error(w, `{"error": "This invitation was sent to a different email address"}`, http.StatusForbidden)
+		return
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	result, err := tx.Exec(
+		"UPDATE organization_invitations SET accepted_at = ? WHERE id = ? AND accepted_at IS NULL",
+		now, invitationID,
+	)
+	if err != nil {
+		log.Printf("Error accepting invitation: %v", err)
+		http.Error(w, `{"error": "Failed to accept invitation"}`, http.StatusInternalServerError)
+		return
+	}
+	if accepted, err := result.RowsAffected(); err != nil || accepted != 1 {
+		http.Error(w, `{"error": "Invalid or expired invitation"}`, http.StatusBadRequest)
+		return
+	}
+	_, err = tx.Exec(
+		"INSERT OR IGNORE INTO organization_members (org_id, user_id, role, joined_at) VALUES (?, ?, ?, ?)",
+		orgID, userID, role, now,
+	)
+	if err != nil {
+		log.Printf("Error adding member: %v", err)
+		http.Error(w, `{"error": "Failed to accept invitation"}`, http.StatusInternalServerError)
+		return
+	}
+	// Opening the emailed link proves the address belongs to the user
+	_, err = tx.Exec("UPDATE users SET email_verified_at = ? WHERE id = ? AND email_verified_at IS NULL", now, userID)
+	if err != nil {
+		log.Printf("Error marking email as verified: %v", err)
+		http.Error(w, `{"error": "Failed to accept invitation"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		http.Error(w, `{"error": "Failed to accept invitation"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d joined organization %d as %s", userID, orgID, role)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"org_id": orgID,
+		"name":   orgName,
+		"role":   role,
+	})
+}
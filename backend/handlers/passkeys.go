@@ -0,0 +1,654 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"defenzo/config"
+	"defenzo/middleware"
+	"defenzo/webauthn"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// webauthnChallengeTTL is how long the user has to answer a passkey prompt
+	webauthnChallengeTTL = 5 * time.Minute
+	// maxPasskeysPerUser limits how many passkeys an account can register
+	maxPasskeysPerUser = 10
+	// maxPasskeyNameLength keeps passkey labels short enough to list
+	maxPasskeyNameLength  = 100
+	defaultWebAuthnRPName = "DEFENZO"
+)
+
+// Ceremonies a WebAuthn challenge can be used for
+const (
+	webauthnPurposeRegister = "register"
+	webauthnPurposeLogin    = "login"
+	webauthnPurposeMFA      = "mfa"
+)
+
+var (
+	// errInvalidPasskey is returned for assertions that do not verify
+	errInvalidPasskey = errors.New("invalid passkey")
+	// errPasskeyCloned is returned for credentials whose signature counter went backwards
+	errPasskeyCloned = errors.New("passkey may have been cloned")
+)
+
+// WebAuthn is the relying party configuration, nil when passkeys are disabled
+var WebAuthn *webauthn.Config
+
+// Passkey is a registered WebAuthn credential as listed to its owner
+type Passkey struct {
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	BackedUp      bool   `json:"backed_up"`
+	CreatedAt     string `json:"created_at"`
+	LastUsedAt    string `json:"last_used_at,omitempty"`
+	CloneDetected bool   `json:"clone_detected"`
+}
+
+// InitWebAuthn configures passkeys from the environment.
+//
+// WEBAUTHN_RP_ID is the domain passkeys are bound to and enables the feature.
+// WEBAUTHN_ORIGINS is a comma separated list of accepted origins and defaults
+// to https://<WEBAUTHN_RP_ID>; native apps need their own origin here, such as
+// android:apk-key-hash:<hash>. WEBAUTHN_RP_NAME is shown by authenticators.
+func InitWebAuthn() {
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	if rpID == "" {
+		log.Printf("Passkeys disabled, WEBAUTHN_RP_ID is not set")
+		return
+	}
+
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	if len(origins) == 0 {
+		origins = []string{"https://" + rpID}
+	}
+	name := os.Getenv("WEBAUTHN_RP_NAME")
+	if name == "" {
+		name = defaultWebAuthnRPName
+	}
+
+	WebAuthn = &webauthn.Config{
+		RPID:    rpID,
+		RPName:  name,
+		Origins: origins,
+		Timeout: webauthnChallengeTTL,
+	}
+	log.Printf("Passkeys enabled for %s", rpID)
+}
+
+// passkeysEnabled writes a 404 response when passkeys are not configured
+func passkeysEnabled(w http.ResponseWriter) bool {
+	if WebAuthn == nil {
+		http.Error(w, `{"error": "Passkeys are not enabled"}`, http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// createWebAuthnChallenge stores a challenge for one ceremony, userID is 0
+// for passkey logins where the user is not known yet
+func createWebAuthnChallenge(purpose string, userID int) (webauthn.Bytes, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if _, err := config.DB.Exec("DELETE FROM webauthn_challenges WHERE expires_at < ?", now.Format(time.RFC3339)); err != nil {
+		log.Printf("Error cleaning up expired WebAuthn challenges: %v", err)
+	}
+
+	user := sql.NullInt64{Int64: int64(userID), Valid: userID != 0}
+	_, err = config.DB.Exec(
+		"INSERT INTO webauthn_challenges (challenge_hash, purpose, user_id, expires_at) VALUES (?, ?, ?, ?)",
+		hashToken(base64.RawURLEncoding.EncodeToString(challenge)), purpose, user, now.Add(webauthnChallengeTTL).Format(time.RFC3339),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// consumeWebAuthnChallenge deletes a pending challenge so it can only be
+// answered once, and returns the user it was issued to (0 for none)
+func consumeWebAuthnChallenge(challenge []byte, purpose string) (int, error) {
+	challengeHash := hashToken(base64.RawURLEncoding.EncodeToString(challenge))
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID sql.NullInt64
+	var expiresAt string
+	err = tx.QueryRow(
+		"SELECT user_id, expires_at FROM webauthn_challenges WHERE challenge_hash = ? AND purpose = ?",
+		challengeHash, purpose,
+	).Scan(&userID, &expiresAt)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidUserToken
+	} else if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec("DELETE FROM webauthn_challenges WHERE challenge_hash = ?", challengeHash)
+	if err != nil {
+		return 0, err
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted != 1 {
+		return 0, errInvalidUserToken
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if expires, err := time.Parse(time.RFC3339, expiresAt); err != nil || time.Now().After(expires) {
+		return 0, errInvalidUserToken
+	}
+	return int(userID.Int64), nil
+}
+
+// webauthnUserHandle returns the random user handle of the account, creating
+// it on first use. It identifies the account to authenticators without
+// revealing the user ID or email.
+func webauthnUserHandle(userID int) ([]byte, error) {
+	var handle sql.NullString
+	if err := config.DB.QueryRow("SELECT webauthn_user_handle FROM users WHERE id = ?", userID).Scan(&handle); err != nil {
+		return nil, err
+	}
+	if !handle.Valid {
+		generated, err := webauthn.NewChallenge()
+		if err != nil {
+			return nil, err
+		}
+		// Another request may have set a handle in the meantime, keep that one
+		if _, err := config.DB.Exec(
+			"UPDATE users SET webauthn_user_handle = ? WHERE id = ? AND webauthn_user_handle IS NULL",
+			hex.EncodeToString(generated), userID,
+		); err != nil {
+			return nil, err
+		}
+		if err := config.DB.QueryRow("SELECT webauthn_user_handle FROM users WHERE id = ?", userID).Scan(&handle); err != nil {
+			return nil, err
+		}
+	}
+	return hex.DecodeString(handle.String)
+}
+
+// passkeyDescriptors returns the user's credentials for allow and exclude lists
+func passkeyDescriptors(userID int) ([]webauthn.CredentialDescriptor, error) {
+	rows, err := config.DB.Query("SELECT credential_id, transports FROM webauthn_credentials WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	descriptors := []webauthn.CredentialDescriptor{}
+	for rows.Next() {
+		var credentialID, transports string
+		if err := rows.Scan(&credentialID, &transports); err != nil {
+			return nil, err
+		}
+		id, err := base64.RawURLEncoding.DecodeString(credentialID)
+		if err != nil {
+			return nil, err
+		}
+		descriptor := webauthn.CredentialDescriptor{Type: "public-key", ID: id}
+		if transports != "" {
+			descriptor.Transports = strings.Split(transports, ",")
+		}
+		descriptors = append(descriptors, descriptor)
+	}
+	return descriptors, rows.Err()
+}
+
+// hasPasskeys reports whether the user has registered a passkey
+func hasPasskeys(userID int) (bool, error) {
+	var exists bool
+	err := config.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM webauthn_credentials WHERE user_id = ?)", userID).Scan(&exists)
+	return exists, err
+}
+
+// verifyPasskeyAssertion checks a passkey response against a pending
+// challenge and the stored credential and returns the user it belongs to.
+// A signature counter that did not increase marks the credential as cloned,
+// after which it can no longer be used.
+func verifyPasskeyAssertion(resp *webauthn.CredentialResponse, purpose string, requireVerification bool) (int, error) {
+	challenge, err := resp.Challenge()
+	if err != nil {
+		return 0, errInvalidPasskey
+	}
+	challengeUserID, err := consumeWebAuthnChallenge(challenge, purpose)
+	if err == errInvalidUserToken {
+		return 0, errInvalidPasskey
+	} else if err != nil {
+		return 0, err
+	}
+	rawID, err := resp.CredentialID()
+	if err != nil {
+		return 0, errInvalidPasskey
+	}
+
+	var id, userID int
+	var publicKey []byte
+	var signCount uint32
+	var handle sql.NullString
+	var cloneDetectedAt sql.NullString
+	err = config.DB.QueryRow(`
+		SELECT c.id, c.user_id, c.public_key, c.sign_count, c.clone_detected_at, u.webauthn_user_handle
+		FROM webauthn_credentials c JOIN users u ON u.id = c.user_id
+		WHERE c.credential_id = ?
+	`, base64.RawURLEncoding.EncodeToString(rawID)).Scan(&id, &userID, &publicKey, &signCount, &cloneDetectedAt, &handle)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidPasskey
+	} else if err != nil {
+		return 0, err
+	}
+
+	// A challenge issued to one user cannot be answered with another user's passkey
+	if challengeUserID != 0 && challengeUserID != userID {
+		return 0, errInvalidPasskey
+	}
+	if len(resp.Response.UserHandle) > 0 && hex.EncodeToString(resp.Response.UserHandle) != handle.String {
+		return 0, errInvalidPasskey
+	}
+	if cloneDetectedAt.Valid {
+		return 0, errPasskeyCloned
+	}
+
+	assertion, err := WebAuthn.VerifyAssertion(resp, challenge, publicKey, signCount, requireVerification)
+	if err == webauthn.ErrSignCountRegression {
+		log.Printf("Passkey %d of user %d sent sign count %d after %d, it may have been cloned", id, userID, assertion.SignCount, signCount)
+		if _, err := config.DB.Exec(
+			"UPDATE webauthn_credentials SET clone_detected_at = ? WHERE id = ?",
+			time.Now().Format(time.RFC3339), id,
+		); err != nil {
+			log.Printf("Error flagging cloned passkey: %v", err)
+		}
+		return 0, errPasskeyCloned
+	} else if err != nil {
+		log.Printf("Rejected passkey %d of user %d: %v", id, userID, err)
+		return 0, errInvalidPasskey
+	}
+
+	// Compare and set, so two uses of the same counter value cannot both succeed
+	result, err := config.DB.Exec(
+		"UPDATE webauthn_credentials SET sign_count = ?, backed_up = ?, last_used_at = ? WHERE id = ? AND sign_count = ?",
+		assertion.SignCount, assertion.BackedUp, time.Now().Format(time.RFC3339), id, signCount,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated != 1 {
+		return 0, errInvalidPasskey
+	}
+	return userID, nil
+}
+
+// ListPasskeys returns the passkeys registered for the user
+func ListPasskeys(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling list passkeys request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT id, name, backed_up, created_at, last_used_at, clone_detected_at
+		FROM webauthn_credentials WHERE user_id = ? ORDER BY created_at
+	`, userID)
+	if err != nil {
+		log.Printf("Database error while fetching passkeys: %v", err)
+		http.Error(w, `{"error": "Failed to fetch passkeys"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	passkeys := []Passkey{}
+	for rows.Next() {
+		var p Passkey
+		var lastUsedAt, cloneDetectedAt sql.NullString
+		if err := rows.Scan(&p.ID, &p.Name, &p.BackedUp, &p.CreatedAt, &lastUsedAt, &cloneDetectedAt); err != nil {
+			log.Printf("Error scanning passkey row: %v", err)
+			http.Error(w, `{"error": "Failed to scan passkey data"}`, http.StatusInternalServerError)
+			return
+		}
+		p.LastUsedAt = lastUsedAt.String
+		p.CloneDetected = cloneDetectedAt.Valid
+		passkeys = append(passkeys, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(passkeys)
+}
+
+// BeginPasskeyRegistration returns the options for creating a new passkey
+func BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling begin passkey registration request")
+	if !passkeysEnabled(w) {
+		return
+	}
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var email string
+	var fullName sql.NullString
+	if err := config.DB.QueryRow("SELECT email, full_name FROM users WHERE id = ?", userID).Scan(&email, &fullName); err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	existing, err := passkeyDescriptors(userID)
+	if err != nil {
+		log.Printf("Error fetching passkeys: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if len(existing) >= maxPasskeysPerUser {
+		http.Error(w, `{"error": "Too many passkeys, remove one first"}`, http.StatusConflict)
+		return
+	}
+
+	handle, err := webauthnUserHandle(userID)
+	if err != nil {
+		log.Printf("Error getting WebAuthn user handle: %v", err)
+		http.Error(w, `{"error": "Failed to start passkey registration"}`, http.StatusInternalServerError)
+		return
+	}
+	challenge, err := createWebAuthnChallenge(webauthnPurposeRegister, userID)
+	if err != nil {
+		log.Printf("Error creating WebAuthn challenge: %v", err)
+		http.Error(w, `{"error": "Failed to start passkey registration"}`, http.StatusInternalServerError)
+		return
+	}
+
+	displayName := fullName.String
+	if displayName == "" {
+		displayName = email
+	}
+	options := WebAuthn.CreationOptions(challenge, webauthn.User{ID: handle, Name: email, DisplayName: displayName}, existing)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"publicKey": options,
+	})
+}
+
+// FinishPasskeyRegistration verifies the new credential and stores it
+func FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling finish passkey registration request")
+	if !passkeysEnabled(w) {
+		return
+	}
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name       string                       `json:"name"`
+		Credential *webauthn.CredentialResponse `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Credential == nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	if len(name) > maxPasskeyNameLength {
+		http.Error(w, `{"error": "Name must be at most 100 characters"}`, http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := req.Credential.Challenge()
+	if err != nil {
+		http.Error(w, `{"error": "Invalid passkey response"}`, http.StatusBadRequest)
+		return
+	}
+	challengeUserID, err := consumeWebAuthnChallenge(challenge, webauthnPurposeRegister)
+	if err == errInvalidUserToken || (err == nil && challengeUserID != userID) {
+		http.Error(w, `{"error": "Invalid or expired registration attempt"}`, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error consuming WebAuthn challenge: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	credential, err := WebAuthn.VerifyRegistration(req.Credential, challenge, false)
+	if err != nil {
+		log.Printf("Rejected passkey registration for user %d: %v", userID, err)
+		http.Error(w, `{"error": "Invalid passkey response"}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	result, err := config.DB.Exec(`
+		INSERT INTO webauthn_credentials
+			(user_id, credential_id, public_key, algorithm, sign_count, name, transports, aaguid, backed_up, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(credential_id) DO NOTHING
+	`,
+		userID,
+		base64.RawURLEncoding.EncodeToString(credential.ID),
+		credential.PublicKey,
+		credential.Algorithm,
+		credential.SignCount,
+		name,
+		strings.Join(credential.Transports, ","),
+		hex.EncodeToString(credential.AAGUID),
+		credential.BackedUp,
+		now,
+	)
+	if err != nil {
+		log.Printf("Error saving passkey: %v", err)
+		http.Error(w, `{"error": "Failed to save passkey"}`, http.StatusInternalServerError)
+		return
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted != 1 {
+		http.Error(w, `{"error": "This passkey is already registered"}`, http.StatusConflict)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Printf("Error getting last insert ID: %v", err)
+		http.Error(w, `{"error": "Failed to save passkey"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d registered passkey %d", userID, id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Passkey{
+		ID:        int(id),
+		Name:      name,
+		BackedUp:  credential.BackedUp,
+		CreatedAt: now,
+	})
+}
+
+// DeletePasskey removes one of the user's passkeys
+func DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling delete passkey request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	passkeyID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error": "Invalid passkey ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	result, err := config.DB.Exec("DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?", passkeyID, userID)
+	if err != nil {
+		log.Printf("Error deleting passkey: %v", err)
+		http.Error(w, `{"error": "Failed to delete passkey"}`, http.StatusInternalServerError)
+		return
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		http.Error(w, `{"error": "Passkey not found"}`, http.StatusNotFound)
+		return
+	}
+
+	log.Printf("User %d deleted passkey %d", userID, passkeyID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Passkey deleted",
+	})
+}
+
+// BeginPasskeyLogin returns the options for signing in with any passkey
+// registered for this site. No email is asked for, so the endpoint does not
+// reveal which accounts have passkeys.
+func BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling begin passkey login request")
+	if !passkeysEnabled(w) {
+		return
+	}
+
+	challenge, err := createWebAuthnChallenge(webauthnPurposeLogin, 0)
+	if err != nil {
+		log.Printf("Error creating WebAuthn challenge: %v", err)
+		http.Error(w, `{"error": "Failed to start passkey login"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"publicKey": WebAuthn.RequestOptions(challenge, nil, webauthn.VerificationRequired),
+	})
+}
+
+// FinishPasskeyLogin signs the user in with a passkey. The authenticator has
+// verified the user with a PIN or biometric on top of holding the key, so no
+// second factor is asked for. The response is the same as for Login.
+func FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling finish passkey login request")
+	if !passkeysEnabled(w) {
+		return
+	}
+
+	var req struct {
+		Credential *webauthn.CredentialResponse `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Credential == nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := verifyPasskeyAssertion(req.Credential, webauthnPurposeLogin, true)
+	if err == errInvalidPasskey {
+		http.Error(w, `{"error": "Invalid passkey"}`, http.StatusUnauthorized)
+		return
+	} else if err == errPasskeyCloned {
+		http.Error(w, `{"error": "This passkey has been disabled because it may have been copied, sign in another way and remove it"}`, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("Error verifying passkey: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := issueTokens(r, userID)
+	if err != nil {
+		log.Printf("Error generating tokens: %v", err)
+		http.Error(w, `{"error": "Failed to generate token"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d signed in with a passkey", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// BeginPasskeyMFA returns the options for answering a two-factor challenge
+// from Login with one of the user's passkeys instead of an authenticator code
+func BeginPasskeyMFA(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling begin passkey two-factor request")
+	if !passkeysEnabled(w) {
+		return
+	}
+
+	var req struct {
+		MFAToken string `json:"mfa_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	var userID, attempts int
+	var expiresAt string
+	err := config.DB.QueryRow(
+		"SELECT user_id, attempts, expires_at FROM mfa_challenges WHERE token_hash = ?",
+		hashToken(req.MFAToken),
+	).Scan(&userID, &attempts, &expiresAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error": "Invalid or expired challenge"}`, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("Error loading MFA challenge: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if expires, err := time.Parse(time.RFC3339, expiresAt); err != nil || time.Now().After(expires) || attempts >= maxMFAAttempts {
+		http.Error(w, `{"error": "Invalid or expired challenge"}`, http.StatusUnauthorized)
+		return
+	}
+
+	allow, err := passkeyDescriptors(userID)
+	if err != nil {
+		log.Printf("Error fetching passkeys: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if len(allow) == 0 {
+		http.Error(w, `{"error": "No passkeys are registered for this account"}`, http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := createWebAuthnChallenge(webauthnPurposeMFA, userID)
+	if err != nil {
+		log.Printf("Error creating WebAuthn challenge: %v", err)
+		http.Error(w, `{"error": "Failed to start passkey verification"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// The password was already checked, so holding the passkey is the second factor
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"publicKey": WebAuthn.RequestOptions(challenge, allow, webauthn.VerificationDiscouraged),
+	})
+}
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"defenzo/config"
+	"defenzo/middleware"
+	"defenzo/webauthn"
+	"defenzo/webauthn/webauthntest"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testRPID   = "defenzo.test"
+	testOrigin = "https://defenzo.test"
+)
+
+// enablePasskeys configures WebAuthn for the test and returns an
+// authenticator for the same relying party
+func enablePasskeys(t *testing.T) *webauthntest.Authenticator {
+	t.Helper()
+	WebAuthn = &webauthn.Config{RPID: testRPID, RPName: "DEFENZO", Origins: []string{testOrigin}, Timeout: time.Minute}
+	t.Cleanup(func() { WebAuthn = nil })
+	return webauthntest.New(testRPID, testOrigin)
+}
+
+// passkeyOptions is the part of the WebAuthn options the authenticator needs
+type passkeyOptions struct {
+	PublicKey struct {
+		Challenge webauthn.Bytes `json:"challenge"`
+		User      struct {
+			ID webauthn.Bytes `json:"id"`
+		} `json:"user"`
+		AllowCredentials []webauthn.CredentialDescriptor `json:"allowCredentials"`
+	} `json:"publicKey"`
+}
+
+func decodeOptions(t *testing.T, w *httptest.ResponseRecorder) passkeyOptions {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("begin returned %d: %s", w.Code, w.Body)
+	}
+	var options passkeyOptions
+	if err := json.NewDecoder(w.Body).Decode(&options); err != nil {
+		t.Fatal(err)
+	}
+	return options
+}
+
+// registerPasskey adds a passkey to the user's account through the API
+func registerPasskey(t *testing.T, auth *webauthntest.Authenticator, accessToken string) *webauthntest.Credential {
+	t.Helper()
+	options := decodeOptions(t, callHandler(t, BeginPasskeyRegistration, accessToken, nil))
+	cred, resp, err := auth.Register(options.PublicKey.Challenge, options.PublicKey.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := map[string]interface{}{"name": "Laptop", "credential": resp}
+	if w := callHandler(t, FinishPasskeyRegistration, accessToken, body); w.Code != http.StatusCreated {
+		t.Fatalf("finish registration returned %d: %s", w.Code, w.Body)
+	}
+
+	// The challenge was used up
+	if w := callHandler(t, FinishPasskeyRegistration, accessToken, body); w.Code != http.StatusBadRequest {
+		t.Fatalf("replayed registration returned %d, want 400", w.Code)
+	}
+	return cred
+}
+
+// passkeyLogin signs in with the passkey alone
+func passkeyLogin(t *testing.T, auth *webauthntest.Authenticator, cred *webauthntest.Credential) *httptest.ResponseRecorder {
+	t.Helper()
+	options := decodeOptions(t, callHandler(t, BeginPasskeyLogin, "", nil))
+	resp, err := auth.Assert(cred, options.PublicKey.Challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return callHandler(t, FinishPasskeyLogin, "", map[string]interface{}{"credential": resp})
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	auth := enablePasskeys(t)
+	userID := createTestUser(t, "passkey@example.com", "")
+	cred := registerPasskey(t, auth, signIn(t, userID))
+
+	options := decodeOptions(t, callHandler(t, BeginPasskeyLogin, "", nil))
+	resp, err := auth.Assert(cred, options.PublicKey.Challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := callHandler(t, FinishPasskeyLogin, "", map[string]interface{}{"credential": resp})
+	if w.Code != http.StatusOK {
+		t.Fatalf("passkey login returned %d: %s", w.Code, w.Body)
+	}
+	var tokens tokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&tokens); err != nil || tokens.Token == "" {
+		t.Fatalf("no tokens in %s", w.Body)
+	}
+
+	// Each login challenge can only be answered once
+	if w := callHandler(t, FinishPasskeyLogin, "", map[string]interface{}{"credential": resp}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("replayed assertion returned %d, want 401", w.Code)
+	}
+
+	// Signing in without user verification is not enough on its own
+	auth.UserVerified = false
+	if w := passkeyLogin(t, auth, cred); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unverified passkey login returned %d, want 401", w.Code)
+	}
+}
+
+func TestPasskeyAnswersLoginMFA(t *testing.T) {
+	auth := enablePasskeys(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("Correct-Horse-Battery-9"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := createTestUser(t, "mfa-passkey@example.com", string(hash))
+	cred := registerPasskey(t, auth, signIn(t, userID))
+
+	// Without an authenticator app the passkey still makes a second factor mandatory
+	w := callHandler(t, Login, "", map[string]string{"email": "mfa-passkey@example.com", "password": "Correct-Horse-Battery-9"})
+	var challenge struct {
+		MFARequired bool     `json:"mfa_required"`
+		MFAToken    string   `json:"mfa_token"`
+		MFAMethods  []string `json:"mfa_methods"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&challenge); err != nil {
+		t.Fatal(err)
+	}
+	if !challenge.MFARequired || len(challenge.MFAMethods) != 1 || challenge.MFAMethods[0] != "passkey" {
+		t.Fatalf("login returned %d with %+v, want a passkey challenge", w.Code, challenge)
+	}
+
+	options := decodeOptions(t, callHandler(t, BeginPasskeyMFA, "", map[string]string{"mfa_token": challenge.MFAToken}))
+	if len(options.PublicKey.AllowCredentials) != 1 || !bytes.Equal(options.PublicKey.AllowCredentials[0].ID, cred.ID) {
+		t.Fatalf("allowCredentials = %+v, want the registered passkey", options.PublicKey.AllowCredentials)
+	}
+
+	// A passkey of another account does not answer the challenge
+	other := createTestUser(t, "mfa-other@example.com", "")
+	otherCred := registerPasskey(t, auth, signIn(t, other))
+	resp, err := auth.Assert(otherCred, options.PublicKey.Challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := map[string]interface{}{"mfa_token": challenge.MFAToken, "passkey": resp}
+	if w := callHandler(t, VerifyLoginMFA, "", body); w.Code != http.StatusUnauthorized {
+		t.Fatalf("other user's passkey returned %d, want 401", w.Code)
+	}
+	var attempts int
+	if err := config.DB.QueryRow("SELECT attempts FROM mfa_challenges WHERE token_hash = ?", hashToken(challenge.MFAToken)).Scan(&attempts); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 1 {
+		t.Fatalf("failed attempts = %d, want 1", attempts)
+	}
+
+	// The password was checked already, so presence is enough for the second factor
+	auth.UserVerified = false
+	options = decodeOptions(t, callHandler(t, BeginPasskeyMFA, "", map[string]string{"mfa_token": challenge.MFAToken}))
+	resp, err = auth.Assert(cred, options.PublicKey.Challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = map[string]interface{}{"mfa_token": challenge.MFAToken, "passkey": resp}
+	w = callHandler(t, VerifyLoginMFA, "", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("passkey second factor returned %d: %s", w.Code, w.Body)
+	}
+	var tokens tokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&tokens); err != nil || tokens.Token == "" {
+		t.Fatalf("no tokens in %s", w.Body)
+	}
+
+	// The MFA challenge is single use
+	if w := callHandler(t, VerifyLoginMFA, "", body); w.Code != http.StatusUnauthorized {
+		t.Fatalf("reused MFA challenge returned %d, want 401", w.Code)
+	}
+}
+
+func TestPasskeyCloneDetection(t *testing.T) {
+	auth := enablePasskeys(t)
+	userID := createTestUser(t, "clone@example.com", "")
+	accessToken := signIn(t, userID)
+	cred := registerPasskey(t, auth, accessToken)
+
+	if w := passkeyLogin(t, auth, cred); w.Code != http.StatusOK {
+		t.Fatalf("passkey login returned %d: %s", w.Code, w.Body)
+	}
+	if w := passkeyLogin(t, auth, cred); w.Code != http.StatusOK {
+		t.Fatalf("second passkey login returned %d: %s", w.Code, w.Body)
+	}
+
+	// A copy of the key that lags behind sends a counter already seen
+	clone := *cred
+	clone.SignCount = 1
+	if w := passkeyLogin(t, auth, &clone); w.Code != http.StatusUnauthorized {
+		t.Fatalf("cloned passkey login returned %d, want 401", w.Code)
+	}
+	var cloneDetectedAt sql.NullString
+	var signCount int
+	err := config.DB.QueryRow(
+		"SELECT clone_detected_at, sign_count FROM webauthn_credentials WHERE user_id = ?", userID,
+	).Scan(&cloneDetectedAt, &signCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cloneDetectedAt.Valid || signCount != 2 {
+		t.Fatalf("clone_detected_at = %v and sign_count = %d, want flagged at 2", cloneDetectedAt, signCount)
+	}
+
+	// Once flagged, the credential is disabled even with a fresh counter
+	if w := passkeyLogin(t, auth, cred); w.Code != http.StatusUnauthorized {
+		t.Fatalf("flagged passkey login returned %d, want 401", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+accessToken)
+	w := httptest.NewRecorder()
+	middleware.AuthMiddleware(ListPasskeys)(w, r)
+	var passkeys []Passkey
+	if err := json.NewDecoder(w.Body).Decode(&passkeys); err != nil {
+		t.Fatal(err)
+	}
+	if len(passkeys) != 1 || !passkeys[0].CloneDetected {
+		t.Fatalf("passkeys = %+v, want one flagged as cloned", passkeys)
+	}
+}
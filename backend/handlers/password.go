@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"defenzo/config"
+	"defenzo/mailer"
+	"defenzo/passwordpolicy"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordResetTTL = time.Hour
+	// passwordResetInterval and passwordResetDailyLimit keep the endpoint
+	// from being used to flood someone's inbox
+	passwordResetInterval   = time.Minute
+	passwordResetDailyLimit = 5
+)
+
+// PasswordPolicy is the minimum strength of new passwords, configured by InitPasswordPolicy
+var PasswordPolicy = passwordpolicy.Default
+
+// InitPasswordPolicy reads the required password strength from
+// PASSWORD_MIN_STRENGTH, either weak, medium or strong or a score from 0 to 6
+func InitPasswordPolicy() {
+	policy, err := passwordpolicy.Parse(os.Getenv("PASSWORD_MIN_STRENGTH"))
+	if err != nil {
+		log.Fatalf("Invalid PASSWORD_MIN_STRENGTH: %v", err)
+	}
+	PasswordPolicy = policy
+	log.Printf("Passwords need a strength score of at least %d", policy.MinScore)
+}
+
+// rejectWeakPassword checks a new password against the policy and, if it
+// fails, writes a 400 response with the rating and suggestions
+func rejectWeakPassword(w http.ResponseWriter, password, email, name string) bool {
+	result := PasswordPolicy.Check(password, email, name)
+	if result.Acceptable {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":       "Password is too weak",
+		"score":       result.Score,
+		"label":       result.Label,
+		"min_score":   PasswordPolicy.MinScore,
+		"suggestions": result.Suggestions,
+	})
+	return true
+}
+
+// appLink builds a link into the mobile app, APP_URL defaults to the Expo scheme
+func appLink(path, token string) string {
+	base := os.Getenv("APP_URL")
+	if base == "" {
+		base = "myapp://"
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base + path + "?token=" + url.QueryEscape(token)
+}
+
+// ForgotPassword emails a password reset link if the address belongs to an account
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling forgot password request")
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(w, `{"error": "Email is required"}`, http.StatusBadRequest)
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+
+	var userID int
+	err := config.DB.QueryRow("SELECT id FROM users WHERE email = ? COLLATE NOCASE", email).Scan(&userID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Database error during forgot password: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err == nil {
+		wait, _, err := userTokenWait(userID, tokenPurposePasswordReset, passwordResetInterval, passwordResetDailyLimit)
+		if err != nil {
+			log.Printf("Error checking password reset throttle: %v", err)
+			http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+			return
+		}
+		if wait > 0 {
+			// Answer as if the email was sent, the throttle would otherwise
+			// tell which addresses have an account
+			log.Printf("Password reset for user %d throttled", userID)
+			writeForgotPasswordResponse(w)
+			return
+		}
+
+		token, err := createUserToken(userID, tokenPurposePasswordReset, "", passwordResetTTL)
+		if err != nil {
+			log.Printf("Error creating password reset token: %v", err)
+			http.Error(w, `{"error": "Failed to create reset token"}`, http.StatusInternalServerError)
+			return
+		}
+
+		// Send in the background so response times do not reveal whether the email exists
+		go func() {
+			err := mailer.Send(mailer.Message{
+				To:      email,
+				Subject: "Reset your DEFENZO password",
+				Body: fmt.Sprintf(
+					"Someone asked to reset the password for your DEFENZO account.\n\n"+
+						"Open this link within %d minutes to choose a new password:\n%s\n\n"+
+						"If this wasn't you, you can ignore this email.",
+					int(passwordResetTTL.Minutes()), appLink("reset-password", token),
+				),
+			})
+			if err != nil {
+				log.Printf("Error sending password reset email to user %d: %v", userID, err)
+			}
+		}()
+		log.Printf("Created password reset token for user %d", userID)
+	} else {
+		log.Printf("Password reset requested for unknown email")
+	}
+
+	writeForgotPasswordResponse(w)
+}
+
+// writeForgotPasswordResponse answers every forgot password request the same
+// way, so the endpoint cannot be used to discover accounts
+func writeForgotPasswordResponse(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If an account exists for that email, a reset link has been sent",
+	})
+}
+
+// ResetPassword sets a new password using a token from ForgotPassword
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling reset password request")
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" || req.Password == "" {
+		http.Error(w, `{"error": "Token and password are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	// Check the password before using up the token, so the user can try another one
+	userID, err := userTokenOwner(req.Token, tokenPurposePasswordReset)
+	if err == errInvalidUserToken {
+		http.Error(w, `{"error": "Invalid or expired reset token"}`, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error looking up password reset token: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	var email string
+	var fullName sql.NullString
+	if err := config.DB.QueryRow("SELECT email, full_name FROM users WHERE id = ?", userID).Scan(&email, &fullName); err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, `{"error": "Invalid or expired reset token"}`, http.StatusBadRequest)
+		return
+	}
+	if rejectWeakPassword(w, req.Password, email, fullName.String) {
+		return
+	}
+
+	userID, _, err = consumeUserToken(req.Token, tokenPurposePasswordReset)
+	if err == errInvalidUserToken {
+		http.Error(w, `{"error": "Invalid or expired reset token"}`, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error consuming password reset token: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Hash password
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("Error hashing password: %v", err)
+		http.Error(w, `{"error": "Failed to hash password"}`, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = config.DB.Exec("UPDATE users SET password_hash = ? WHERE id = ?", string(hashedPassword), userID)
+	if err != nil {
+		log.Printf("Error updating password: %v", err)
+		http.Error(w, `{"error": "Failed to update password"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Any other reset links and every existing session stop working
+	if err := invalidateUserTokens(userID, tokenPurposePasswordReset); err != nil {
+		log.Printf("Error invalidating reset tokens: %v", err)
+	}
+	if err := revokeAllUserTokens(userID); err != nil {
+		log.Printf("Error revoking sessions after password reset: %v", err)
+		http.Error(w, `{"error": "Failed to revoke existing sessions"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Password reset for user %d", userID)
+	recordAuditEvent(r, userID, auditPasswordReset, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Password has been reset",
+	})
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"defenzo/config"
+)
+
+func TestForgotPasswordIsThrottled(t *testing.T) {
+	userID := createTestUser(t, "forgot@example.com", "")
+	resetTokens := func() int {
+		t.Helper()
+		var n int
+		if err := config.DB.QueryRow(
+			"SELECT COUNT(*) FROM user_tokens WHERE user_id = ? AND purpose = ?", userID, tokenPurposePasswordReset,
+		).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	forgot := func() {
+		t.Helper()
+		if w := callHandler(t, ForgotPassword, "", map[string]string{"email": "forgot@example.com"}); w.Code != http.StatusOK {
+			t.Fatalf("forgot password returned %d: %s", w.Code, w.Body)
+		}
+	}
+
+	// A second request right away looks the same but sends nothing
+	forgot()
+	forgot()
+	if n := resetTokens(); n != 1 {
+		t.Fatalf("%d reset emails sent within a minute, want 1", n)
+	}
+
+	for i := 1; i < passwordResetDailyLimit+2; i++ {
+		if _, err := config.DB.Exec(
+			"UPDATE user_tokens SET created_at = ? WHERE user_id = ? AND created_at > ?",
+			time.Now().Add(-passwordResetInterval-time.Second).Format(time.RFC3339), userID,
+			time.Now().Add(-passwordResetInterval).Format(time.RFC3339),
+		); err != nil {
+			t.Fatal(err)
+		}
+		forgot()
+	}
+	if n := resetTokens(); n != passwordResetDailyLimit {
+		t.Fatalf("%d reset emails sent in a day, want %d", n, passwordResetDailyLimit)
+	}
+}
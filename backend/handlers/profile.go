@@ -1,17 +1,260 @@
 package handlers
 
 import (
+	"database/sql"
 	"defenzo/config"
+	"defenzo/mailer"
 	"defenzo/middleware"
+	"defenzo/models"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
+// maxFullNameLength is the longest display name accepted, counted in characters
+const maxFullNameLength = 100
+
+// loadProfile returns the profile of a user as shown to that user
+func loadProfile(userID int) (*models.User, error) {
+	var user models.User
+	var fullName, profilePictureURL, emailVerifiedAt sql.NullString
+	err := config.DB.QueryRow(
+		"SELECT id, email, full_name, profile_picture_url, email_verified_at, created_at FROM users WHERE id = ?",
+		userID,
+	).Scan(&user.ID, &user.Email, &fullName, &profilePictureURL, &emailVerifiedAt, &user.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert NullString to string, using empty string if NULL
+	user.FullName = fullName.String
+	user.ProfilePictureURL = profilePictureURL.String
+	user.EmailVerified = emailVerifiedAt.Valid
+
+	user.PendingEmail, err = pendingEmailChange(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	user.Roles, err = loadUserRoles(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// validateFullName trims the name and checks its length and characters
+func validateFullName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("Full name cannot be empty")
+	}
+	if utf8.RuneCountInString(name) > maxFullNameLength {
+		return "", fmt.Errorf("Full name must be at most %d characters", maxFullNameLength)
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return "", fmt.Errorf("Full name contains invalid characters")
+		}
+	}
+	return name, nil
+}
+
+// UpdateProfile changes the editable profile fields. A new email address is
+// not applied directly, a confirmation link is sent to it instead.
+func UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling update profile request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		FullName        *string `json:"full_name"`
+		Email           *string `json:"email"`
+		CurrentPassword string  `json:"current_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	var currentEmail, passwordHash string
+	err = config.DB.QueryRow("SELECT email, password_hash FROM users WHERE id = ?", userID).Scan(&currentEmail, &passwordHash)
+	if err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	// Validate everything before changing anything
+	var fullName string
+	if req.FullName != nil {
+		fullName, err = validateFullName(*req.FullName)
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var newEmail string
+	if req.Email != nil && !strings.EqualFold(strings.TrimSpace(*req.Email), currentEmail) {
+		newEmail, err = validateEmail(*req.Email)
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.CurrentPassword == "" {
+			http.Error(w, `{"error": "Current password is required to change email"}`, http.StatusBadRequest)
+			return
+		}
+		if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.CurrentPassword)) != nil {
+			http.Error(w, `{"error": "Current password is incorrect"}`, http.StatusUnauthorized)
+			return
+		}
+		taken, err := emailInUse(newEmail, userID)
+		if err != nil {
+			log.Printf("Error checking email: %v", err)
+			http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			http.Error(w, `{"error": "Email already exists"}`, http.StatusConflict)
+			return
+		}
+	}
+
+	if req.FullName != nil {
+		if _, err := config.DB.Exec("UPDATE users SET full_name = ? WHERE id = ?", fullName, userID); err != nil {
+			log.Printf("Error updating full name: %v", err)
+			http.Error(w, `{"error": "Failed to update profile"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if newEmail != "" {
+		if err := requestEmailChange(userID, currentEmail, newEmail); err != nil {
+			log.Printf("Error requesting email change: %v", err)
+			http.Error(w, `{"error": "Failed to send confirmation email"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	user, err := loadProfile(userID)
+	if err != nil {
+		log.Printf("Error getting user profile: %v", err)
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Updated profile for user %d", userID)
+	if req.FullName != nil {
+		recordAuditEvent(r, userID, auditProfileUpdated, map[string]interface{}{"fields": []string{"full_name"}})
+	}
+	if newEmail != "" {
+		recordAuditEvent(r, userID, auditEmailChangeRequested, map[string]interface{}{"new_email": newEmail})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// ChangePassword sets a new password after checking the current one. Every
+// other session is signed out, the session making the request stays valid.
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling change password request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		http.Error(w, `{"error": "Current and new password are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	var email, passwordHash string
+	var fullName sql.NullString
+	err = config.DB.QueryRow("SELECT email, password_hash, full_name FROM users WHERE id = ?", userID).Scan(&email, &passwordHash, &fullName)
+	if err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.CurrentPassword)) != nil {
+		http.Error(w, `{"error": "Current password is incorrect"}`, http.StatusUnauthorized)
+		return
+	}
+	if rejectWeakPassword(w, req.NewPassword, email, fullName.String) {
+		return
+	}
+
+	// Hash password
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("Error hashing password: %v", err)
+		http.Error(w, `{"error": "Failed to hash password"}`, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = config.DB.Exec("UPDATE users SET password_hash = ? WHERE id = ?", string(hashedPassword), userID)
+	if err != nil {
+		log.Printf("Error updating password: %v", err)
+		http.Error(w, `{"error": "Failed to update password"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := invalidateUserTokens(userID, tokenPurposePasswordReset); err != nil {
+		log.Printf("Error invalidating reset tokens: %v", err)
+	}
+	revoked, err := revokeOtherSessions(userID, middleware.GetSessionID(r))
+	if err != nil {
+		log.Printf("Error revoking sessions after password change: %v", err)
+		http.Error(w, `{"error": "Failed to revoke other sessions"}`, http.StatusInternalServerError)
+		return
+	}
+
+	go func() {
+		err := mailer.Send(mailer.Message{
+			To:      email,
+			Subject: "Your DEFENZO password was changed",
+			Body: "The password for your DEFENZO account was just changed and your other devices were signed out.\n\n" +
+				"If this wasn't you, reset your password right away.",
+		})
+		if err != nil {
+			log.Printf("Error sending password change notice to user %d: %v", userID, err)
+		}
+	}()
+
+	log.Printf("Password changed for user %d, %d other sessions revoked", userID, revoked)
+	recordAuditEvent(r, userID, auditPasswordChanged, map[string]interface{}{"sessions_revoked": revoked})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Password has been changed",
+	})
+}
+
 // UploadProfilePicture handles profile picture upload
 func UploadProfilePicture(w http.ResponseWriter, r *http.Request) {
 	userID, err := middleware.GetUserID(r)
@@ -35,7 +278,7 @@ func UploadProfilePicture(w http.ResponseWriter, r *http.Request) {
 	defer file.Close()
 
 	// Create uploads directory if it doesn't exist
-	uploadDir := "uploads/profile_pictures"
+	uploadDir := profilePictureDir
 	if err := os.MkdirAll(uploadDir, 0755); err != nil {
 		http.Error(w, `{"error": "Failed to create upload directory"}`, http.StatusInternalServerError)
 		return
@@ -61,12 +304,16 @@ func UploadProfilePicture(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Update user's profile picture URL in database
-	relativePath := "uploads/profile_pictures/" + filename
+	relativePath := profilePictureDir + "/" + filename
 	_, err = config.DB.Exec("UPDATE users SET profile_picture_url = ? WHERE id = ?", relativePath, userID)
 	if err != nil {
 		http.Error(w, `{"error": "Failed to update profile picture URL"}`, http.StatusInternalServerError)
 		return
 	}
+	recordAuditEvent(r, userID, auditProfilePictureUploaded, map[string]interface{}{
+		"filename": filename,
+		"size":     handler.Size,
+	})
 
 	// Return success response with the URL
 	w.Header().Set("Content-Type", "application/json")
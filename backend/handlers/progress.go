@@ -29,14 +29,15 @@ func GetUserProgress(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Getting progress for user ID: %d", userID)
 
-	// Get all progress records for the user
+	// Get all progress records for the user, leaving out lessons that were
+	// removed from their course
 	rows, err := config.DB.Query(`
-		SELECT p.id, p.user_id, p.course_id, p.lesson_id, p.completed, p.progress, p.last_accessed,
+		SELECT p.id, p.user_id, p.course_id, p.lesson_id, p.completed, p.progress, p.last_accessed, p.course_version,
 			   c.title as course_title, l.title as lesson_title
 		FROM user_course_progress p
 		LEFT JOIN courses c ON p.course_id = c.id
-		LEFT JOIN lessons l ON p.lesson_id = l.id
-		WHERE p.user_id = ?
+		LEFT JOIN lessons l ON p.lesson_id = l.id AND l.course_id = p.course_id
+		WHERE p.user_id = ? AND (p.lesson_id IS NULL OR l.id IS NOT NULL)
 		ORDER BY p.course_id, p.lesson_id
 	`, userID)
 	if err != nil {
@@ -59,6 +60,7 @@ func GetUserProgress(w http.ResponseWriter, r *http.Request) {
 			&p.Completed,
 			&p.Progress,
 			&p.LastAccessed,
+			&p.CourseVersion,
 			&courseTitle,
 			&lessonTitle,
 		)
@@ -129,7 +131,7 @@ func UpdateUserProgress(w http.ResponseWriter, r *http.Request) {
 
 	// Verify course exists
 	var courseExists bool
-	err = config.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM courses WHERE id = ?)", progress.CourseID).Scan(&courseExists)
+	err = config.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM courses WHERE id = ? AND status = 'published')", progress.CourseID).Scan(&courseExists)
 	if err != nil {
 		log.Printf("Error checking if course exists: %v", err)
 		http.Error(w, `{"error": "Failed to verify course"}`, http.StatusInternalServerError)
@@ -174,12 +176,13 @@ func UpdateUserProgress(w http.ResponseWriter, r *http.Request) {
 	if progress.LessonID != "" {
 		log.Printf("Updating lesson progress for lesson %s", progress.LessonID)
 		_, err = tx.Exec(`
-			INSERT INTO user_course_progress (user_id, course_id, lesson_id, completed, progress, last_accessed)
-			VALUES (?, ?, ?, ?, ?, ?)
+			INSERT INTO user_course_progress (user_id, course_id, lesson_id, completed, progress, last_accessed, course_version)
+			VALUES (?, ?, ?, ?, ?, ?, (SELECT version FROM courses WHERE id = ?))
 			ON CONFLICT(user_id, course_id, lesson_id) DO UPDATE SET
 				completed = excluded.completed,
 				progress = excluded.progress,
-				last_accessed = excluded.last_accessed
+				last_accessed = excluded.last_accessed,
+				course_version = excluded.course_version
 		`,
 			userID,
 			progress.CourseID,
@@ -187,6 +190,7 @@ func UpdateUserProgress(w http.ResponseWriter, r *http.Request) {
 			progress.Completed,
 			progress.Progress,
 			time.Now().Format(time.RFC3339),
+			progress.CourseID,
 		)
 		if err != nil {
 			log.Printf("Error updating lesson progress: %v", err)
@@ -209,10 +213,12 @@ func UpdateUserProgress(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("Total lessons in course: %d", totalLessons)
 
+	// Only lessons still in the course count
 	err = tx.QueryRow(`
 		SELECT COUNT(*) FROM user_course_progress
 		WHERE user_id = ? AND course_id = ? AND completed = 1
-	`, userID, progress.CourseID).Scan(&completedLessons)
+			AND lesson_id IN (SELECT id FROM lessons WHERE course_id = ?)
+	`, userID, progress.CourseID, progress.CourseID).Scan(&completedLessons)
 	if err != nil {
 		log.Printf("Error counting completed lessons: %v", err)
 		http.Error(w, `{"error": "Failed to update progress"}`, http.StatusInternalServerError)
@@ -230,18 +236,20 @@ func UpdateUserProgress(w http.ResponseWriter, r *http.Request) {
 	// Update course progress (row with lesson_id IS NULL)
 	log.Printf("Updating course progress")
 	_, err = tx.Exec(`
-		INSERT INTO user_course_progress (user_id, course_id, lesson_id, completed, progress, last_accessed)
-		VALUES (?, ?, NULL, ?, ?, ?)
+		INSERT INTO user_course_progress (user_id, course_id, lesson_id, completed, progress, last_accessed, course_version)
+		VALUES (?, ?, NULL, ?, ?, ?, (SELECT version FROM courses WHERE id = ?))
 		ON CONFLICT(user_id, course_id, lesson_id) DO UPDATE SET
 			completed = excluded.completed,
 			progress = excluded.progress,
-			last_accessed = excluded.last_accessed
+			last_accessed = excluded.last_accessed,
+			course_version = excluded.course_version
 	`,
 		userID,
 		progress.CourseID,
 		completedLessons == totalLessons, // Course is completed if all lessons are completed
 		courseProgress,
 		time.Now().Format(time.RFC3339),
+		progress.CourseID,
 	)
 	if err != nil {
 		log.Printf("Error updating course progress: %v", err)
@@ -0,0 +1,13 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// writeJSONError sends an error response with a message that is not a fixed
+// string, escaping it so the body stays valid JSON
+func writeJSONError(w http.ResponseWriter, message string, code int) {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	http.Error(w, string(body), code)
+}
@@ -0,0 +1,709 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"defenzo/config"
+	"defenzo/content"
+	"defenzo/middleware"
+	"defenzo/models"
+
+	"github.com/gorilla/mux"
+)
+
+// CourseRevision is a version of a course, from draft through review to
+// published and later retired by the next one
+type CourseRevision struct {
+	ID          int    `json:"id"`
+	CourseID    string `json:"course_id"`
+	Version     int    `json:"version"`
+	Status      string `json:"status"`
+	BasedOn     *int   `json:"based_on"`
+	AuthorID    *int   `json:"author_id"`
+	ReviewerID  *int   `json:"reviewer_id"`
+	ReviewNote  string `json:"review_note,omitempty"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+	SubmittedAt string `json:"submitted_at,omitempty"`
+	ReviewedAt  string `json:"reviewed_at,omitempty"`
+	PublishedAt string `json:"published_at,omitempty"`
+	// Course is the content of the revision in catalog form, left out of lists
+	Course *content.Course `json:"course,omitempty"`
+}
+
+// openRevisionStatuses are the states of a revision still on its way to publication
+var openRevisionStatuses = []interface{}{models.RevisionDraft, models.RevisionInReview, models.RevisionApproved}
+
+const revisionColumns = `id, course_id, version, status, based_on, author_id, reviewer_id, review_note,
+	created_at, updated_at, submitted_at, reviewed_at, published_at, snapshot`
+
+// scanRevision reads a row of revisionColumns, with its snapshot if withCourse is set
+func scanRevision(row interface{ Scan(...interface{}) error }, withCourse bool) (*CourseRevision, error) {
+	var rev CourseRevision
+	var submittedAt, reviewedAt, publishedAt sql.NullString
+	var snapshot string
+	err := row.Scan(
+		&rev.ID, &rev.CourseID, &rev.Version, &rev.Status, &rev.BasedOn, &rev.AuthorID, &rev.ReviewerID, &rev.ReviewNote,
+		&rev.CreatedAt, &rev.UpdatedAt, &submittedAt, &reviewedAt, &publishedAt, &snapshot,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rev.SubmittedAt = submittedAt.String
+	rev.ReviewedAt = reviewedAt.String
+	rev.PublishedAt = publishedAt.String
+	if withCourse {
+		rev.Course = &content.Course{}
+		if err := json.Unmarshal([]byte(snapshot), rev.Course); err != nil {
+			return nil, fmt.Errorf("parsing revision %d of course %s: %v", rev.Version, rev.CourseID, err)
+		}
+	}
+	return &rev, nil
+}
+
+// loadRevision returns a revision with its content, errContentNotFound if
+// the course has no such version
+func loadRevision(courseID string, version int) (*CourseRevision, error) {
+	row := config.DB.QueryRow("SELECT "+revisionColumns+" FROM course_revisions WHERE course_id = ? AND version = ?", courseID, version)
+	rev, err := scanRevision(row, true)
+	if err == sql.ErrNoRows {
+		return nil, errContentNotFound
+	}
+	return rev, err
+}
+
+// revisionFromRequest loads the revision named by the route, writing the
+// error response and returning nil when it cannot
+func revisionFromRequest(w http.ResponseWriter, r *http.Request) *CourseRevision {
+	vars := mux.Vars(r)
+	version, err := strconv.Atoi(vars["version"])
+	if err != nil {
+		http.Error(w, `{"error": "Invalid version"}`, http.StatusBadRequest)
+		return nil
+	}
+	rev, err := loadRevision(vars["id"], version)
+	if err == errContentNotFound {
+		http.Error(w, `{"error": "Revision not found"}`, http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		log.Printf("Error loading revision %d of course %s: %v", version, vars["id"], err)
+		http.Error(w, `{"error": "Failed to fetch revision"}`, http.StatusInternalServerError)
+		return nil
+	}
+	return rev
+}
+
+// writeRevision responds with the current state of a revision
+func writeRevision(w http.ResponseWriter, courseID string, version, code int) {
+	rev, err := loadRevision(courseID, version)
+	if err != nil {
+		log.Printf("Error loading revision %d of course %s: %v", version, courseID, err)
+		http.Error(w, `{"error": "Failed to fetch revision"}`, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(rev)
+}
+
+// liveSnapshot returns the course as learners see it now, nil if it does not
+// exist. Its status is left out, a revision is published when it goes live.
+func liveSnapshot(courseID string) (*content.Course, error) {
+	course, err := content.Snapshot(courseID)
+	if course != nil {
+		course.Status = ""
+	}
+	return course, err
+}
+
+// encodeSnapshot stores the content of a revision as JSON
+func encodeSnapshot(course *content.Course) string {
+	data, _ := json.Marshal(course)
+	return string(data)
+}
+
+// snapshotBundle validates the content of a revision as the published course
+func snapshotBundle(course content.Course) (*content.Bundle, error) {
+	course.Status = models.CourseStatusPublished
+	bundle := &content.Bundle{Courses: []content.Course{course}, Assets: map[string][]byte{}}
+	if errs := content.Validate(bundle); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return bundle, nil
+}
+
+// planSnapshot validates the content of a revision and works out how
+// publishing it changes the course
+func planSnapshot(course content.Course) (*content.Plan, error) {
+	bundle, err := snapshotBundle(course)
+	if err != nil {
+		return nil, err
+	}
+	return content.MakePlan(bundle)
+}
+
+// planSnapshotTx is planSnapshot against the course as the transaction
+// publishing the revision sees it
+func planSnapshotTx(tx *sql.Tx, course content.Course) (*content.Plan, error) {
+	bundle, err := snapshotBundle(course)
+	if err != nil {
+		return nil, err
+	}
+	return content.MakePlanTx(tx, bundle)
+}
+
+// publishRevision makes a revision the live version of its course in the
+// transaction. The course and its lessons are replaced by the planned
+// content, learners' course progress is counted again over the new lessons,
+// and the revision that was live before is retired.
+func publishRevision(tx *sql.Tx, courseID string, version int, plan *content.Plan) error {
+	if err := content.ApplyTx(tx, plan); err != nil {
+		return err
+	}
+	if err := recountCourseProgress(tx, courseID); err != nil {
+		return err
+	}
+	now := time.Now().Format(time.RFC3339)
+	if _, err := tx.Exec(
+		"UPDATE course_revisions SET status = ?, updated_at = ? WHERE course_id = ? AND status = ?",
+		models.RevisionRetired, now, courseID, models.RevisionPublished,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"UPDATE course_revisions SET status = ?, published_at = ?, updated_at = ? WHERE course_id = ? AND version = ?",
+		models.RevisionPublished, now, now, courseID, version,
+	); err != nil {
+		return err
+	}
+	_, err := tx.Exec("UPDATE courses SET version = ? WHERE id = ?", version, courseID)
+	return err
+}
+
+// recountCourseProgress sets the course level progress of every learner of
+// a course to the share of its current lessons they completed, the way
+// UpdateUserProgress counts it
+func recountCourseProgress(tx *sql.Tx, courseID string) error {
+	var total int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM lessons WHERE course_id = ?", courseID).Scan(&total); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		WITH done AS (
+			SELECT user_id, COUNT(*) AS lessons FROM user_course_progress
+			WHERE course_id = ? AND completed = 1 AND lesson_id IN (SELECT id FROM lessons WHERE course_id = ?)
+			GROUP BY user_id
+		), counted AS (
+			SELECT p.id, COALESCE(done.lessons, 0) AS lessons
+			FROM user_course_progress p LEFT JOIN done ON done.user_id = p.user_id
+			WHERE p.course_id = ? AND p.lesson_id IS NULL
+		)
+		UPDATE user_course_progress SET
+			progress = (SELECT CAST(ROUND(100.0 * lessons / MAX(?, 1)) AS INTEGER) FROM counted WHERE counted.id = user_course_progress.id),
+			completed = (SELECT lessons = ? FROM counted WHERE counted.id = user_course_progress.id)
+		WHERE id IN (SELECT id FROM counted)`,
+		courseID, courseID, courseID, total, total,
+	)
+	return err
+}
+
+// ListCourseRevisions returns the revisions of a course, newest first,
+// without their content (instructors and admins)
+func ListCourseRevisions(w http.ResponseWriter, r *http.Request) {
+	courseID := mux.Vars(r)["id"]
+
+	if exists, err := contentIDTaken("courses", courseID); err != nil {
+		log.Printf("Error checking course: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	} else if !exists {
+		http.Error(w, `{"error": "Course not found"}`, http.StatusNotFound)
+		return
+	}
+
+	rows, err := config.DB.Query("SELECT "+revisionColumns+" FROM course_revisions WHERE course_id = ? ORDER BY version DESC", courseID)
+	if err != nil {
+		log.Printf("Database error while listing revisions: %v", err)
+		http.Error(w, `{"error": "Failed to fetch revisions"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	revisions := []CourseRevision{}
+	for rows.Next() {
+		rev, err := scanRevision(rows, false)
+		if err != nil {
+			log.Printf("Error scanning revision: %v", err)
+			http.Error(w, `{"error": "Failed to fetch revisions"}`, http.StatusInternalServerError)
+			return
+		}
+		revisions = append(revisions, *rev)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// CreateCourseRevision starts a draft of the next version of a course
+// (instructors and admins). It is a copy of the live course, or of the
+// version named by from, and is based on the live version either way: that
+// is the version it replaces. A course has one revision in progress at a time.
+//
+// The first revision of a course that is already published also records
+// the published content as version 1, so it can be rolled back to.
+func CreateCourseRevision(w http.ResponseWriter, r *http.Request) {
+	courseID := mux.Vars(r)["id"]
+	userID, _ := middleware.GetUserID(r)
+	log.Printf("Handling create revision request for course %s", courseID)
+
+	var req struct {
+		From int `json:"from"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	live, err := liveSnapshot(courseID)
+	if err != nil {
+		log.Printf("Error loading course %s: %v", courseID, err)
+		http.Error(w, `{"error": "Failed to fetch course"}`, http.StatusInternalServerError)
+		return
+	} else if live == nil {
+		http.Error(w, `{"error": "Course not found"}`, http.StatusNotFound)
+		return
+	}
+
+	snapshot := live
+	if req.From != 0 {
+		from, err := loadRevision(courseID, req.From)
+		if err == errContentNotFound {
+			http.Error(w, `{"error": "Revision to start from not found"}`, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf("Error loading revision %d of course %s: %v", req.From, courseID, err)
+			http.Error(w, `{"error": "Failed to fetch revision"}`, http.StatusInternalServerError)
+			return
+		}
+		snapshot = from.Course
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var open int
+	err = tx.QueryRow(
+		"SELECT version FROM course_revisions WHERE course_id = ? AND status IN (?, ?, ?)",
+		append([]interface{}{courseID}, openRevisionStatuses...)...,
+	).Scan(&open)
+	if err == nil {
+		writeJSONError(w, fmt.Sprintf("Revision %d of the course is still in progress", open), http.StatusConflict)
+		return
+	} else if err != sql.ErrNoRows {
+		log.Printf("Error checking open revisions: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var latest, liveVersion int
+	var status string
+	if err := tx.QueryRow(
+		"SELECT (SELECT COALESCE(MAX(version), 0) FROM course_revisions WHERE course_id = ?), version, status FROM courses WHERE id = ?",
+		courseID, courseID,
+	).Scan(&latest, &liveVersion, &status); err != nil {
+		log.Printf("Error reading course versions: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	if latest == 0 && status == models.CourseStatusPublished {
+		// Keep what learners see now as the first version
+		latest, liveVersion = 1, 1
+		if _, err := tx.Exec(
+			`INSERT INTO course_revisions (course_id, version, status, snapshot, created_at, updated_at, published_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			courseID, latest, models.RevisionPublished, encodeSnapshot(live), now, now, now,
+		); err != nil {
+			log.Printf("Error recording the published version: %v", err)
+			http.Error(w, `{"error": "Failed to create revision"}`, http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec("UPDATE courses SET version = ? WHERE id = ?", liveVersion, courseID); err != nil {
+			log.Printf("Error setting course version: %v", err)
+			http.Error(w, `{"error": "Failed to create revision"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// The revision replaces the live version, whichever it started from
+	basedOn := liveVersion
+	version := latest + 1
+	if _, err := tx.Exec(
+		`INSERT INTO course_revisions (course_id, version, status, snapshot, based_on, author_id, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		courseID, version, models.RevisionDraft, encodeSnapshot(snapshot), nullableID(basedOn), nullableID(userID), now, now,
+	); err != nil {
+		log.Printf("Error creating revision: %v", err)
+		http.Error(w, `{"error": "Failed to create revision"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing revision: %v", err)
+		http.Error(w, `{"error": "Failed to create revision"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Created revision %d of course %s", version, courseID)
+	writeRevision(w, courseID, version, http.StatusCreated)
+}
+
+// GetCourseRevision returns a revision with its content (instructors and admins)
+func GetCourseRevision(w http.ResponseWriter, r *http.Request) {
+	rev := revisionFromRequest(w, r)
+	if rev == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rev)
+}
+
+// UpdateCourseRevision replaces the content of a draft revision
+// (instructors and admins). The body is the whole course in catalog form,
+// as exported by the content command, with lesson IDs local to the course.
+func UpdateCourseRevision(w http.ResponseWriter, r *http.Request) {
+	rev := revisionFromRequest(w, r)
+	if rev == nil {
+		return
+	}
+	if rev.Status != models.RevisionDraft {
+		http.Error(w, `{"error": "Only a draft revision can be edited"}`, http.StatusConflict)
+		return
+	}
+
+	var course content.Course
+	if err := json.NewDecoder(r.Body).Decode(&course); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if course.ID == "" {
+		course.ID = rev.CourseID
+	} else if course.ID != rev.CourseID {
+		http.Error(w, `{"error": "The id of a course cannot be changed"}`, http.StatusBadRequest)
+		return
+	}
+	course.Status = ""
+	if course.Lessons == nil {
+		course.Lessons = []content.Lesson{}
+	}
+
+	// Check now what would otherwise only fail when the revision is published
+	if _, err := planSnapshot(course); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := config.DB.Exec(
+		"UPDATE course_revisions SET snapshot = ?, updated_at = ? WHERE id = ? AND status = ?",
+		encodeSnapshot(&course), time.Now().Format(time.RFC3339), rev.ID, models.RevisionDraft,
+	); err != nil {
+		log.Printf("Error updating revision: %v", err)
+		http.Error(w, `{"error": "Failed to update revision"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Updated revision %d of course %s", rev.Version, rev.CourseID)
+	writeRevision(w, rev.CourseID, rev.Version, http.StatusOK)
+}
+
+// SubmitCourseRevision sends a draft revision for review (instructors and admins)
+func SubmitCourseRevision(w http.ResponseWriter, r *http.Request) {
+	rev := revisionFromRequest(w, r)
+	if rev == nil {
+		return
+	}
+	if rev.Status != models.RevisionDraft {
+		http.Error(w, `{"error": "Only a draft revision can be submitted"}`, http.StatusConflict)
+		return
+	}
+	if _, err := planSnapshot(*rev.Course); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	if _, err := config.DB.Exec(
+		"UPDATE course_revisions SET status = ?, submitted_at = ?, updated_at = ? WHERE id = ?",
+		models.RevisionInReview, now, now, rev.ID,
+	); err != nil {
+		log.Printf("Error submitting revision: %v", err)
+		http.Error(w, `{"error": "Failed to submit revision"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Submitted revision %d of course %s for review", rev.Version, rev.CourseID)
+	writeRevision(w, rev.CourseID, rev.Version, http.StatusOK)
+}
+
+// ReviewCourseRevision approves a revision in review, or sends it back to
+// draft with a note on what to change (admin only). Nobody reviews their
+// own revision.
+func ReviewCourseRevision(w http.ResponseWriter, r *http.Request) {
+	userID, _ := middleware.GetUserID(r)
+	rev := revisionFromRequest(w, r)
+	if rev == nil {
+		return
+	}
+
+	var req struct {
+		Approve bool   `json:"approve"`
+		Note    string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if rev.Status != models.RevisionInReview {
+		http.Error(w, `{"error": "The revision is not in review"}`, http.StatusConflict)
+		return
+	}
+	if rev.AuthorID != nil && *rev.AuthorID == userID {
+		http.Error(w, `{"error": "A revision cannot be reviewed by its author"}`, http.StatusForbidden)
+		return
+	}
+
+	status := models.RevisionDraft
+	if req.Approve {
+		status = models.RevisionApproved
+	}
+	now := time.Now().Format(time.RFC3339)
+	if _, err := config.DB.Exec(
+		"UPDATE course_revisions SET status = ?, reviewer_id = ?, review_note = ?, reviewed_at = ?, updated_at = ? WHERE id = ?",
+		status, userID, req.Note, now, now, rev.ID,
+	); err != nil {
+		log.Printf("Error reviewing revision: %v", err)
+		http.Error(w, `{"error": "Failed to review revision"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Revision %d of course %s reviewed: %s", rev.Version, rev.CourseID, status)
+	writeRevision(w, rev.CourseID, rev.Version, http.StatusOK)
+}
+
+// PublishCourseRevision makes an approved revision the live version of its
+// course (admin only). The course and its lessons are replaced in one
+// transaction, so learners see either the old version or the new one.
+//
+// A revision only replaces the version it was started from. If another one
+// went live since, such as a rollback, the revision goes back to draft on
+// top of the live version, for its author to check, and 409 is returned.
+func PublishCourseRevision(w http.ResponseWriter, r *http.Request) {
+	rev := revisionFromRequest(w, r)
+	if rev == nil {
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var status string
+	var basedOn sql.NullInt64
+	var liveVersion int
+	if err := tx.QueryRow(
+		"SELECT r.status, r.based_on, c.version FROM course_revisions r JOIN courses c ON c.id = r.course_id WHERE r.id = ?",
+		rev.ID,
+	).Scan(&status, &basedOn, &liveVersion); err != nil {
+		log.Printf("Error reading revision %d of course %s: %v", rev.Version, rev.CourseID, err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if status != models.RevisionApproved {
+		http.Error(w, `{"error": "Only an approved revision can be published"}`, http.StatusConflict)
+		return
+	}
+	if int(basedOn.Int64) != liveVersion {
+		note := fmt.Sprintf("Version %d went live after this revision was started, check the changes against it", liveVersion)
+		if _, err := tx.Exec(
+			"UPDATE course_revisions SET status = ?, based_on = ?, review_note = ?, updated_at = ? WHERE id = ?",
+			models.RevisionDraft, nullableID(liveVersion), note, time.Now().Format(time.RFC3339), rev.ID,
+		); err != nil {
+			log.Printf("Error sending revision back to draft: %v", err)
+			http.Error(w, `{"error": "Failed to publish revision"}`, http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing revision: %v", err)
+			http.Error(w, `{"error": "Failed to publish revision"}`, http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Revision %d of course %s is out of date, sent back to draft", rev.Version, rev.CourseID)
+		writeJSONError(w, note, http.StatusConflict)
+		return
+	}
+
+	plan, err := planSnapshotTx(tx, *rev.Course)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := publishRevision(tx, rev.CourseID, rev.Version, plan); err != nil {
+		log.Printf("Error publishing revision %d of course %s: %v", rev.Version, rev.CourseID, err)
+		http.Error(w, `{"error": "Failed to publish revision"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing publication: %v", err)
+		http.Error(w, `{"error": "Failed to publish revision"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Published revision %d of course %s", rev.Version, rev.CourseID)
+	writeRevision(w, rev.CourseID, rev.Version, http.StatusOK)
+}
+
+// DiffCourseRevision lists what a revision changes compared to the live
+// course, or to the version given by against (admin only)
+func DiffCourseRevision(w http.ResponseWriter, r *http.Request) {
+	rev := revisionFromRequest(w, r)
+	if rev == nil {
+		return
+	}
+
+	var base *content.Course
+	against := 0
+	if value := r.URL.Query().Get("against"); value != "" {
+		var err error
+		if against, err = strconv.Atoi(value); err != nil || against < 1 {
+			http.Error(w, `{"error": "Invalid against"}`, http.StatusBadRequest)
+			return
+		}
+		other, err := loadRevision(rev.CourseID, against)
+		if err == errContentNotFound {
+			http.Error(w, `{"error": "Revision to compare with not found"}`, http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Error loading revision %d of course %s: %v", against, rev.CourseID, err)
+			http.Error(w, `{"error": "Failed to fetch revision"}`, http.StatusInternalServerError)
+			return
+		}
+		base = other.Course
+	} else {
+		live, err := liveSnapshot(rev.CourseID)
+		if err != nil || live == nil {
+			log.Printf("Error loading course %s: %v", rev.CourseID, err)
+			http.Error(w, `{"error": "Failed to fetch course"}`, http.StatusInternalServerError)
+			return
+		}
+		base = live
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version": rev.Version,
+		// against is 0 for the live course
+		"against": against,
+		"changes": content.Diff(base, rev.Course),
+	})
+}
+
+// RollbackCourse puts an earlier version of a course live again (admin
+// only). The content of that version becomes a new published revision, so
+// the history only ever grows. Revisions in progress are left alone.
+func RollbackCourse(w http.ResponseWriter, r *http.Request) {
+	courseID := mux.Vars(r)["id"]
+	userID, _ := middleware.GetUserID(r)
+	log.Printf("Handling rollback request for course %s", courseID)
+
+	var req struct {
+		Version int `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Version < 1 {
+		http.Error(w, `{"error": "version is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	target, err := loadRevision(courseID, req.Version)
+	if err == errContentNotFound {
+		http.Error(w, `{"error": "Revision not found"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error loading revision %d of course %s: %v", req.Version, courseID, err)
+		http.Error(w, `{"error": "Failed to fetch revision"}`, http.StatusInternalServerError)
+		return
+	}
+	switch target.Status {
+	case models.RevisionPublished:
+		http.Error(w, `{"error": "This version is already live"}`, http.StatusConflict)
+		return
+	case models.RevisionRetired:
+	default:
+		http.Error(w, `{"error": "Only a version that was published can be rolled back to"}`, http.StatusConflict)
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	plan, err := planSnapshotTx(tx, *target.Course)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	var version, liveVersion int
+	if err := tx.QueryRow(
+		"SELECT (SELECT COALESCE(MAX(version), 0) + 1 FROM course_revisions WHERE course_id = ?), version FROM courses WHERE id = ?",
+		courseID, courseID,
+	).Scan(&version, &liveVersion); err != nil {
+		log.Printf("Error reading course versions: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().Format(time.RFC3339)
+	if _, err := tx.Exec(
+		`INSERT INTO course_revisions (course_id, version, status, snapshot, based_on, author_id, reviewer_id, review_note,
+			created_at, updated_at, reviewed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		courseID, version, models.RevisionApproved, encodeSnapshot(target.Course), nullableID(liveVersion), nullableID(userID),
+		nullableID(userID), fmt.Sprintf("Rollback to version %d", req.Version), now, now, now,
+	); err != nil {
+		log.Printf("Error creating rollback revision: %v", err)
+		http.Error(w, `{"error": "Failed to roll back"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := publishRevision(tx, courseID, version, plan); err != nil {
+		log.Printf("Error publishing rollback of course %s: %v", courseID, err)
+		http.Error(w, `{"error": "Failed to roll back"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing rollback: %v", err)
+		http.Error(w, `{"error": "Failed to roll back"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Rolled course %s back to version %d as version %d", courseID, req.Version, version)
+	writeRevision(w, courseID, version, http.StatusCreated)
+}
@@ -0,0 +1,364 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"defenzo/config"
+	"defenzo/content"
+	"defenzo/middleware"
+	"defenzo/models"
+	"defenzo/repository"
+
+	"github.com/gorilla/mux"
+)
+
+// callRevisionHandler sends a JSON body to a handler of a course revision
+// route, signed in as the user
+func callRevisionHandler(t *testing.T, handler http.HandlerFunc, userID int, vars map[string]string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(data))
+	r.Header.Set("Authorization", "Bearer "+signIn(t, userID))
+	r = mux.SetURLVars(r, vars)
+	w := httptest.NewRecorder()
+	middleware.AuthMiddleware(handler)(w, r)
+	return w
+}
+
+// publishCourse creates a published course with lessons of the given local IDs
+func publishCourse(t *testing.T, courseID string, lessonIDs ...string) content.Course {
+	t.Helper()
+	course := content.Course{ID: courseID, Title: "Course " + courseID, Tags: []string{}, Lessons: []content.Lesson{}}
+	for _, id := range lessonIDs {
+		course.Lessons = append(course.Lessons, content.Lesson{ID: id, Title: "Lesson " + id, Type: models.LessonTypeCards})
+	}
+	bundle := &content.Bundle{Courses: []content.Course{course}, Assets: map[string][]byte{}}
+	if errs := content.Validate(bundle); len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	plan, err := content.MakePlan(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := content.Apply(plan); err != nil {
+		t.Fatal(err)
+	}
+	return course
+}
+
+// publishChange takes a course through a revision with the change made to
+// its content, from draft to published, and returns the new version
+func publishChange(t *testing.T, courseID string, author, reviewer int, change func(course *content.Course)) int {
+	t.Helper()
+	w := callRevisionHandler(t, CreateCourseRevision, author, map[string]string{"id": courseID}, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create revision returned %d: %s", w.Code, w.Body)
+	}
+	var rev CourseRevision
+	if err := json.NewDecoder(w.Body).Decode(&rev); err != nil {
+		t.Fatal(err)
+	}
+	change(rev.Course)
+
+	vars := map[string]string{"id": courseID, "version": fmt.Sprint(rev.Version)}
+	steps := []struct {
+		handler http.HandlerFunc
+		user    int
+		body    interface{}
+	}{
+		{UpdateCourseRevision, author, rev.Course},
+		{SubmitCourseRevision, author, nil},
+		{ReviewCourseRevision, reviewer, map[string]bool{"approve": true}},
+		{PublishCourseRevision, reviewer, nil},
+	}
+	for i, step := range steps {
+		if w := callRevisionHandler(t, step.handler, step.user, vars, step.body); w.Code != http.StatusOK {
+			t.Fatalf("step %d of revision %d returned %d: %s", i+1, rev.Version, w.Code, w.Body)
+		}
+	}
+	return rev.Version
+}
+
+// completeLesson records that the user finished a lesson
+func completeLesson(t *testing.T, userID int, courseID, lessonID string) {
+	t.Helper()
+	body := map[string]interface{}{"course_id": courseID, "lesson_id": lessonID, "completed": true, "progress": 100}
+	if w := callHandler(t, UpdateUserProgress, signIn(t, userID), body); w.Code != http.StatusOK {
+		t.Fatalf("progress update returned %d: %s", w.Code, w.Body)
+	}
+}
+
+// courseProgress returns the learner's progress in the course
+func courseProgress(t *testing.T, courseID string, userID int) int {
+	t.Helper()
+	course, err := repository.GetCourse(courseID, userID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return course.Progress
+}
+
+// completedLessons lists the lessons of the course as the learner sees them,
+// with whether each is completed
+func completedLessons(t *testing.T, courseID string, userID int) map[string]bool {
+	t.Helper()
+	course, err := repository.GetCourse(courseID, userID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lessons := map[string]bool{}
+	for _, lesson := range course.Lessons {
+		lessons[lesson.ID] = lesson.Completed
+	}
+	return lessons
+}
+
+func TestRemovedLessonKeepsProgress(t *testing.T) {
+	author := createTestUser(t, "retire-author@example.com", "")
+	admin := createTestUser(t, "retire-admin@example.com", "")
+	learner := createTestUser(t, "retire-learner@example.com", "")
+	publishCourse(t, "retire", "intro", "outro")
+	completeLesson(t, learner, "retire", "retire-intro")
+
+	publishChange(t, "retire", author, admin, func(course *content.Course) {
+		course.Lessons = course.Lessons[1:]
+	})
+	if lessons := completedLessons(t, "retire", learner); len(lessons) != 1 || lessons["retire-outro"] {
+		t.Fatalf("lessons after the removal = %v, want retire-outro not completed", lessons)
+	}
+	var kept int
+	if err := config.DB.QueryRow(
+		"SELECT COUNT(*) FROM user_course_progress WHERE user_id = ? AND lesson_id = 'retire-intro' AND completed = 1", learner,
+	).Scan(&kept); err != nil {
+		t.Fatal(err)
+	}
+	if kept != 1 {
+		t.Fatal("the progress in the removed lesson was deleted")
+	}
+
+	// The lesson is no longer part of the course for the learner's progress
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+signIn(t, learner))
+	w := httptest.NewRecorder()
+	middleware.AuthMiddleware(GetUserProgress)(w, r)
+	var progress []models.UserProgress
+	if err := json.NewDecoder(w.Body).Decode(&progress); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range progress {
+		if p.LessonID == "retire-intro" {
+			t.Fatalf("progress lists the removed lesson: %+v", p)
+		}
+	}
+
+	// Rolling back brings the lesson back with the learner's completion
+	body := map[string]int{"version": 1}
+	if w := callRevisionHandler(t, RollbackCourse, admin, map[string]string{"id": "retire"}, body); w.Code != http.StatusCreated {
+		t.Fatalf("rollback returned %d: %s", w.Code, w.Body)
+	}
+	if lessons := completedLessons(t, "retire", learner); len(lessons) != 2 || !lessons["retire-intro"] || lessons["retire-outro"] {
+		t.Fatalf("lessons after the rollback = %v, want retire-intro completed", lessons)
+	}
+}
+
+func TestPublishRecountsCourseProgress(t *testing.T) {
+	author := createTestUser(t, "recount-author@example.com", "")
+	admin := createTestUser(t, "recount-admin@example.com", "")
+	learner := createTestUser(t, "recount-learner@example.com", "")
+	idle := createTestUser(t, "recount-idle@example.com", "")
+	publishCourse(t, "recount", "one", "two")
+	completeLesson(t, learner, "recount", "recount-one")
+	if _, err := config.DB.Exec(
+		"INSERT INTO user_course_progress (user_id, course_id, completed, progress, last_accessed) VALUES (?, 'recount', 0, 0, datetime('now'))", idle,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if got := courseProgress(t, "recount", learner); got != 50 {
+		t.Fatalf("progress = %d%%, want 50%%", got)
+	}
+
+	// Dropping the completed lesson leaves nothing done
+	publishChange(t, "recount", author, admin, func(course *content.Course) {
+		course.Lessons = course.Lessons[1:]
+	})
+	if got := courseProgress(t, "recount", learner); got != 0 {
+		t.Fatalf("progress after the removal = %d%%, want 0%%", got)
+	}
+
+	// A new lesson next to the completed one takes it to a third
+	publishChange(t, "recount", author, admin, func(course *content.Course) {
+		course.Lessons = []content.Lesson{
+			{ID: "one", Title: "Lesson one", Type: models.LessonTypeCards},
+			{ID: "two", Title: "Lesson two", Type: models.LessonTypeCards},
+			{ID: "three", Title: "Lesson three", Type: models.LessonTypeCards},
+		}
+	})
+	if got := courseProgress(t, "recount", learner); got != 33 {
+		t.Fatalf("progress with a lesson added = %d%%, want 33%%", got)
+	}
+
+	// Back to the first version, one of two lessons is done again
+	body := map[string]int{"version": 1}
+	if w := callRevisionHandler(t, RollbackCourse, admin, map[string]string{"id": "recount"}, body); w.Code != http.StatusCreated {
+		t.Fatalf("rollback returned %d: %s", w.Code, w.Body)
+	}
+	if got := courseProgress(t, "recount", learner); got != 50 {
+		t.Fatalf("progress after the rollback = %d%%, want 50%%", got)
+	}
+	if got := courseProgress(t, "recount", idle); got != 0 {
+		t.Fatalf("progress of a learner with nothing done = %d%%, want 0%%", got)
+	}
+}
+
+func TestImportRefusesPublishedCourse(t *testing.T) {
+	course := publishCourse(t, "frozen", "one")
+	plan := func(course content.Course) *content.Plan {
+		t.Helper()
+		bundle := &content.Bundle{Courses: []content.Course{course}, Assets: map[string][]byte{}}
+		if errs := content.Validate(bundle); len(errs) > 0 {
+			t.Fatal(errs[0])
+		}
+		plan, err := content.MakePlan(bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return plan
+	}
+
+	// Importing the catalog it came from again changes nothing
+	if err := content.Apply(plan(course)); err != nil {
+		t.Fatalf("unchanged import of a published course: %v", err)
+	}
+
+	course.Title = "Edited in place"
+	changed := plan(course)
+	if len(changed.Published) != 1 || changed.Published[0] != "frozen" {
+		t.Fatalf("Published = %v, want [frozen]", changed.Published)
+	}
+	if err := content.Apply(changed); err == nil {
+		t.Fatal("import changed a published course")
+	}
+	if live, err := content.Snapshot("frozen"); err != nil || live.Title != "Course frozen" {
+		t.Fatalf("live course = %+v, %v", live, err)
+	}
+
+	// Drafts are still imported
+	course.Status = models.CourseStatusDraft
+	if _, err := config.DB.Exec("UPDATE courses SET status = ? WHERE id = 'frozen'", models.CourseStatusDraft); err != nil {
+		t.Fatal(err)
+	}
+	if err := content.Apply(plan(course)); err != nil {
+		t.Fatalf("import of a draft: %v", err)
+	}
+}
+
+func TestCoursesArePublishedThroughRevisions(t *testing.T) {
+	author := createTestUser(t, "status-author@example.com", "")
+	admin := createTestUser(t, "status-admin@example.com", "")
+	status := func() string {
+		t.Helper()
+		var status string
+		if err := config.DB.QueryRow("SELECT status FROM courses WHERE id = 'status'").Scan(&status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+	course := map[string]interface{}{"id": "status", "title": "Status", "tags": []string{"one"}, "status": models.CourseStatusPublished}
+	if w := callRevisionHandler(t, CreateCourse, admin, nil, course); w.Code != http.StatusBadRequest {
+		t.Fatalf("creating a published course returned %d, want 400", w.Code)
+	}
+	delete(course, "status")
+	if w := callRevisionHandler(t, CreateCourse, admin, nil, course); w.Code != http.StatusCreated {
+		t.Fatalf("create course returned %d: %s", w.Code, w.Body)
+	}
+
+	vars := map[string]string{"id": "status"}
+	course["status"] = models.CourseStatusPublished
+	if w := callRevisionHandler(t, UpdateCourse, admin, vars, course); w.Code != http.StatusBadRequest {
+		t.Fatalf("publishing through an update returned %d, want 400", w.Code)
+	}
+	if got := status(); got != models.CourseStatusDraft {
+		t.Fatalf("status = %s, want draft", got)
+	}
+
+	publishChange(t, "status", author, admin, func(course *content.Course) {})
+	if got := status(); got != models.CourseStatusPublished {
+		t.Fatalf("status after the revision = %s, want published", got)
+	}
+
+	// Unpublishing cannot carry an edit of the published course
+	course["status"] = models.CourseStatusDraft
+	course["title"] = "Edited while unpublishing"
+	if w := callRevisionHandler(t, UpdateCourse, admin, vars, course); w.Code != http.StatusBadRequest {
+		t.Fatalf("unpublishing with an edit returned %d, want 400", w.Code)
+	}
+	course["title"] = "Status"
+	if w := callRevisionHandler(t, UpdateCourse, admin, vars, course); w.Code != http.StatusOK {
+		t.Fatalf("unpublishing returned %d: %s", w.Code, w.Body)
+	}
+	if got := status(); got != models.CourseStatusDraft {
+		t.Fatalf("status after unpublishing = %s, want draft", got)
+	}
+}
+
+func TestPublishRefusesOutdatedRevision(t *testing.T) {
+	author := createTestUser(t, "outdated-author@example.com", "")
+	admin := createTestUser(t, "outdated-admin@example.com", "")
+	publishCourse(t, "outdated", "one")
+	publishChange(t, "outdated", author, admin, func(course *content.Course) {
+		course.Title = "Second"
+	})
+
+	w := callRevisionHandler(t, CreateCourseRevision, author, map[string]string{"id": "outdated"}, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create revision returned %d: %s", w.Code, w.Body)
+	}
+	var rev CourseRevision
+	if err := json.NewDecoder(w.Body).Decode(&rev); err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{"id": "outdated", "version": fmt.Sprint(rev.Version)}
+	review := func() {
+		t.Helper()
+		if w := callRevisionHandler(t, SubmitCourseRevision, author, vars, nil); w.Code != http.StatusOK {
+			t.Fatalf("submit returned %d: %s", w.Code, w.Body)
+		}
+		if w := callRevisionHandler(t, ReviewCourseRevision, admin, vars, map[string]bool{"approve": true}); w.Code != http.StatusOK {
+			t.Fatalf("review returned %d: %s", w.Code, w.Body)
+		}
+	}
+	review()
+
+	// A rollback goes live while the revision waits
+	body := map[string]int{"version": 1}
+	if w := callRevisionHandler(t, RollbackCourse, admin, map[string]string{"id": "outdated"}, body); w.Code != http.StatusCreated {
+		t.Fatalf("rollback returned %d: %s", w.Code, w.Body)
+	}
+	if w := callRevisionHandler(t, PublishCourseRevision, admin, vars, nil); w.Code != http.StatusConflict {
+		t.Fatalf("publishing an outdated revision returned %d, want 409", w.Code)
+	}
+	if live, err := content.Snapshot("outdated"); err != nil || live.Title != "Course outdated" {
+		t.Fatalf("live course = %+v, %v, want the rolled back version", live, err)
+	}
+	outdated, err := loadRevision("outdated", rev.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outdated.Status != models.RevisionDraft || outdated.BasedOn == nil || *outdated.BasedOn != rev.Version+1 {
+		t.Fatalf("outdated revision = %s based on %v, want a draft based on %d", outdated.Status, outdated.BasedOn, rev.Version+1)
+	}
+
+	// Once checked again, it goes live
+	review()
+	if w := callRevisionHandler(t, PublishCourseRevision, admin, vars, nil); w.Code != http.StatusOK {
+		t.Fatalf("publish after another review returned %d: %s", w.Code, w.Body)
+	}
+}
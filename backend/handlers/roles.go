@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"defenzo/config"
+	"defenzo/middleware"
+	"defenzo/models"
+
+	"github.com/gorilla/mux"
+)
+
+// loadUserRoles returns the roles a user holds, every user is at least a learner
+func loadUserRoles(userID int) ([]string, error) {
+	rows, err := config.DB.Query("SELECT role FROM user_roles WHERE user_id = ? ORDER BY role", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	hasLearner := false
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		if role == models.RoleLearner {
+			hasLearner = true
+		}
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if !hasLearner {
+		roles = append(roles, models.RoleLearner)
+	}
+	return roles, nil
+}
+
+// grantDefaultRole gives a newly created user the learner role
+func grantDefaultRole(userID int) error {
+	_, err := config.DB.Exec(
+		"INSERT OR IGNORE INTO user_roles (user_id, role, granted_at) VALUES (?, ?, ?)",
+		userID, models.RoleLearner, time.Now().Format(time.RFC3339),
+	)
+	return err
+}
+
+// isValidRole reports whether the role exists in the roles table
+func isValidRole(role string) (bool, error) {
+	var exists bool
+	err := config.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM roles WHERE name = ?)", role).Scan(&exists)
+	return exists, err
+}
+
+// ListUsers returns all users with their roles (admin only)
+func ListUsers(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling list users request")
+
+	rows, err := config.DB.Query(`
+		SELECT id, email, full_name, profile_picture_url, email_verified_at, created_at
+		FROM users
+		ORDER BY id
+	`)
+	if err != nil {
+		log.Printf("Database error while listing users: %v", err)
+		http.Error(w, `{"error": "Failed to fetch users"}`, http.StatusInternalServerError)
+		return
+	}
+
+	users := []models.User{}
+	for rows.Next() {
+		var user models.User
+		var fullName, profilePictureURL, emailVerifiedAt sql.NullString
+		if err := rows.Scan(&user.ID, &user.Email, &fullName, &profilePictureURL, &emailVerifiedAt, &user.CreatedAt); err != nil {
+			rows.Close()
+			log.Printf("Error scanning user row: %v", err)
+			http.Error(w, `{"error": "Failed to scan user data"}`, http.StatusInternalServerError)
+			return
+		}
+		user.FullName = fullName.String
+		user.ProfilePictureURL = profilePictureURL.String
+		user.EmailVerified = emailVerifiedAt.Valid
+		users = append(users, user)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating user rows: %v", err)
+		http.Error(w, `{"error": "Failed to fetch users"}`, http.StatusInternalServerError)
+		return
+	}
+
+	for i := range users {
+		roles, err := loadUserRoles(users[i].ID)
+		if err != nil {
+			log.Printf("Error loading roles for user %d: %v", users[i].ID, err)
+			http.Error(w, `{"error": "Failed to fetch roles"}`, http.StatusInternalServerError)
+			return
+		}
+		users[i].Roles = roles
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// GetUserRoles returns the roles of a user (admin only)
+func GetUserRoles(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error": "Invalid user ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	if err := config.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists); err != nil {
+		log.Printf("Error checking user: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	roles, err := loadUserRoles(userID)
+	if err != nil {
+		log.Printf("Error loading roles for user %d: %v", userID, err)
+		http.Error(w, `{"error": "Failed to fetch roles"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id": userID,
+		"roles":   roles,
+	})
+}
+
+// SetUserRoles replaces the roles of a user (admin only). The user's access
+// tokens stop working at once, so the roles in them are never out of date:
+// the app refreshes and gets the new ones.
+func SetUserRoles(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling set user roles request")
+	adminID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error": "Invalid user ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Roles []string `json:"roles"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	// Learner is implicit, so always keep it
+	roles := map[string]bool{models.RoleLearner: true}
+	for _, role := range req.Roles {
+		valid, err := isValidRole(role)
+		if err != nil {
+			log.Printf("Error checking role: %v", err)
+			http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+			return
+		}
+		if !valid {
+			http.Error(w, `{"error": "Unknown role"}`, http.StatusBadRequest)
+			return
+		}
+		roles[role] = true
+	}
+
+	var exists bool
+	if err := config.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists); err != nil {
+		log.Printf("Error checking user: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, `{"error": "Failed to update roles"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM user_roles WHERE user_id = ?", userID); err != nil {
+		log.Printf("Error clearing roles: %v", err)
+		http.Error(w, `{"error": "Failed to update roles"}`, http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().Format(time.RFC3339)
+	for role := range roles {
+		_, err := tx.Exec(
+			"INSERT INTO user_roles (user_id, role, granted_at, granted_by) VALUES (?, ?, ?, ?)",
+			userID, role, now, adminID,
+		)
+		if err != nil {
+			log.Printf("Error granting role %s: %v", role, err)
+			http.Error(w, `{"error": "Failed to update roles"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Never leave the platform without an admin
+	var admins int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM user_roles WHERE role = ?", models.RoleAdmin).Scan(&admins); err != nil {
+		log.Printf("Error counting admins: %v", err)
+		http.Error(w, `{"error": "Failed to update roles"}`, http.StatusInternalServerError)
+		return
+	}
+	if admins == 0 {
+		http.Error(w, `{"error": "Cannot remove the last admin"}`, http.StatusConflict)
+		return
+	}
+
+	// Access tokens carry the roles, expire them all, including those issued
+	// within the current second
+	if _, err := tx.Exec("UPDATE users SET tokens_valid_after = ? WHERE id = ?", time.Now().Unix()+1, userID); err != nil {
+		log.Printf("Error expiring access tokens: %v", err)
+		http.Error(w, `{"error": "Failed to update roles"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		http.Error(w, `{"error": "Failed to update roles"}`, http.StatusInternalServerError)
+		return
+	}
+
+	updated, err := loadUserRoles(userID)
+	if err != nil {
+		log.Printf("Error loading roles for user %d: %v", userID, err)
+		http.Error(w, `{"error": "Failed to fetch roles"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Admin %d set roles of user %d to %v", adminID, userID, updated)
+	recordAuditEvent(r, userID, auditRolesChanged, map[string]interface{}{"roles": updated})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id": userID,
+		"roles":   updated,
+	})
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"defenzo/config"
+	"defenzo/middleware"
+	"defenzo/models"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSetUserRolesExpiresAccessTokens(t *testing.T) {
+	admin := createTestUser(t, "roles-admin@example.com", "")
+	demoted := createTestUser(t, "roles-demoted@example.com", "")
+	for _, userID := range []int{admin, demoted} {
+		if _, err := config.DB.Exec(
+			"INSERT INTO user_roles (user_id, role, granted_at) VALUES (?, ?, datetime('now'))", userID, models.RoleAdmin,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	adminOnly := func(accessToken string) int {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+accessToken)
+		w := httptest.NewRecorder()
+		handler := middleware.RequireRole(models.RoleAdmin)(func(w http.ResponseWriter, r *http.Request) {})
+		middleware.AuthMiddleware(handler)(w, r)
+		return w.Code
+	}
+
+	oldToken := signIn(t, demoted)
+	if code := adminOnly(oldToken); code != http.StatusOK {
+		t.Fatalf("admin route returned %d before the change, want 200", code)
+	}
+
+	r := httptest.NewRequest("PUT", "/", strings.NewReader(`{"roles": []}`))
+	r.Header.Set("Authorization", "Bearer "+signIn(t, admin))
+	r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(demoted)})
+	w := httptest.NewRecorder()
+	middleware.AuthMiddleware(SetUserRoles)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("set roles returned %d: %s", w.Code, w.Body)
+	}
+	if code := adminOnly(oldToken); code != http.StatusUnauthorized {
+		t.Fatalf("admin route with a token from before the change returned %d, want 401", code)
+	}
+}
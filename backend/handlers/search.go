@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"defenzo/config"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+	// maxSearchTerms keeps a pasted paragraph from becoming a huge query
+	maxSearchTerms = 8
+)
+
+// Markers around the matched words in titles and snippets. FTS5 puts
+// control characters around them, which become the HTML marks once the
+// text around them has been escaped.
+const (
+	searchMarkStart = "<mark>"
+	searchMarkEnd   = "</mark>"
+	ftsMarkStart    = "\x02"
+	ftsMarkEnd      = "\x03"
+)
+
+// searchMarker escapes highlighted text and turns the FTS5 markers into marks
+var searchMarker = strings.NewReplacer(ftsMarkStart, searchMarkStart, ftsMarkEnd, searchMarkEnd)
+
+// SearchResult is a course or lesson matching a search
+type SearchResult struct {
+	Type        string `json:"type"`
+	CourseID    string `json:"course_id"`
+	CourseTitle string `json:"course_title"`
+	LessonID    string `json:"lesson_id,omitempty"`
+	// Title and Snippet are HTML, escaped and with the matches marked
+	Title   string `json:"title"`
+	Snippet string `json:"snippet"`
+	// Link opens the course, at the lesson for lesson results
+	Link string `json:"link"`
+}
+
+// searchTerms splits a query into words, dropping punctuation so users
+// cannot inject FTS5 query syntax
+func searchTerms(q string) []string {
+	terms := strings.FieldsFunc(q, func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	if len(terms) > maxSearchTerms {
+		terms = terms[:maxSearchTerms]
+	}
+	return terms
+}
+
+// searchLink is the app route of a course, or of a lesson inside it
+func searchLink(courseID, lessonID string) string {
+	link := "/course/" + url.PathEscape(courseID)
+	if lessonID != "" {
+		link += "?lesson=" + url.QueryEscape(lessonID)
+	}
+	return link
+}
+
+// Search finds published courses and lessons, by course title, description
+// and tags and by lesson title and content, best matches first. Each result
+// has its matches marked and links to where it is in the app.
+func Search(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	terms := searchTerms(query.Get("q"))
+	if len(terms) == 0 {
+		http.Error(w, `{"error": "q is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultSearchLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			writeJSONError(w, fmt.Sprintf("Invalid limit, use 1 to %d", maxSearchLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	offset := 0
+	if value := query.Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, `{"error": "Invalid offset"}`, http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	results, err := searchFullText(terms, limit, offset)
+	if err != nil {
+		log.Printf("Database error while searching: %v", err)
+		http.Error(w, `{"error": "Failed to search"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// searchFullText ranks matches with FTS5, a match in a title counts more
+// than one in tags, which counts more than one in the text
+func searchFullText(terms []string, limit, offset int) ([]SearchResult, error) {
+	// Every term must match, the last one as a prefix so results come while typing
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + term + `"`
+	}
+	quoted[len(quoted)-1] += "*"
+
+	rows, err := config.DB.Query(`
+		SELECT search_index.course_id, search_index.lesson_id, c.title,
+			highlight(search_index, 2, ?, ?),
+			snippet(search_index, 4, ?, ?, '…', 16)
+		FROM search_index
+		JOIN courses c ON c.id = search_index.course_id
+		WHERE search_index MATCH ? AND c.status = 'published'
+		ORDER BY bm25(search_index, 0, 0, 10.0, 5.0, 1.0)
+		LIMIT ? OFFSET ?`,
+		ftsMarkStart, ftsMarkEnd, ftsMarkStart, ftsMarkEnd,
+		strings.Join(quoted, " "), limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var result SearchResult
+		if err := rows.Scan(&result.CourseID, &result.LessonID, &result.CourseTitle, &result.Title, &result.Snippet); err != nil {
+			return nil, err
+		}
+		result.Title = searchMarker.Replace(html.EscapeString(result.Title))
+		result.Snippet = searchMarker.Replace(html.EscapeString(result.Snippet))
+		completeSearchResult(&result)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// completeSearchResult fills in the type and link of a result
+func completeSearchResult(result *SearchResult) {
+	result.Type = "course"
+	if result.LessonID != "" {
+		result.Type = "lesson"
+	}
+	result.Link = searchLink(result.CourseID, result.LessonID)
+}
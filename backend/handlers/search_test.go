@@ -0,0 +1,110 @@
+//go:build sqlite_fts5
+
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"defenzo/config"
+)
+
+// search runs a search and returns the results
+func search(t *testing.T, q string) []SearchResult {
+	t.Helper()
+	w := httptest.NewRecorder()
+	Search(w, httptest.NewRequest("GET", "/api/search?q="+url.QueryEscape(q), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("search for %q returned %d: %s", q, w.Code, w.Body)
+	}
+	var results []SearchResult
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+// mustExec runs a statement that has to succeed
+func mustExec(t *testing.T, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := config.DB.Exec(query, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// searchIDs lists the courses and lessons found, in order
+func searchIDs(t *testing.T, q string) []string {
+	t.Helper()
+	ids := []string{}
+	for _, result := range search(t, q) {
+		id := result.CourseID
+		if result.LessonID != "" {
+			id = result.LessonID
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestSearchIndexFollowsContent(t *testing.T) {
+	mustExec(t, "INSERT INTO courses (id, title, description, tags) VALUES ('sync', 'Quishing basics', 'Codes that lie', '[\"qrcode\"]')")
+	mustExec(t, `INSERT INTO lessons (id, course_id, title, type, content) VALUES ('sync-1', 'sync', 'First', 'cards', '{"cards": [{"text": "Scan nothing unfamiliar"}]}')`)
+	for q, want := range map[string]string{"quishing": "sync", "qrcode": "sync", "unfamiliar": "sync-1"} {
+		if got := searchIDs(t, q); len(got) != 1 || got[0] != want {
+			t.Fatalf("search for %q after insert = %v, want [%s]", q, got, want)
+		}
+	}
+
+	mustExec(t, "UPDATE courses SET title = 'Smishing basics' WHERE id = 'sync'")
+	mustExec(t, `UPDATE lessons SET content = '{"cards": [{"text": "Report every stranger"}]}' WHERE id = 'sync-1'`)
+	for q, want := range map[string]int{"quishing": 0, "smishing": 1, "unfamiliar": 0, "stranger": 1} {
+		if got := searchIDs(t, q); len(got) != want {
+			t.Fatalf("search for %q after update = %v, want %d results", q, got, want)
+		}
+	}
+
+	mustExec(t, "DELETE FROM lessons WHERE id = 'sync-1'")
+	if got := searchIDs(t, "stranger"); len(got) != 0 {
+		t.Fatalf("deleted lesson still found: %v", got)
+	}
+	mustExec(t, "DELETE FROM courses WHERE id = 'sync'")
+	if got := searchIDs(t, "smishing"); len(got) != 0 {
+		t.Fatalf("deleted course still found: %v", got)
+	}
+}
+
+func TestSearchRanksTitlesFirst(t *testing.T) {
+	mustExec(t, "INSERT INTO courses (id, title, description, tags) VALUES ('rank-body', 'Locked files', 'What vishing callers want', '[]')")
+	mustExec(t, "INSERT INTO courses (id, title, description, tags) VALUES ('rank-title', 'Vishing', 'Phone scams', '[]')")
+	mustExec(t, "INSERT INTO courses (id, title, description, tags) VALUES ('rank-tags', 'Phone calls', 'Who is calling', '[\"vishing\"]')")
+	mustExec(t, "INSERT INTO courses (id, title, description, tags, status) VALUES ('rank-draft', 'Vishing drafts', '', '[]', 'draft')")
+
+	got := searchIDs(t, "vishing")
+	want := []string{"rank-title", "rank-tags", "rank-body"}
+	if len(got) != len(want) {
+		t.Fatalf("search = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("search = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSearchEscapesHTML(t *testing.T) {
+	mustExec(t, "INSERT INTO courses (id, title, description, tags) VALUES ('escape', '<b>Pretexting</b> & more', '<script>alert(1)</script> pretexting', '[]')")
+
+	results := search(t, "pretexting")
+	if len(results) != 1 {
+		t.Fatalf("%d results, want 1", len(results))
+	}
+	if want := "&lt;b&gt;<mark>Pretexting</mark>&lt;/b&gt; &amp; more"; results[0].Title != want {
+		t.Fatalf("title = %q, want %q", results[0].Title, want)
+	}
+	if want := "&lt;script&gt;alert(1)&lt;/script&gt; <mark>pretexting</mark>"; results[0].Snippet != want {
+		t.Fatalf("snippet = %q, want %q", results[0].Snippet, want)
+	}
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"defenzo/config"
+)
+
+// Purposes of the single-use tokens stored in user_tokens
+const (
+	tokenPurposePasswordReset = "password_reset"
+	tokenPurposeVerifyEmail   = "verify_email"
+	tokenPurposeChangeEmail   = "change_email"
+	tokenPurposeMagicLink     = "magic_link"
+	tokenPurposeDeleteAccount = "delete_account"
+)
+
+// errInvalidUserToken is returned for unknown, expired or already used tokens
+var errInvalidUserToken = errors.New("invalid or expired token")
+
+// randomToken returns a URL-safe random string built from n random bytes
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hex SHA-256 digest used to store tokens at rest
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createUserToken stores a new single-use token for the user and returns it in plain text
+func createUserToken(userID int, purpose, data string, ttl time.Duration) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	_, err = config.DB.Exec(
+		"INSERT INTO user_tokens (user_id, purpose, token_hash, data, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userID,
+		purpose,
+		hashToken(token),
+		data,
+		now.Add(ttl).Format(time.RFC3339),
+		now.Format(time.RFC3339),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// userTokenWait returns how long the user has to wait before another token
+// of the purpose may be sent, 0 if one may be sent now. At most one is sent
+// per interval and dailyLimit in 24 hours, daily is set when the daily
+// limit is what holds it back.
+func userTokenWait(userID int, purpose string, interval time.Duration, dailyLimit int) (wait time.Duration, daily bool, err error) {
+	now := time.Now()
+	var lastSent sql.NullString
+	var sentToday int
+	err = config.DB.QueryRow(`
+		SELECT MAX(created_at), COUNT(*) FROM user_tokens
+		WHERE user_id = ? AND purpose = ? AND created_at > ?
+	`, userID, purpose, now.Add(-24*time.Hour).Format(time.RFC3339)).Scan(&lastSent, &sentToday)
+	if err != nil {
+		return 0, false, err
+	}
+	if sentToday >= dailyLimit {
+		return 24 * time.Hour, true, nil
+	}
+	if lastSent.Valid {
+		if sentAt, err := time.Parse(time.RFC3339, lastSent.String); err == nil {
+			if wait := interval - now.Sub(sentAt); wait > 0 {
+				return wait, false, nil
+			}
+		}
+	}
+	return 0, false, nil
+}
+
+// userTokenOwner returns the user a token was issued to without using it up
+func userTokenOwner(token, purpose string) (int, error) {
+	var userID int
+	err := config.DB.QueryRow(
+		"SELECT user_id FROM user_tokens WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?",
+		hashToken(token), purpose, time.Now().Format(time.RFC3339),
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidUserToken
+	}
+	return userID, err
+}
+
+// consumeUserToken marks a token as used and returns the user and data it was issued for
+func consumeUserToken(token, purpose string) (int, string, error) {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	var id, userID int
+	var data sql.NullString
+	var expiresAt string
+	var usedAt sql.NullString
+	err = tx.QueryRow(
+		"SELECT id, user_id, data, expires_at, used_at FROM user_tokens WHERE token_hash = ? AND purpose = ?",
+		hashToken(token), purpose,
+	).Scan(&id, &userID, &data, &expiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return 0, "", errInvalidUserToken
+	} else if err != nil {
+		return 0, "", err
+	}
+
+	expires, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil || usedAt.Valid || time.Now().After(expires) {
+		return 0, "", errInvalidUserToken
+	}
+
+	result, err := tx.Exec("UPDATE user_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL", time.Now().Format(time.RFC3339), id)
+	if err != nil {
+		return 0, "", err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated != 1 {
+		return 0, "", errInvalidUserToken
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, "", err
+	}
+	return userID, data.String, nil
+}
+
+// invalidateUserTokens marks every outstanding token of the given purpose as used
+func invalidateUserTokens(userID int, purpose string) error {
+	_, err := config.DB.Exec(
+		"UPDATE user_tokens SET used_at = ? WHERE user_id = ? AND purpose = ? AND used_at IS NULL",
+		time.Now().Format(time.RFC3339), userID, purpose,
+	)
+	return err
+}
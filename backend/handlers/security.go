@@ -105,8 +105,11 @@ func CheckPassword(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Handling password check request")
 	w.Header().Set("Content-Type", "application/json")
 
+	// Email and name are optional, they let a sign-up form preview the policy
 	var requestBody struct {
 		Password string `json:"password"`
+		Email    string `json:"email"`
+		FullName string `json:"full_name"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
 		log.Printf("Error decoding password check request: %v", err)
@@ -119,70 +122,7 @@ func CheckPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result := checkPasswordComplexity(requestBody.Password)
+	result := PasswordPolicy.Check(requestBody.Password, requestBody.Email, requestBody.FullName)
 	log.Printf("Password check result: %+v", result)
 	json.NewEncoder(w).Encode(result)
 }
-
-// checkPasswordComplexity evaluates password strength
-func checkPasswordComplexity(password string) models.PasswordCheckResult {
-	score := 0
-	suggestions := []string{}
-
-	if len(password) >= 8 {
-		score++
-	} else {
-		suggestions = append(suggestions, "Use at least 8 characters")
-	}
-	if len(password) >= 12 {
-		score++
-	} else {
-		suggestions = append(suggestions, "Use at least 12 characters")
-	}
-	upper, lower, digit, special := false, false, false, false
-	for _, c := range password {
-		switch {
-		case c >= 'A' && c <= 'Z':
-			upper = true
-		case c >= 'a' && c <= 'z':
-			lower = true
-		case c >= '0' && c <= '9':
-			digit = true
-		case (c >= 33 && c <= 47) || (c >= 58 && c <= 64) || (c >= 91 && c <= 96) || (c >= 123 && c <= 126):
-			special = true
-		}
-	}
-	if upper {
-		score++
-	} else {
-		suggestions = append(suggestions, "Add uppercase letters")
-	}
-	if lower {
-		score++
-	} else {
-		suggestions = append(suggestions, "Add lowercase letters")
-	}
-	if digit {
-		score++
-	} else {
-		suggestions = append(suggestions, "Add numbers")
-	}
-	if special {
-		score++
-	} else {
-		suggestions = append(suggestions, "Add special characters")
-	}
-
-	label := "Weak"
-	if score >= 6 {
-		label = "Strong"
-	} else if score >= 4 {
-		label = "Medium"
-	}
-
-	return models.PasswordCheckResult{
-		Score:       score,
-		Label:       label,
-		Suggestions: suggestions,
-	}
-}
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"defenzo/config"
+	"defenzo/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+// maxUserAgentLength keeps arbitrary client headers from bloating the sessions table
+const maxUserAgentLength = 512
+
+// Session is a signed-in device as shown to the user
+type Session struct {
+	ID         string `json:"id"`
+	UserAgent  string `json:"user_agent"`
+	IP         string `json:"ip"`
+	CreatedAt  string `json:"created_at"`
+	LastSeenAt string `json:"last_seen_at"`
+	Current    bool   `json:"current"`
+}
+
+// createSession records a new signed-in device and returns its ID
+func createSession(r *http.Request, userID int) (string, error) {
+	sessionID, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	_, err = config.DB.Exec(
+		"INSERT INTO sessions (id, user_id, user_agent, ip, created_at, last_seen_at) VALUES (?, ?, ?, ?, ?, ?)",
+		sessionID, userID, userAgent, middleware.ClientIP(r), now, now,
+	)
+	if err != nil {
+		return "", err
+	}
+	return sessionID, nil
+}
+
+// revokeOtherSessions signs out every session of the user except currentID
+// and returns how many were revoked
+func revokeOtherSessions(userID int, currentID string) (int, error) {
+	rows, err := config.DB.Query("SELECT id FROM sessions WHERE user_id = ? AND id != ?", userID, currentID)
+	if err != nil {
+		return 0, err
+	}
+	var sessionIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		sessionIDs = append(sessionIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range sessionIDs {
+		if err := revokeTokenFamily(id); err != nil {
+			return 0, err
+		}
+	}
+	return len(sessionIDs), nil
+}
+
+// ListSessions returns the user's active sessions, most recently used first
+func ListSessions(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling list sessions request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	currentID := middleware.GetSessionID(r)
+
+	rows, err := config.DB.Query(`
+		SELECT id, user_agent, ip, created_at, last_seen_at
+		FROM sessions
+		WHERE user_id = ?
+		ORDER BY last_seen_at DESC
+	`, userID)
+	if err != nil {
+		log.Printf("Database error while fetching sessions: %v", err)
+		http.Error(w, `{"error": "Failed to fetch sessions"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt); err != nil {
+			log.Printf("Error scanning session row: %v", err)
+			http.Error(w, `{"error": "Failed to scan session data"}`, http.StatusInternalServerError)
+			return
+		}
+		s.Current = s.ID == currentID
+		sessions = append(sessions, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating session rows: %v", err)
+		http.Error(w, `{"error": "Failed to fetch sessions"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// DeleteSession signs out one of the user's sessions
+func DeleteSession(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling delete session request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	sessionID := mux.Vars(r)["id"]
+
+	var exists bool
+	err = config.DB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM sessions WHERE id = ? AND user_id = ?)",
+		sessionID, userID,
+	).Scan(&exists)
+	if err != nil {
+		log.Printf("Error checking session: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, `{"error": "Session not found"}`, http.StatusNotFound)
+		return
+	}
+
+	if err := revokeTokenFamily(sessionID); err != nil {
+		log.Printf("Error revoking session: %v", err)
+		http.Error(w, `{"error": "Failed to revoke session"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d revoked a session", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Session revoked",
+	})
+}
+
+// DeleteOtherSessions signs out every session except the one making the request
+func DeleteOtherSessions(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling delete other sessions request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	currentID := middleware.GetSessionID(r)
+
+	revoked, err := revokeOtherSessions(userID, currentID)
+	if err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+		http.Error(w, `{"error": "Failed to revoke sessions"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d revoked %d other sessions", userID, revoked)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"revoked": revoked,
+	})
+}
@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"defenzo/config"
+	"defenzo/middleware"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// tokenResponse is returned by every endpoint that signs a user in
+type tokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// issueTokens starts a new session for the user and returns its first access/refresh pair.
+// The session ID doubles as the refresh token family ID.
+func issueTokens(r *http.Request, userID int) (*tokenResponse, error) {
+	// Signing in keeps an account that was scheduled for deletion
+	if err := cancelAccountDeletion(userID); err != nil {
+		return nil, err
+	}
+
+	sessionID, err := createSession(r, userID)
+	if err != nil {
+		return nil, err
+	}
+	recordAuditEvent(r, userID, auditSessionStarted, map[string]interface{}{"session_id": sessionID})
+	return issueTokensInFamily(userID, sessionID)
+}
+
+// issueTokensInFamily signs an access token and stores a new refresh token in an existing family
+func issueTokensInFamily(userID int, familyID string) (*tokenResponse, error) {
+	accessToken, err := generateAccessToken(userID, familyID)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	_, err = config.DB.Exec(
+		"INSERT INTO refresh_tokens (user_id, token_hash, family_id, expires_at, created_at) VALUES (?, ?, ?, ?, ?)",
+		userID,
+		hashToken(refreshToken),
+		familyID,
+		now.Add(refreshTokenTTL).Format(time.RFC3339),
+		now.Format(time.RFC3339),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// generateAccessToken creates a short-lived signed JWT with a unique, revocable ID
+func generateAccessToken(userID int, familyID string) (string, error) {
+	tokenID, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	// Roles are embedded so RequireRole does not need a database lookup
+	roles, err := loadUserRoles(userID)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	return middleware.SignToken(jwt.MapClaims{
+		"user_id": userID,
+		"roles":   roles,
+		"jti":     tokenID,
+		"sid":     familyID,
+		"iat":     now.Unix(),
+		"exp":     now.Add(accessTokenTTL).Unix(),
+	})
+}
+
+// revokeTokenFamily revokes every refresh token descending from the same login
+// and ends the session, which also invalidates its access tokens
+func revokeTokenFamily(familyID string) error {
+	_, err := config.DB.Exec(
+		"UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL",
+		time.Now().Format(time.RFC3339), familyID,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = config.DB.Exec("DELETE FROM sessions WHERE id = ?", familyID)
+	return err
+}
+
+// revokeAllUserTokens signs the user out everywhere by revoking every refresh
+// token and API token and rejecting access tokens issued before now
+func revokeAllUserTokens(userID int) error {
+	now := time.Now()
+	_, err := config.DB.Exec(
+		"UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL",
+		now.Format(time.RFC3339), userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if _, err := config.DB.Exec("DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+
+	if _, err := config.DB.Exec(
+		"UPDATE api_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL",
+		now.Format(time.RFC3339), userID,
+	); err != nil {
+		return err
+	}
+
+	_, err = config.DB.Exec("UPDATE users SET tokens_valid_after = ? WHERE id = ?", now.Unix(), userID)
+	return err
+}
+
+// revokeAccessToken blocks an access token until its natural expiry
+func revokeAccessToken(tokenID string, expiresAt time.Time) error {
+	// Expired entries are no longer needed because the JWT itself is rejected
+	if _, err := config.DB.Exec("DELETE FROM revoked_tokens WHERE expires_at < ?", time.Now().Format(time.RFC3339)); err != nil {
+		log.Printf("Error cleaning up revoked tokens: %v", err)
+	}
+
+	_, err := config.DB.Exec(
+		"INSERT OR IGNORE INTO revoked_tokens (jti, expires_at) VALUES (?, ?)",
+		tokenID, expiresAt.Format(time.RFC3339),
+	)
+	return err
+}
+
+// RefreshToken exchanges a refresh token for a new access/refresh pair
+func RefreshToken(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling token refresh request")
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, `{"error": "refresh_token is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	tokenHash := hashToken(req.RefreshToken)
+	var id, userID int
+	var familyID, expiresAt string
+	var rotatedAt, revokedAt sql.NullString
+	err := config.DB.QueryRow(
+		"SELECT id, user_id, family_id, expires_at, rotated_at, revoked_at FROM refresh_tokens WHERE token_hash = ?",
+		tokenHash,
+	).Scan(&id, &userID, &familyID, &expiresAt, &rotatedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error": "Invalid refresh token"}`, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("Error loading refresh token: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if revokedAt.Valid {
+		http.Error(w, `{"error": "Invalid refresh token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	// A refresh token that was already rotated is being replayed, which means
+	// it leaked. Revoke the whole family so neither party can keep using it.
+	if rotatedAt.Valid {
+		log.Printf("Refresh token reuse detected for user %d, revoking token family", userID)
+		if err := revokeTokenFamily(familyID); err != nil {
+			log.Printf("Error revoking token family: %v", err)
+		}
+		http.Error(w, `{"error": "Invalid refresh token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	expires, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil || time.Now().After(expires) {
+		http.Error(w, `{"error": "Refresh token expired"}`, http.StatusUnauthorized)
+		return
+	}
+
+	// Mark the token as rotated, guarding against two concurrent refreshes
+	result, err := config.DB.Exec(
+		"UPDATE refresh_tokens SET rotated_at = ? WHERE id = ? AND rotated_at IS NULL AND revoked_at IS NULL",
+		time.Now().Format(time.RFC3339), id,
+	)
+	if err != nil {
+		log.Printf("Error rotating refresh token: %v", err)
+		http.Error(w, `{"error": "Failed to refresh token"}`, http.StatusInternalServerError)
+		return
+	}
+	if rotated, err := result.RowsAffected(); err != nil || rotated != 1 {
+		if err := revokeTokenFamily(familyID); err != nil {
+			log.Printf("Error revoking token family: %v", err)
+		}
+		http.Error(w, `{"error": "Invalid refresh token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := issueTokensInFamily(userID, familyID)
+	if err != nil {
+		log.Printf("Error generating tokens: %v", err)
+		http.Error(w, `{"error": "Failed to generate token"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := middleware.TouchSession(familyID, r); err != nil {
+		log.Printf("Error updating session: %v", err)
+	}
+
+	log.Printf("Refreshed tokens for user %d", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// Logout revokes the current access token and the refresh tokens of the same login
+func Logout(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling logout request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	claims, ok := middleware.GetTokenClaims(r)
+	if !ok {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	tokenID, _ := claims["jti"].(string)
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		http.Error(w, `{"error": "Invalid token claims"}`, http.StatusUnauthorized)
+		return
+	}
+	if err := revokeAccessToken(tokenID, expiresAt.Time); err != nil {
+		log.Printf("Error revoking access token: %v", err)
+		http.Error(w, `{"error": "Failed to log out"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if familyID, ok := claims["sid"].(string); ok && familyID != "" {
+		if err := revokeTokenFamily(familyID); err != nil {
+			log.Printf("Error revoking token family: %v", err)
+			http.Error(w, `{"error": "Failed to log out"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	log.Printf("Logged out user %d", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Logged out",
+	})
+}
+
+// GetJWKS publishes the public keys that verify our access tokens
+func GetJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": middleware.PublicJWKs(),
+	})
+}
@@ -0,0 +1,565 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"defenzo/config"
+	"defenzo/middleware"
+	"defenzo/totp"
+	"defenzo/webauthn"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	mfaChallengeTTL   = 5 * time.Minute
+	maxMFAAttempts    = 5
+	recoveryCodeCount = 10
+	defaultTOTPIssuer = "DEFENZO"
+
+	// maxMFAFailures is how many wrong second factors a user can send across
+	// all their challenges. After that one more is allowed every
+	// mfaFailureDelay until a correct one clears the count.
+	maxMFAFailures  = 10
+	mfaFailureDelay = 15 * time.Minute
+)
+
+// isTOTPEnabled reports whether the user has a confirmed authenticator app
+func isTOTPEnabled(userID int) (bool, error) {
+	var enabled bool
+	err := config.DB.QueryRow("SELECT enabled FROM user_totp WHERE user_id = ?", userID).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// createMFAChallenge stores a short-lived challenge that must be answered with a second factor
+func createMFAChallenge(userID int) (string, error) {
+	challenge, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	// Clean up expired challenges while we are here
+	if _, err := config.DB.Exec("DELETE FROM mfa_challenges WHERE expires_at < ?", time.Now().Format(time.RFC3339)); err != nil {
+		log.Printf("Error cleaning up expired MFA challenges: %v", err)
+	}
+
+	_, err = config.DB.Exec(
+		"INSERT INTO mfa_challenges (token_hash, user_id, attempts, expires_at) VALUES (?, ?, 0, ?)",
+		hashToken(challenge),
+		userID,
+		time.Now().Add(mfaChallengeTTL).Format(time.RFC3339),
+	)
+	if err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// reserveMFAAttempt counts an attempt at answering a challenge before the
+// second factor is checked, against the challenge and against its user, so
+// concurrent guesses cannot go over either limit. It reports whether the
+// challenge and the user still had attempts left.
+func reserveMFAAttempt(challengeHash string, userID int) (challengeOK, userOK bool, err error) {
+	result, err := config.DB.Exec(
+		"UPDATE mfa_challenges SET attempts = attempts + 1 WHERE token_hash = ? AND attempts < ?",
+		challengeHash, maxMFAAttempts,
+	)
+	if err != nil {
+		return false, false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, false, err
+	}
+
+	now := time.Now()
+	result, err = config.DB.Exec(`
+		INSERT INTO mfa_failures (user_id, failures, last_failure_at) VALUES (?, 1, ?)
+		ON CONFLICT(user_id) DO UPDATE SET failures = failures + 1, last_failure_at = excluded.last_failure_at
+		WHERE failures < ? OR last_failure_at < ?`,
+		userID, now.Format(time.RFC3339), maxMFAFailures, now.Add(-mfaFailureDelay).Format(time.RFC3339),
+	)
+	if err != nil {
+		return true, false, err
+	}
+	n, err := result.RowsAffected()
+	return true, n > 0, err
+}
+
+// clearMFAFailures forgets the user's wrong second factors once they sent a
+// correct one
+func clearMFAFailures(userID int) error {
+	_, err := config.DB.Exec("DELETE FROM mfa_failures WHERE user_id = ?", userID)
+	return err
+}
+
+// verifyTOTPCode checks a code against the user's secret and marks its time step as used
+func verifyTOTPCode(userID int, code string, requireEnabled bool) (bool, error) {
+	var secret string
+	var enabled bool
+	var lastUsedStep int64
+	err := config.DB.QueryRow(
+		"SELECT secret, enabled, last_used_step FROM user_totp WHERE user_id = ?",
+		userID,
+	).Scan(&secret, &enabled, &lastUsedStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if requireEnabled && !enabled {
+		return false, nil
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok || step <= lastUsedStep {
+		return false, nil
+	}
+
+	// Only accept each code once, even if it is still inside the skew window
+	result, err := config.DB.Exec(
+		"UPDATE user_totp SET last_used_step = ? WHERE user_id = ? AND last_used_step < ?",
+		step, userID, step,
+	)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return updated == 1, nil
+}
+
+// useRecoveryCode consumes one of the user's unused recovery codes
+func useRecoveryCode(userID int, code string) (bool, error) {
+	result, err := config.DB.Exec(
+		"UPDATE user_recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		time.Now().Format(time.RFC3339),
+		userID,
+		hashToken(normalizeRecoveryCode(code)),
+	)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return updated == 1, nil
+}
+
+// normalizeRecoveryCode makes recovery codes case and separator insensitive
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// replaceRecoveryCodes removes any existing recovery codes and generates a new set
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	now := time.Now().Format(time.RFC3339)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		raw := hex.EncodeToString(b)
+		_, err := tx.Exec(
+			"INSERT INTO user_recovery_codes (user_id, code_hash, created_at) VALUES (?, ?, ?)",
+			userID, hashToken(raw), now,
+		)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, raw[:5]+"-"+raw[5:])
+	}
+	return codes, nil
+}
+
+// GetTOTPStatus returns whether two-factor authentication is enabled for the user
+func GetTOTPStatus(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	enabled, err := isTOTPEnabled(userID)
+	if err != nil {
+		log.Printf("Error checking two-factor status: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var remaining int
+	err = config.DB.QueryRow(
+		"SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = ? AND used_at IS NULL",
+		userID,
+	).Scan(&remaining)
+	if err != nil {
+		log.Printf("Error counting recovery codes: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":                  enabled,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// EnrollTOTP generates a new authenticator secret that still has to be confirmed
+func EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling TOTP enrollment request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	enabled, err := isTOTPEnabled(userID)
+	if err != nil {
+		log.Printf("Error checking two-factor status: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, `{"error": "Two-factor authentication is already enabled"}`, http.StatusConflict)
+		return
+	}
+
+	var email string
+	if err := config.DB.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+		log.Printf("Error getting user email: %v", err)
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		log.Printf("Error generating TOTP secret: %v", err)
+		http.Error(w, `{"error": "Failed to generate secret"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Replace any earlier, unconfirmed enrollment
+	_, err = config.DB.Exec(`
+		INSERT INTO user_totp (user_id, secret, enabled, last_used_step, created_at)
+		VALUES (?, ?, 0, 0, ?)
+		ON CONFLICT(user_id) DO UPDATE SET
+			secret = excluded.secret,
+			enabled = 0,
+			last_used_step = 0,
+			created_at = excluded.created_at,
+			confirmed_at = NULL
+	`, userID, secret, time.Now().Format(time.RFC3339))
+	if err != nil {
+		log.Printf("Error saving TOTP secret: %v", err)
+		http.Error(w, `{"error": "Failed to save secret"}`, http.StatusInternalServerError)
+		return
+	}
+
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = defaultTOTPIssuer
+	}
+
+	log.Printf("Started TOTP enrollment for user %d", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_url": totp.URI(issuer, email, secret),
+	})
+}
+
+// ConfirmTOTP enables two-factor authentication once the user proves the app is set up
+func ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling TOTP confirmation request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, `{"error": "Code is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	enabled, err := isTOTPEnabled(userID)
+	if err != nil {
+		log.Printf("Error checking two-factor status: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, `{"error": "Two-factor authentication is already enabled"}`, http.StatusConflict)
+		return
+	}
+
+	valid, err := verifyTOTPCode(userID, req.Code, false)
+	if err != nil {
+		log.Printf("Error verifying TOTP code: %v", err)
+		http.Error(w, `{"error": "Failed to verify code"}`, http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, `{"error": "Invalid code"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, `{"error": "Failed to enable two-factor authentication"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE user_totp SET enabled = 1, confirmed_at = ? WHERE user_id = ?",
+		time.Now().Format(time.RFC3339), userID,
+	)
+	if err != nil {
+		log.Printf("Error enabling TOTP: %v", err)
+		http.Error(w, `{"error": "Failed to enable two-factor authentication"}`, http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		log.Printf("Error generating recovery codes: %v", err)
+		http.Error(w, `{"error": "Failed to generate recovery codes"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		http.Error(w, `{"error": "Failed to enable two-factor authentication"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Enabled TOTP for user %d", userID)
+
+	// Recovery codes are only ever shown here, we keep nothing but their hashes
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":        true,
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTOTP turns off two-factor authentication after re-checking password and code
+func DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling TOTP disable request")
+	userID, err := middleware.GetUserID(r)
+	if err != nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	var passwordHash string
+	if err := config.DB.QueryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&passwordHash); err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)) != nil {
+		http.Error(w, `{"error": "Invalid password"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var valid bool
+	if req.RecoveryCode != "" {
+		valid, err = useRecoveryCode(userID, req.RecoveryCode)
+	} else {
+		valid, err = verifyTOTPCode(userID, req.Code, true)
+	}
+	if err != nil {
+		log.Printf("Error verifying second factor: %v", err)
+		http.Error(w, `{"error": "Failed to verify code"}`, http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, `{"error": "Invalid code"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, `{"error": "Failed to disable two-factor authentication"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM user_totp WHERE user_id = ?", userID); err != nil {
+		log.Printf("Error deleting TOTP secret: %v", err)
+		http.Error(w, `{"error": "Failed to disable two-factor authentication"}`, http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = ?", userID); err != nil {
+		log.Printf("Error deleting recovery codes: %v", err)
+		http.Error(w, `{"error": "Failed to disable two-factor authentication"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		http.Error(w, `{"error": "Failed to disable two-factor authentication"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Disabled TOTP for user %d", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{
+		"enabled": false,
+	})
+}
+
+// VerifyLoginMFA completes a login that was answered with an mfa_required
+// challenge, using an authenticator code, a recovery code or a passkey
+func VerifyLoginMFA(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling two-factor login verification")
+	var req struct {
+		MFAToken     string                       `json:"mfa_token"`
+		Code         string                       `json:"code"`
+		RecoveryCode string                       `json:"recovery_code"`
+		Passkey      *webauthn.CredentialResponse `json:"passkey"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	challengeHash := hashToken(req.MFAToken)
+	var userID, attempts int
+	var expiresAt string
+	err := config.DB.QueryRow(
+		"SELECT user_id, attempts, expires_at FROM mfa_challenges WHERE token_hash = ?",
+		challengeHash,
+	).Scan(&userID, &attempts, &expiresAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error": "Invalid or expired challenge"}`, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("Error loading MFA challenge: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	expires, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil || time.Now().After(expires) || attempts >= maxMFAAttempts {
+		config.DB.Exec("DELETE FROM mfa_challenges WHERE token_hash = ?", challengeHash)
+		http.Error(w, `{"error": "Invalid or expired challenge"}`, http.StatusUnauthorized)
+		return
+	}
+
+	// The attempt counts as failed until the second factor checks out
+	challengeOK, userOK, err := reserveMFAAttempt(challengeHash, userID)
+	if err != nil {
+		log.Printf("Error recording MFA attempt: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if !challengeOK {
+		config.DB.Exec("DELETE FROM mfa_challenges WHERE token_hash = ?", challengeHash)
+		http.Error(w, `{"error": "Invalid or expired challenge"}`, http.StatusUnauthorized)
+		return
+	}
+	if !userOK {
+		log.Printf("Too many failed second factors for user %d", userID)
+		http.Error(w, `{"error": "Too many failed verification attempts, please try again later"}`, http.StatusTooManyRequests)
+		return
+	}
+
+	var valid bool
+	if req.Passkey != nil && WebAuthn != nil {
+		var passkeyUserID int
+		passkeyUserID, err = verifyPasskeyAssertion(req.Passkey, webauthnPurposeMFA, false)
+		if err == errInvalidPasskey || err == errPasskeyCloned {
+			err = nil
+		}
+		valid = err == nil && passkeyUserID == userID
+	} else if req.RecoveryCode != "" {
+		valid, err = useRecoveryCode(userID, req.RecoveryCode)
+	} else {
+		valid, err = verifyTOTPCode(userID, req.Code, true)
+	}
+	if err != nil {
+		log.Printf("Error verifying second factor: %v", err)
+		http.Error(w, `{"error": "Failed to verify code"}`, http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		log.Printf("Invalid second factor for user %d", userID)
+		method := "totp"
+		if req.Passkey != nil {
+			method = "passkey"
+		} else if req.RecoveryCode != "" {
+			method = "recovery_code"
+		}
+		recordAuditEvent(r, userID, auditMFAFailed, map[string]interface{}{"method": method})
+		http.Error(w, `{"error": "Invalid code"}`, http.StatusUnauthorized)
+		return
+	}
+
+	// Challenges are single use
+	result, err := config.DB.Exec("DELETE FROM mfa_challenges WHERE token_hash = ?", challengeHash)
+	if err != nil {
+		log.Printf("Error deleting MFA challenge: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if consumed, err := result.RowsAffected(); err != nil || consumed != 1 {
+		http.Error(w, `{"error": "Invalid or expired challenge"}`, http.StatusUnauthorized)
+		return
+	}
+	if err := clearMFAFailures(userID); err != nil {
+		log.Printf("Error clearing failed MFA attempts: %v", err)
+	}
+
+	tokens, err := issueTokens(r, userID)
+	if err != nil {
+		log.Printf("Error generating tokens: %v", err)
+		http.Error(w, `{"error": "Failed to generate token"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Successfully completed two-factor login for user %d", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
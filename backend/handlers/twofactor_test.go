@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"defenzo/config"
+	"defenzo/totp"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// createTOTPUser creates a user with a password and a confirmed
+// authenticator app, and returns the user and the app's secret
+func createTOTPUser(t *testing.T, email, password string) (int, string) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := createTestUser(t, email, string(hash))
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.DB.Exec(
+		"INSERT INTO user_totp (user_id, secret, enabled, created_at) VALUES (?, ?, 1, datetime('now'))", userID, secret,
+	); err != nil {
+		t.Fatal(err)
+	}
+	return userID, secret
+}
+
+// mfaLogin signs in with the password and returns the second factor challenge
+func mfaLogin(t *testing.T, email, password string) string {
+	t.Helper()
+	w := callHandler(t, Login, "", map[string]string{"email": email, "password": password})
+	var challenge struct {
+		MFAToken string `json:"mfa_token"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&challenge); err != nil || challenge.MFAToken == "" {
+		t.Fatalf("login returned %d without a challenge", w.Code)
+	}
+	return challenge.MFAToken
+}
+
+// wrongCode returns a code the authenticator app does not show now
+func wrongCode(t *testing.T, secret string) string {
+	t.Helper()
+	code, err := totp.CodeAt(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string('0'+(code[0]-'0'+5)%10) + code[1:]
+}
+
+func TestMFAFailuresCountAcrossChallenges(t *testing.T) {
+	const email, password = "mfa-guess@example.com", "Correct-Horse-Battery-9"
+	userID, secret := createTOTPUser(t, email, password)
+
+	// A new challenge after each correct password does not give more guesses
+	failures := 0
+	for failures < maxMFAFailures {
+		token := mfaLogin(t, email, password)
+		for i := 0; i < maxMFAAttempts && failures < maxMFAFailures; i++ {
+			body := map[string]string{"mfa_token": token, "code": wrongCode(t, secret)}
+			if w := callHandler(t, VerifyLoginMFA, "", body); w.Code != http.StatusUnauthorized {
+				t.Fatalf("wrong code %d returned %d, want 401", failures+1, w.Code)
+			}
+			failures++
+		}
+	}
+	token := mfaLogin(t, email, password)
+	body := map[string]string{"mfa_token": token, "code": wrongCode(t, secret)}
+	if w := callHandler(t, VerifyLoginMFA, "", body); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("wrong code over the limit returned %d, want 429", w.Code)
+	}
+
+	// Once the delay has passed, a correct code goes through and clears the count
+	if _, err := config.DB.Exec(
+		"UPDATE mfa_failures SET last_failure_at = ? WHERE user_id = ?",
+		time.Now().Add(-mfaFailureDelay-time.Minute).Format(time.RFC3339), userID,
+	); err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.CodeAt(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = map[string]string{"mfa_token": token, "code": code}
+	if w := callHandler(t, VerifyLoginMFA, "", body); w.Code != http.StatusOK {
+		t.Fatalf("correct code after the delay returned %d: %s", w.Code, w.Body)
+	}
+	var left int
+	config.DB.QueryRow("SELECT COUNT(*) FROM mfa_failures WHERE user_id = ?", userID).Scan(&left)
+	if left != 0 {
+		t.Fatal("a correct code did not clear the failures")
+	}
+}
+
+func TestMFAAttemptsAreCountedAtomically(t *testing.T) {
+	const email, password = "mfa-race@example.com", "Correct-Horse-Battery-9"
+	userID, secret := createTOTPUser(t, email, password)
+	token := mfaLogin(t, email, password)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			callHandler(t, VerifyLoginMFA, "", map[string]string{"mfa_token": token, "code": wrongCode(t, secret)})
+		}()
+	}
+	wg.Wait()
+
+	var failures int
+	if err := config.DB.QueryRow("SELECT failures FROM mfa_failures WHERE user_id = ?", userID).Scan(&failures); err != nil {
+		t.Fatal(err)
+	}
+	if failures != maxMFAAttempts {
+		t.Fatalf("%d guesses were checked against one challenge, want %d", failures, maxMFAAttempts)
+	}
+}
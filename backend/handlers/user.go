@@ -3,14 +3,16 @@ package handlers
 import (
 	"database/sql"
 	"defenzo/config"
+	"defenzo/loginguard"
 	"defenzo/middleware"
 	"defenzo/models"
 	"encoding/json"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -29,8 +31,31 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	email, err := validateEmail(credentials.Email)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	credentials.Email = email
+
 	log.Printf("Registering user with email: %s, full name: %s", credentials.Email, credentials.FullName)
 
+	// Addresses differing only in case belong to the same mailbox
+	taken, err := emailInUse(credentials.Email, 0)
+	if err != nil {
+		log.Printf("Error checking email: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, `{"error": "Email already exists"}`, http.StatusBadRequest)
+		return
+	}
+
+	if rejectWeakPassword(w, credentials.Password, credentials.Email, credentials.FullName) {
+		return
+	}
+
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(credentials.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -61,24 +86,29 @@ func Register(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("Successfully registered user with ID: %d", userID)
+	recordAuditEvent(r, int(userID), auditRegister, nil)
 
-	// Generate JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": userID,
-		"exp":     time.Now().Add(time.Hour * 24 * 7).Unix(), // Token expires in 7 days
-	})
+	if err := grantDefaultRole(int(userID)); err != nil {
+		log.Printf("Error granting default role: %v", err)
+		http.Error(w, `{"error": "Failed to assign role"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Ask the user to confirm the address, registration succeeds even if mail fails
+	if err := sendVerificationEmail(int(userID), credentials.Email); err != nil {
+		log.Printf("Error sending verification email: %v", err)
+	}
 
-	tokenString, err := token.SignedString(middleware.JWTSecret)
+	// Generate access and refresh tokens
+	tokens, err := issueTokens(r, int(userID))
 	if err != nil {
-		log.Printf("Error generating JWT token: %v", err)
+		log.Printf("Error generating tokens: %v", err)
 		http.Error(w, `{"error": "Failed to generate token"}`, http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"token": tokenString,
-	})
+	json.NewEncoder(w).Encode(tokens)
 }
 
 // Login handles user login
@@ -97,19 +127,43 @@ func Login(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Attempting login for email: %s", credentials.Email)
 
+	// Slow down and lock out repeated failures before doing any expensive work.
+	// The attempt is held until the password is checked, so parallel guesses
+	// cannot all slip past the throttle.
+	accountKey := loginguard.Key(loginguard.KindAccount, credentials.Email)
+	ipKey := loginguard.Key(loginguard.KindIP, middleware.ClientIP(r))
+	wait, err := LoginGuard.Reserve(accountKey, ipKey)
+	if err != nil {
+		log.Printf("Error checking login throttle: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		log.Printf("Login throttled for email: %s", credentials.Email)
+		recordAuditEvent(r, 0, auditLoginFailed, map[string]interface{}{"email": credentials.Email, "reason": "throttled"})
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, `{"error": "Too many failed login attempts, please try again later"}`, http.StatusTooManyRequests)
+		return
+	}
+
 	// Get user from database
 	var user models.User
 	var passwordHash string
-	err := config.DB.QueryRow(
-		"SELECT id, email, full_name, password_hash FROM users WHERE email = ?",
+	err = config.DB.QueryRow(
+		"SELECT id, email, full_name, password_hash FROM users WHERE email = ? COLLATE NOCASE",
 		credentials.Email,
 	).Scan(&user.ID, &user.Email, &user.FullName, &passwordHash)
 	if err == sql.ErrNoRows {
 		log.Printf("User not found: %s", credentials.Email)
+		recordAuditEvent(r, 0, auditLoginFailed, map[string]interface{}{"email": credentials.Email, "reason": "unknown_email"})
+		failLogin(accountKey, ipKey)
 		http.Error(w, `{"error": "Invalid email or password"}`, http.StatusUnauthorized)
 		return
 	} else if err != nil {
 		log.Printf("Database error during login: %v", err)
+		if err := LoginGuard.Release(accountKey, ipKey); err != nil {
+			log.Printf("Error releasing login throttle: %v", err)
+		}
 		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
 		return
 	}
@@ -120,29 +174,27 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	err = bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(credentials.Password))
 	if err != nil {
 		log.Printf("Invalid password for user: %s", credentials.Email)
+		recordAuditEvent(r, user.ID, auditLoginFailed, map[string]interface{}{"email": credentials.Email, "reason": "invalid_password"})
+		failLogin(accountKey, ipKey)
 		http.Error(w, `{"error": "Invalid email or password"}`, http.StatusUnauthorized)
 		return
 	}
 
-	// Generate JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": user.ID,
-		"exp":     time.Now().Add(time.Hour * 24 * 7).Unix(), // Token expires in 7 days
-	})
-
-	tokenString, err := token.SignedString(middleware.JWTSecret)
-	if err != nil {
-		log.Printf("Error generating JWT token: %v", err)
-		http.Error(w, `{"error": "Failed to generate token"}`, http.StatusInternalServerError)
-		return
+	if err := LoginGuard.Succeed(accountKey); err != nil {
+		log.Printf("Error resetting login throttle: %v", err)
+	}
+	if err := LoginGuard.Release(ipKey); err != nil {
+		log.Printf("Error releasing login throttle: %v", err)
 	}
 
-	log.Printf("Successfully logged in user: %s", user.Email)
+	completeLogin(w, r, user.ID, user.Email)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"token": tokenString,
-	})
+// failLogin counts a login attempt held by the guard as failed
+func failLogin(keys ...string) {
+	if err := LoginGuard.FailReserved(keys...); err != nil {
+		log.Printf("Error recording failed login: %v", err)
+	}
 }
 
 // GetProfile handles getting user profile
@@ -157,24 +209,76 @@ func GetProfile(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Getting profile for user ID: %d", userID)
 
-	var user models.User
-	var fullName, profilePictureURL sql.NullString
-	err = config.DB.QueryRow(
-		"SELECT id, email, full_name, profile_picture_url, created_at FROM users WHERE id = ?",
-		userID,
-	).Scan(&user.ID, &user.Email, &fullName, &profilePictureURL, &user.CreatedAt)
+	user, err := loadProfile(userID)
 	if err != nil {
 		log.Printf("Error getting user profile: %v", err)
 		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
 		return
 	}
 
-	// Convert NullString to string, using empty string if NULL
-	user.FullName = fullName.String
-	user.ProfilePictureURL = profilePictureURL.String
-
 	log.Printf("Found user profile: ID=%d, Email=%s, FullName=%s", user.ID, user.Email, user.FullName)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
 }
+
+// completeLogin finishes a sign-in after the user proved who they are. Users
+// with two-factor authentication get a challenge, everyone else gets tokens.
+func completeLogin(w http.ResponseWriter, r *http.Request, userID int, email string) {
+	// An authenticator app or a registered passkey makes a second factor
+	// mandatory, either one can answer the challenge
+	var methods []string
+	totpEnabled, err := isTOTPEnabled(userID)
+	if err != nil {
+		log.Printf("Error checking two-factor status: %v", err)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if totpEnabled {
+		methods = append(methods, "totp")
+	}
+	if WebAuthn != nil {
+		passkeys, err := hasPasskeys(userID)
+		if err != nil {
+			log.Printf("Error checking passkeys: %v", err)
+			http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+			return
+		}
+		if passkeys {
+			methods = append(methods, "passkey")
+		}
+	}
+
+	if len(methods) > 0 {
+		challenge, err := createMFAChallenge(userID)
+		if err != nil {
+			log.Printf("Error creating MFA challenge: %v", err)
+			http.Error(w, `{"error": "Failed to start two-factor login"}`, http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Two-factor authentication required for user: %s", email)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    challenge,
+			"mfa_methods":  methods,
+			"expires_in":   int(mfaChallengeTTL.Seconds()),
+		})
+		return
+	}
+
+	// Generate access and refresh tokens
+	tokens, err := issueTokens(r, userID)
+	if err != nil {
+		log.Printf("Error generating tokens: %v", err)
+		http.Error(w, `{"error": "Failed to generate token"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Successfully logged in user: %s", email)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"defenzo/config"
+)
+
+func TestEmailIsCaseInsensitive(t *testing.T) {
+	const password = "Correct-Horse-Battery-9"
+	w := callHandler(t, Register, "", map[string]string{"email": " Mixed.Case@Example.com ", "password": password, "full_name": "Mixed"})
+	if w.Code/100 != 2 {
+		t.Fatalf("register returned %d: %s", w.Code, w.Body)
+	}
+	var stored string
+	if err := config.DB.QueryRow("SELECT email FROM users WHERE email = ?", "mixed.case@example.com").Scan(&stored); err != nil {
+		t.Fatalf("the address was not stored in lowercase: %v", err)
+	}
+
+	for _, email := range []string{"mixed.case@example.com", "MIXED.CASE@example.com"} {
+		if w := callHandler(t, Login, "", map[string]string{"email": email, "password": password}); w.Code != http.StatusOK {
+			t.Fatalf("login as %s returned %d: %s", email, w.Code, w.Body)
+		}
+	}
+
+	w = callHandler(t, Register, "", map[string]string{"email": "MIXED.case@example.com", "password": password, "full_name": "Again"})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("registering the address again in another case returned %d, want 400", w.Code)
+	}
+
+	// The database holds the line even when the check in Register is raced
+	if _, err := config.DB.Exec(
+		"INSERT INTO users (email, password_hash, full_name, created_at) VALUES ('Mixed.Case@example.com', '', 'Race', datetime('now'))",
+	); err == nil {
+		t.Fatal("a second account with the address in another case was stored")
+	}
+}
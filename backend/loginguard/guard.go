@@ -0,0 +1,426 @@
+// Package loginguard slows down and locks out repeated failed logins.
+//
+// Failures are counted per key, such as "account:alice@example.com" or
+// "ip:203.0.113.7". After a few free attempts every further attempt has to
+// wait for an exponentially growing delay, and after too many failures the
+// key is locked for a while. State lives in SQLite so it survives restarts.
+package loginguard
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"strings"
+	"time"
+)
+
+// Key kinds used by the login handler
+const (
+	KindAccount = "account"
+	KindIP      = "ip"
+)
+
+// Policy controls how quickly a key is slowed down and locked
+type Policy struct {
+	// FreeAttempts is the number of failures allowed before delays start
+	FreeAttempts int
+	// BaseDelay is the delay after the first failure past FreeAttempts, doubling each time
+	BaseDelay time.Duration
+	// MaxDelay caps the progressive delay
+	MaxDelay time.Duration
+	// MaxFailures locks the key once reached
+	MaxFailures int
+	// LockoutDuration is how long a lockout lasts
+	LockoutDuration time.Duration
+	// Window forgets failures older than this
+	Window time.Duration
+}
+
+// DefaultPolicies are used by New. IPs get more room because of shared NATs.
+var DefaultPolicies = map[string]Policy{
+	KindAccount: {
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		MaxFailures:     10,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	},
+	KindIP: {
+		FreeAttempts:    10,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		MaxFailures:     50,
+		LockoutDuration: time.Hour,
+		Window:          time.Hour,
+	},
+}
+
+// Entry is the stored state of one key
+type Entry struct {
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+
+	// pending counts attempts reserved and not yet failed or released
+	pending    int
+	reservedAt time.Time
+}
+
+// reservationTimeout forgets reservations of attempts that never finished,
+// such as those of a request that crashed
+const reservationTimeout = time.Minute
+
+// Guard tracks failed attempts in the login_throttle table
+type Guard struct {
+	DB       *sql.DB
+	Policies map[string]Policy
+	// Now returns the current time and can be replaced in tests
+	Now func() time.Time
+	// OnLockout is called whenever a key gets locked
+	OnLockout func(entry Entry)
+}
+
+// New creates a guard with the default policies and the real clock
+func New(db *sql.DB) *Guard {
+	return &Guard{DB: db, Policies: DefaultPolicies, Now: time.Now}
+}
+
+// Key builds a key of the given kind, values are case insensitive
+func Key(kind, value string) string {
+	return kind + ":" + strings.ToLower(strings.TrimSpace(value))
+}
+
+// policy returns the policy for the kind encoded in the key
+func (g *Guard) policy(key string) Policy {
+	kind, _, _ := strings.Cut(key, ":")
+	if p, ok := g.Policies[kind]; ok {
+		return p
+	}
+	return g.Policies[KindAccount]
+}
+
+// querier runs the queries of the guard, on the database or on a connection
+// holding a write transaction
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// inWriteTx runs fn in a transaction that holds the write lock from the
+// start, so no other attempt can read the counters until it is done
+func (g *Guard) inWriteTx(fn func(q querier) error) error {
+	ctx := context.Background()
+	conn, err := g.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return err
+	}
+	if err := fn(conn); err != nil {
+		conn.ExecContext(ctx, "ROLLBACK")
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		conn.ExecContext(ctx, "ROLLBACK")
+		return err
+	}
+	return nil
+}
+
+// load reads the state of a key, returning a zero entry if there is none
+func (g *Guard) load(q querier, key string) (Entry, error) {
+	entry := Entry{Key: key}
+	var lastFailure string
+	var lockedUntil, reservedAt sql.NullString
+	err := q.QueryRowContext(context.Background(),
+		"SELECT failures, last_failure_at, locked_until, pending, reserved_at FROM login_throttle WHERE key = ?",
+		key,
+	).Scan(&entry.Failures, &lastFailure, &lockedUntil, &entry.pending, &reservedAt)
+	if err == sql.ErrNoRows {
+		return entry, nil
+	} else if err != nil {
+		return entry, err
+	}
+
+	entry.LastFailureAt, _ = time.Parse(time.RFC3339, lastFailure)
+	if lockedUntil.Valid {
+		if t, err := time.Parse(time.RFC3339, lockedUntil.String); err == nil {
+			entry.LockedUntil = &t
+		}
+	}
+	if reservedAt.Valid {
+		entry.reservedAt, _ = time.Parse(time.RFC3339, reservedAt.String)
+	}
+	if g.Now().Sub(entry.reservedAt) > reservationTimeout {
+		entry.pending = 0
+	}
+
+	// Forget failures that are too old to matter
+	if g.Now().Sub(entry.LastFailureAt) > g.policy(key).Window && !entry.locked(g.Now()) {
+		entry.Failures = 0
+	}
+	return entry, nil
+}
+
+// locked reports whether the entry is locked at time now
+func (e Entry) locked(now time.Time) bool {
+	return e.LockedUntil != nil && now.Before(*e.LockedUntil)
+}
+
+// wait returns how long the caller has to wait before the next attempt for
+// this entry. Attempts in progress count as failures until they are over.
+func (g *Guard) wait(entry Entry) time.Duration {
+	now := g.Now()
+	if entry.locked(now) {
+		return entry.LockedUntil.Sub(now)
+	}
+
+	p := g.policy(entry.Key)
+	over := entry.Failures + entry.pending - p.FreeAttempts
+	if over <= 0 {
+		return 0
+	}
+
+	last := entry.LastFailureAt
+	if entry.pending > 0 && entry.reservedAt.After(last) {
+		last = entry.reservedAt
+	}
+
+	delay := time.Duration(float64(p.BaseDelay) * math.Pow(2, float64(over-1)))
+	if delay > p.MaxDelay || delay <= 0 {
+		delay = p.MaxDelay
+	}
+	if remaining := last.Add(delay).Sub(now); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// Check returns how long the caller must wait before attempting a login for
+// any of the keys. Zero means the attempt may proceed.
+func (g *Guard) Check(keys ...string) (time.Duration, error) {
+	return g.check(g.DB, keys)
+}
+
+// check returns the longest wait of the keys
+func (g *Guard) check(q querier, keys []string) (time.Duration, error) {
+	var longest time.Duration
+	for _, key := range keys {
+		entry, err := g.load(q, key)
+		if err != nil {
+			return 0, err
+		}
+		if w := g.wait(entry); w > longest {
+			longest = w
+		}
+	}
+	return longest, nil
+}
+
+// Reserve holds an attempt for every key before it is made, unless one of
+// the keys has to wait, in which case nothing is held and the wait is
+// returned. Checking and holding happen in one transaction, so concurrent
+// attempts cannot all pass the check before any of them counts. A held
+// attempt delays the next ones like a failure but never locks a key: the
+// caller ends it with FailReserved if it failed, or with Release or Succeed.
+func (g *Guard) Reserve(keys ...string) (time.Duration, error) {
+	var wait time.Duration
+	err := g.inWriteTx(func(q querier) error {
+		var err error
+		if wait, err = g.check(q, keys); err != nil || wait > 0 {
+			return err
+		}
+		now := g.Now()
+		for _, key := range keys {
+			entry, err := g.load(q, key)
+			if err != nil {
+				return err
+			}
+			entry.pending++
+			entry.reservedAt = now
+			if err := g.store(q, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return wait, nil
+}
+
+// Fail records a failed attempt for every key and locks keys that reached their limit
+func (g *Guard) Fail(keys ...string) error {
+	return g.fail(keys, false)
+}
+
+// FailReserved records that attempts held by Reserve failed, locking keys
+// that reached their limit
+func (g *Guard) FailReserved(keys ...string) error {
+	return g.fail(keys, true)
+}
+
+// fail counts a failure for every key and notifies about the keys it locked
+func (g *Guard) fail(keys []string, reserved bool) error {
+	var locked []Entry
+	err := g.inWriteTx(func(q querier) error {
+		var err error
+		locked, err = g.count(q, keys, reserved)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	g.notifyLockouts(locked)
+	return nil
+}
+
+// count adds a failure to every key, ending a reservation of it if reserved
+// is set, and returns the entries it locked
+func (g *Guard) count(q querier, keys []string, reserved bool) ([]Entry, error) {
+	now := g.Now()
+	var locked []Entry
+	for _, key := range keys {
+		entry, err := g.load(q, key)
+		if err != nil {
+			return nil, err
+		}
+		if reserved && entry.pending > 0 {
+			entry.pending--
+		}
+
+		p := g.policy(key)
+		entry.Failures++
+		entry.LastFailureAt = now
+		if entry.Failures >= p.MaxFailures {
+			until := now.Add(p.LockoutDuration)
+			entry.LockedUntil = &until
+			entry.Failures = 0
+			locked = append(locked, entry)
+		} else if !entry.locked(now) {
+			entry.LockedUntil = nil
+		}
+
+		if err := g.store(q, entry); err != nil {
+			return nil, err
+		}
+	}
+	return locked, nil
+}
+
+// store writes the state of a key
+func (g *Guard) store(q querier, entry Entry) error {
+	var lockedUntil, reservedAt interface{}
+	if entry.LockedUntil != nil {
+		lockedUntil = entry.LockedUntil.Format(time.RFC3339)
+	}
+	if entry.pending > 0 {
+		reservedAt = entry.reservedAt.Format(time.RFC3339)
+	}
+	_, err := q.ExecContext(context.Background(), `
+		INSERT INTO login_throttle (key, failures, last_failure_at, locked_until, pending, reserved_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET
+			failures = excluded.failures,
+			last_failure_at = excluded.last_failure_at,
+			locked_until = excluded.locked_until,
+			pending = excluded.pending,
+			reserved_at = excluded.reserved_at
+	`, entry.Key, entry.Failures, entry.LastFailureAt.Format(time.RFC3339), lockedUntil, entry.pending, reservedAt)
+	return err
+}
+
+// notifyLockouts calls OnLockout for newly locked keys, once their
+// transaction is over
+func (g *Guard) notifyLockouts(locked []Entry) {
+	if g.OnLockout == nil {
+		return
+	}
+	for _, entry := range locked {
+		g.OnLockout(entry)
+	}
+}
+
+// Release gives back the attempt reserved for the keys, leaving them as
+// they were before the reservation
+func (g *Guard) Release(keys ...string) error {
+	return g.inWriteTx(func(q querier) error {
+		for _, key := range keys {
+			entry, err := g.load(q, key)
+			if err != nil {
+				return err
+			}
+			if entry.pending == 0 {
+				continue
+			}
+			entry.pending--
+			if err := g.store(q, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Succeed forgets the failures of the given keys after a successful login
+func (g *Guard) Succeed(keys ...string) error {
+	for _, key := range keys {
+		if _, err := g.DB.Exec("DELETE FROM login_throttle WHERE key = ?", key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns every key that currently has failures or an active lockout
+func (g *Guard) List() ([]Entry, error) {
+	rows, err := g.DB.Query("SELECT key FROM login_throttle ORDER BY last_failure_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now := g.Now()
+	entries := []Entry{}
+	for _, key := range keys {
+		entry, err := g.load(g.DB, key)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Failures > 0 || entry.locked(now) {
+			if !entry.locked(now) {
+				entry.LockedUntil = nil
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// Clear removes the failures and any lockout of a key
+func (g *Guard) Clear(key string) (bool, error) {
+	result, err := g.DB.Exec("DELETE FROM login_throttle WHERE key = ?", key)
+	if err != nil {
+		return false, err
+	}
+	cleared, err := result.RowsAffected()
+	return cleared > 0, err
+}
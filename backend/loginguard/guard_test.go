@@ -0,0 +1,339 @@
+package loginguard
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// testPolicy allows two free failures, delays of 1s, 2s and 4s after that
+// and locks the key on the sixth failure
+var testPolicy = Policy{
+	FreeAttempts:    2,
+	BaseDelay:       time.Second,
+	MaxDelay:        4 * time.Second,
+	MaxFailures:     6,
+	LockoutDuration: 15 * time.Minute,
+	Window:          time.Hour,
+}
+
+// clock is a fake time source that only moves when told to
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newTestGuard returns a guard on a fresh database, driven by the returned clock
+func newTestGuard(t *testing.T) (*Guard, *clock) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "guard.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec(`CREATE TABLE login_throttle (
+		key TEXT PRIMARY KEY,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_failure_at DATETIME NOT NULL,
+		locked_until DATETIME,
+		pending INTEGER NOT NULL DEFAULT 0,
+		reserved_at DATETIME
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &clock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	g := New(db)
+	g.Policies = map[string]Policy{KindAccount: testPolicy, KindIP: testPolicy}
+	g.Now = c.Now
+	return g, c
+}
+
+func mustWait(t *testing.T, g *Guard, key string, want time.Duration) {
+	t.Helper()
+	got, err := g.Check(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("wait = %v, want %v", got, want)
+	}
+}
+
+func mustFail(t *testing.T, g *Guard, key string) {
+	t.Helper()
+	if err := g.Fail(key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProgressiveDelay(t *testing.T) {
+	g, c := newTestGuard(t)
+	key := Key(KindAccount, "alice@example.com")
+
+	mustFail(t, g, key)
+	mustFail(t, g, key)
+	mustWait(t, g, key, 0)
+
+	mustFail(t, g, key)
+	mustWait(t, g, key, time.Second)
+	c.Advance(time.Second)
+	mustWait(t, g, key, 0)
+
+	mustFail(t, g, key)
+	mustWait(t, g, key, 2*time.Second)
+	c.Advance(500 * time.Millisecond)
+	mustWait(t, g, key, 1500*time.Millisecond)
+	c.Advance(1500 * time.Millisecond)
+
+	mustFail(t, g, key)
+	mustWait(t, g, key, 4*time.Second)
+}
+
+func TestDelayCappedAtMaxDelay(t *testing.T) {
+	g, _ := newTestGuard(t)
+	g.Policies[KindAccount] = Policy{
+		FreeAttempts:    0,
+		BaseDelay:       time.Second,
+		MaxDelay:        3 * time.Second,
+		MaxFailures:     100,
+		LockoutDuration: time.Minute,
+		Window:          time.Hour,
+	}
+	key := Key(KindAccount, "alice@example.com")
+	for i := 0; i < 5; i++ {
+		mustFail(t, g, key)
+	}
+	mustWait(t, g, key, 3*time.Second)
+}
+
+func TestOldFailuresAreForgotten(t *testing.T) {
+	g, c := newTestGuard(t)
+	key := Key(KindAccount, "alice@example.com")
+	for i := 0; i < 4; i++ {
+		mustFail(t, g, key)
+	}
+	mustWait(t, g, key, 2*time.Second)
+
+	c.Advance(testPolicy.Window + time.Second)
+	mustFail(t, g, key)
+	mustWait(t, g, key, 0)
+}
+
+func TestLockoutAndExpiry(t *testing.T) {
+	g, c := newTestGuard(t)
+	var locked []Entry
+	g.OnLockout = func(entry Entry) { locked = append(locked, entry) }
+	key := Key(KindAccount, "alice@example.com")
+
+	for i := 0; i < testPolicy.MaxFailures-1; i++ {
+		mustFail(t, g, key)
+		c.Advance(time.Minute)
+	}
+	if len(locked) != 0 {
+		t.Fatalf("locked after %d failures", testPolicy.MaxFailures-1)
+	}
+
+	mustFail(t, g, key)
+	if len(locked) != 1 {
+		t.Fatalf("OnLockout called %d times, want 1", len(locked))
+	}
+	if locked[0].Key != key || locked[0].LockedUntil == nil || !locked[0].LockedUntil.Equal(c.Now().Add(testPolicy.LockoutDuration)) {
+		t.Fatalf("OnLockout got %+v", locked[0])
+	}
+	mustWait(t, g, key, testPolicy.LockoutDuration)
+
+	c.Advance(testPolicy.LockoutDuration - time.Minute)
+	mustWait(t, g, key, time.Minute)
+	c.Advance(time.Minute)
+	mustWait(t, g, key, 0)
+
+	// The lockout started the count over
+	mustFail(t, g, key)
+	mustWait(t, g, key, 0)
+	if len(locked) != 1 {
+		t.Fatalf("OnLockout called %d times, want 1", len(locked))
+	}
+}
+
+func TestSucceedResets(t *testing.T) {
+	g, _ := newTestGuard(t)
+	account := Key(KindAccount, "alice@example.com")
+	ip := Key(KindIP, "203.0.113.7")
+	for i := 0; i < 4; i++ {
+		if err := g.Fail(account, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustWait(t, g, account, 2*time.Second)
+
+	if err := g.Succeed(account); err != nil {
+		t.Fatal(err)
+	}
+	mustWait(t, g, account, 0)
+	mustWait(t, g, ip, 2*time.Second)
+
+	entries, err := g.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != ip {
+		t.Fatalf("List() = %+v, want only %s", entries, ip)
+	}
+}
+
+func TestReserveCountsAttempt(t *testing.T) {
+	g, _ := newTestGuard(t)
+	account := Key(KindAccount, "alice@example.com")
+	ip := Key(KindIP, "203.0.113.7")
+
+	for i := 0; i < 3; i++ {
+		wait, err := g.Reserve(account, ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != 0 {
+			t.Fatalf("reservation %d waits %v", i+1, wait)
+		}
+	}
+	wait, err := g.Reserve(account, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait != time.Second {
+		t.Fatalf("wait = %v, want 1s", wait)
+	}
+
+	// A refused reservation is not counted, and a held one is not a failure
+	entry, err := g.load(g.DB, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.pending != 3 || entry.Failures != 0 {
+		t.Fatalf("pending = %d, failures = %d, want 3 and 0", entry.pending, entry.Failures)
+	}
+
+	// Failing one and releasing the others leaves a single failure
+	if err := g.FailReserved(ip); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := g.Release(ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustWait(t, g, ip, 0)
+	if entry, _ = g.load(g.DB, ip); entry.pending != 0 || entry.Failures != 1 {
+		t.Fatalf("pending = %d, failures = %d after release, want 0 and 1", entry.pending, entry.Failures)
+	}
+}
+
+func TestReservationOnlyLocksOnFailure(t *testing.T) {
+	g, c := newTestGuard(t)
+	var locked []Entry
+	g.OnLockout = func(entry Entry) { locked = append(locked, entry) }
+	key := Key(KindAccount, "alice@example.com")
+	for i := 0; i < testPolicy.MaxFailures-1; i++ {
+		mustFail(t, g, key)
+	}
+	c.Advance(time.Minute)
+	before, err := g.load(g.DB, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last attempt before the lockout succeeds: nothing is locked and the
+	// key is left as it was
+	if wait, err := g.Reserve(key); err != nil || wait != 0 {
+		t.Fatalf("Reserve() = %v, %v", wait, err)
+	}
+	if len(locked) != 0 {
+		t.Fatal("OnLockout called for a reservation")
+	}
+	if err := g.Release(key); err != nil {
+		t.Fatal(err)
+	}
+	after, err := g.load(g.DB, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Failures != before.Failures || !after.LastFailureAt.Equal(before.LastFailureAt) || after.LockedUntil != nil || after.pending != 0 {
+		t.Fatalf("after release = %+v, want %+v", after, before)
+	}
+	mustWait(t, g, key, 0)
+
+	// The same attempt failing locks the key
+	if wait, err := g.Reserve(key); err != nil || wait != 0 {
+		t.Fatalf("Reserve() = %v, %v", wait, err)
+	}
+	if err := g.FailReserved(key); err != nil {
+		t.Fatal(err)
+	}
+	if len(locked) != 1 {
+		t.Fatalf("OnLockout called %d times, want 1", len(locked))
+	}
+	mustWait(t, g, key, testPolicy.LockoutDuration)
+}
+
+func TestAbandonedReservationExpires(t *testing.T) {
+	g, c := newTestGuard(t)
+	key := Key(KindAccount, "alice@example.com")
+	for i := 0; i < testPolicy.FreeAttempts+1; i++ {
+		if _, err := g.Reserve(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustWait(t, g, key, time.Second)
+
+	c.Advance(reservationTimeout + time.Second)
+	mustWait(t, g, key, 0)
+}
+
+func TestReserveIsAtomic(t *testing.T) {
+	g, _ := newTestGuard(t)
+	key := Key(KindAccount, "alice@example.com")
+
+	const attempts = 40
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, err := g.Reserve(key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if wait == 0 {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The free attempts and the one after them pass, the rest must wait
+	if want := testPolicy.FreeAttempts + 1; allowed != want {
+		t.Fatalf("%d of %d parallel attempts allowed, want %d", allowed, attempts, want)
+	}
+}
@@ -0,0 +1,57 @@
+// Package mailer delivers transactional email such as password reset links.
+package mailer
+
+import (
+	"log"
+	"os"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email messages
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Default is the mailer used by the handlers, configured by InitMailer
+var Default Mailer = &OutboxMailer{Dir: "outbox"}
+
+// InitMailer selects the mail driver from the environment.
+//
+// MAIL_DRIVER=smtp sends through SMTP_HOST/SMTP_PORT using SMTP_USERNAME,
+// SMTP_PASSWORD and MAIL_FROM. Anything else writes messages to MAIL_OUTBOX_DIR
+// (default "outbox") so the app can be tested without a mail server.
+func InitMailer() {
+	switch os.Getenv("MAIL_DRIVER") {
+	case "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		Default = &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}
+		log.Printf("Mailer configured to use SMTP server %s:%s", os.Getenv("SMTP_HOST"), port)
+	default:
+		dir := os.Getenv("MAIL_OUTBOX_DIR")
+		if dir == "" {
+			dir = "outbox"
+		}
+		Default = &OutboxMailer{Dir: dir}
+		log.Printf("Mailer configured to write messages to %s/", dir)
+	}
+}
+
+// Send delivers a message through the default mailer
+func Send(msg Message) error {
+	return Default.Send(msg)
+}
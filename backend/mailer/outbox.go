@@ -0,0 +1,30 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// OutboxMailer writes each message to an .eml file instead of sending it
+type OutboxMailer struct {
+	Dir string
+}
+
+// Send implements Mailer
+func (m *OutboxMailer) Send(msg Message) error {
+	if err := os.MkdirAll(m.Dir, 0700); err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	filename := fmt.Sprintf("%s_%s.eml", time.Now().Format("20060102T150405"), hex.EncodeToString(suffix))
+
+	return os.WriteFile(filepath.Join(m.Dir, filename), formatMessage("no-reply@defenzo.local", msg), 0600)
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"defenzo/config"
+	"defenzo/content"
+	"defenzo/handlers"
+	"defenzo/mailer"
+	"defenzo/middleware"
 	"defenzo/routes"
 	"log"
 	"net/http"
@@ -27,6 +31,43 @@ func main() {
 	// Initialize database
 	config.InitDB()
 	config.MigrateDB()
+	if !config.FullTextSearch {
+		log.Fatalf("SQLite was built without FTS5, which search needs: build with -tags sqlite_fts5")
+	}
+
+	// Run a command instead of the server, such as "defenzo content import courses.json"
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "content":
+			os.Exit(content.Run(os.Args[2:]))
+		default:
+			log.Fatalf("Unknown command %q, the only command is content", os.Args[1])
+		}
+	}
+
+	config.BootstrapAdmin()
+
+	// Load token signing keys
+	middleware.InitKeys()
+
+	// Configure outgoing email
+	mailer.InitMailer()
+
+	// Set up brute-force protection for logins
+	handlers.InitLoginGuard()
+
+	// Load the minimum password strength
+	handlers.InitPasswordPolicy()
+
+	// Load "Sign in with..." providers
+	handlers.InitOIDC()
+	handlers.InitWebAuthn()
+
+	// Remove accounts whose deletion grace period has ended
+	handlers.StartAccountPurge()
+
+	// Drop audit events older than the retention period
+	handlers.StartAuditRetention()
 
 	// Create router
 	r := mux.NewRouter()
@@ -41,6 +82,7 @@ func main() {
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Content-Type", "Authorization", "Accept"},
+		ExposedHeaders:   []string{"X-Next-Cursor"},
 		AllowCredentials: true,
 		MaxAge:           300, // Maximum age for browser to cache the response
 	})
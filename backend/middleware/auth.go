@@ -1,68 +1,143 @@
 package middleware
 
 import (
-	"fmt"
+	"log"
 	"net/http"
-	"strconv"
+	"strings"
+
+	"defenzo/config"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var JWTSecret = []byte("your_secret_key_here") // Change this to a secure random value in production
-
 // AuthMiddleware is a middleware that checks for a valid JWT token
 func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(userIDHeader)
+
 		// Get token from Authorization header
-		tokenString := r.Header.Get("Authorization")
-		if tokenString == "" {
+		if r.Header.Get("Authorization") == "" {
 			http.Error(w, `{"error": "Authorization token required"}`, http.StatusUnauthorized)
 			return
 		}
 
-		// Remove "Bearer " prefix if present
-		if len(tokenString) > 7 && tokenString[:7] == "Bearer " {
-			tokenString = tokenString[7:]
-		}
-
-		// Parse and validate token
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return JWTSecret, nil
-		})
-		if err != nil {
-			http.Error(w, `{"error": "Invalid token"}`, http.StatusUnauthorized)
+		identity, authErr := authenticate(r)
+		if authErr != nil {
+			http.Error(w, authErr.body, authErr.status)
 			return
 		}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			http.Error(w, `{"error": "Invalid token claims"}`, http.StatusUnauthorized)
+		next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), identity)))
+	}
+}
+
+// OptionalAuth lets anonymous requests through and authenticates the rest.
+// A request that sends a token must send a valid one, so an expired token is
+// answered with 401 and the client can refresh instead of silently being
+// treated as anonymous.
+func OptionalAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(userIDHeader)
+
+		if r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Add user ID to request context
-		userID, ok := claims["user_id"].(float64)
-		if !ok {
-			http.Error(w, `{"error": "Invalid user ID in token"}`, http.StatusUnauthorized)
+		identity, authErr := authenticate(r)
+		if authErr != nil {
+			http.Error(w, authErr.body, authErr.status)
 			return
 		}
 
-		// Add user ID to request context
-		r.Header.Set("X-User-ID", fmt.Sprintf("%d", int(userID)))
-
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), identity)))
 	}
 }
 
-// GetUserID extracts the user ID from the request context
-func GetUserID(r *http.Request) (int, error) {
-	userIDStr := r.Header.Get("X-User-ID")
-	if userIDStr == "" {
-		return 0, fmt.Errorf("user ID not found in request context")
+// authError is an authentication failure and the response it results in
+type authError struct {
+	status int
+	body   string
+}
+
+// authenticate validates the bearer token of the request and returns who sent it
+func authenticate(r *http.Request) (*Identity, *authError) {
+	tokenString := r.Header.Get("Authorization")
+
+	// Remove "Bearer " prefix if present
+	if len(tokenString) > 7 && tokenString[:7] == "Bearer " {
+		tokenString = tokenString[7:]
 	}
-	userID, err := strconv.Atoi(userIDStr)
+
+	if strings.HasPrefix(tokenString, APITokenPrefix) {
+		return authenticateAPIToken(r, tokenString)
+	}
+
+	// Parse and validate token
+	token, err := ParseToken(tokenString)
 	if err != nil {
-		return 0, fmt.Errorf("invalid user ID format: %v", err)
+		return nil, &authError{http.StatusUnauthorized, `{"error": "Invalid token"}`}
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, &authError{http.StatusUnauthorized, `{"error": "Invalid token claims"}`}
 	}
-	return userID, nil
+
+	userID, ok := claims["user_id"].(float64)
+	if !ok {
+		return nil, &authError{http.StatusUnauthorized, `{"error": "Invalid user ID in token"}`}
+	}
+
+	// Every access token carries an ID so that it can be revoked on logout
+	tokenID, ok := claims["jti"].(string)
+	if !ok || tokenID == "" {
+		return nil, &authError{http.StatusUnauthorized, `{"error": "Invalid token"}`}
+	}
+
+	issuedAt, err := claims.GetIssuedAt()
+	if err != nil || issuedAt == nil {
+		return nil, &authError{http.StatusUnauthorized, `{"error": "Invalid token"}`}
+	}
+
+	revoked, err := isTokenRevoked(tokenID, int(userID), issuedAt.Unix())
+	if err != nil {
+		log.Printf("Error checking token revocation: %v", err)
+		return nil, &authError{http.StatusInternalServerError, `{"error": "Database error"}`}
+	}
+	if revoked {
+		return nil, &authError{http.StatusUnauthorized, `{"error": "Token has been revoked"}`}
+	}
+
+	// The token must belong to a session that has not been signed out
+	sessionID, _ := claims["sid"].(string)
+	active, err := sessionExists(sessionID, int(userID))
+	if err != nil {
+		log.Printf("Error checking session: %v", err)
+		return nil, &authError{http.StatusInternalServerError, `{"error": "Database error"}`}
+	}
+	if !active {
+		return nil, &authError{http.StatusUnauthorized, `{"error": "Session has ended"}`}
+	}
+	if err := TouchSession(sessionID, r); err != nil {
+		log.Printf("Error updating session: %v", err)
+	}
+
+	return &Identity{
+		UserID:    int(userID),
+		SessionID: sessionID,
+		TokenID:   tokenID,
+		Claims:    claims,
+	}, nil
+}
+
+// isTokenRevoked reports whether the token ID was revoked before it expired, or
+// whether the user signed out everywhere after the token was issued
+func isTokenRevoked(tokenID string, userID int, issuedAt int64) (bool, error) {
+	var revoked bool
+	err := config.DB.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = ?)
+			OR EXISTS(SELECT 1 FROM users WHERE id = ? AND tokens_valid_after > ?)
+	`, tokenID, userID, issuedAt).Scan(&revoked)
+	return revoked, err
 }
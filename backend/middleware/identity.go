@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// userIDHeader used to carry the authenticated user between middleware and
+// handlers. It is removed from every request so a client cannot set it.
+const userIDHeader = "X-User-ID"
+
+type contextKey string
+
+const identityContextKey contextKey = "identity"
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	UserID    int
+	SessionID string
+	TokenID   string
+	// Claims are the verified claims of the access token, nil for API tokens
+	Claims jwt.MapClaims
+	// APITokenID is set when the request used a personal access token
+	APITokenID int
+	// Scopes limit what an API token may do, login tokens have none and may do everything
+	Scopes []string
+}
+
+// withIdentity returns a copy of ctx carrying the identity
+func withIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey, identity)
+}
+
+// GetIdentity returns the authenticated caller, ok is false for anonymous requests
+func GetIdentity(r *http.Request) (*Identity, bool) {
+	identity, ok := r.Context().Value(identityContextKey).(*Identity)
+	return identity, ok && identity != nil
+}
+
+// GetTokenClaims returns the claims of the access token that authenticated the request
+func GetTokenClaims(r *http.Request) (jwt.MapClaims, bool) {
+	identity, ok := GetIdentity(r)
+	if !ok {
+		return nil, false
+	}
+	return identity.Claims, true
+}
+
+// GetUserID returns the ID of the authenticated user, or an error for
+// anonymous requests
+func GetUserID(r *http.Request) (int, error) {
+	identity, ok := GetIdentity(r)
+	if !ok {
+		return 0, fmt.Errorf("user ID not found in request context")
+	}
+	return identity.UserID, nil
+}
+
+// StripIdentityHeaders removes identity headers sent by clients before any
+// handler runs, for routes with and without authentication alike
+func StripIdentityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(userIDHeader)
+		next.ServeHTTP(w, r)
+	})
+}
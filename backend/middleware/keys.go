@@ -0,0 +1,232 @@
+package middleware
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is one key that access tokens can be signed or verified with
+type SigningKey struct {
+	ID         string
+	PrivateKey interface{}
+	PublicKey  interface{}
+}
+
+// KeySet holds every key accepted for verification and the one used for signing.
+// Rotating means adding a new key, making it active, and removing the old key
+// once tokens signed with it have expired.
+type KeySet struct {
+	Method    jwt.SigningMethod
+	ActiveKID string
+	Keys      map[string]*SigningKey
+}
+
+// Keys is the key set used to sign and verify access tokens, configured by InitKeys
+var Keys *KeySet
+
+// InitKeys loads the signing keys from the environment.
+//
+// JWT_ALGORITHM selects HS256 (default), RS256 or EdDSA. Every other algorithm
+// is rejected when tokens are verified. JWT_KEYS is a comma separated list of
+// kid=value pairs, where value is the shared secret for HS256 or the path to a
+// PEM encoded private key for RS256 and EdDSA. JWT_ACTIVE_KID picks the key that
+// signs new tokens and defaults to the first one. A single JWT_SECRET is also
+// accepted as key "default".
+func InitKeys() {
+	keys, err := LoadKeys(os.Getenv("JWT_ALGORITHM"), os.Getenv("JWT_KEYS"), os.Getenv("JWT_ACTIVE_KID"))
+	if err != nil {
+		log.Fatalf("Failed to load JWT signing keys: %v", err)
+	}
+	Keys = keys
+	log.Printf("JWT signing configured: algorithm %s, active key %q, %d key(s) accepted",
+		Keys.Method.Alg(), Keys.ActiveKID, len(Keys.Keys))
+}
+
+// LoadKeys builds a key set from the configuration values described in InitKeys
+func LoadKeys(algorithm, keyList, activeKID string) (*KeySet, error) {
+	if algorithm == "" {
+		algorithm = jwt.SigningMethodHS256.Alg()
+	}
+
+	var method jwt.SigningMethod
+	switch algorithm {
+	case jwt.SigningMethodHS256.Alg():
+		method = jwt.SigningMethodHS256
+	case jwt.SigningMethodRS256.Alg():
+		method = jwt.SigningMethodRS256
+	case jwt.SigningMethodEdDSA.Alg():
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", algorithm)
+	}
+
+	if keyList == "" && os.Getenv("JWT_SECRET") != "" && method == jwt.SigningMethodHS256 {
+		keyList = "default=" + os.Getenv("JWT_SECRET")
+	}
+
+	set := &KeySet{Method: method, Keys: map[string]*SigningKey{}}
+	var order []string
+	for _, entry := range strings.Split(keyList, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kid, value, ok := strings.Cut(entry, "=")
+		if !ok || kid == "" || value == "" {
+			return nil, fmt.Errorf("invalid JWT_KEYS entry %q, expected kid=value", entry)
+		}
+		if _, exists := set.Keys[kid]; exists {
+			return nil, fmt.Errorf("duplicate key ID %q", kid)
+		}
+
+		key, err := loadKey(method, kid, value)
+		if err != nil {
+			return nil, err
+		}
+		set.Keys[kid] = key
+		order = append(order, kid)
+	}
+
+	if len(set.Keys) == 0 {
+		if method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("JWT_KEYS is required for %s", method.Alg())
+		}
+
+		// Without configuration fall back to a random secret. Tokens will not
+		// survive a restart, but nothing is signed with a well-known value.
+		log.Printf("Warning: no JWT keys configured, generating a temporary signing key")
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		set.Keys["ephemeral"] = &SigningKey{ID: "ephemeral", PrivateKey: secret, PublicKey: secret}
+		order = append(order, "ephemeral")
+	}
+
+	set.ActiveKID = activeKID
+	if set.ActiveKID == "" {
+		set.ActiveKID = order[0]
+	}
+	if _, ok := set.Keys[set.ActiveKID]; !ok {
+		return nil, fmt.Errorf("active key ID %q is not in JWT_KEYS", set.ActiveKID)
+	}
+	return set, nil
+}
+
+// loadKey parses a single configured key for the given signing method
+func loadKey(method jwt.SigningMethod, kid, value string) (*SigningKey, error) {
+	if method == jwt.SigningMethodHS256 {
+		if len(value) < 32 {
+			return nil, fmt.Errorf("key %q must be at least 32 characters long", kid)
+		}
+		return &SigningKey{ID: kid, PrivateKey: []byte(value), PublicKey: []byte(value)}, nil
+	}
+
+	pemData, err := os.ReadFile(value)
+	if err != nil {
+		return nil, fmt.Errorf("reading key %q: %v", kid, err)
+	}
+
+	switch method {
+	case jwt.SigningMethodRS256:
+		privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pemData)
+		if err != nil {
+			return nil, fmt.Errorf("parsing RSA key %q: %v", kid, err)
+		}
+		return &SigningKey{ID: kid, PrivateKey: privateKey, PublicKey: &privateKey.PublicKey}, nil
+	default:
+		privateKey, err := jwt.ParseEdPrivateKeyFromPEM(pemData)
+		if err != nil {
+			return nil, fmt.Errorf("parsing Ed25519 key %q: %v", kid, err)
+		}
+		edKey, ok := privateKey.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("key %q is not an Ed25519 key", kid)
+		}
+		return &SigningKey{ID: kid, PrivateKey: edKey, PublicKey: edKey.Public()}, nil
+	}
+}
+
+// SignToken signs the claims with the active key and records its ID in the kid header
+func SignToken(claims jwt.Claims) (string, error) {
+	key := Keys.Keys[Keys.ActiveKID]
+	token := jwt.NewWithClaims(Keys.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.PrivateKey)
+}
+
+// ParseToken verifies a token against the key named in its kid header. Only
+// the configured algorithm is accepted, so "none" or an HMAC token signed
+// with a public key are rejected.
+func ParseToken(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			return nil, fmt.Errorf("token has no key ID")
+		}
+		key, ok := Keys.Keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key ID %q", kid)
+		}
+		return key.PublicKey, nil
+	}, jwt.WithValidMethods([]string{Keys.Method.Alg()}))
+}
+
+// JWK is the public part of a signing key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+// PublicJWKs returns the verification keys other services can use to check
+// our tokens. Shared HMAC secrets are never published, so the list is empty
+// when HS256 is configured.
+func PublicJWKs() []JWK {
+	kids := make([]string, 0, len(Keys.Keys))
+	for kid := range Keys.Keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	jwks := []JWK{}
+	for _, kid := range kids {
+		key := Keys.Keys[kid]
+		switch pub := key.PublicKey.(type) {
+		case *rsa.PublicKey:
+			jwks = append(jwks, JWK{
+				KeyType:   "RSA",
+				KeyID:     key.ID,
+				Use:       "sig",
+				Algorithm: Keys.Method.Alg(),
+				N:         base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			jwks = append(jwks, JWK{
+				KeyType:   "OKP",
+				KeyID:     key.ID,
+				Use:       "sig",
+				Algorithm: Keys.Method.Alg(),
+				Curve:     "Ed25519",
+				X:         base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+	return jwks
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// GetRoles returns the roles embedded in the access token of the request
+func GetRoles(r *http.Request) []string {
+	claims, ok := GetTokenClaims(r)
+	if !ok {
+		return nil
+	}
+
+	list, ok := claims["roles"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	roles := make([]string, 0, len(list))
+	for _, role := range list {
+		if name, ok := role.(string); ok {
+			roles = append(roles, name)
+		}
+	}
+	return roles
+}
+
+// HasRole reports whether the authenticated user holds the given role
+func HasRole(r *http.Request, role string) bool {
+	for _, held := range GetRoles(r) {
+		if held == role {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireRole only lets requests through if the user holds one of the given
+// roles. It must be wrapped by AuthMiddleware, for example:
+//
+//	middleware.AuthMiddleware(middleware.RequireRole("admin")(handlers.ListUsers))
+func RequireRole(roles ...string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			for _, role := range roles {
+				if HasRole(r, role) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			http.Error(w, `{"error": "Forbidden"}`, http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"defenzo/config"
+)
+
+// sessionTouchInterval limits how often last_seen_at is written for a session
+const sessionTouchInterval = time.Minute
+
+// GetSessionID returns the ID of the session the request's access token belongs to
+func GetSessionID(r *http.Request) string {
+	identity, ok := GetIdentity(r)
+	if !ok {
+		return ""
+	}
+	return identity.SessionID
+}
+
+// sessionExists reports whether the session is still active
+func sessionExists(sessionID string, userID int) (bool, error) {
+	var exists bool
+	err := config.DB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM sessions WHERE id = ? AND user_id = ?)",
+		sessionID, userID,
+	).Scan(&exists)
+	return exists, err
+}
+
+// TouchSession records that the session was just used from the request's IP
+func TouchSession(sessionID string, r *http.Request) error {
+	now := time.Now()
+	_, err := config.DB.Exec(
+		"UPDATE sessions SET last_seen_at = ?, ip = ? WHERE id = ? AND last_seen_at < ?",
+		now.Format(time.RFC3339),
+		ClientIP(r),
+		sessionID,
+		now.Add(-sessionTouchInterval).Format(time.RFC3339),
+	)
+	return err
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+
+	"defenzo/config"
+)
+
+// EmailVerificationRequired reports whether unverified accounts are limited.
+// It is controlled by the REQUIRE_EMAIL_VERIFICATION environment variable.
+func EmailVerificationRequired() bool {
+	return os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true"
+}
+
+// VerifiedAuthMiddleware wraps AuthMiddleware and, when email verification is
+// required, rejects users who have not confirmed their email address yet
+func VerifiedAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if !EmailVerificationRequired() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		userID, err := GetUserID(r)
+		if err != nil {
+			http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+
+		var verifiedAt sql.NullString
+		err = config.DB.QueryRow("SELECT email_verified_at FROM users WHERE id = ?", userID).Scan(&verifiedAt)
+		if err != nil {
+			log.Printf("Error checking email verification: %v", err)
+			http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		if !verifiedAt.Valid {
+			http.Error(w, `{"error": "Email address must be verified first"}`, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -11,22 +11,66 @@ type ScanResult struct {
 	Error string `json:"error,omitempty"`
 }
 
-// PasswordCheckResult represents the response for password complexity
-type PasswordCheckResult struct {
-	Score       int      `json:"score"`
-	Label       string   `json:"label"`
-	Suggestions []string `json:"suggestions"`
-}
+// Roles a user can hold, every user is at least a learner
+const (
+	RoleLearner    = "learner"
+	RoleInstructor = "instructor"
+	RoleAdmin      = "admin"
+)
+
+// Roles a user can hold within an organization
+const (
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+// Scopes a personal access token can be granted
+const (
+	ScopeScan         = "scan"
+	ScopeProgressRead = "progress:read"
+	ScopeBadgesRead   = "badges:read"
+)
+
+// APITokenScopes lists every scope in the order shown to users
+var APITokenScopes = []string{ScopeScan, ScopeProgressRead, ScopeBadgesRead}
 
 // User represents a user in the system
 type User struct {
-	ID                int    `json:"id"`
-	Email             string `json:"email"`
-	FullName          string `json:"full_name"`
-	ProfilePictureURL string `json:"profile_picture_url"`
-	CreatedAt         string `json:"created_at"`
+	ID                int      `json:"id"`
+	Email             string   `json:"email"`
+	FullName          string   `json:"full_name"`
+	ProfilePictureURL string   `json:"profile_picture_url"`
+	EmailVerified     bool     `json:"email_verified"`
+	PendingEmail      string   `json:"pending_email,omitempty"`
+	Roles             []string `json:"roles,omitempty"`
+	CreatedAt         string   `json:"created_at"`
 }
 
+// Publication states of a course, drafts are only visible to admins
+const (
+	CourseStatusDraft     = "draft"
+	CourseStatusPublished = "published"
+)
+
+// States of a course revision. A draft is submitted for review, approved or
+// sent back to draft, then published. Publishing retires the revision that
+// was live before.
+const (
+	RevisionDraft     = "draft"
+	RevisionInReview  = "in_review"
+	RevisionApproved  = "approved"
+	RevisionPublished = "published"
+	RevisionRetired   = "retired"
+)
+
+// Lesson types the app knows how to display
+const (
+	LessonTypeDialog         = "dialog"
+	LessonTypeCards          = "cards"
+	LessonTypeScenario       = "scenario"
+	LessonTypeChatSimulation = "chat_simulation"
+)
+
 // Course represents a course in the system
 type Course struct {
 	ID          string   `json:"id"`
@@ -41,7 +85,15 @@ type Course struct {
 	Rating      float64  `json:"rating"`
 	Learners    int      `json:"learners"`
 	Recommended bool     `json:"recommended"`
-	Lessons     []Lesson `json:"lessons"`
+	Status      string   `json:"status,omitempty"`
+	// Version is the live revision of the course, 0 before the first one
+	Version int      `json:"version,omitempty"`
+	Lessons []Lesson `json:"lessons"`
+	// LastAccessed is when the caller last worked on the course, if ever
+	LastAccessed string `json:"last_accessed,omitempty"`
+	// NextLessonID is the first lesson the caller has not completed, where
+	// they resume the course. It is empty once every lesson is completed.
+	NextLessonID string `json:"next_lesson_id,omitempty"`
 }
 
 // Lesson represents a lesson in a course
@@ -54,6 +106,8 @@ type Lesson struct {
 	Content   string `json:"content"`
 	OrderNum  int    `json:"order_num"`
 	Completed bool   `json:"completed"`
+	// LastAccessed is when the caller last worked on the lesson, if ever
+	LastAccessed string `json:"last_accessed,omitempty"`
 }
 
 // UserProgress represents a user's progress in a course
@@ -65,6 +119,8 @@ type UserProgress struct {
 	Completed    bool   `json:"completed"`
 	Progress     int    `json:"progress"`
 	LastAccessed string `json:"last_accessed"`
-	CourseTitle  string `json:"course_title,omitempty"`
-	LessonTitle  string `json:"lesson_title,omitempty"`
+	// CourseVersion is the version of the course the progress was made in
+	CourseVersion int    `json:"course_version,omitempty"`
+	CourseTitle   string `json:"course_title,omitempty"`
+	LessonTitle   string `json:"lesson_title,omitempty"`
 }
@@ -0,0 +1,440 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID     = "client-id"
+	testClientSecret = "client-secret"
+	testRedirectURL  = "https://app.example/api/oidc/test/callback"
+)
+
+// fakeIssuer is an OpenID provider serving discovery, keys and the token endpoint
+type fakeIssuer struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu           sync.Mutex
+	keys         map[string]*ecdsa.PrivateKey
+	jwksRequests int
+	// grants maps authorization codes to the PKCE challenge they were
+	// requested with and the ID token they are exchanged for
+	grants map[string]grant
+}
+
+type grant struct {
+	challenge string
+	idToken   string
+}
+
+// testClock is a fake time source for the provider
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newTestProvider starts a fake issuer publishing key "k1" and returns a
+// provider configured for it, driven by the returned clock
+func newTestProvider(t *testing.T) (*fakeIssuer, *Provider, *testClock) {
+	t.Helper()
+	f := &fakeIssuer{t: t, keys: map[string]*ecdsa.PrivateKey{}, grants: map[string]grant{}}
+	f.addKey("k1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Metadata{
+			Issuer:                f.server.URL,
+			AuthorizationEndpoint: f.server.URL + "/authorize",
+			TokenEndpoint:         f.server.URL + "/token",
+			JWKSURI:               f.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", f.serveKeys)
+	mux.HandleFunc("/token", f.serveToken)
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+
+	clock := &testClock{now: time.Now().Truncate(time.Second)}
+	p := NewProvider("test", f.server.URL, testClientID, testClientSecret, testRedirectURL)
+	p.HTTPClient = f.server.Client()
+	p.Now = clock.Now
+	return f, p, clock
+}
+
+// addKey generates and publishes a new signing key
+func (f *fakeIssuer) addKey(kid string) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.mu.Lock()
+	f.keys[kid] = key
+	f.mu.Unlock()
+	return key
+}
+
+func (f *fakeIssuer) serveKeys(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.jwksRequests++
+	var keys []jsonWebKey
+	for kid, key := range f.keys {
+		keys = append(keys, jsonWebKey{
+			KeyType: "EC",
+			KeyID:   kid,
+			Use:     "sig",
+			Curve:   "P-256",
+			X:       base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			Y:       base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func (f *fakeIssuer) serveToken(w http.ResponseWriter, r *http.Request) {
+	fail := func(reason string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": reason})
+	}
+	if id, secret, _ := r.BasicAuth(); id != testClientID || secret != testClientSecret {
+		fail("bad client credentials")
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != testRedirectURL {
+		fail("bad grant")
+		return
+	}
+
+	f.mu.Lock()
+	g, ok := f.grants[r.PostFormValue("code")]
+	delete(f.grants, r.PostFormValue("code"))
+	f.mu.Unlock()
+	if !ok {
+		fail("unknown code")
+		return
+	}
+	if CodeChallenge(r.PostFormValue("code_verifier")) != g.challenge {
+		fail("PKCE verification failed")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": g.idToken})
+}
+
+// authorize plays the user signing in at the authorization URL and returns
+// the code the provider redirects back with
+func (f *fakeIssuer) authorize(authURL, idToken string) (code, state string) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		f.t.Fatalf("code_challenge_method = %q", query.Get("code_challenge_method"))
+	}
+	code = "code-" + query.Get("state")
+	f.mu.Lock()
+	f.grants[code] = grant{challenge: query.Get("code_challenge"), idToken: idToken}
+	f.mu.Unlock()
+	return code, query.Get("state")
+}
+
+// claims returns valid ID token claims for the nonce
+func (f *fakeIssuer) claims(now time.Time, nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            f.server.URL,
+		"aud":            testClientID,
+		"sub":            "subject-1",
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+	}
+}
+
+// sign signs claims as an ES256 ID token with the named key
+func (f *fakeIssuer) sign(kid string, claims jwt.MapClaims) string {
+	f.mu.Lock()
+	key := f.keys[kid]
+	f.mu.Unlock()
+	return signWith(f.t, kid, key, claims)
+}
+
+func signWith(t *testing.T, kid string, key *ecdsa.PrivateKey, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	_, p, _ := newTestProvider(t)
+	authURL, err := p.AuthCodeURL(context.Background(), "state-1", "nonce-1", "verifier-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURL,
+		"scope":                 "openid email profile",
+		"state":                 "state-1",
+		"nonce":                 "nonce-1",
+		"code_challenge":        CodeChallenge("verifier-1"),
+		"code_challenge_method": "S256",
+	}
+	for name, value := range want {
+		if got := u.Query().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+	if u.Query().Has("code_verifier") {
+		t.Error("the PKCE verifier must not leave the server")
+	}
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// Example from RFC 7636, appendix B
+	got := CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Fatalf("CodeChallenge = %q, want %q", got, want)
+	}
+}
+
+func TestExchangeRequiresVerifier(t *testing.T) {
+	f, p, clock := newTestProvider(t)
+	ctx := context.Background()
+	idToken := f.sign("k1", f.claims(clock.Now(), "nonce-1"))
+
+	authURL, err := p.AuthCodeURL(ctx, "state-1", "nonce-1", "verifier-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := f.authorize(authURL, idToken)
+	if _, err := p.Exchange(ctx, code, "another-verifier"); err == nil {
+		t.Fatal("exchange with the wrong verifier succeeded")
+	}
+
+	code, _ = f.authorize(authURL, idToken)
+	got, err := p.Exchange(ctx, code, "verifier-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != idToken {
+		t.Fatal("exchange returned a different ID token")
+	}
+
+	// Codes are single use
+	if _, err := p.Exchange(ctx, code, "verifier-1"); err == nil {
+		t.Fatal("exchange succeeded twice with the same code")
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	f, p, clock := newTestProvider(t)
+	ctx := context.Background()
+
+	claims, err := p.VerifyIDToken(ctx, f.sign("k1", f.claims(clock.Now(), "nonce-1")), "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Claims{Subject: "subject-1", Email: "alice@example.com", EmailVerified: true, Name: "Alice"}
+	if *claims != want {
+		t.Fatalf("claims = %+v, want %+v", *claims, want)
+	}
+
+	// Some providers send email_verified as a string
+	c := f.claims(clock.Now(), "nonce-1")
+	c["email_verified"] = "true"
+	if claims, err := p.VerifyIDToken(ctx, f.sign("k1", c), "nonce-1"); err != nil || !claims.EmailVerified {
+		t.Fatalf("string email_verified: claims %+v, err %v", claims, err)
+	}
+	c["email_verified"] = "false"
+	if claims, err := p.VerifyIDToken(ctx, f.sign("k1", c), "nonce-1"); err != nil || claims.EmailVerified {
+		t.Fatalf("unverified email: claims %+v, err %v", claims, err)
+	}
+}
+
+func TestVerifyIDTokenRejects(t *testing.T) {
+	f, p, clock := newTestProvider(t)
+	ctx := context.Background()
+	now := clock.Now()
+
+	forger, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmac := jwt.NewWithClaims(jwt.SigningMethodHS256, f.claims(now, "nonce-1"))
+	hmac.Header["kid"] = "k1"
+	hmacToken, err := hmac.SignedString([]byte("shared-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, f.claims(now, "nonce-1"))
+	none.Header["kid"] = "k1"
+	noneToken, err := none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(change func(c jwt.MapClaims)) string {
+		c := f.claims(now, "nonce-1")
+		change(c)
+		return f.sign("k1", c)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		nonce string
+	}{
+		{"wrong nonce", f.sign("k1", f.claims(now, "nonce-2")), "nonce-1"},
+		{"no expected nonce", f.sign("k1", f.claims(now, "")), ""},
+		{"forged signature", signWith(t, "k1", forger, f.claims(now, "nonce-1")), "nonce-1"},
+		{"tampered payload", tamper(t, f.sign("k1", f.claims(now, "nonce-1"))), "nonce-1"},
+		{"HS256", hmacToken, "nonce-1"},
+		{"alg none", noneToken, "nonce-1"},
+		{"other audience", with(func(c jwt.MapClaims) { c["aud"] = "someone-else" }), "nonce-1"},
+		{"several audiences without azp", with(func(c jwt.MapClaims) { c["aud"] = []string{testClientID, "other"} }), "nonce-1"},
+		{"other issuer", with(func(c jwt.MapClaims) { c["iss"] = "https://evil.example" }), "nonce-1"},
+		{"expired", with(func(c jwt.MapClaims) { c["exp"] = now.Add(-Leeway - time.Second).Unix() }), "nonce-1"},
+		{"no expiry", with(func(c jwt.MapClaims) { delete(c, "exp") }), "nonce-1"},
+		{"no subject", with(func(c jwt.MapClaims) { delete(c, "sub") }), "nonce-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if claims, err := p.VerifyIDToken(ctx, tt.token, tt.nonce); err == nil {
+				t.Fatalf("token accepted with claims %+v", claims)
+			}
+		})
+	}
+
+	// Several audiences are fine when we are the authorized party
+	token := with(func(c jwt.MapClaims) {
+		c["aud"] = []string{testClientID, "other"}
+		c["azp"] = testClientID
+	})
+	if _, err := p.VerifyIDToken(ctx, token, "nonce-1"); err != nil {
+		t.Fatalf("token with azp rejected: %v", err)
+	}
+}
+
+// tamper changes the subject of a signed token without signing it again
+func tamper(t *testing.T, token string) string {
+	parts := strings.Split(token, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload = []byte(strings.Replace(string(payload), "subject-1", "subject-2", 1))
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	return strings.Join(parts, ".")
+}
+
+func TestVerifyIDTokenExpiry(t *testing.T) {
+	f, p, clock := newTestProvider(t)
+	ctx := context.Background()
+	token := f.sign("k1", f.claims(clock.Now(), "nonce-1"))
+
+	// Expiry is five minutes out, clock skew up to Leeway is tolerated
+	clock.Advance(5*time.Minute + Leeway - time.Second)
+	if _, err := p.VerifyIDToken(ctx, token, "nonce-1"); err != nil {
+		t.Fatalf("token rejected within the leeway: %v", err)
+	}
+	clock.Advance(2 * time.Second)
+	if _, err := p.VerifyIDToken(ctx, token, "nonce-1"); err == nil {
+		t.Fatal("expired token accepted")
+	}
+}
+
+func TestUnknownKeyIDRefetchesKeys(t *testing.T) {
+	f, p, clock := newTestProvider(t)
+	ctx := context.Background()
+
+	if _, err := p.VerifyIDToken(ctx, f.sign("k1", f.claims(clock.Now(), "n")), "n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.VerifyIDToken(ctx, f.sign("k1", f.claims(clock.Now(), "n")), "n"); err != nil {
+		t.Fatal(err)
+	}
+	if f.jwksRequests != 1 {
+		t.Fatalf("keys fetched %d times, want 1", f.jwksRequests)
+	}
+
+	// The provider rotates to a new key
+	f.addKey("k2")
+	clock.Advance(keyRefreshInterval)
+	if _, err := p.VerifyIDToken(ctx, f.sign("k2", f.claims(clock.Now(), "n")), "n"); err != nil {
+		t.Fatalf("token signed with the rotated key rejected: %v", err)
+	}
+	if f.jwksRequests != 2 {
+		t.Fatalf("keys fetched %d times, want 2", f.jwksRequests)
+	}
+
+	// Unknown key IDs refetch at most once per interval
+	for i := 0; i < 3; i++ {
+		if _, err := p.VerifyIDToken(ctx, signWith(t, "k3", f.keys["k1"], f.claims(clock.Now(), "n")), "n"); err == nil {
+			t.Fatal("token with an unpublished key ID accepted")
+		}
+	}
+	if f.jwksRequests != 2 {
+		t.Fatalf("keys fetched %d times, want 2", f.jwksRequests)
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	f, _, _ := newTestProvider(t)
+	// Another server claiming to be the fake issuer
+	impostor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Metadata{
+			Issuer:                f.server.URL,
+			AuthorizationEndpoint: f.server.URL + "/authorize",
+			TokenEndpoint:         f.server.URL + "/token",
+			JWKSURI:               f.server.URL + "/jwks",
+		})
+	}))
+	defer impostor.Close()
+
+	p := NewProvider("test", impostor.URL, testClientID, testClientSecret, testRedirectURL)
+	p.HTTPClient = impostor.Client()
+	if _, err := p.Discover(context.Background()); err == nil {
+		t.Fatal("discovery accepted a document for another issuer")
+	}
+}
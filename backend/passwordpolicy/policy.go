@@ -0,0 +1,184 @@
+// Package passwordpolicy rates password strength and decides whether a
+// password is good enough to be set on an account.
+//
+// A password earns one point each for being at least 8 and at least 12
+// characters long and for containing uppercase letters, lowercase letters,
+// digits and special characters, for a score between 0 and 6. A policy
+// requires a minimum score and rejects passwords built from the user's own
+// name or email address.
+package passwordpolicy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Strength labels, from weakest to strongest
+const (
+	LabelWeak   = "Weak"
+	LabelMedium = "Medium"
+	LabelStrong = "Strong"
+)
+
+// MaxScore is the score of a password that meets every rule
+const MaxScore = 6
+
+// minPersonalLength skips name parts so short that matching them would
+// reject ordinary passwords, such as the "jo" of jo@example.com
+const minPersonalLength = 3
+
+// personalSuggestion is given for passwords containing the user's name or email
+const personalSuggestion = "Don't use your name or email address"
+
+// labelScores is the score at which each label starts
+var labelScores = map[string]int{
+	LabelWeak:   0,
+	LabelMedium: 4,
+	LabelStrong: 6,
+}
+
+// Result is the strength of a password and how to improve it
+type Result struct {
+	Score       int      `json:"score"`
+	Label       string   `json:"label"`
+	Suggestions []string `json:"suggestions"`
+	// Acceptable reports whether the password satisfies the policy
+	Acceptable bool `json:"acceptable"`
+}
+
+// Policy is the minimum strength a new password must have
+type Policy struct {
+	MinScore int
+}
+
+// Default requires a Medium password
+var Default = Policy{MinScore: labelScores[LabelMedium]}
+
+// Parse reads a policy from a label such as "medium" or a score from 0 to 6.
+// An empty value gives the default policy.
+func Parse(value string) (Policy, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return Default, nil
+	}
+	for label, score := range labelScores {
+		if strings.EqualFold(value, label) {
+			return Policy{MinScore: score}, nil
+		}
+	}
+	score, err := strconv.Atoi(value)
+	if err != nil || score < 0 || score > MaxScore {
+		return Policy{}, fmt.Errorf("password policy %q must be weak, medium, strong or a score from 0 to %d", value, MaxScore)
+	}
+	return Policy{MinScore: score}, nil
+}
+
+// Rate scores a password without applying a policy
+func Rate(password string) Result {
+	score := 0
+	suggestions := []string{}
+
+	if len(password) >= 8 {
+		score++
+	} else {
+		suggestions = append(suggestions, "Use at least 8 characters")
+	}
+	if len(password) >= 12 {
+		score++
+	} else {
+		suggestions = append(suggestions, "Use at least 12 characters")
+	}
+	upper, lower, digit, special := false, false, false, false
+	for _, c := range password {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= '0' && c <= '9':
+			digit = true
+		case (c >= 33 && c <= 47) || (c >= 58 && c <= 64) || (c >= 91 && c <= 96) || (c >= 123 && c <= 126):
+			special = true
+		}
+	}
+	if upper {
+		score++
+	} else {
+		suggestions = append(suggestions, "Add uppercase letters")
+	}
+	if lower {
+		score++
+	} else {
+		suggestions = append(suggestions, "Add lowercase letters")
+	}
+	if digit {
+		score++
+	} else {
+		suggestions = append(suggestions, "Add numbers")
+	}
+	if special {
+		score++
+	} else {
+		suggestions = append(suggestions, "Add special characters")
+	}
+
+	label := LabelWeak
+	if score >= labelScores[LabelStrong] {
+		label = LabelStrong
+	} else if score >= labelScores[LabelMedium] {
+		label = LabelMedium
+	}
+
+	return Result{
+		Score:       score,
+		Label:       label,
+		Suggestions: suggestions,
+	}
+}
+
+// Check rates a password and decides whether the policy accepts it. The
+// email and name of the account, when known, may not appear in the password.
+func (p Policy) Check(password, email, name string) Result {
+	result := Rate(password)
+	result.Acceptable = result.Score >= p.MinScore
+
+	if containsPersonalInfo(password, email, name) {
+		result.Acceptable = false
+		result.Suggestions = append(result.Suggestions, personalSuggestion)
+	}
+	return result
+}
+
+// containsPersonalInfo reports whether the password contains the local part
+// of the email address, the full name or any part of it, ignoring case
+func containsPersonalInfo(password, email, name string) bool {
+	password = strings.ToLower(password)
+
+	parts := []string{}
+	if local, _, found := strings.Cut(email, "@"); found {
+		parts = append(parts, local)
+		// Also catch "jane" in jane.doe@example.com
+		parts = append(parts, splitWords(local)...)
+	}
+	if name = strings.TrimSpace(name); name != "" {
+		parts = append(parts, name)
+		parts = append(parts, splitWords(name)...)
+	}
+
+	for _, part := range parts {
+		part = strings.ToLower(part)
+		if len(part) >= minPersonalLength && strings.Contains(password, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitWords splits on anything that is not a letter or digit
+func splitWords(s string) []string {
+	return strings.FieldsFunc(s, func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+}
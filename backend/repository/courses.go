@@ -0,0 +1,305 @@
+// Package repository loads courses together with their lessons and a
+// user's progress in a fixed number of queries, however many courses there
+// are.
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"defenzo/config"
+	"defenzo/models"
+)
+
+// ErrNotFound is returned when a course does not exist or is not visible
+var ErrNotFound = errors.New("course not found")
+
+// defaultSortColumns lists recommended courses first, then by rating
+var defaultSortColumns = []string{"recommended", "COALESCE(rating, 0)", "id"}
+
+// CourseQuery describes which courses FindCourses loads and what comes with them
+type CourseQuery struct {
+	// Conditions are SQL expressions over the courses table that must all hold
+	Conditions []string
+	Args       []interface{}
+	// SortColumns are sorted descending and the last one must be unique.
+	// Recommended courses come first by default, then the best rated.
+	SortColumns []string
+	// Limit is the most courses to load, 0 loads all
+	Limit int
+	// IncludeDrafts also loads unpublished courses and fills in their Status
+	IncludeDrafts bool
+	// WithLessons adds the lessons of each course in order
+	WithLessons bool
+	// UserID is the caller whose progress, completed lessons and place to
+	// resume are filled in, 0 for anonymous callers
+	UserID int
+}
+
+// FindCourses loads the courses matching the query in order, and for each
+// course the values of its sort columns, which a page cursor can be made from
+func FindCourses(q CourseQuery) ([]models.Course, [][]interface{}, error) {
+	sortColumns := q.SortColumns
+	if len(sortColumns) == 0 {
+		sortColumns = defaultSortColumns
+	}
+	conditions := q.Conditions
+	if !q.IncludeDrafts {
+		conditions = append([]string{"status = 'published'"}, conditions...)
+	}
+
+	query := `SELECT id, title, description, category, duration, progress, level, tags, image, rating,
+		learners, recommended, status, version, ` + strings.Join(sortColumns, ", ") + `
+		FROM courses`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY " + strings.Join(sortColumns, " DESC, ") + " DESC"
+	args := q.Args
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args[:len(args):len(args)], q.Limit)
+	}
+
+	rows, err := config.DB.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	var courses []models.Course
+	var keys [][]interface{}
+	for rows.Next() {
+		var course models.Course
+		var description, category, duration, level, tags, image sql.NullString
+		var progress, learners sql.NullInt64
+		var rating sql.NullFloat64
+		var recommended sql.NullBool
+		key := make([]interface{}, len(sortColumns))
+		dest := []interface{}{
+			&course.ID, &course.Title, &description, &category, &duration, &progress, &level, &tags, &image, &rating,
+			&learners, &recommended, &course.Status, &course.Version,
+		}
+		for i := range key {
+			dest = append(dest, &key[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+
+		course.Description = description.String
+		course.Category = category.String
+		course.Duration = duration.String
+		course.Progress = int(progress.Int64)
+		course.Level = level.String
+		course.Image = image.String
+		course.Rating = rating.Float64
+		course.Learners = int(learners.Int64)
+		course.Recommended = recommended.Bool
+		if tags.String != "" {
+			if err := json.Unmarshal([]byte(tags.String), &course.Tags); err != nil {
+				rows.Close()
+				return nil, nil, fmt.Errorf("parsing tags of course %s: %v", course.ID, err)
+			}
+		}
+		if !q.IncludeDrafts {
+			course.Status = ""
+		}
+		courses = append(courses, course)
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(courses) == 0 {
+		return courses, keys, nil
+	}
+
+	// Lessons are loaded either way to find where each course resumes
+	if err := attachLessons(courses, q.WithLessons); err != nil {
+		return nil, nil, err
+	}
+	if err := attachProgress(courses, q.UserID); err != nil {
+		return nil, nil, err
+	}
+	for i := range courses {
+		for _, lesson := range courses[i].Lessons {
+			if !lesson.Completed {
+				courses[i].NextLessonID = lesson.ID
+				break
+			}
+		}
+		if !q.WithLessons {
+			courses[i].Lessons = nil
+		}
+	}
+	return courses, keys, nil
+}
+
+// GetCourse loads one course with its lessons and the user's progress, if
+// userID is set. Drafts are only found with includeDrafts.
+func GetCourse(courseID string, userID int, includeDrafts bool) (*models.Course, error) {
+	courses, _, err := FindCourses(CourseQuery{
+		Conditions:    []string{"id = ?"},
+		Args:          []interface{}{courseID},
+		IncludeDrafts: includeDrafts,
+		WithLessons:   true,
+		UserID:        userID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(courses) == 0 {
+		return nil, ErrNotFound
+	}
+	return &courses[0], nil
+}
+
+// courseIDs returns the IDs of the courses as a JSON array, so a single
+// query parameter can hold any number of them through json_each
+func courseIDs(courses []models.Course) string {
+	ids := make([]string, len(courses))
+	for i, course := range courses {
+		ids[i] = course.ID
+	}
+	data, _ := json.Marshal(ids)
+	return string(data)
+}
+
+// courseIndex maps course IDs to their position in the slice
+func courseIndex(courses []models.Course) map[string]int {
+	index := make(map[string]int, len(courses))
+	for i, course := range courses {
+		index[course.ID] = i
+	}
+	return index
+}
+
+// attachLessons loads the lessons of all the courses in one query, their
+// content only if withContent is set
+func attachLessons(courses []models.Course, withContent bool) error {
+	contentColumn := "NULL"
+	if withContent {
+		contentColumn = "content"
+	}
+	rows, err := config.DB.Query(`
+		SELECT id, course_id, title, type, duration, `+contentColumn+`, order_num
+		FROM lessons
+		WHERE course_id IN (SELECT value FROM json_each(?))
+		ORDER BY course_id, order_num`,
+		courseIDs(courses),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	index := courseIndex(courses)
+	for rows.Next() {
+		var lesson models.Lesson
+		var duration, content sql.NullString
+		var orderNum sql.NullInt64
+		if err := rows.Scan(&lesson.ID, &lesson.CourseID, &lesson.Title, &lesson.Type, &duration, &content, &orderNum); err != nil {
+			return err
+		}
+		lesson.Duration = duration.String
+		lesson.Content = content.String
+		lesson.OrderNum = int(orderNum.Int64)
+
+		i := index[lesson.CourseID]
+		courses[i].Lessons = append(courses[i].Lessons, lesson)
+	}
+	return rows.Err()
+}
+
+// accessTime reads a last_accessed value, which the driver returns as a
+// time.Time unless it was stored in a format it does not know
+func accessTime(value interface{}) time.Time {
+	t, _ := value.(time.Time)
+	return t
+}
+
+// formatAccessTime formats a last_accessed time for responses, empty if unknown
+func formatAccessTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// attachProgress merges the user's progress rows into the courses and their
+// lessons in one query. Without a user, or where they have not started,
+// courses are at 0% with no lesson completed.
+func attachProgress(courses []models.Course, userID int) error {
+	for i := range courses {
+		courses[i].Progress = 0
+	}
+	if userID == 0 {
+		return nil
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT course_id, lesson_id, completed, progress, last_accessed
+		FROM user_course_progress
+		WHERE user_id = ? AND course_id IN (SELECT value FROM json_each(?))`,
+		userID, courseIDs(courses),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type lessonProgress struct {
+		completed    bool
+		lastAccessed time.Time
+	}
+	lessons := map[string]lessonProgress{}
+	courseAccessed := map[string]time.Time{}
+	// The course level row can be repeated, the latest one counts
+	courseProgressAt := map[string]time.Time{}
+	index := courseIndex(courses)
+	for rows.Next() {
+		var courseID string
+		var lessonID sql.NullString
+		var completed bool
+		var progress int
+		var lastAccessedValue interface{}
+		if err := rows.Scan(&courseID, &lessonID, &completed, &progress, &lastAccessedValue); err != nil {
+			return err
+		}
+		i, ok := index[courseID]
+		if !ok {
+			continue
+		}
+		lastAccessed := accessTime(lastAccessedValue)
+		if lastAccessed.After(courseAccessed[courseID]) {
+			courseAccessed[courseID] = lastAccessed
+		}
+		if lessonID.Valid {
+			lessons[courseID+"\x00"+lessonID.String] = lessonProgress{completed, lastAccessed}
+		} else if at, seen := courseProgressAt[courseID]; !seen || lastAccessed.After(at) {
+			courseProgressAt[courseID] = lastAccessed
+			courses[i].Progress = progress
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range courses {
+		course := &courses[i]
+		course.LastAccessed = formatAccessTime(courseAccessed[course.ID])
+		for j := range course.Lessons {
+			lesson := &course.Lessons[j]
+			if p, ok := lessons[course.ID+"\x00"+lesson.ID]; ok {
+				lesson.Completed = p.completed
+				lesson.LastAccessed = formatAccessTime(p.lastAccessed)
+			}
+		}
+	}
+	return nil
+}
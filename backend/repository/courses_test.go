@@ -0,0 +1,242 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"defenzo/config"
+	"defenzo/models"
+)
+
+const (
+	benchCourses          = 300
+	benchLessonsPerCourse = 5
+	benchUserID           = 1
+)
+
+// TestMain seeds a fresh database in a temporary directory with published
+// courses, their lessons and the progress of one learner through them
+func TestMain(m *testing.M) {
+	flag.Parse()
+	dir, err := os.MkdirTemp("", "defenzo-repository")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+
+	config.InitDB()
+	config.MigrateDB()
+	if err := seedCourses(); err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	config.DB.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func seedCourses() error {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	content := strings.Repeat("Lesson text. ", 150)
+	now := time.Now().UTC()
+	for c := 0; c < benchCourses; c++ {
+		courseID := fmt.Sprintf("course-%03d", c)
+		_, err := tx.Exec(`
+			INSERT INTO courses (id, title, description, category, duration, level, tags, image, rating, learners, recommended, status)
+			VALUES (?, ?, 'A course', 'Security', '1h', 'Beginner', '["web","network"]', '', ?, ?, ?, 'published')`,
+			courseID, "Course "+courseID, float64(c%50)/10, c*3, c%7 == 0,
+		)
+		if err != nil {
+			return err
+		}
+		for l := 0; l < benchLessonsPerCourse; l++ {
+			_, err := tx.Exec(
+				"INSERT INTO lessons (id, course_id, title, type, duration, content, order_num) VALUES (?, ?, ?, 'text', '10m', ?, ?)",
+				fmt.Sprintf("%s-lesson-%d", courseID, l), courseID, fmt.Sprintf("Lesson %d", l), content, l+1,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		// The learner finished the first two lessons of every other course
+		if c%2 == 1 {
+			continue
+		}
+		accessed := now.Add(-time.Duration(c) * time.Minute).Format(time.RFC3339)
+		_, err = tx.Exec(
+			"INSERT INTO user_course_progress (user_id, course_id, completed, progress, last_accessed) VALUES (?, ?, 0, 40, ?)",
+			benchUserID, courseID, accessed,
+		)
+		if err != nil {
+			return err
+		}
+		for l := 0; l < 2; l++ {
+			_, err := tx.Exec(
+				"INSERT INTO user_course_progress (user_id, course_id, lesson_id, completed, progress, last_accessed) VALUES (?, ?, ?, 1, 100, ?)",
+				benchUserID, courseID, fmt.Sprintf("%s-lesson-%d", courseID, l), accessed,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// findCoursesPerCourse is how courses were loaded before FindCourses: one
+// query for the courses, then one for the progress and one for the lessons
+// of every course
+func findCoursesPerCourse(userID int, withLessons bool) ([]models.Course, error) {
+	rows, err := config.DB.Query(`
+		SELECT id, title, description, category, duration, progress, level, tags, image, rating, learners, recommended
+		FROM courses
+		WHERE status = 'published'
+		ORDER BY recommended DESC, COALESCE(rating, 0) DESC, id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var courses []models.Course
+	for rows.Next() {
+		var course models.Course
+		var tags string
+		err := rows.Scan(&course.ID, &course.Title, &course.Description, &course.Category, &course.Duration,
+			&course.Progress, &course.Level, &tags, &course.Image, &course.Rating, &course.Learners, &course.Recommended)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(tags), &course.Tags); err != nil {
+			return nil, err
+		}
+
+		course.Progress = 0
+		if userID > 0 {
+			var progress sql.NullInt64
+			err := config.DB.QueryRow(
+				"SELECT progress FROM user_course_progress WHERE user_id = ? AND course_id = ? AND lesson_id IS NULL ORDER BY last_accessed DESC LIMIT 1",
+				userID, course.ID,
+			).Scan(&progress)
+			if err == nil && progress.Valid {
+				course.Progress = int(progress.Int64)
+			}
+		}
+
+		if withLessons {
+			lessonRows, err := config.DB.Query(
+				"SELECT id, title, type, duration, content, order_num FROM lessons WHERE course_id = ? ORDER BY order_num",
+				course.ID,
+			)
+			if err != nil {
+				return nil, err
+			}
+			for lessonRows.Next() {
+				var lesson models.Lesson
+				if err := lessonRows.Scan(&lesson.ID, &lesson.Title, &lesson.Type, &lesson.Duration, &lesson.Content, &lesson.OrderNum); err != nil {
+					lessonRows.Close()
+					return nil, err
+				}
+				lesson.CourseID = course.ID
+				course.Lessons = append(course.Lessons, lesson)
+			}
+			lessonRows.Close()
+			if err := lessonRows.Err(); err != nil {
+				return nil, err
+			}
+		}
+		courses = append(courses, course)
+	}
+	return courses, rows.Err()
+}
+
+func TestFindCoursesMatchesPerCourse(t *testing.T) {
+	want, err := findCoursesPerCourse(benchUserID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := FindCourses(CourseQuery{WithLessons: true, UserID: benchUserID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) || len(got) != benchCourses {
+		t.Fatalf("got %d courses, want %d", len(got), len(want))
+	}
+
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.ID != w.ID || g.Progress != w.Progress || g.Rating != w.Rating || strings.Join(g.Tags, ",") != strings.Join(w.Tags, ",") {
+			t.Fatalf("course %d = %s at %d%%, want %s at %d%%", i, g.ID, g.Progress, w.ID, w.Progress)
+		}
+		if len(g.Lessons) != len(w.Lessons) {
+			t.Fatalf("course %s has %d lessons, want %d", g.ID, len(g.Lessons), len(w.Lessons))
+		}
+		for j := range w.Lessons {
+			if g.Lessons[j].ID != w.Lessons[j].ID || g.Lessons[j].Content != w.Lessons[j].Content {
+				t.Fatalf("lesson %d of course %s = %s, want %s", j, g.ID, g.Lessons[j].ID, w.Lessons[j].ID)
+			}
+		}
+
+		// Only the batched path knows which lessons are done and where to resume
+		started := g.Progress > 0
+		if g.Lessons[0].Completed != started || (started && g.NextLessonID != w.Lessons[2].ID) {
+			t.Fatalf("course %s: first lesson completed %v, next lesson %q", g.ID, g.Lessons[0].Completed, g.NextLessonID)
+		}
+	}
+}
+
+// BenchmarkFindCourses compares loading every course for a signed-in
+// learner in batched queries with one query per course. Without lessons the
+// old path is cheaper, since it never looked for the lesson to resume.
+func BenchmarkFindCourses(b *testing.B) {
+	for _, withLessons := range []bool{true, false} {
+		name := "lessons"
+		if !withLessons {
+			name = "summary"
+		}
+		b.Run(name+"/batched", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := FindCourses(CourseQuery{WithLessons: withLessons, UserID: benchUserID}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(name+"/per-course", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := findCoursesPerCourse(benchUserID, withLessons); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkGetCourse loads a single course with its lessons and progress
+func BenchmarkGetCourse(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := GetCourse(fmt.Sprintf("course-%03d", i%benchCourses), benchUserID, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -5,36 +5,127 @@ import (
 
 	"defenzo/handlers"
 	"defenzo/middleware"
+	"defenzo/models"
 
 	"github.com/gorilla/mux"
 )
 
 // SetupRoutes configures all the routes for the application
 func SetupRoutes(r *mux.Router) {
+	// Identity only ever comes from a verified token, never from client headers
+	r.Use(middleware.StripIdentityHeaders)
+
 	// Public routes
 	r.HandleFunc("/api/register", handlers.Register).Methods("POST")
 	r.HandleFunc("/api/login", handlers.Login).Methods("POST")
+	r.HandleFunc("/api/login/mfa", handlers.VerifyLoginMFA).Methods("POST")
+	r.HandleFunc("/api/login/mfa/passkey", handlers.BeginPasskeyMFA).Methods("POST")
+	r.HandleFunc("/api/login/passkey/begin", handlers.BeginPasskeyLogin).Methods("POST")
+	r.HandleFunc("/api/login/passkey/finish", handlers.FinishPasskeyLogin).Methods("POST")
+	r.HandleFunc("/api/login/magic", handlers.RequestMagicLink).Methods("POST")
+	r.HandleFunc("/api/login/magic/redeem", handlers.RedeemMagicLink).Methods("POST")
+	r.HandleFunc("/api/oidc/providers", handlers.ListOIDCProviders).Methods("GET")
+	r.HandleFunc("/api/oidc/{provider}/start", handlers.StartOIDCLogin).Methods("GET")
+	r.HandleFunc("/api/oidc/{provider}/callback", handlers.OIDCCallback).Methods("GET", "POST")
+	r.HandleFunc("/api/token/refresh", handlers.RefreshToken).Methods("POST")
+	r.HandleFunc("/api/password/forgot", handlers.ForgotPassword).Methods("POST")
+	r.HandleFunc("/api/password/reset", handlers.ResetPassword).Methods("POST")
+	r.HandleFunc("/api/email/verify", handlers.VerifyEmail).Methods("GET", "POST")
+	r.HandleFunc("/api/email/change/confirm", handlers.ConfirmEmailChange).Methods("GET", "POST")
+	r.HandleFunc("/api/account/delete/confirm", handlers.ConfirmAccountDeletion).Methods("GET", "POST")
+	r.HandleFunc("/.well-known/jwks.json", handlers.GetJWKS).Methods("GET")
 
 	// Security tools
-	r.HandleFunc("/api/scan", handlers.ScanURL).Methods("POST")
+	r.HandleFunc("/api/scan", middleware.AcceptAPITokens(models.ScopeScan)(middleware.OptionalAuth(handlers.ScanURL))).Methods("POST")
 	r.HandleFunc("/api/password-check", handlers.CheckPassword).Methods("POST")
 
 	// Protected routes
+	r.HandleFunc("/api/logout", middleware.AuthMiddleware(handlers.Logout)).Methods("POST")
+	r.HandleFunc("/api/sessions", middleware.AuthMiddleware(handlers.ListSessions)).Methods("GET")
+	r.HandleFunc("/api/sessions/others", middleware.AuthMiddleware(handlers.DeleteOtherSessions)).Methods("DELETE")
+	r.HandleFunc("/api/sessions/{id}", middleware.AuthMiddleware(handlers.DeleteSession)).Methods("DELETE")
 	r.HandleFunc("/api/profile", middleware.AuthMiddleware(handlers.GetProfile)).Methods("GET")
+	r.HandleFunc("/api/profile", middleware.AuthMiddleware(handlers.UpdateProfile)).Methods("PUT")
+	r.HandleFunc("/api/profile/password", middleware.AuthMiddleware(handlers.ChangePassword)).Methods("POST")
 	r.HandleFunc("/api/profile/picture", middleware.AuthMiddleware(handlers.UploadProfilePicture)).Methods("POST")
+	r.HandleFunc("/api/tokens", middleware.AuthMiddleware(handlers.ListAPITokens)).Methods("GET")
+	r.HandleFunc("/api/tokens", middleware.AuthMiddleware(handlers.CreateAPIToken)).Methods("POST")
+	r.HandleFunc("/api/tokens/{id}", middleware.AuthMiddleware(handlers.RevokeAPIToken)).Methods("DELETE")
+	r.HandleFunc("/api/orgs", middleware.AuthMiddleware(handlers.ListOrganizations)).Methods("GET")
+	r.HandleFunc("/api/orgs", middleware.AuthMiddleware(handlers.CreateOrganization)).Methods("POST")
+	r.HandleFunc("/api/orgs/invitations/accept", middleware.AuthMiddleware(handlers.AcceptOrgInvitation)).Methods("POST")
+	r.HandleFunc("/api/orgs/{id:[0-9]+}", middleware.AuthMiddleware(handlers.DeleteOrganization)).Methods("DELETE")
+	r.HandleFunc("/api/orgs/{id:[0-9]+}/members", middleware.AuthMiddleware(handlers.ListOrgMembers)).Methods("GET")
+	r.HandleFunc("/api/orgs/{id:[0-9]+}/members/{userID:[0-9]+}", middleware.AuthMiddleware(handlers.UpdateOrgMember)).Methods("PUT")
+	r.HandleFunc("/api/orgs/{id:[0-9]+}/members/{userID:[0-9]+}", middleware.AuthMiddleware(handlers.RemoveOrgMember)).Methods("DELETE")
+	r.HandleFunc("/api/orgs/{id:[0-9]+}/invitations", middleware.AuthMiddleware(handlers.ListOrgInvitations)).Methods("GET")
+	r.HandleFunc("/api/orgs/{id:[0-9]+}/invitations", middleware.AuthMiddleware(handlers.CreateOrgInvitation)).Methods("POST")
+	r.HandleFunc("/api/orgs/{id:[0-9]+}/invitations/{invitationID:[0-9]+}", middleware.AuthMiddleware(handlers.RevokeOrgInvitation)).Methods("DELETE")
+	r.HandleFunc("/api/orgs/{id:[0-9]+}/progress", middleware.AuthMiddleware(handlers.GetOrgProgress)).Methods("GET")
+	r.HandleFunc("/api/orgs/{id:[0-9]+}/badges", middleware.AuthMiddleware(handlers.GetOrgBadges)).Methods("GET")
+	r.HandleFunc("/api/account", middleware.AuthMiddleware(handlers.DeleteAccount)).Methods("DELETE")
+	r.HandleFunc("/api/account/export", middleware.AuthMiddleware(handlers.ExportAccount)).Methods("GET")
+	r.HandleFunc("/api/account/activity", middleware.AuthMiddleware(handlers.GetAccountActivity)).Methods("GET")
+	r.HandleFunc("/api/email/verify/resend", middleware.AuthMiddleware(handlers.ResendVerificationEmail)).Methods("POST")
+
+	// Two-factor authentication routes
+	r.HandleFunc("/api/2fa/totp", middleware.AuthMiddleware(handlers.GetTOTPStatus)).Methods("GET")
+	r.HandleFunc("/api/2fa/totp/enroll", middleware.AuthMiddleware(handlers.EnrollTOTP)).Methods("POST")
+	r.HandleFunc("/api/2fa/totp/confirm", middleware.AuthMiddleware(handlers.ConfirmTOTP)).Methods("POST")
+	r.HandleFunc("/api/2fa/totp/disable", middleware.AuthMiddleware(handlers.DisableTOTP)).Methods("POST")
+
+	// Passkey routes
+	r.HandleFunc("/api/passkeys", middleware.AuthMiddleware(handlers.ListPasskeys)).Methods("GET")
+	r.HandleFunc("/api/passkeys/register/begin", middleware.AuthMiddleware(handlers.BeginPasskeyRegistration)).Methods("POST")
+	r.HandleFunc("/api/passkeys/register/finish", middleware.AuthMiddleware(handlers.FinishPasskeyRegistration)).Methods("POST")
+	r.HandleFunc("/api/passkeys/{id:[0-9]+}", middleware.AuthMiddleware(handlers.DeletePasskey)).Methods("DELETE")
 
 	// Course routes
-	r.HandleFunc("/api/courses", handlers.GetCourses).Methods("GET")
-	r.HandleFunc("/api/courses/{id}", handlers.GetCourseByID).Methods("GET")
+	r.HandleFunc("/api/courses", middleware.OptionalAuth(handlers.GetCourses)).Methods("GET")
+	r.HandleFunc("/api/courses/{id}", middleware.OptionalAuth(handlers.GetCourseByID)).Methods("GET")
+	r.HandleFunc("/api/search", handlers.Search).Methods("GET")
 
 	// Progress routes
-	r.HandleFunc("/api/user/progress", middleware.AuthMiddleware(handlers.GetUserProgress)).Methods("GET")
+	r.HandleFunc("/api/user/progress", middleware.AcceptAPITokens(models.ScopeProgressRead)(middleware.AuthMiddleware(handlers.GetUserProgress))).Methods("GET")
 	r.HandleFunc("/api/user/progress", middleware.AuthMiddleware(handlers.UpdateUserProgress)).Methods("POST")
 
 	// Badge routes
-	r.HandleFunc("/api/user/badges", middleware.AuthMiddleware(handlers.GetUserBadges)).Methods("GET")
-	r.HandleFunc("/api/user/badges/progress", middleware.AuthMiddleware(handlers.UpdateBadgeProgress)).Methods("POST")
-	r.HandleFunc("/api/user/badges/check", middleware.AuthMiddleware(handlers.CheckAndAwardBadges)).Methods("POST")
+	r.HandleFunc("/api/user/badges", middleware.AcceptAPITokens(models.ScopeBadgesRead)(middleware.AuthMiddleware(handlers.GetUserBadges))).Methods("GET")
+	// Badge awards and tool-usage tracking can be limited to verified accounts
+	r.HandleFunc("/api/user/badges/progress", middleware.VerifiedAuthMiddleware(handlers.UpdateBadgeProgress)).Methods("POST")
+	r.HandleFunc("/api/user/badges/check", middleware.VerifiedAuthMiddleware(handlers.CheckAndAwardBadges)).Methods("POST")
+
+	// Admin routes
+	admin := middleware.RequireRole(models.RoleAdmin)
+	r.HandleFunc("/api/admin/users", middleware.AuthMiddleware(admin(handlers.ListUsers))).Methods("GET")
+	r.HandleFunc("/api/admin/users/{id}/roles", middleware.AuthMiddleware(admin(handlers.GetUserRoles))).Methods("GET")
+	r.HandleFunc("/api/admin/users/{id}/roles", middleware.AuthMiddleware(admin(handlers.SetUserRoles))).Methods("PUT")
+	r.HandleFunc("/api/admin/lockouts", middleware.AuthMiddleware(admin(handlers.ListLockouts))).Methods("GET")
+	r.HandleFunc("/api/admin/lockouts/{key}", middleware.AuthMiddleware(admin(handlers.ClearLockout))).Methods("DELETE")
+	r.HandleFunc("/api/admin/audit-events", middleware.AuthMiddleware(admin(handlers.ListAuditEvents))).Methods("GET")
+
+	// Course authoring, drafts are only visible here
+	r.HandleFunc("/api/admin/courses", middleware.AuthMiddleware(admin(handlers.ListAdminCourses))).Methods("GET")
+	r.HandleFunc("/api/admin/courses", middleware.AuthMiddleware(admin(handlers.CreateCourse))).Methods("POST")
+	r.HandleFunc("/api/admin/courses/{id}", middleware.AuthMiddleware(admin(handlers.GetAdminCourse))).Methods("GET")
+	r.HandleFunc("/api/admin/courses/{id}", middleware.AuthMiddleware(admin(handlers.UpdateCourse))).Methods("PUT")
+	r.HandleFunc("/api/admin/courses/{id}", middleware.AuthMiddleware(admin(handlers.DeleteCourse))).Methods("DELETE")
+	r.HandleFunc("/api/admin/courses/{id}/lessons", middleware.AuthMiddleware(admin(handlers.CreateLesson))).Methods("POST")
+	r.HandleFunc("/api/admin/courses/{id}/lessons/order", middleware.AuthMiddleware(admin(handlers.ReorderLessons))).Methods("PUT")
+	r.HandleFunc("/api/admin/courses/{id}/lessons/{lessonId}", middleware.AuthMiddleware(admin(handlers.UpdateLesson))).Methods("PUT")
+	r.HandleFunc("/api/admin/courses/{id}/lessons/{lessonId}", middleware.AuthMiddleware(admin(handlers.DeleteLesson))).Methods("DELETE")
+
+	// Course revisions, written by instructors, reviewed and published by admins
+	author := middleware.RequireRole(models.RoleInstructor, models.RoleAdmin)
+	r.HandleFunc("/api/admin/courses/{id}/revisions", middleware.AuthMiddleware(author(handlers.ListCourseRevisions))).Methods("GET")
+	r.HandleFunc("/api/admin/courses/{id}/revisions", middleware.AuthMiddleware(author(handlers.CreateCourseRevision))).Methods("POST")
+	r.HandleFunc("/api/admin/courses/{id}/revisions/{version:[0-9]+}", middleware.AuthMiddleware(author(handlers.GetCourseRevision))).Methods("GET")
+	r.HandleFunc("/api/admin/courses/{id}/revisions/{version:[0-9]+}", middleware.AuthMiddleware(author(handlers.UpdateCourseRevision))).Methods("PUT")
+	r.HandleFunc("/api/admin/courses/{id}/revisions/{version:[0-9]+}/diff", middleware.AuthMiddleware(admin(handlers.DiffCourseRevision))).Methods("GET")
+	r.HandleFunc("/api/admin/courses/{id}/revisions/{version:[0-9]+}/submit", middleware.AuthMiddleware(author(handlers.SubmitCourseRevision))).Methods("POST")
+	r.HandleFunc("/api/admin/courses/{id}/revisions/{version:[0-9]+}/review", middleware.AuthMiddleware(admin(handlers.ReviewCourseRevision))).Methods("POST")
+	r.HandleFunc("/api/admin/courses/{id}/revisions/{version:[0-9]+}/publish", middleware.AuthMiddleware(admin(handlers.PublishCourseRevision))).Methods("POST")
+	r.HandleFunc("/api/admin/courses/{id}/rollback", middleware.AuthMiddleware(admin(handlers.RollbackCourse))).Methods("POST")
 
 	// Serve static files
 	fs := http.FileServer(http.Dir("uploads"))
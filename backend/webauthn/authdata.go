@@ -0,0 +1,86 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Authenticator data flags (WebAuthn section 6.1)
+const (
+	FlagUserPresent            = 0x01
+	FlagUserVerified           = 0x04
+	FlagBackupEligible         = 0x08
+	FlagBackedUp               = 0x10
+	FlagAttestedCredentialData = 0x40
+	FlagExtensionData          = 0x80
+)
+
+// maxCredentialIDLength is the longest credential ID the specification allows
+const maxCredentialIDLength = 1023
+
+// AuthenticatorData is the parsed data an authenticator signs in every ceremony
+type AuthenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+	// Only present when registering a credential
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// Has reports whether all of the given flags are set
+func (a *AuthenticatorData) Has(flags byte) bool {
+	return a.Flags&flags == flags
+}
+
+// ParseAuthenticatorData decodes the binary authenticator data structure
+func ParseAuthenticatorData(data []byte) (*AuthenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data is too short")
+	}
+	authData := &AuthenticatorData{
+		RPIDHash:  append([]byte(nil), data[:32]...),
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if authData.Has(FlagAttestedCredentialData) {
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data is too short")
+		}
+		authData.AAGUID = append([]byte(nil), rest[:16]...)
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength == 0 || idLength > maxCredentialIDLength || idLength > len(rest) {
+			return nil, errors.New("invalid credential ID length")
+		}
+		authData.CredentialID = append([]byte(nil), rest[:idLength]...)
+		rest = rest[idLength:]
+
+		// The key is a CBOR item of unknown length, so decode it to find its end
+		_, afterKey, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, err
+		}
+		authData.PublicKey = append([]byte(nil), rest[:len(rest)-len(afterKey)]...)
+		rest = afterKey
+	}
+
+	if authData.Has(FlagExtensionData) {
+		extensions, afterExtensions, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := extensions.(map[interface{}]interface{}); !ok {
+			return nil, errors.New("extension data is not a map")
+		}
+		rest = afterExtensions
+	}
+
+	if len(rest) != 0 {
+		return nil, errors.New("trailing bytes after authenticator data")
+	}
+	return authData, nil
+}
@@ -0,0 +1,136 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithm identifiers (RFC 9053) accepted for credentials
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// SupportedAlgorithms are offered to authenticators in order of preference
+var SupportedAlgorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+// COSE key parameters (RFC 9052 section 7)
+const (
+	coseKeyType   = 1
+	coseAlgorithm = 3
+	coseCurve     = -1
+	coseX         = -2 // also the RSA modulus n
+	coseY         = -3 // also the RSA exponent e
+
+	coseKeyTypeOKP = 1
+	coseKeyTypeEC2 = 2
+	coseKeyTypeRSA = 3
+
+	coseCurveP256    = 1
+	coseCurveEd25519 = 6
+)
+
+// PublicKey is a credential public key decoded from its COSE encoding
+type PublicKey struct {
+	Algorithm int
+	Key       crypto.PublicKey
+}
+
+// ParsePublicKey decodes a COSE_Key as stored with a credential
+func ParsePublicKey(cose []byte) (*PublicKey, error) {
+	value, rest, err := decodeCBOR(cose)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("cose: trailing data after key")
+	}
+	return publicKeyFromMap(value)
+}
+
+// publicKeyFromMap converts a decoded COSE_Key map into a Go public key
+func publicKeyFromMap(value interface{}) (*PublicKey, error) {
+	params, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("cose: key is not a map")
+	}
+	keyType, _ := params[int64(coseKeyType)].(int64)
+	alg, ok := params[int64(coseAlgorithm)].(int64)
+	if !ok {
+		return nil, errors.New("cose: key has no algorithm")
+	}
+	bytesParam := func(label int64) []byte {
+		b, _ := params[label].([]byte)
+		return b
+	}
+
+	switch {
+	case alg == AlgES256 && keyType == coseKeyTypeEC2:
+		if curve, _ := params[int64(coseCurve)].(int64); curve != coseCurveP256 {
+			return nil, fmt.Errorf("cose: unsupported curve %d for ES256", curve)
+		}
+		x, y := bytesParam(coseX), bytesParam(coseY)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("cose: invalid P-256 coordinates")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("cose: EC point is not on the curve")
+		}
+		return &PublicKey{Algorithm: AlgES256, Key: key}, nil
+
+	case alg == AlgEdDSA && keyType == coseKeyTypeOKP:
+		if curve, _ := params[int64(coseCurve)].(int64); curve != coseCurveEd25519 {
+			return nil, fmt.Errorf("cose: unsupported curve %d for EdDSA", curve)
+		}
+		x := bytesParam(coseX)
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("cose: invalid Ed25519 key length")
+		}
+		return &PublicKey{Algorithm: AlgEdDSA, Key: ed25519.PublicKey(x)}, nil
+
+	case alg == AlgRS256 && keyType == coseKeyTypeRSA:
+		n, e := bytesParam(coseX), bytesParam(coseY)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("cose: invalid RSA key")
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("cose: invalid RSA exponent")
+		}
+		return &PublicKey{Algorithm: AlgRS256, Key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}}, nil
+	}
+	return nil, fmt.Errorf("cose: unsupported algorithm %d for key type %d", alg, keyType)
+}
+
+// Verify checks an authenticator signature over message
+func (k *PublicKey) Verify(message, signature []byte) error {
+	switch key := k.Key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, message, signature) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(message)
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	return fmt.Errorf("cose: unsupported key type %T", k.Key)
+}
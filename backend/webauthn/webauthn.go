@@ -0,0 +1,403 @@
+// Package webauthn implements the relying party side of Web Authentication
+// (W3C WebAuthn Level 2) for passkeys: the options sent to the client and the
+// verification of registration and authentication responses. Attestation is
+// not used for trust decisions, so no certificate chains are checked.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Ceremony types found in the client data
+const (
+	ceremonyCreate = "webauthn.create"
+	ceremonyGet    = "webauthn.get"
+)
+
+// User verification requirements
+const (
+	VerificationRequired    = "required"
+	VerificationPreferred   = "preferred"
+	VerificationDiscouraged = "discouraged"
+)
+
+var (
+	// ErrInvalidSignature is returned when an assertion signature does not verify
+	ErrInvalidSignature = errors.New("webauthn: invalid signature")
+	// ErrSignCountRegression is returned when the authenticator's signature
+	// counter did not increase, which means the credential may have been cloned
+	ErrSignCountRegression = errors.New("webauthn: signature counter did not increase")
+)
+
+// Bytes is binary data encoded as unpadded base64url in JSON, the encoding
+// browsers and passkey libraries use for WebAuthn values
+type Bytes []byte
+
+// MarshalJSON encodes the bytes as base64url without padding
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+// UnmarshalJSON accepts base64url with or without padding
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return fmt.Errorf("invalid base64url value: %v", err)
+	}
+	*b = decoded
+	return nil
+}
+
+// Config identifies the relying party, which is this server
+type Config struct {
+	// RPID is the domain credentials are scoped to, such as "defenzo.app"
+	RPID string
+	// RPName is shown to users by the authenticator
+	RPName string
+	// Origins are the accepted client origins, for example
+	// "https://defenzo.app" or "android:apk-key-hash:..." for the Android app
+	Origins []string
+	// Timeout is how long the client should wait for the user
+	Timeout time.Duration
+}
+
+// NewChallenge returns a random challenge for one ceremony
+func NewChallenge() (Bytes, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// RelyingParty describes the server in creation options
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// User describes the account a credential is created for
+type User struct {
+	ID          Bytes  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// CredentialParameter is an accepted credential type and algorithm
+type CredentialParameter struct {
+	Type      string `json:"type"`
+	Algorithm int    `json:"alg"`
+}
+
+// CredentialDescriptor identifies an existing credential
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         Bytes    `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+// AuthenticatorSelection states what kind of authenticator is wanted
+type AuthenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// CreationOptions are passed to navigator.credentials.create to register a passkey
+type CreationOptions struct {
+	Challenge              Bytes                  `json:"challenge"`
+	RP                     RelyingParty           `json:"rp"`
+	User                   User                   `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are passed to navigator.credentials.get to sign in
+type RequestOptions struct {
+	Challenge        Bytes                  `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// CreationOptions builds the options for registering a discoverable
+// credential, excluding credentials the user already has
+func (c *Config) CreationOptions(challenge Bytes, user User, exclude []CredentialDescriptor) CreationOptions {
+	params := make([]CredentialParameter, 0, len(SupportedAlgorithms))
+	for _, alg := range SupportedAlgorithms {
+		params = append(params, CredentialParameter{Type: "public-key", Algorithm: alg})
+	}
+	if exclude == nil {
+		exclude = []CredentialDescriptor{}
+	}
+	return CreationOptions{
+		Challenge:          challenge,
+		RP:                 RelyingParty{ID: c.RPID, Name: c.RPName},
+		User:               user,
+		PubKeyCredParams:   params,
+		Timeout:            c.Timeout.Milliseconds(),
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   VerificationPreferred,
+		},
+		Attestation: "none",
+	}
+}
+
+// RequestOptions builds the options for an assertion. An empty allow list
+// lets the user pick any discoverable credential for this relying party.
+func (c *Config) RequestOptions(challenge Bytes, allow []CredentialDescriptor, userVerification string) RequestOptions {
+	if allow == nil {
+		allow = []CredentialDescriptor{}
+	}
+	return RequestOptions{
+		Challenge:        challenge,
+		Timeout:          c.Timeout.Milliseconds(),
+		RPID:             c.RPID,
+		AllowCredentials: allow,
+		UserVerification: userVerification,
+	}
+}
+
+// CredentialResponse is a PublicKeyCredential as serialized by the client,
+// holding either an attestation (registration) or an assertion (login)
+type CredentialResponse struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes    `json:"clientDataJSON"`
+		AttestationObject Bytes    `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+		AuthenticatorData Bytes    `json:"authenticatorData"`
+		Signature         Bytes    `json:"signature"`
+		UserHandle        Bytes    `json:"userHandle"`
+	} `json:"response"`
+}
+
+// CredentialID returns the ID of the credential that produced the response
+func (r *CredentialResponse) CredentialID() ([]byte, error) {
+	if len(r.RawID) > 0 {
+		return r.RawID, nil
+	}
+	id, err := base64.RawURLEncoding.DecodeString(r.ID)
+	if err != nil || len(id) == 0 {
+		return nil, errors.New("webauthn: missing credential ID")
+	}
+	return id, nil
+}
+
+// clientData is the JSON the client signs over (WebAuthn section 5.8.1)
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// Challenge returns the challenge the response was created for, so the
+// caller can look up the ceremony it belongs to before verifying it
+func (r *CredentialResponse) Challenge() (Bytes, error) {
+	var data clientData
+	if err := json.Unmarshal(r.Response.ClientDataJSON, &data); err != nil {
+		return nil, fmt.Errorf("webauthn: invalid client data: %v", err)
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(data.Challenge, "="))
+	if err != nil || len(challenge) == 0 {
+		return nil, errors.New("webauthn: invalid challenge in client data")
+	}
+	return challenge, nil
+}
+
+// verifyClientData checks the ceremony type, challenge and origin
+func (c *Config) verifyClientData(raw []byte, ceremony string, challenge []byte) error {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("webauthn: invalid client data: %v", err)
+	}
+	if data.Type != ceremony {
+		return fmt.Errorf("webauthn: client data type is %q, expected %q", data.Type, ceremony)
+	}
+	received, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(data.Challenge, "="))
+	if err != nil || len(challenge) == 0 || subtle.ConstantTimeCompare(received, challenge) != 1 {
+		return errors.New("webauthn: challenge mismatch")
+	}
+	if data.CrossOrigin {
+		return errors.New("webauthn: cross-origin requests are not accepted")
+	}
+	for _, origin := range c.Origins {
+		if data.Origin == origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("webauthn: origin %q is not allowed", data.Origin)
+}
+
+// verifyAuthenticatorData checks the relying party and the user flags
+func (c *Config) verifyAuthenticatorData(authData *AuthenticatorData, requireVerification bool) error {
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return errors.New("webauthn: credential belongs to another relying party")
+	}
+	if !authData.Has(FlagUserPresent) {
+		return errors.New("webauthn: user was not present")
+	}
+	if requireVerification && !authData.Has(FlagUserVerified) {
+		return errors.New("webauthn: user was not verified")
+	}
+	return nil
+}
+
+// Credential is a newly registered credential to be stored for the user
+type Credential struct {
+	ID             []byte
+	PublicKey      []byte
+	Algorithm      int
+	SignCount      uint32
+	AAGUID         []byte
+	Transports     []string
+	UserVerified   bool
+	BackupEligible bool
+	BackedUp       bool
+}
+
+// VerifyRegistration checks an attestation response against the challenge
+// issued for it and returns the credential to store
+func (c *Config) VerifyRegistration(resp *CredentialResponse, challenge []byte, requireVerification bool) (*Credential, error) {
+	if resp.Type != "public-key" {
+		return nil, errors.New("webauthn: credential type must be public-key")
+	}
+	if err := c.verifyClientData(resp.Response.ClientDataJSON, ceremonyCreate, challenge); err != nil {
+		return nil, err
+	}
+
+	value, rest, err := decodeCBOR(resp.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: invalid attestation object: %v", err)
+	}
+	attestation, ok := value.(map[interface{}]interface{})
+	if !ok || len(rest) != 0 {
+		return nil, errors.New("webauthn: invalid attestation object")
+	}
+	format, _ := attestation["fmt"].(string)
+	rawAuthData, _ := attestation["authData"].([]byte)
+	statement, _ := attestation["attStmt"].(map[interface{}]interface{})
+	if format == "" || rawAuthData == nil || statement == nil {
+		return nil, errors.New("webauthn: attestation object is missing fields")
+	}
+	// Other formats are accepted, but their statement is not relied upon
+	if format == "none" && len(statement) != 0 {
+		return nil, errors.New("webauthn: none attestation must have an empty statement")
+	}
+
+	authData, err := ParseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: %v", err)
+	}
+	if err := c.verifyAuthenticatorData(authData, requireVerification); err != nil {
+		return nil, err
+	}
+	if !authData.Has(FlagAttestedCredentialData) {
+		return nil, errors.New("webauthn: response contains no credential")
+	}
+	if id, err := resp.CredentialID(); err != nil || !bytes.Equal(id, authData.CredentialID) {
+		return nil, errors.New("webauthn: credential ID does not match authenticator data")
+	}
+
+	key, err := ParsePublicKey(authData.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: %v", err)
+	}
+
+	return &Credential{
+		ID:             authData.CredentialID,
+		PublicKey:      authData.PublicKey,
+		Algorithm:      key.Algorithm,
+		SignCount:      authData.SignCount,
+		AAGUID:         authData.AAGUID,
+		Transports:     resp.Response.Transports,
+		UserVerified:   authData.Has(FlagUserVerified),
+		BackupEligible: authData.Has(FlagBackupEligible),
+		BackedUp:       authData.Has(FlagBackedUp),
+	}, nil
+}
+
+// Assertion is the outcome of a verified login with a stored credential
+type Assertion struct {
+	SignCount    uint32
+	UserVerified bool
+	BackedUp     bool
+}
+
+// VerifyAssertion checks an assertion response made with a stored credential.
+// The signature counter must increase unless the authenticator does not keep
+// one, otherwise ErrSignCountRegression is returned together with the
+// verified assertion: the signature is genuine, but the credential may have
+// been copied to another device.
+func (c *Config) VerifyAssertion(resp *CredentialResponse, challenge, publicKey []byte, storedSignCount uint32, requireVerification bool) (*Assertion, error) {
+	if resp.Type != "public-key" {
+		return nil, errors.New("webauthn: credential type must be public-key")
+	}
+	if err := c.verifyClientData(resp.Response.ClientDataJSON, ceremonyGet, challenge); err != nil {
+		return nil, err
+	}
+
+	authData, err := ParseAuthenticatorData(resp.Response.AuthenticatorData)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: %v", err)
+	}
+	if err := c.verifyAuthenticatorData(authData, requireVerification); err != nil {
+		return nil, err
+	}
+
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: stored key: %v", err)
+	}
+	clientDataHash := sha256.Sum256(resp.Response.ClientDataJSON)
+	signed := append(append([]byte(nil), resp.Response.AuthenticatorData...), clientDataHash[:]...)
+	if err := key.Verify(signed, resp.Response.Signature); err != nil {
+		return nil, err
+	}
+
+	assertion := &Assertion{
+		SignCount:    authData.SignCount,
+		UserVerified: authData.Has(FlagUserVerified),
+		BackedUp:     authData.Has(FlagBackedUp),
+	}
+	if err := CheckSignCount(storedSignCount, authData.SignCount); err != nil {
+		return assertion, err
+	}
+	return assertion, nil
+}
+
+// CheckSignCount compares a received signature counter with the stored one.
+// Authenticators without a counter, such as synced passkeys, always send zero.
+func CheckSignCount(stored, received uint32) error {
+	if stored == 0 && received == 0 {
+		return nil
+	}
+	if received <= stored {
+		return ErrSignCountRegression
+	}
+	return nil
+}
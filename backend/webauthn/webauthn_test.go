@@ -0,0 +1,303 @@
+package webauthn_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"defenzo/webauthn"
+	"defenzo/webauthn/webauthntest"
+)
+
+const (
+	testRPID   = "defenzo.test"
+	testOrigin = "https://defenzo.test"
+)
+
+var testConfig = &webauthn.Config{
+	RPID:    testRPID,
+	RPName:  "DEFENZO",
+	Origins: []string{testOrigin},
+	Timeout: time.Minute,
+}
+
+func newChallenge(t *testing.T) webauthn.Bytes {
+	t.Helper()
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return challenge
+}
+
+// register creates a credential on the authenticator and verifies it
+func register(t *testing.T, auth *webauthntest.Authenticator) (*webauthntest.Credential, *webauthn.Credential) {
+	t.Helper()
+	challenge := newChallenge(t)
+	cred, resp, err := auth.Register(challenge, []byte("user-handle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := testConfig.VerifyRegistration(resp, challenge, true)
+	if err != nil {
+		t.Fatalf("VerifyRegistration: %v", err)
+	}
+	return cred, stored
+}
+
+// withClientData replaces one field of the client data in a response
+func withClientData(t *testing.T, resp *webauthn.CredentialResponse, field string, value interface{}) {
+	t.Helper()
+	var data map[string]interface{}
+	if err := json.Unmarshal(resp.Response.ClientDataJSON, &data); err != nil {
+		t.Fatal(err)
+	}
+	data[field] = value
+	raw, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Response.ClientDataJSON = raw
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	auth := webauthntest.New(testRPID, testOrigin)
+	cred, stored := register(t, auth)
+
+	if string(stored.ID) != string(cred.ID) {
+		t.Errorf("credential ID = %x, want %x", stored.ID, cred.ID)
+	}
+	if stored.Algorithm != webauthn.AlgES256 || stored.SignCount != 0 || !stored.UserVerified {
+		t.Errorf("credential = %+v", stored)
+	}
+	key, err := webauthn.ParsePublicKey(stored.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cred.Key.PublicKey.Equal(key.Key) {
+		t.Error("stored public key does not match the authenticator's key")
+	}
+}
+
+func TestVerifyRegistrationRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(auth *webauthntest.Authenticator, resp *webauthn.CredentialResponse)
+		// requireVerification is passed to VerifyRegistration
+		requireVerification bool
+	}{
+		{"other origin", func(auth *webauthntest.Authenticator, resp *webauthn.CredentialResponse) {
+			withClientData(t, resp, "origin", "https://evil.test")
+		}, false},
+		{"cross origin", func(auth *webauthntest.Authenticator, resp *webauthn.CredentialResponse) {
+			withClientData(t, resp, "crossOrigin", true)
+		}, false},
+		{"assertion client data", func(auth *webauthntest.Authenticator, resp *webauthn.CredentialResponse) {
+			withClientData(t, resp, "type", "webauthn.get")
+		}, false},
+		{"other challenge", func(auth *webauthntest.Authenticator, resp *webauthn.CredentialResponse) {
+			withClientData(t, resp, "challenge", "b3RoZXItY2hhbGxlbmdl")
+		}, false},
+		{"other credential ID", func(auth *webauthntest.Authenticator, resp *webauthn.CredentialResponse) {
+			resp.RawID = []byte("another-id")
+		}, false},
+		{"not a public key credential", func(auth *webauthntest.Authenticator, resp *webauthn.CredentialResponse) {
+			resp.Type = "password"
+		}, false},
+		{"truncated attestation", func(auth *webauthntest.Authenticator, resp *webauthn.CredentialResponse) {
+			resp.Response.AttestationObject = resp.Response.AttestationObject[:len(resp.Response.AttestationObject)-1]
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := webauthntest.New(testRPID, testOrigin)
+			challenge := newChallenge(t)
+			_, resp, err := auth.Register(challenge, []byte("user-handle"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.change(auth, resp)
+			if _, err := testConfig.VerifyRegistration(resp, challenge, tt.requireVerification); err == nil {
+				t.Fatal("registration accepted")
+			}
+		})
+	}
+
+	t.Run("other relying party", func(t *testing.T) {
+		auth := webauthntest.New("evil.test", testOrigin)
+		challenge := newChallenge(t)
+		_, resp, err := auth.Register(challenge, []byte("user-handle"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := testConfig.VerifyRegistration(resp, challenge, false); err == nil {
+			t.Fatal("registration for another relying party accepted")
+		}
+	})
+
+	t.Run("user not verified", func(t *testing.T) {
+		auth := webauthntest.New(testRPID, testOrigin)
+		auth.UserVerified = false
+		challenge := newChallenge(t)
+		_, resp, err := auth.Register(challenge, []byte("user-handle"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := testConfig.VerifyRegistration(resp, challenge, true); err == nil {
+			t.Fatal("unverified registration accepted where verification is required")
+		}
+		if _, err := testConfig.VerifyRegistration(resp, challenge, false); err != nil {
+			t.Fatalf("unverified registration rejected where verification is optional: %v", err)
+		}
+	})
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	auth := webauthntest.New(testRPID, testOrigin)
+	cred, stored := register(t, auth)
+
+	signCount := stored.SignCount
+	for i := 0; i < 2; i++ {
+		challenge := newChallenge(t)
+		resp, err := auth.Assert(cred, challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertion, err := testConfig.VerifyAssertion(resp, challenge, stored.PublicKey, signCount, true)
+		if err != nil {
+			t.Fatalf("VerifyAssertion: %v", err)
+		}
+		if assertion.SignCount != signCount+1 || !assertion.UserVerified {
+			t.Fatalf("assertion = %+v after sign count %d", assertion, signCount)
+		}
+		signCount = assertion.SignCount
+	}
+}
+
+func TestVerifyAssertionRejects(t *testing.T) {
+	auth := webauthntest.New(testRPID, testOrigin)
+	cred, stored := register(t, auth)
+	other, otherStored := register(t, auth)
+
+	assert := func(t *testing.T, c *webauthntest.Credential) (webauthn.Bytes, *webauthn.CredentialResponse) {
+		challenge := newChallenge(t)
+		resp, err := auth.Assert(c, challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return challenge, resp
+	}
+
+	t.Run("signed by another key", func(t *testing.T) {
+		challenge, resp := assert(t, other)
+		if _, err := testConfig.VerifyAssertion(resp, challenge, stored.PublicKey, 0, false); !errors.Is(err, webauthn.ErrInvalidSignature) {
+			t.Fatalf("err = %v, want ErrInvalidSignature", err)
+		}
+		if _, err := testConfig.VerifyAssertion(resp, challenge, otherStored.PublicKey, 0, false); err != nil {
+			t.Fatalf("err = %v with the right key", err)
+		}
+	})
+
+	t.Run("tampered client data", func(t *testing.T) {
+		challenge, resp := assert(t, cred)
+		resp.Response.ClientDataJSON = append(resp.Response.ClientDataJSON[:len(resp.Response.ClientDataJSON)-1], ' ', '}')
+		if _, err := testConfig.VerifyAssertion(resp, challenge, stored.PublicKey, 0, false); !errors.Is(err, webauthn.ErrInvalidSignature) {
+			t.Fatalf("err = %v, want ErrInvalidSignature", err)
+		}
+	})
+
+	t.Run("other challenge", func(t *testing.T) {
+		_, resp := assert(t, cred)
+		if _, err := testConfig.VerifyAssertion(resp, newChallenge(t), stored.PublicKey, 0, false); err == nil {
+			t.Fatal("assertion for another challenge accepted")
+		}
+	})
+
+	t.Run("registration client data", func(t *testing.T) {
+		challenge, resp := assert(t, cred)
+		withClientData(t, resp, "type", "webauthn.create")
+		if _, err := testConfig.VerifyAssertion(resp, challenge, stored.PublicKey, 0, false); err == nil {
+			t.Fatal("assertion with create client data accepted")
+		}
+	})
+
+	t.Run("user not verified", func(t *testing.T) {
+		auth.UserVerified = false
+		defer func() { auth.UserVerified = true }()
+		challenge, resp := assert(t, cred)
+		if _, err := testConfig.VerifyAssertion(resp, challenge, stored.PublicKey, 0, true); err == nil {
+			t.Fatal("unverified assertion accepted where verification is required")
+		}
+	})
+}
+
+func TestVerifyAssertionSignCountRegression(t *testing.T) {
+	auth := webauthntest.New(testRPID, testOrigin)
+	cred, stored := register(t, auth)
+
+	// The stored counter is ahead of the authenticator, as when a copy of
+	// the key has been used elsewhere
+	challenge := newChallenge(t)
+	resp, err := auth.Assert(cred, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion, err := testConfig.VerifyAssertion(resp, challenge, stored.PublicKey, 5, false)
+	if !errors.Is(err, webauthn.ErrSignCountRegression) {
+		t.Fatalf("err = %v, want ErrSignCountRegression", err)
+	}
+	// The signature itself is genuine, so the counter is reported
+	if assertion == nil || assertion.SignCount != 1 {
+		t.Fatalf("assertion = %+v, want sign count 1", assertion)
+	}
+
+	// Replaying the same counter value is a regression too
+	challenge = newChallenge(t)
+	cred.SignCount = 0
+	resp, err = auth.Assert(cred, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testConfig.VerifyAssertion(resp, challenge, stored.PublicKey, 1, false); !errors.Is(err, webauthn.ErrSignCountRegression) {
+		t.Fatalf("err = %v, want ErrSignCountRegression", err)
+	}
+}
+
+func TestVerifyAssertionWithoutCounter(t *testing.T) {
+	auth := webauthntest.New(testRPID, testOrigin)
+	cred, stored := register(t, auth)
+	cred.NoCounter = true
+
+	for i := 0; i < 2; i++ {
+		challenge := newChallenge(t)
+		resp, err := auth.Assert(cred, challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := testConfig.VerifyAssertion(resp, challenge, stored.PublicKey, 0, false); err != nil {
+			t.Fatalf("assertion %d without counter rejected: %v", i+1, err)
+		}
+	}
+}
+
+func TestCheckSignCount(t *testing.T) {
+	tests := []struct {
+		stored, received uint32
+		want             error
+	}{
+		{0, 0, nil},
+		{0, 1, nil},
+		{5, 6, nil},
+		{5, 100, nil},
+		{5, 5, webauthn.ErrSignCountRegression},
+		{5, 4, webauthn.ErrSignCountRegression},
+		// A counter that stops counting after being used is a regression
+		{5, 0, webauthn.ErrSignCountRegression},
+	}
+	for _, tt := range tests {
+		if got := webauthn.CheckSignCount(tt.stored, tt.received); got != tt.want {
+			t.Errorf("CheckSignCount(%d, %d) = %v, want %v", tt.stored, tt.received, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Package webauthntest provides a software authenticator for testing relying
+// parties. It creates ES256 credentials with "none" attestation and signs
+// assertions with them, the way a platform authenticator would.
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+
+	"defenzo/webauthn"
+)
+
+// Authenticator answers WebAuthn ceremonies for one relying party and origin
+type Authenticator struct {
+	RPID   string
+	Origin string
+	// UserVerified sets the UV flag, as after a PIN or biometric check
+	UserVerified bool
+}
+
+// Credential is a key pair created by the authenticator
+type Credential struct {
+	ID         []byte
+	Key        *ecdsa.PrivateKey
+	UserHandle []byte
+	// SignCount is the counter value sent with the next assertion, minus one
+	SignCount uint32
+	// NoCounter makes the credential always send zero, like synced passkeys
+	NoCounter bool
+}
+
+// New returns an authenticator that verifies its user
+func New(rpID, origin string) *Authenticator {
+	return &Authenticator{RPID: rpID, Origin: origin, UserVerified: true}
+}
+
+// Register creates a credential for the user handle and returns it with the
+// attestation response for the challenge
+func (a *Authenticator) Register(challenge, userHandle []byte) (*Credential, *webauthn.CredentialResponse, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, nil, err
+	}
+	cred := &Credential{ID: id, Key: key, UserHandle: userHandle}
+
+	publicKey := encodeCBOR(cborMap{
+		{int64(1), int64(2)},  // kty: EC2
+		{int64(3), int64(-7)}, // alg: ES256
+		{int64(-1), int64(1)}, // crv: P-256
+		{int64(-2), key.X.FillBytes(make([]byte, 32))},
+		{int64(-3), key.Y.FillBytes(make([]byte, 32))},
+	})
+	attested := make([]byte, 16, 18+len(id)+len(publicKey)) // zero AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(id)))
+	attested = append(attested, id...)
+	attested = append(attested, publicKey...)
+	authData := a.authenticatorData(webauthn.FlagAttestedCredentialData, 0, attested)
+
+	resp := newResponse(id)
+	resp.Response.ClientDataJSON = a.clientData("webauthn.create", challenge)
+	resp.Response.AttestationObject = encodeCBOR(cborMap{
+		{"fmt", "none"},
+		{"attStmt", cborMap{}},
+		{"authData", authData},
+	})
+	resp.Response.Transports = []string{"internal"}
+	return cred, resp, nil
+}
+
+// Assert signs the challenge with the credential, counting the signature
+// unless the credential has no counter
+func (a *Authenticator) Assert(cred *Credential, challenge []byte) (*webauthn.CredentialResponse, error) {
+	if !cred.NoCounter {
+		cred.SignCount++
+	}
+	count := cred.SignCount
+	if cred.NoCounter {
+		count = 0
+	}
+	authData := a.authenticatorData(0, count, nil)
+	clientData := a.clientData("webauthn.get", challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, cred.Key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	resp := newResponse(cred.ID)
+	resp.Response.ClientDataJSON = clientData
+	resp.Response.AuthenticatorData = authData
+	resp.Response.Signature = signature
+	resp.Response.UserHandle = cred.UserHandle
+	return resp, nil
+}
+
+func newResponse(id []byte) *webauthn.CredentialResponse {
+	return &webauthn.CredentialResponse{
+		ID:    base64.RawURLEncoding.EncodeToString(id),
+		RawID: id,
+		Type:  "public-key",
+	}
+}
+
+// authenticatorData builds the signed authenticator data with the user
+// present and, if set, verified
+func (a *Authenticator) authenticatorData(flags byte, signCount uint32, attested []byte) []byte {
+	flags |= webauthn.FlagUserPresent
+	if a.UserVerified {
+		flags |= webauthn.FlagUserVerified
+	}
+	rpIDHash := sha256.Sum256([]byte(a.RPID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, signCount)
+	return append(data, attested...)
+}
+
+func (a *Authenticator) clientData(ceremony string, challenge []byte) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":        ceremony,
+		"challenge":   base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+	return data
+}
+
+// cborMap is a CBOR map whose entries are encoded in order
+type cborMap []cborEntry
+
+type cborEntry struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// encodeCBOR encodes the few CBOR types authenticators produce: integers,
+// byte and text strings and maps
+func encodeCBOR(value interface{}) []byte {
+	switch v := value.(type) {
+	case int64:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case cborMap:
+		out := cborHead(5, uint64(len(v)))
+		for _, entry := range v {
+			out = append(out, encodeCBOR(entry.Key)...)
+			out = append(out, encodeCBOR(entry.Value)...)
+		}
+		return out
+	}
+	panic("webauthntest: cannot encode value as CBOR")
+}
+
+// cborHead encodes a major type with its argument in the shortest form
+func cborHead(major byte, arg uint64) []byte {
+	major <<= 5
+	switch {
+	case arg < 24:
+		return []byte{major | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major | 24, byte(arg)}
+	case arg <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major | 25}, uint16(arg))
+	case arg <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major | 26}, uint32(arg))
+	}
+	return binary.BigEndian.AppendUint64([]byte{major | 27}, arg)
+}